@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+	"strings"
+)
+
+const apiKeyCtxKey contextKey = "apiKey"
+
+// generateAPIKey generates a key like "rk_<prefix>_<secret>" and returns it together with its prefix
+// and the hash of its secret part
+func generateAPIKey() (key, prefix, secretHash string, err error) {
+	p := make([]byte, 6)
+	s := make([]byte, 32)
+	if _, err = rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	if _, err = rand.Read(s); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(p)
+	secret := base64.RawURLEncoding.EncodeToString(s)
+	return "rk_" + prefix + "_" + secret, prefix, hashAPIKeySecret(secret), nil
+}
+
+// hashAPIKeySecret returns the hash under which the secret part of a key is stored
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyFromRequest reads the key from the Authorization: Bearer or the X-API-Key header
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// apiKeyError is a failed check of an api key and the HTTP status it is answered with
+type apiKeyError struct {
+	status     int
+	retryAfter int
+	err        error
+}
+
+func (e *apiKeyError) Error() string {
+	return e.err.Error()
+}
+
+// authenticateAPIKey checks the raw key, its scope and its rate limit. Failures are returned as *apiKeyError.
+func (app *Config) authenticateAPIKey(raw, scope string, defaultRate Rate) (*data.APIKey, error) {
+	rest, found := strings.CutPrefix(raw, "rk_")
+	prefix, secret, _ := strings.Cut(rest, "_")
+	if !found || prefix == "" || secret == "" {
+		return nil, &apiKeyError{status: http.StatusUnauthorized, err: errors.New("api key is required")}
+	}
+
+	key, err := app.Repo.GetAPIKeyByPrefix(prefix)
+	if err != nil && !errors.Is(err, data.ErrAPIKeyNotFound) {
+		return nil, &apiKeyError{status: http.StatusInternalServerError, err: errors.New("couldn't check api key")}
+	}
+	if key == nil || subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashAPIKeySecret(secret))) != 1 ||
+		key.RevokedAt != nil {
+		return nil, &apiKeyError{status: http.StatusUnauthorized, err: errors.New("invalid api key")}
+	}
+	if !key.HasScope(scope) {
+		return nil, &apiKeyError{status: http.StatusForbidden, err: fmt.Errorf("api key lacks the %s scope", scope)}
+	}
+
+	rate := parseRate(key.RateLimit, defaultRate)
+	allowed, remaining, err := app.RateLimiter.Take("partner:"+key.Prefix, rate)
+	if err != nil {
+		log.Printf("rate limiter of api key %s failed: %v", key.Prefix, err)
+	} else if !allowed {
+		retryAfter := math.Ceil((1 - remaining) / rate.refillPerSecond())
+		return nil, &apiKeyError{
+			status:     http.StatusTooManyRequests,
+			retryAfter: int(math.Max(1, retryAfter)),
+			err:        errors.New("too many requests"),
+		}
+	}
+
+	app.Repo.TouchAPIKey(key.ID)
+	return key, nil
+}
+
+// apiKeyMiddleware authenticates partners by API key, an alternative to authTokenMiddleware for /partner routes.
+// The key must be granted the scope and is rate limited by its own limit or by the default partner limit.
+func (app *Config) apiKeyMiddleware(scope string, defaultRate Rate) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := app.authenticateAPIKey(apiKeyFromRequest(r), scope, defaultRate)
+			if err != nil {
+				var keyErr *apiKeyError
+				errors.As(err, &keyErr)
+				if keyErr.retryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(keyErr.retryAfter))
+				}
+				app.errorJSON(w, keyErr.err, keyErr.status)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), apiKeyCtxKey, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// getAPIKeyFromContext returns the key authenticated by apiKeyMiddleware
+func (app *Config) getAPIKeyFromContext(w http.ResponseWriter, r *http.Request) (*data.APIKey, error) {
+	key, ok := r.Context().Value(apiKeyCtxKey).(*data.APIKey)
+	if !ok {
+		app.errorJSON(w, errors.New("api key is required"), http.StatusUnauthorized)
+		return nil, errors.New("no api key in context")
+	}
+	return key, nil
+}
+
+// createAPIKey issues a new partner key, the full key is returned only in this response
+func (app *Config) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		RateLimit string   `json:"rate_limit,omitempty"`
+	}
+	adminID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestPayload.Name) == "" || len(requestPayload.Scopes) == 0 {
+		app.errorJSON(w, errors.New("name and at least one scope are required"), http.StatusBadRequest)
+		return
+	}
+	if requestPayload.RateLimit != "" && parseRate(requestPayload.RateLimit, Rate{}).Burst == 0 {
+		app.errorJSON(w, errors.New(`rate_limit must look like "100/1m"`), http.StatusBadRequest)
+		return
+	}
+
+	raw, prefix, secretHash, err := generateAPIKey()
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't generate api key"), http.StatusInternalServerError)
+		return
+	}
+	key := data.APIKey{
+		Name:       strings.TrimSpace(requestPayload.Name),
+		Prefix:     prefix,
+		SecretHash: secretHash,
+		Scopes:     requestPayload.Scopes,
+		RateLimit:  requestPayload.RateLimit,
+		CreatedBy:  adminID,
+	}
+	err = app.Repo.CreateAPIKey(&key)
+	if err != nil {
+		if errors.Is(err, data.ErrUnknownScope) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't create api key"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created api key %d, store it now, it is not shown again", key.ID),
+		Data: map[string]any{
+			"key":     raw,
+			"api_key": key,
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// listAPIKeys returns all partner keys without their secrets
+func (app *Config) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.Repo.ListAPIKeys()
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch api keys"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d api keys", len(keys)),
+		Data:    keys,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// revokeAPIKey revokes the partner key with id from the URL
+func (app *Config) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	err = app.Repo.RevokeAPIKey(id)
+	if err != nil {
+		if errors.Is(err, data.ErrAPIKeyNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't revoke api key"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked api key %d", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// partnerAwardPoints credits points to a user on behalf of the partner. external_id identifies the action
+// on the partner's side, so a retried request doesn't credit the points twice.
+func (app *Config) partnerAwardPoints(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		UserID     int    `json:"user_id"`
+		Amount     int    `json:"amount"`
+		ExternalID string `json:"external_id"`
+		Reason     string `json:"reason,omitempty"`
+	}
+	key, err := app.getAPIKeyFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	award, err := app.Repo.AwardPartnerPoints(key, data.PartnerAward{
+		UserID:     requestPayload.UserID,
+		Amount:     requestPayload.Amount,
+		ExternalID: requestPayload.ExternalID,
+		Reason:     requestPayload.Reason,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidAwardAmount), errors.Is(err, data.ErrExternalIDRequired):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		case errors.Is(err, data.ErrUserNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrExternalIDReused):
+			app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		case errors.Is(err, data.ErrFraudBlocked):
+			app.errorJSON(w, err, http.StatusForbidden)
+		default:
+			app.errorJSON(w, errors.New("couldn't award points"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Awarded %d points to user %d", award.Amount, award.UserID),
+		Data:    award,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// partnerGetPoints returns the points balance of the user with id from the URL
+func (app *Config) partnerGetPoints(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	balance, err := app.Repo.GetPointsBalance(id)
+	if errors.Is(err, data.ErrUserNotFound) {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		app.errorJSON(w, errors.New("couldn't fetch points balance"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched points balance of user %d", id),
+		Data:    balance,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reward-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	key, prefix, secretHash, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := time.Now()
+	tests := []struct {
+		name       string
+		raw        string
+		stored     *data.APIKey
+		scope      string
+		wantStatus int // 0 when the key is accepted
+	}{
+		{"valid", key, &data.APIKey{Scopes: []string{"points:write"}}, "points:write", 0},
+		{"empty", "", &data.APIKey{Scopes: []string{"points:write"}}, "points:write", http.StatusUnauthorized},
+		{"no rk_ prefix", strings.TrimPrefix(key, "rk_"), &data.APIKey{Scopes: []string{"points:write"}}, "points:write", http.StatusUnauthorized},
+		{"no secret", "rk_" + prefix + "_", &data.APIKey{Scopes: []string{"points:write"}}, "points:write", http.StatusUnauthorized},
+		{"unknown prefix", "rk_000000000000_" + strings.SplitN(key, "_", 3)[2], &data.APIKey{Scopes: []string{"points:write"}}, "points:write", http.StatusUnauthorized},
+		{"wrong secret", "rk_" + prefix + "_guessed", &data.APIKey{Scopes: []string{"points:write"}}, "points:write", http.StatusUnauthorized},
+		{"revoked", key, &data.APIKey{Scopes: []string{"points:write"}, RevokedAt: &revokedAt}, "points:write", http.StatusUnauthorized},
+		{"missing scope", key, &data.APIKey{Scopes: []string{"points:read"}}, "points:write", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			stored := *tt.stored
+			stored.ID, stored.Prefix, stored.SecretHash = 1, prefix, secretHash
+			repo.apiKeys[prefix] = &stored
+			app := &Config{Repo: repo, RateLimiter: newMemoryStore()}
+
+			got, err := app.authenticateAPIKey(tt.raw, tt.scope, Rate{Burst: 10, Per: time.Minute})
+			if tt.wantStatus == 0 {
+				if err != nil || got == nil || got.ID != 1 {
+					t.Fatalf("authenticateAPIKey() = %v, %v, want key 1", got, err)
+				}
+				if len(repo.touchedKey) != 1 {
+					t.Errorf("accepted key was touched %d times, want once", len(repo.touchedKey))
+				}
+				return
+			}
+
+			var keyErr *apiKeyError
+			if !errors.As(err, &keyErr) || keyErr.status != tt.wantStatus {
+				t.Fatalf("authenticateAPIKey() error = %v, want status %d", err, tt.wantStatus)
+			}
+			if len(repo.touchedKey) != 0 {
+				t.Error("refused key was touched")
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKeyRateLimit(t *testing.T) {
+	key, prefix, secretHash, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, otherPrefix, otherHash, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newFakeRepo()
+	// the first key has its own limit, the other one gets the default
+	repo.apiKeys[prefix] = &data.APIKey{ID: 1, Prefix: prefix, SecretHash: secretHash, Scopes: []string{"points:write"}, RateLimit: "2/1m"}
+	repo.apiKeys[otherPrefix] = &data.APIKey{ID: 2, Prefix: otherPrefix, SecretHash: otherHash, Scopes: []string{"points:write"}}
+	app := &Config{Repo: repo, RateLimiter: newMemoryStore()}
+	defaultRate := Rate{Burst: 5, Per: time.Minute}
+
+	for i := range 2 {
+		if _, err := app.authenticateAPIKey(key, "points:write", defaultRate); err != nil {
+			t.Fatalf("request %d within the limit of the key failed: %v", i+1, err)
+		}
+	}
+	_, err = app.authenticateAPIKey(key, "points:write", defaultRate)
+	var keyErr *apiKeyError
+	if !errors.As(err, &keyErr) || keyErr.status != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit of the key: error = %v, want status %d", err, http.StatusTooManyRequests)
+	}
+	if keyErr.retryAfter < 1 {
+		t.Errorf("retry after = %d, want at least 1 second", keyErr.retryAfter)
+	}
+
+	// every key is limited on its own
+	for i := range 5 {
+		if _, err := app.authenticateAPIKey(otherKey, "points:write", defaultRate); err != nil {
+			t.Fatalf("request %d of the other key failed: %v", i+1, err)
+		}
+	}
+}
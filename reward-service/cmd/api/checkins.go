@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+	"strings"
+)
+
+// parseRewards parses a comma separated list of check-in rewards like "10,20,100", falling back to def when it is empty
+func parseRewards(list string, def []int) []int {
+	var rewards []int
+	for _, item := range strings.Split(list, ",") {
+		points, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		rewards = append(rewards, points)
+	}
+	if len(rewards) == 0 {
+		return def
+	}
+	return rewards
+}
+
+// checkIn records the daily check-in of the authenticated user and pays the streak reward
+func (app *Config) checkIn(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		TimeZone string `json:"time_zone,omitempty"`
+	}
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	if r.ContentLength != 0 {
+		err = app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	checkin, err := app.Repo.CheckIn(id, requestPayload.TimeZone, app.CheckinRules)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyCheckedIn):
+			app.errorJSON(w, err, http.StatusConflict)
+		case errors.Is(err, data.ErrUnknownTimeZone):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		case errors.Is(err, data.ErrFraudBlocked):
+			app.errorJSON(w, err, http.StatusForbidden)
+		default:
+			app.errorJSON(w, errors.New("couldn't check in"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Checked in for day %d of the streak, added points %d", checkin.CurrentStreak, checkin.Points),
+		Data:    checkin,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getStreak retrieves the check-in streak of the authenticated user
+func (app *Config) getStreak(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	streak, err := app.Repo.GetStreak(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch streak"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched check-in streak"),
+		Data:    streak,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// buyStreakFreeze exchanges points of the authenticated user for a streak freeze
+func (app *Config) buyStreakFreeze(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	streak, err := app.Repo.BuyStreakFreeze(id, app.CheckinRules)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyFreezes), errors.Is(err, data.ErrInsufficientPoints):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		default:
+			app.errorJSON(w, errors.New("couldn't buy streak freeze"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Bought streak freeze for %d points", app.CheckinRules.FreezePrice),
+		Data:    streak,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
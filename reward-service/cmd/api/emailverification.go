@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateEmail checks that the email is a plain address like "user@example.com"
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return errors.New("invalid email address")
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// sendVerificationEmail sends the user a single-use link which activates the account
+func (app *Config) sendVerificationEmail(userID int, email string) error {
+	nonce, err := randomNonce()
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	expires := time.Now().Add(app.EmailTokenTTL)
+	err = app.Repo.CreateEmailVerification(userID, nonce, expires)
+	if err != nil {
+		return err
+	}
+
+	token := app.signToken("verify-email", fmt.Sprintf("%d|%s", userID, nonce), expires)
+	body := fmt.Sprintf("Confirm your email address by opening the link:\n%s/auth/verify-email?token=%s\n\n"+
+		"The link is valid until %s.\n", app.PublicURL, token, expires.Format(time.RFC1123))
+	return app.Mailer.Send(email, "Confirm your email address", body)
+}
+
+// verifyEmail activates the account by the token from the verification link
+func (app *Config) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	payload, err := app.verifyToken("verify-email", r.URL.Query().Get("token"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	idStr, nonce, _ := strings.Cut(payload, "|")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		app.errorJSON(w, errMalformedToken, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Repo.VerifyEmail(id, nonce)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidVerification) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't verify email"), http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Email verified, the account is active"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// resendVerification sends a new verification link. The response is the same whether the email is registered or not.
+func (app *Config) resendVerification(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetByEmail(requestPayload.Email)
+	if err == nil && user.Active == 0 {
+		err = app.sendVerificationEmail(user.ID, user.Email)
+		if err != nil {
+			log.Printf("failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("If the account exists and is not verified yet, a new link was sent to %s", requestPayload.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reward-service/data"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	publishBatch   = 100
+	publishTimeout = 10 * time.Second
+	publishLease   = time.Minute
+)
+
+// Publisher sends domain events from the outbox to a sink. Events are published at least once and in order
+// within a batch, so a publisher should be idempotent by event ID. A new broker only needs an implementation
+// of Publisher and a case in newPublisher.
+type Publisher interface {
+	Publish(ctx context.Context, event *data.DomainEvent) error
+}
+
+// logPublisher writes the events to the log
+type logPublisher struct{}
+
+// Publish logs the event
+func (logPublisher) Publish(ctx context.Context, event *data.DomainEvent) error {
+	log.Printf("event %d %s %s user=%d %s", event.Sequence, event.Type, event.ID, event.UserID, event.Data)
+	return nil
+}
+
+// broker passes messages to subscribers inside the process. A subscriber which does not keep up loses
+// messages instead of slowing the publishing down.
+type broker[T any] struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]chan T
+}
+
+// newBroker returns a broker without subscribers
+func newBroker[T any]() *broker[T] {
+	return &broker[T]{subs: make(map[int]chan T)}
+}
+
+// Subscribe returns a channel with the messages published from now on and the function ending the subscription
+func (b *broker[T]) Subscribe(buffer int) (<-chan T, func()) {
+	ch := make(chan T, buffer)
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish passes the message to every subscriber
+func (b *broker[T]) Publish(ctx context.Context, msg T) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for id, ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("subscriber %d is too slow, dropped a message", id)
+		}
+	}
+	return nil
+}
+
+// httpPublisher posts every event as JSON to a URL, signed like the outbound webhooks when a secret is set
+type httpPublisher struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Publish posts the event, any 2xx status is a success
+func (p *httpPublisher) Publish(ctx context.Context, event *data.DomainEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", event.ID)
+	req.Header.Set("X-Event-Type", event.Type)
+	if p.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Event-Timestamp", timestamp)
+		req.Header.Set("X-Event-Signature", signWebhook(p.secret, timestamp, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event sink responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// multiPublisher publishes every event to all of its sinks by name. The progress of each sink is tracked
+// on its own, so a sink refusing an event doesn't hold up the others or make them see it twice.
+type multiPublisher map[string]Publisher
+
+// names returns the names of the sinks in a fixed order
+func (m multiPublisher) names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newPublisher returns the sink with the given name
+func (app *Config) newPublisher(name string) (Publisher, error) {
+	switch name {
+	case "log":
+		return logPublisher{}, nil
+	case "inprocess":
+		return app.Events, nil
+	case "webhooks":
+		return webhookPublisher{repo: app.Repo}, nil
+	case "http":
+		url := os.Getenv("EVENT_HTTP_URL")
+		if url == "" {
+			return nil, errors.New("EVENT_HTTP_URL is required by the http event sink")
+		}
+		return &httpPublisher{url: url, secret: os.Getenv("EVENT_HTTP_SECRET"), client: app.Client}, nil
+	case "nats", "kafka":
+		return nil, fmt.Errorf("event sink %s needs a broker client which is not built into this binary", name)
+	default:
+		return nil, fmt.Errorf("unknown event sink %s", name)
+	}
+}
+
+// setupPublisher builds the publisher from the comma separated list of sinks. The webhooks sink is always
+// added, the webhook subscriptions are managed through the admin API.
+func (app *Config) setupPublisher(sinks string) error {
+	app.Events = newBroker[*data.DomainEvent]()
+
+	publisher := multiPublisher{}
+	for _, name := range append(strings.Split(sinks, ","), "webhooks") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, err := app.newPublisher(name)
+		if err != nil {
+			return err
+		}
+		publisher[name] = p
+	}
+	app.Publisher = publisher
+	return nil
+}
+
+// publishEvents periodically publishes the events from the outbox
+func (app *Config) publishEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			n, err := app.publishOutbox()
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if n < publishBatch {
+				break
+			}
+		}
+	}
+}
+
+// publishOutbox publishes a batch of events from the outbox to every sink and returns the size of the batch.
+// A sink skips the rest of the batch after the first event it refuses, so it gets the events in order.
+// Such events are published again after the lease runs out, only to the sinks which didn't accept them yet.
+func (app *Config) publishOutbox() (int, error) {
+	events, err := app.Repo.ClaimOutboxEvents(publishBatch, publishLease)
+	if err != nil {
+		return 0, err
+	}
+
+	names := app.Publisher.names()
+	failed := make(map[string]bool)
+	accepted := make(map[string][]int64)
+	var published []int64
+	for _, event := range events {
+		var sent []string
+		done := true
+		for _, name := range names {
+			if slices.Contains(event.PublishedTo, name) {
+				continue
+			}
+			if failed[name] {
+				done = false
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+			err := app.Publisher[name].Publish(ctx, event)
+			cancel()
+			if err != nil {
+				log.Printf("failed to publish event %d %s to %s: %v", event.Sequence, event.Type, name, err)
+				failed[name] = true
+				done = false
+				continue
+			}
+			sent = append(sent, name)
+		}
+
+		if done {
+			published = append(published, event.Sequence)
+			continue
+		}
+		for _, name := range sent {
+			accepted[name] = append(accepted[name], event.Sequence)
+		}
+	}
+
+	for name, sequences := range accepted {
+		err = app.Repo.MarkEventsPublishedTo(name, sequences)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = app.Repo.MarkEventsPublished(published)
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// purgeOutbox periodically deletes the events published longer than retention ago
+func (app *Config) purgeOutbox(retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.Repo.DeletePublishedEvents(time.Now().Add(-retention))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Deleted %d published outbox events", n)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reward-service/data"
+	"slices"
+	"testing"
+)
+
+// recordingPublisher remembers the events it accepted, it refuses the events in refuse
+type recordingPublisher struct {
+	refuse   map[int64]bool
+	received []int64
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, event *data.DomainEvent) error {
+	if p.refuse[event.Sequence] {
+		return errors.New("sink is down")
+	}
+	p.received = append(p.received, event.Sequence)
+	return nil
+}
+
+func TestPublishOutboxFailingSink(t *testing.T) {
+	repo := newFakeRepo()
+	for i := int64(1); i <= 4; i++ {
+		repo.events = append(repo.events, &data.DomainEvent{Sequence: i, Type: data.DomainPointsAwarded})
+	}
+	healthy := &recordingPublisher{}
+	flaky := &recordingPublisher{refuse: map[int64]bool{2: true}}
+	app := &Config{Repo: repo, Publisher: multiPublisher{"healthy": healthy, "flaky": flaky}}
+
+	n, err := app.publishOutbox()
+	if err != nil || n != 4 {
+		t.Fatalf("publishOutbox() = %d, %v", n, err)
+	}
+	if !slices.Equal(healthy.received, []int64{1, 2, 3, 4}) {
+		t.Errorf("healthy sink received %v, want every event", healthy.received)
+	}
+	if !slices.Equal(flaky.received, []int64{1}) {
+		t.Errorf("failing sink received %v, want only the events before the refused one", flaky.received)
+	}
+	if !repo.published[1] || repo.published[2] || repo.published[3] || repo.published[4] {
+		t.Errorf("published events %v, want only the first", repo.published)
+	}
+
+	delete(flaky.refuse, 2)
+	_, err = app.publishOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(healthy.received, []int64{1, 2, 3, 4}) {
+		t.Errorf("healthy sink received %v after the retry, want no duplicates", healthy.received)
+	}
+	if !slices.Equal(flaky.received, []int64{1, 2, 3, 4}) {
+		t.Errorf("failing sink received %v after the retry, want every event once in order", flaky.received)
+	}
+	for i := int64(1); i <= 4; i++ {
+		if !repo.published[i] {
+			t.Errorf("event %d is not published after the retry", i)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// listFraudEvents lists the latest events flagged or blocked by the fraud checks
+func (app *Config) listFraudEvents(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	events, err := app.Repo.GetFraudEvents(limit)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch fraud events"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d fraud events", len(events)),
+		Data:    events,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
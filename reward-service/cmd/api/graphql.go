@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const (
+	defaultHistoryLimit   = 20
+	maxHistoryLimit       = 100
+	maxIntrospectionDepth = 15
+)
+
+// listFieldSizes are the sizes assumed for list fields when the query doesn't limit them with top or limit
+var listFieldSizes = map[string]int{
+	"leaderboard":  defaultBoardTop,
+	"transactions": defaultHistoryLimit,
+	"referrals":    20,
+	"tasks":        20,
+}
+
+var errNotAllowed = errors.New("only the user and admins can see this field")
+
+type gqlRequestKey struct{}
+
+// loader batches the loads of one GraphQL request. The executor resolves the query breadth first, so the keys
+// requested by all the fields on one level are fetched together when the first of their values is needed.
+type loader[K comparable, V any] struct {
+	mu      sync.Mutex
+	fetch   func(keys []K) (map[K]V, error)
+	pending []K
+	values  map[K]V
+	errs    map[K]error
+}
+
+// newLoader returns a loader fetching the values with fetch
+func newLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{fetch: fetch, values: make(map[K]V), errs: make(map[K]error)}
+}
+
+// load registers the key for the next batch and returns the thunk resolving its value
+func (l *loader[K, V]) load(key K) func() (any, error) {
+	l.mu.Lock()
+	_, loaded := l.values[key]
+	_, failed := l.errs[key]
+	if !loaded && !failed {
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (any, error) {
+		return l.get(key)
+	}
+}
+
+// get returns the value of the key, fetching the pending batch if the key is in it
+func (l *loader[K, V]) get(key K) (V, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.pending) > 0 {
+		keys := l.pending
+		l.pending = nil
+		values, err := l.fetch(keys)
+		for _, k := range keys {
+			if err != nil {
+				l.errs[k] = err
+				continue
+			}
+			l.values[k] = values[k]
+		}
+	}
+	return l.values[key], l.errs[key]
+}
+
+// gqlRequest holds the authenticated user and the loaders of one GraphQL request
+type gqlRequest struct {
+	app       *Config
+	viewerID  int
+	adminOnce sync.Once
+	admin     bool
+
+	users     *loader[int, *data.User]
+	ranks     *loader[int, int]
+	referrals *loader[int, []*data.Referral]
+	historyMu sync.Mutex
+	histories map[int]*loader[int, []*data.Transaction]
+	completed *loader[int, map[string]bool]
+}
+
+// newGQLRequest returns the state of a request of the user
+func (app *Config) newGQLRequest(viewerID int) *gqlRequest {
+	return &gqlRequest{
+		app:      app,
+		viewerID: viewerID,
+		users: newLoader(func(ids []int) (map[int]*data.User, error) {
+			users, err := app.Repo.GetUsersByIDs(ids)
+			if err != nil {
+				return nil, err
+			}
+			byID := make(map[int]*data.User, len(users))
+			for _, u := range users {
+				byID[u.ID] = u
+			}
+			return byID, nil
+		}),
+		ranks: newLoader(func(ids []int) (map[int]int, error) {
+			standings, err := app.Repo.GetStandings(ids)
+			if err != nil {
+				return nil, err
+			}
+			ranks := make(map[int]int, len(standings))
+			for id, s := range standings {
+				ranks[id] = s.Rank
+			}
+			return ranks, nil
+		}),
+		referrals: newLoader(app.Repo.GetReferrals),
+		histories: make(map[int]*loader[int, []*data.Transaction]),
+		completed: newLoader(func(ids []int) (map[int]map[string]bool, error) {
+			// only the tasks of the viewer are ever asked for
+			codes, err := app.Repo.GetCompletedTaskCodes(ids[0])
+			if err != nil {
+				return nil, err
+			}
+			done := make(map[string]bool, len(codes))
+			for _, code := range codes {
+				done[code] = true
+			}
+			return map[int]map[string]bool{ids[0]: done}, nil
+		}),
+	}
+}
+
+// history returns the loader of the transactions with the given limit
+func (q *gqlRequest) history(limit int) *loader[int, []*data.Transaction] {
+	q.historyMu.Lock()
+	defer q.historyMu.Unlock()
+
+	l, ok := q.histories[limit]
+	if !ok {
+		l = newLoader(func(ids []int) (map[int][]*data.Transaction, error) {
+			return q.app.Repo.GetHistories(ids, limit)
+		})
+		q.histories[limit] = l
+	}
+	return l
+}
+
+// canView reports whether the viewer may see the private fields of the user
+func (q *gqlRequest) canView(userID int) bool {
+	if userID == q.viewerID {
+		return true
+	}
+	q.adminOnce.Do(func() {
+		q.admin, _ = q.app.Repo.IsAdmin(q.viewerID)
+	})
+	return q.admin
+}
+
+func requestFrom(p graphql.ResolveParams) *gqlRequest {
+	return p.Context.Value(gqlRequestKey{}).(*gqlRequest)
+}
+
+// from resolves a field from the source value of type T
+func from[T any](fn func(T) any) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return fn(p.Source.(T)), nil
+	}
+}
+
+// private resolves a field of a user visible only to the user and to admins
+func private(fn func(p graphql.ResolveParams, u *data.User) (any, error)) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		u := p.Source.(*data.User)
+		if !requestFrom(p).canView(u.ID) {
+			return nil, errNotAllowed
+		}
+		return fn(p, u)
+	}
+}
+
+// newGraphQLSchema builds the schema of the dashboard API
+func newGraphQLSchema() (graphql.Schema, error) {
+	transactionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Transaction",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"amount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"kind":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"memo":      &graphql.Field{Type: graphql.String},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: from(func(t *data.Transaction) any { return t.CreatedAt })},
+		},
+	})
+
+	var userType *graphql.Object
+
+	referralType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Referral",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"user": &graphql.Field{
+					Type:        userType,
+					Description: "The user who redeemed the referrer",
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return requestFrom(p).users.load(p.Source.(*data.Referral).UserID), nil
+					},
+				},
+				"redeemedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: from(func(r *data.Referral) any { return r.RedeemedAt })},
+			}
+		}),
+	})
+
+	userType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"firstName": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: from(func(u *data.User) any { return u.FirstName })},
+			"score":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"tier":      &graphql.Field{Type: graphql.String},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: from(func(u *data.User) any { return u.CreatedAt })},
+			"rank": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "Place on the balance leaderboard",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return requestFrom(p).ranks.load(p.Source.(*data.User).ID), nil
+				},
+			},
+			"lastName": &graphql.Field{
+				Type: graphql.String,
+				Resolve: private(func(p graphql.ResolveParams, u *data.User) (any, error) {
+					return u.LastName, nil
+				}),
+			},
+			"email": &graphql.Field{
+				Type: graphql.String,
+				Resolve: private(func(p graphql.ResolveParams, u *data.User) (any, error) {
+					return u.Email, nil
+				}),
+			},
+			"referrer": &graphql.Field{
+				Type: graphql.String,
+				Resolve: private(func(p graphql.ResolveParams, u *data.User) (any, error) {
+					return u.Referrer, nil
+				}),
+			},
+			"transactions": &graphql.Field{
+				Type:        graphql.NewList(graphql.NewNonNull(transactionType)),
+				Description: "Latest ledger entries, newest first",
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultHistoryLimit},
+				},
+				Resolve: private(func(p graphql.ResolveParams, u *data.User) (any, error) {
+					limit, _ := p.Args["limit"].(int)
+					if limit <= 0 || limit > maxHistoryLimit {
+						return nil, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+					}
+					return requestFrom(p).history(limit).load(u.ID), nil
+				}),
+			},
+			"referrals": &graphql.Field{
+				Type:        graphql.NewList(graphql.NewNonNull(referralType)),
+				Description: "Redemptions of the referrer of the user, newest first",
+				Resolve: private(func(p graphql.ResolveParams, u *data.User) (any, error) {
+					return requestFrom(p).referrals.load(u.ID), nil
+				}),
+			},
+		},
+	})
+
+	taskType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Task",
+		Fields: graphql.Fields{
+			"code":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"points":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"verifier":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"repeatable": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"completed": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Whether the viewer has completed the task or is waiting for its verification",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					q := requestFrom(p)
+					code := p.Source.(*data.Task).Code
+					thunk := q.completed.load(q.viewerID)
+					return func() (any, error) {
+						done, err := thunk()
+						if err != nil {
+							return nil, err
+						}
+						return done.(map[string]bool)[code], nil
+					}, nil
+				},
+			},
+		},
+	})
+
+	entryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "LeaderboardEntry",
+		Fields: graphql.Fields{
+			"rank":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"points": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"user": &graphql.Field{
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return requestFrom(p).users.load(p.Source.(*data.LeaderboardEntry).UserID), nil
+				},
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					q := requestFrom(p)
+					return q.users.load(q.viewerID), nil
+				},
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return requestFrom(p).users.load(p.Args["id"].(int)), nil
+				},
+			},
+			"leaderboard": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(entryType))),
+				Args: graphql.FieldConfigArgument{
+					"board":  &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: data.BoardBalance},
+					"window": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: data.WindowAll},
+					"top":    &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultBoardTop},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					top, _ := p.Args["top"].(int)
+					if top <= 0 || top > maxBoardTop {
+						return nil, fmt.Errorf("top must be between 1 and %d", maxBoardTop)
+					}
+					board, _ := p.Args["board"].(string)
+					window, _ := p.Args["window"].(string)
+					return requestFrom(p).app.Repo.GetTopUsers(board, window, top)
+				},
+			},
+			"tasks": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(taskType))),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return requestFrom(p).app.Repo.GetTasks()
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// queryLimits measures the depth and the complexity of a query before it is executed. Every field costs 1 plus
+// the cost of its selection, multiplied by the size of the list the field returns.
+type queryLimits struct {
+	doc       *ast.Document
+	variables map[string]any
+	maxDepth  int
+	fragments map[string]*ast.FragmentDefinition
+}
+
+// checkQueryLimits returns an error if an operation of the document is deeper or more complex than allowed.
+// Fragments spreading themselves are refused here too, the validation of the library overflows the stack on them.
+func checkQueryLimits(doc *ast.Document, variables map[string]any, maxDepth, maxComplexity int) error {
+	l := &queryLimits{
+		doc:       doc,
+		variables: variables,
+		maxDepth:  maxDepth,
+		fragments: make(map[string]*ast.FragmentDefinition),
+	}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			l.fragments[f.Name.Value] = f
+		}
+	}
+	visited := make(map[string]int)
+	for name := range l.fragments {
+		err := l.checkFragment(name, visited)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		cost, err := l.cost(op.SelectionSet, 0, maxDepth)
+		if err != nil {
+			return err
+		}
+		if cost > maxComplexity {
+			return fmt.Errorf("query complexity %d exceeds the limit of %d", cost, maxComplexity)
+		}
+	}
+	return nil
+}
+
+func (l *queryLimits) cost(set *ast.SelectionSet, depth, maxDepth int) (int, error) {
+	if set == nil {
+		return 0, nil
+	}
+
+	total := 0
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			name := s.Name.Value
+			if name == "__typename" {
+				continue
+			}
+			if depth+1 > maxDepth {
+				return 0, fmt.Errorf("query depth exceeds the limit of %d", l.maxDepth)
+			}
+			if name == "__schema" || name == "__type" {
+				// introspection is only limited in depth, it doesn't touch the database
+				_, err := l.cost(s.SelectionSet, depth+1, maxIntrospectionDepth)
+				if err != nil {
+					return 0, err
+				}
+				continue
+			}
+			children, err := l.cost(s.SelectionSet, depth+1, maxDepth)
+			if err != nil {
+				return 0, err
+			}
+			total += 1 + l.listSize(s)*children
+		case *ast.InlineFragment:
+			cost, err := l.cost(s.SelectionSet, depth, maxDepth)
+			if err != nil {
+				return 0, err
+			}
+			total += cost
+		case *ast.FragmentSpread:
+			f, ok := l.fragments[s.Name.Value]
+			if !ok {
+				// unknown fragments are reported by the validation
+				continue
+			}
+			cost, err := l.cost(f.SelectionSet, depth, maxDepth)
+			if err != nil {
+				return 0, err
+			}
+			total += cost
+		}
+	}
+	return total, nil
+}
+
+// checkFragment walks the spreads of the fragment depth first, a fragment met again on the way spreads itself
+func (l *queryLimits) checkFragment(name string, visited map[string]int) error {
+	const (
+		walking = 1
+		done    = 2
+	)
+	switch visited[name] {
+	case walking:
+		return fmt.Errorf("fragment %s spreads itself", name)
+	case done:
+		return nil
+	}
+	f, ok := l.fragments[name]
+	if !ok {
+		return nil
+	}
+
+	visited[name] = walking
+	var walk func(set *ast.SelectionSet) error
+	walk = func(set *ast.SelectionSet) error {
+		if set == nil {
+			return nil
+		}
+		for _, selection := range set.Selections {
+			var err error
+			switch s := selection.(type) {
+			case *ast.Field:
+				err = walk(s.SelectionSet)
+			case *ast.InlineFragment:
+				err = walk(s.SelectionSet)
+			case *ast.FragmentSpread:
+				err = l.checkFragment(s.Name.Value, visited)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(f.SelectionSet)
+	visited[name] = done
+	return err
+}
+
+// listSize returns how many items the field returns at most: the top or limit argument of the query
+// or the assumed size of the list field
+func (l *queryLimits) listSize(f *ast.Field) int {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "top" && arg.Name.Value != "limit" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			if n, ok := l.variables[v.Name.Value].(float64); ok && n > 0 {
+				return int(n)
+			}
+		}
+	}
+	if n, ok := listFieldSizes[f.Name.Value]; ok {
+		return n
+	}
+	return 1
+}
+
+// graphqlError answers with the errors in the GraphQL response format
+func (app *Config) graphqlError(w http.ResponseWriter, status int, errs ...error) {
+	app.writeJSON(w, status, &graphql.Result{Errors: gqlerrors.FormatErrors(errs...)})
+}
+
+// serveGraphQL executes a GraphQL query of the authenticated user. Queries deeper or more complex than the
+// limits are refused before they reach the database.
+func (app *Config) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName,omitempty"`
+		Variables     map[string]any `json:"variables,omitempty"`
+	}
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.graphqlError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(requestPayload.Query) == "" {
+		app.graphqlError(w, http.StatusBadRequest, errors.New("query is required"))
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: requestPayload.Query})
+	if err != nil {
+		app.graphqlError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = checkQueryLimits(doc, requestPayload.Variables, app.GraphQLMaxDepth, app.GraphQLComplexity)
+	if err != nil {
+		app.graphqlError(w, http.StatusBadRequest, err)
+		return
+	}
+	validation := graphql.ValidateDocument(&app.GraphQLSchema, doc, nil)
+	if !validation.IsValid {
+		app.writeJSON(w, http.StatusBadRequest, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), gqlRequestKey{}, app.newGQLRequest(userID))
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        app.GraphQLSchema,
+		AST:           doc,
+		OperationName: requestPayload.OperationName,
+		Args:          requestPayload.Variables,
+		Context:       ctx,
+	})
+
+	app.writeJSON(w, http.StatusOK, result)
+}
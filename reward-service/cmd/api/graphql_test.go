@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// graphQLResponse is the part of a GraphQL response the tests look at
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// runGraphQL sends the query as user 1 and returns the status and the response
+func runGraphQL(t *testing.T, app *Config, query string) (int, graphQLResponse) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, 1))
+	rec := httptest.NewRecorder()
+	app.serveGraphQL(rec, req)
+
+	var resp graphQLResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("response %q is not JSON: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+// newGraphQLTest returns the API with users 1 to 5, ranked by id
+func newGraphQLTest(t *testing.T) (*Config, *fakeRepo) {
+	t.Helper()
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatalf("newGraphQLSchema() error = %v", err)
+	}
+	repo := newFakeRepo()
+	repo.standings = make(map[int]data.Standing)
+	for id := 1; id <= 5; id++ {
+		repo.users[id] = &data.User{ID: id, FirstName: fmt.Sprintf("User%d", id), LastName: fmt.Sprintf("Last%d", id), Score: 600 - 100*id, CreatedAt: time.Now()}
+		repo.standings[id] = data.Standing{Rank: id, Score: 600 - 100*id}
+	}
+	return &Config{Repo: repo, GraphQLSchema: schema, GraphQLMaxDepth: 6, GraphQLComplexity: 500}, repo
+}
+
+func TestGraphQLQuery(t *testing.T) {
+	app, _ := newGraphQLTest(t)
+
+	status, resp := runGraphQL(t, app, `{ me { id firstName lastName rank } user(id: 2) { firstName lastName email } }`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, errors %v", status, resp.Errors)
+	}
+	// the result is a map, so the fields come out sorted
+	want := `{"me":{"firstName":"User1","id":1,"lastName":"Last1","rank":1},"user":{"email":null,"firstName":"User2","lastName":null}}`
+	if string(resp.Data) != want {
+		t.Errorf("data = %s, want %s", resp.Data, want)
+	}
+	if len(resp.Errors) != 2 || resp.Errors[0].Message != errNotAllowed.Error() || resp.Errors[1].Message != errNotAllowed.Error() {
+		t.Errorf("errors = %v, want the last name and the email of another user refused", resp.Errors)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{"too deep", `{ me { referrals { user { referrals { user { referrals { user { id } } } } } } } }`, "depth"},
+		{"too complex", `{ leaderboard(top: 100) { user { transactions(limit: 100) { id } } } }`, "complexity"},
+		{"fragment in a list", `{ leaderboard(top: 50) { ...entry } } fragment entry on LeaderboardEntry { user { transactions(limit: 20) { id } } }`, "complexity"},
+		{"fragment spreading itself", `{ me { ...a } } fragment a on User { id ...a }`, "spreads itself"},
+		{"fragments spreading each other", `{ me { ...a } } fragment a on User { id ...b } fragment b on User { rank ...a }`, "spreads itself"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, repo := newGraphQLTest(t)
+
+			status, resp := runGraphQL(t, app, tt.query)
+			if status != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+			}
+			if len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, tt.wantErr) {
+				t.Errorf("errors = %v, want one about %s", resp.Errors, tt.wantErr)
+			}
+			if repo.topQueries != 0 || len(repo.userQueries) != 0 || len(repo.standingQueries) != 0 {
+				t.Error("refused query reached the repository")
+			}
+		})
+	}
+}
+
+func TestGraphQLBatching(t *testing.T) {
+	app, repo := newGraphQLTest(t)
+
+	status, resp := runGraphQL(t, app, `{ leaderboard(top: 5) { rank user { firstName rank } } }`)
+	if status != http.StatusOK || len(resp.Errors) != 0 {
+		t.Fatalf("status = %d, errors %v", status, resp.Errors)
+	}
+	var result struct {
+		Leaderboard []struct {
+			Rank int
+			User struct {
+				FirstName string
+				Rank      int
+			}
+		}
+	}
+	err := json.Unmarshal(resp.Data, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Leaderboard) != 5 || result.Leaderboard[4].User.FirstName != "User5" || result.Leaderboard[4].User.Rank != 5 {
+		t.Errorf("leaderboard = %+v", result.Leaderboard)
+	}
+
+	all := []int{1, 2, 3, 4, 5}
+	if len(repo.userQueries) != 1 || !slices.Equal(repo.userQueries[0], all) {
+		t.Errorf("users were loaded in batches %v, want one batch of every entry", repo.userQueries)
+	}
+	if len(repo.standingQueries) != 1 || !slices.Equal(repo.standingQueries[0], all) {
+		t.Errorf("ranks were loaded in batches %v, want one batch of every entry", repo.standingQueries)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reward-service/data"
+	rewardv1 "reward-service/gen/reward/v1"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// rpcAccess declares who may call a method: users with an access token and partner keys granted the scope,
+// an empty scope means that partner keys are refused
+type rpcAccess struct {
+	user  bool
+	scope string
+}
+
+var rpcMethods = map[string]rpcAccess{
+	rewardv1.UserService_GetMe_FullMethodName:                 {user: true},
+	rewardv1.UserService_GetUser_FullMethodName:               {user: true, scope: data.ScopePointsRead},
+	rewardv1.PointsService_GetBalance_FullMethodName:          {user: true, scope: data.ScopePointsRead},
+	rewardv1.PointsService_ListTransactions_FullMethodName:    {user: true, scope: data.ScopePointsRead},
+	rewardv1.PointsService_AwardPoints_FullMethodName:         {scope: data.ScopePointsWrite},
+	rewardv1.TaskService_CompleteTask_FullMethodName:          {user: true},
+	rewardv1.LeaderboardService_GetLeaderboard_FullMethodName: {user: true, scope: data.ScopePointsRead},
+}
+
+// rpcPublicPrefixes are the services callable without credentials
+var rpcPublicPrefixes = []string{"/grpc.health.v1.Health/", "/grpc.reflection."}
+
+// serveGRPC starts the gRPC server on the port, it shares the repository with the REST API. The server uses TLS
+// when GRPC_TLS_CERT and GRPC_TLS_KEY are set, without them it only listens on a private GRPC_HOST.
+func (app *Config) serveGRPC(port string) {
+	host := os.Getenv("GRPC_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	creds, err := grpcCredentials(host, os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	userRate := parseRate(os.Getenv("RATE_LIMIT_USER"), Rate{Burst: 120, Per: time.Minute})
+	partnerRate := parseRate(os.Getenv("RATE_LIMIT_PARTNER"), Rate{Burst: 600, Per: time.Minute})
+
+	s := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(app.unaryAuthInterceptor(userRate, partnerRate)),
+		grpc.ChainStreamInterceptor(app.streamAuthInterceptor(userRate, partnerRate)),
+	)
+	rewardv1.RegisterUserServiceServer(s, &userRPC{app: app})
+	rewardv1.RegisterPointsServiceServer(s, &pointsRPC{app: app})
+	rewardv1.RegisterTaskServiceServer(s, &taskRPC{app: app})
+	rewardv1.RegisterLeaderboardServiceServer(s, &leaderboardRPC{app: app})
+
+	healthServer := health.NewServer()
+	for name := range s.GetServiceInfo() {
+		healthServer.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+	reflection.Register(s)
+
+	log.Printf("Starting gRPC server on %s with %s", lis.Addr(), creds.Info().SecurityProtocol)
+	err = s.Serve(lis)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// grpcCredentials returns the TLS credentials of the certificate and the key, or plaintext credentials when
+// neither is set. Tokens and API keys travel in the metadata, so plaintext is refused unless the host is private.
+func grpcCredentials(host, certFile, keyFile string) (credentials.TransportCredentials, error) {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("GRPC_TLS_CERT and GRPC_TLS_KEY must be set together")
+		}
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the gRPC TLS certificate: %w", err)
+		}
+		return creds, nil
+	}
+
+	// a host name, like the service name in docker compose, must only resolve to private addresses
+	ips, err := net.LookupIP(host)
+	if host == "" || err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("gRPC without TLS may only listen on a loopback or private address, not %q: set GRPC_TLS_CERT and GRPC_TLS_KEY", host)
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() && !ip.IsPrivate() {
+			return nil, fmt.Errorf("gRPC without TLS may only listen on a loopback or private address, %q is %s: set GRPC_TLS_CERT and GRPC_TLS_KEY", host, ip)
+		}
+	}
+	return insecure.NewCredentials(), nil
+}
+
+// authenticateRPC checks the credentials from the metadata against the access rules of the method and returns
+// the context carrying the user or the partner key, like authTokenMiddleware and apiKeyMiddleware do
+func (app *Config) authenticateRPC(ctx context.Context, method string, userRate, partnerRate Rate) (context.Context, error) {
+	for _, prefix := range rpcPublicPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return ctx, nil
+		}
+	}
+	access, ok := rpcMethods[method]
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "method is not available")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		if access.scope == "" {
+			return nil, status.Error(codes.PermissionDenied, "method doesn't accept api keys")
+		}
+		key, err := app.authenticateAPIKey(keys[0], access.scope, partnerRate)
+		if err != nil {
+			return nil, apiKeyStatus(err)
+		}
+		return context.WithValue(ctx, apiKeyCtxKey, key), nil
+	}
+
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		token, found := strings.CutPrefix(auth[0], "Bearer ")
+		if !found {
+			return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+		}
+		if !access.user {
+			return nil, status.Error(codes.PermissionDenied, "method requires an api key")
+		}
+		userID, err := app.authenticateAccessToken(app.SecretKey, token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		// the same bucket as the REST API, so switching the protocol doesn't double the limit
+		allowed, _, err := app.RateLimiter.Take(fmt.Sprintf("user:sub:%d", userID), userRate)
+		if err != nil {
+			log.Printf("rate limiter user failed: %v", err)
+		} else if !allowed {
+			return nil, status.Error(codes.ResourceExhausted, "too many requests")
+		}
+		return context.WithValue(ctx, userIDKey, userID), nil
+	}
+
+	return nil, status.Error(codes.Unauthenticated, "access token or api key is required")
+}
+
+// unaryAuthInterceptor authenticates unary calls
+func (app *Config) unaryAuthInterceptor(userRate, partnerRate Rate) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := app.authenticateRPC(ctx, info.FullMethod, userRate, partnerRate)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authStream replaces the context of a stream with the authenticated one
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+// streamAuthInterceptor authenticates streaming calls
+func (app *Config) streamAuthInterceptor(userRate, partnerRate Rate) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := app.authenticateRPC(ss.Context(), info.FullMethod, userRate, partnerRate)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// apiKeyStatus converts a failed api key check to the gRPC status
+func apiKeyStatus(err error) error {
+	var keyErr *apiKeyError
+	if !errors.As(err, &keyErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch keyErr.status {
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, keyErr.err.Error())
+}
+
+// rpcError converts an error of the repository to the gRPC status, unexpected errors are logged and
+// answered with the fallback message
+func rpcError(err error, fallback string) error {
+	switch {
+	case errors.Is(err, data.ErrUserNotFound), errors.Is(err, data.ErrTaskNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, data.ErrInvalidAwardAmount), errors.Is(err, data.ErrExternalIDRequired),
+		errors.Is(err, data.ErrUnknownBoard):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, data.ErrTaskAlreadyCompleted), errors.Is(err, data.ErrProofTokenUsed):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, data.ErrExternalIDReused):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, data.ErrFraudBlocked):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	var proofErr *invalidProofError
+	if errors.As(err, &proofErr) {
+		return status.Error(codes.InvalidArgument, proofErr.Error())
+	}
+	log.Println(err)
+	return status.Error(codes.Internal, fallback)
+}
+
+// rpcUserID returns the user authenticated by the access token
+func rpcUserID(ctx context.Context) (int, error) {
+	userID, ok := ctx.Value(userIDKey).(int)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "access token is required")
+	}
+	return userID, nil
+}
+
+// rpcAuthorizeUser resolves the user a call is about: 0 means the caller. Users may only access themselves
+// unless they are admins, partner keys were already checked for the scope of the method.
+func (app *Config) rpcAuthorizeUser(ctx context.Context, userID int) (int, error) {
+	if _, ok := ctx.Value(apiKeyCtxKey).(*data.APIKey); ok {
+		if userID <= 0 {
+			return 0, status.Error(codes.InvalidArgument, "user_id is required")
+		}
+		return userID, nil
+	}
+	callerID, err := rpcUserID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if userID == 0 || userID == callerID {
+		return callerID, nil
+	}
+	isAdmin, err := app.Repo.IsAdmin(callerID)
+	if err != nil {
+		return 0, rpcError(err, "couldn't check permissions")
+	}
+	if !isAdmin {
+		return 0, status.Error(codes.PermissionDenied, "users can only access their own data")
+	}
+	return userID, nil
+}
+
+// toPartnerUser is the user as partner keys see it, without the personal data
+func toPartnerUser(u *data.User) *rewardv1.User {
+	return &rewardv1.User{
+		Id:        int32(u.ID),
+		Active:    u.Active == 1,
+		Score:     int32(u.Score),
+		Tier:      u.Tier,
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+}
+
+func toProtoUser(u *data.User) *rewardv1.User {
+	return &rewardv1.User{
+		Id:        int32(u.ID),
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Active:    u.Active == 1,
+		Score:     int32(u.Score),
+		Referrer:  u.Referrer,
+		Tier:      u.Tier,
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+}
+
+// userRPC implements rewardv1.UserServiceServer
+type userRPC struct {
+	rewardv1.UnimplementedUserServiceServer
+	app *Config
+}
+
+func (s *userRPC) GetMe(ctx context.Context, req *rewardv1.GetMeRequest) (*rewardv1.GetMeResponse, error) {
+	userID, err := rpcUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.app.Repo.GetOne(userID)
+	if err != nil {
+		return nil, rpcError(err, "couldn't fetch user")
+	}
+	return &rewardv1.GetMeResponse{User: toProtoUser(user)}, nil
+}
+
+func (s *userRPC) GetUser(ctx context.Context, req *rewardv1.GetUserRequest) (*rewardv1.GetUserResponse, error) {
+	userID, err := s.app.rpcAuthorizeUser(ctx, int(req.GetId()))
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.app.Repo.GetOne(userID)
+	if err != nil {
+		return nil, rpcError(err, "couldn't fetch user")
+	}
+	if _, ok := ctx.Value(apiKeyCtxKey).(*data.APIKey); ok {
+		return &rewardv1.GetUserResponse{User: toPartnerUser(user)}, nil
+	}
+	return &rewardv1.GetUserResponse{User: toProtoUser(user)}, nil
+}
+
+// pointsRPC implements rewardv1.PointsServiceServer
+type pointsRPC struct {
+	rewardv1.UnimplementedPointsServiceServer
+	app *Config
+}
+
+func (s *pointsRPC) GetBalance(ctx context.Context, req *rewardv1.GetBalanceRequest) (*rewardv1.GetBalanceResponse, error) {
+	userID, err := s.app.rpcAuthorizeUser(ctx, int(req.GetUserId()))
+	if err != nil {
+		return nil, err
+	}
+	balance, err := s.app.Repo.GetPointsBalance(userID)
+	if err != nil {
+		return nil, rpcError(err, "couldn't fetch points balance")
+	}
+
+	resp := &rewardv1.GetBalanceResponse{Balance: int32(balance.Balance)}
+	for _, e := range balance.Expirations {
+		resp.Expirations = append(resp.Expirations, &rewardv1.Expiration{
+			Amount:    int32(e.Amount),
+			ExpiresAt: timestamppb.New(e.ExpiresAt),
+		})
+	}
+	return resp, nil
+}
+
+func (s *pointsRPC) ListTransactions(ctx context.Context, req *rewardv1.ListTransactionsRequest) (*rewardv1.ListTransactionsResponse, error) {
+	userID, err := s.app.rpcAuthorizeUser(ctx, int(req.GetUserId()))
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = 50
+	}
+	history, err := s.app.Repo.GetHistory(userID, min(limit, 500))
+	if err != nil {
+		return nil, rpcError(err, "couldn't fetch history")
+	}
+
+	resp := &rewardv1.ListTransactionsResponse{}
+	for _, t := range history {
+		resp.Transactions = append(resp.Transactions, &rewardv1.Transaction{
+			Id:        int32(t.ID),
+			UserId:    int32(t.UserID),
+			Amount:    int32(t.Amount),
+			Kind:      t.Kind,
+			Memo:      t.Memo,
+			CreatedAt: timestamppb.New(t.CreatedAt),
+		})
+	}
+	return resp, nil
+}
+
+func (s *pointsRPC) AwardPoints(ctx context.Context, req *rewardv1.AwardPointsRequest) (*rewardv1.AwardPointsResponse, error) {
+	key, ok := ctx.Value(apiKeyCtxKey).(*data.APIKey)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "api key is required")
+	}
+	award, err := s.app.Repo.AwardPartnerPoints(key, data.PartnerAward{
+		UserID:     int(req.GetUserId()),
+		Amount:     int(req.GetAmount()),
+		ExternalID: req.GetExternalId(),
+		Reason:     req.GetReason(),
+	})
+	if err != nil {
+		return nil, rpcError(err, "couldn't award points")
+	}
+	return &rewardv1.AwardPointsResponse{Award: &rewardv1.PartnerAward{
+		Id:         int32(award.ID),
+		ApiKeyId:   int32(award.APIKeyID),
+		ExternalId: award.ExternalID,
+		UserId:     int32(award.UserID),
+		Amount:     int32(award.Amount),
+		Reason:     award.Reason,
+		CreatedAt:  timestamppb.New(award.CreatedAt),
+	}}, nil
+}
+
+// taskRPC implements rewardv1.TaskServiceServer
+type taskRPC struct {
+	rewardv1.UnimplementedTaskServiceServer
+	app *Config
+}
+
+func (s *taskRPC) CompleteTask(ctx context.Context, req *rewardv1.CompleteTaskRequest) (*rewardv1.CompleteTaskResponse, error) {
+	userID, err := rpcUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !userTasks[req.GetTask()] {
+		return nil, rpcError(data.ErrTaskNotFound, "couldn't find task")
+	}
+	task, err := s.app.Repo.GetTask(req.GetTask())
+	if err != nil {
+		return nil, rpcError(err, "couldn't find task")
+	}
+	completion, err := s.app.submitTask(userID, task, data.Proof{
+		Text:    req.GetProof(),
+		URL:     req.GetProofUrl(),
+		FileRef: req.GetFileRef(),
+	})
+	if err != nil {
+		return nil, rpcError(err, "couldn't complete task")
+	}
+
+	c := &rewardv1.TaskCompletion{
+		Id:        int32(completion.ID),
+		UserId:    int32(completion.UserID),
+		Task:      completion.TaskCode,
+		Status:    completion.Status,
+		Points:    int32(completion.Points),
+		Reason:    completion.Reason,
+		CreatedAt: timestamppb.New(completion.CreatedAt),
+	}
+	if completion.ResolvedAt != nil {
+		c.ResolvedAt = timestamppb.New(*completion.ResolvedAt)
+	}
+	return &rewardv1.CompleteTaskResponse{Completion: c}, nil
+}
+
+// leaderboardRPC implements rewardv1.LeaderboardServiceServer
+type leaderboardRPC struct {
+	rewardv1.UnimplementedLeaderboardServiceServer
+	app *Config
+}
+
+func (s *leaderboardRPC) GetLeaderboard(ctx context.Context, req *rewardv1.GetLeaderboardRequest) (*rewardv1.GetLeaderboardResponse, error) {
+	board, window, top := req.GetBoard(), req.GetWindow(), int(req.GetTop())
+	if board == "" {
+		board = data.BoardBalance
+	}
+	if window == "" {
+		window = data.WindowAll
+	}
+	if top <= 0 {
+		top = defaultBoardTop
+	}
+	entries, err := s.app.Repo.GetTopUsers(board, window, min(top, maxBoardTop))
+	if err != nil {
+		return nil, rpcError(err, "couldn't fetch leaderboard")
+	}
+
+	resp := &rewardv1.GetLeaderboardResponse{}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, &rewardv1.LeaderboardEntry{
+			Rank:      int32(e.Rank),
+			UserId:    int32(e.UserID),
+			FirstName: e.FirstName,
+			Points:    int32(e.Points),
+		})
+	}
+	return resp, nil
+}
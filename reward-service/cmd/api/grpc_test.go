@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reward-service/data"
+	rewardv1 "reward-service/gen/reward/v1"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcUser is the user the gRPC tests ask for
+var rpcUser = &data.User{ID: 7, Email: "bob@example.com", FirstName: "Bob", LastName: "Fake", Referrer: "alice", Score: 40, Active: 1}
+
+func TestGetUserPartnerProjection(t *testing.T) {
+	s := &userRPC{app: &Config{Repo: newFakeRepo(rpcUser)}}
+	ctx := context.WithValue(context.Background(), apiKeyCtxKey, &data.APIKey{ID: 1})
+
+	resp, err := s.GetUser(ctx, &rewardv1.GetUserRequest{Id: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := resp.GetUser()
+	if u.GetEmail() != "" || u.GetFirstName() != "" || u.GetLastName() != "" || u.GetReferrer() != "" {
+		t.Errorf("partner key got personal data: %v", u)
+	}
+	if u.GetId() != 7 || u.GetScore() != 40 {
+		t.Errorf("partner key got %v, want the id and the score", u)
+	}
+
+	ctx = context.WithValue(context.Background(), userIDKey, 7)
+	resp, err = s.GetUser(ctx, &rewardv1.GetUserRequest{Id: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetUser().GetEmail() != "bob@example.com" {
+		t.Errorf("user got %v, want the own email", resp.GetUser())
+	}
+}
+
+func TestCompleteTaskAllowlist(t *testing.T) {
+	repo := newFakeRepo(rpcUser)
+	s := &taskRPC{app: &Config{Repo: repo}}
+	ctx := context.WithValue(context.Background(), userIDKey, 7)
+
+	for _, code := range []string{"dailyCheckin", "telegramBotJoined", ""} {
+		_, err := s.CompleteTask(ctx, &rewardv1.CompleteTaskRequest{Task: code})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("CompleteTask(%q) error = %v, want NotFound", code, err)
+		}
+	}
+	if len(repo.taskLookups) != 0 {
+		t.Errorf("tasks %v were looked up, want them refused before", repo.taskLookups)
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to the directory and returns their paths
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestGRPCCredentials(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name              string
+		host              string
+		certFile, keyFile string
+		wantProtocol      string
+		wantErr           bool
+	}{
+		{"plaintext on loopback", "127.0.0.1", "", "", "insecure", false},
+		{"plaintext on localhost", "localhost", "", "", "insecure", false},
+		{"plaintext on a private network", "10.0.0.5", "", "", "insecure", false},
+		{"plaintext on all interfaces", "", "", "", "", true},
+		{"plaintext on 0.0.0.0", "0.0.0.0", "", "", "", true},
+		{"plaintext on a public address", "203.0.113.10", "", "", "", true},
+		{"tls on a public address", "0.0.0.0", certFile, keyFile, "tls", false},
+		{"certificate without a key", "0.0.0.0", certFile, "", "", true},
+		{"missing certificate", "0.0.0.0", missing, keyFile, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := grpcCredentials(tt.host, tt.certFile, tt.keyFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("grpcCredentials() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && creds.Info().SecurityProtocol != tt.wantProtocol {
+				t.Errorf("grpcCredentials() protocol = %q, want %q", creds.Info().SecurityProtocol, tt.wantProtocol)
+			}
+		})
+	}
+}
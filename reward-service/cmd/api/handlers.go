@@ -4,24 +4,26 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"log"
 	"net/http"
-	"os"
 	"reward-service/data"
 	"strconv"
 	"time"
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"-"`
-	Active    int       `json:"active"`
-	Score     int       `json:"score"`
-	Referrer  string    `json:"referrer,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             int       `json:"id"`
+	Email          string    `json:"email"`
+	FirstName      string    `json:"first_name,omitempty"`
+	LastName       string    `json:"last_name,omitempty"`
+	Password       string    `json:"-"`
+	Active         int       `json:"active"`
+	Score          int       `json:"score"`
+	Referrer       string    `json:"referrer,omitempty"`
+	Tier           string    `json:"tier,omitempty"`
+	RegistrationIP string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
 type contextKey string
@@ -39,6 +41,36 @@ func (app *Config) getIDFromRequest(w http.ResponseWriter, r *http.Request) (int
 	return id, nil
 }
 
+// getOwnIDFromRequest gets id from the URL and makes sure it is the id of the authenticated user,
+// so users can act only on their own account
+func (app *Config) getOwnIDFromRequest(w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return 0, err
+	}
+	if id != userID {
+		err = errors.New("you can only act on your own account")
+		app.errorJSON(w, err, http.StatusForbidden)
+		return 0, err
+	}
+	return id, nil
+}
+
+// getUserIDFromContext gets id of the authenticated user, put into the context by authTokenMiddleware
+func (app *Config) getUserIDFromContext(w http.ResponseWriter, r *http.Request) (int, error) {
+	id, ok := r.Context().Value(userIDKey).(int)
+	if !ok {
+		err := errors.New("couldn't get authenticated user")
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return 0, err
+	}
+	return id, nil
+}
+
 // Registrate insert new user to the database
 func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
@@ -46,8 +78,6 @@ func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 		FirstName string `json:"first_name"`
 		LastName  string `json:"last_name"`
 		Password  string `json:"password"`
-		Active    int    `json:"active,omitempty"`
-		Score     int    `json:"score,omitempty"`
 		Referrer  string `json:"referrer,omitempty"`
 	}
 
@@ -56,27 +86,32 @@ func (app *Config) Registrate(w http.ResponseWriter, r *http.Request) {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	if len(requestPayload.Password) < 8 {
-		app.errorJSON(w, errors.New("password must be at least 8 characters long"), http.StatusBadRequest)
+	err = validateEmail(requestPayload.Email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 	user := User{
-		Email:     requestPayload.Email,
-		FirstName: requestPayload.FirstName,
-		LastName:  requestPayload.LastName,
-		Password:  requestPayload.Password,
-		Active:    requestPayload.Active,
-		Score:     requestPayload.Score,
-		Referrer:  requestPayload.Referrer,
+		Email:          requestPayload.Email,
+		FirstName:      requestPayload.FirstName,
+		LastName:       requestPayload.LastName,
+		Password:       requestPayload.Password,
+		Active:         0,
+		Referrer:       requestPayload.Referrer,
+		RegistrationIP: clientIP(r),
 	}
 	id, err := app.Repo.Insert(data.User(user))
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
+	err = app.sendVerificationEmail(id, user.Email)
+	if err != nil {
+		log.Printf("failed to send verification email to user %d: %v", id, err)
+	}
 	payload := jsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("Succesfully created new user, id: %d", id),
+		Message: fmt.Sprintf("Succesfully created new user, id: %d. Confirm your email address to activate the account", id),
 	}
 
 	app.writeJSON(w, http.StatusAccepted, payload)
@@ -113,35 +148,50 @@ func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	emailKey, ipKey := loginKeys(requestPayload.Email, ip)
+	lockedUntil, err := app.Repo.GetLoginLock(emailKey, ipKey)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		app.writeLocked(w, lockedUntil)
+		return
+	}
+
 	user, err := app.Repo.EmailCheck(requestPayload.Email)
 	if err != nil {
-		app.errorJSON(w, errors.New("user with this email does not exist"), http.StatusBadRequest)
+		// compare against a dummy hash, so an unknown email takes as long as a wrong password
+		app.Repo.PasswordMatches(requestPayload.Password, data.User{Password: app.getDummyHash()})
+		app.recordLoginFailure(requestPayload.Email, ip, false)
+		app.errorJSON(w, errInvalidCredentials, http.StatusBadRequest)
 		return
 	}
 
 	valid, err := app.Repo.PasswordMatches(requestPayload.Password, *user)
 	if err != nil || !valid {
-		app.errorJSON(w, errors.New("invalid password"), http.StatusBadRequest)
+		app.recordLoginFailure(requestPayload.Email, ip, true)
+		app.errorJSON(w, errInvalidCredentials, http.StatusBadRequest)
+		return
+	}
+	app.Repo.ResetLoginFailures(emailKey)
+	if user.Active == 0 {
+		app.errorJSON(w, errors.New("email address is not verified"), http.StatusForbidden)
 		return
 	}
 
-	secretKey := os.Getenv("SECRET_KEY")
-	userData, err := generateTokens(user.ID, secretKey)
+	enabled, err := app.Repo.TOTPEnabled(user.ID)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		app.writeTwoFactorChallenge(w, user.ID)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    userData.AccessToken,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().Add(15 * time.Minute),
-	})
-	err = validateRefreshToken(userData.HashedRefreshToken, userData.RefreshToken)
+	err = app.issueAccessToken(w, user.ID)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
@@ -154,60 +204,157 @@ func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
+// recordCompletion records the completion of the task by the user, approved completions are credited right away.
+// Pending completions of tasks with a webhook verifier are queued and sent to the verifier by requestVerifications.
+func (app *Config) recordCompletion(userID int, task *data.Task, proof data.Proof, approved bool) (*data.TaskCompletion, error) {
+	return app.Repo.CreateCompletion(userID, *task, proof, approved)
+}
+
+// invalidProofError is returned by submitTask when the proof doesn't fit the task
+type invalidProofError struct {
+	err error
+}
+
+func (e *invalidProofError) Error() string {
+	return e.err.Error()
+}
+
+// submitTask checks the proof against the verifier of the task and records the completion. Tasks without a verifier
+// and with a valid proof token are approved right away, the others wait for their verifier.
+func (app *Config) submitTask(userID int, task *data.Task, proof data.Proof) (*data.TaskCompletion, error) {
+	if len(proof.URL) > 2048 || len(proof.FileRef) > 255 {
+		return nil, &invalidProofError{errors.New("proof_url or file_ref is too long")}
+	}
+	if task.Verifier == data.VerifierManual && proof.Text == "" && proof.URL == "" && proof.FileRef == "" {
+		return nil, &invalidProofError{errors.New("task requires a proof for the review")}
+	}
+
+	approved := false
+	switch task.Verifier {
+	case data.VerifierNone:
+		approved = true
+	case data.VerifierProofToken:
+		expires, err := verifyProofToken(proof.Text, userID, task.Code, app.verifierSecret(task.Code))
+		if err != nil {
+			return nil, &invalidProofError{err}
+		}
+		proof.TokenExpiresAt = expires
+		approved = true
+	}
+
+	return app.recordCompletion(userID, task, proof, approved)
+}
+
+// writeCompletionError answers with the status matching the error of recordCompletion
+func (app *Config) writeCompletionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, data.ErrTaskAlreadyCompleted), errors.Is(err, data.ErrProofTokenUsed):
+		app.errorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, data.ErrFraudBlocked):
+		app.errorJSON(w, err, http.StatusForbidden)
+	case errors.Is(err, data.ErrUserNotFound):
+		app.errorJSON(w, err, http.StatusNotFound)
+	default:
+		app.errorJSON(w, errors.New("couldn't add points to the user"), http.StatusInternalServerError)
+	}
+}
+
+// userTasks are the tasks users complete themselves through the task routes and TaskService.CompleteTask,
+// the other tasks are completed for them by webhooks and check-ins
+var userTasks = map[string]bool{
+	"complete":     true,
+	"telegramSign": true,
+	"XSign":        true,
+	"postAboutUs":  true,
+}
+
 // someTask some blank task
 func (app *Config) someTask(w http.ResponseWriter, r *http.Request) {
-	app.completeTask(w, r, 100)
+	app.completeTask(w, r, "complete")
 }
 
-// completeTask completes various task and adding some point to the user
-func (app *Config) completeTask(w http.ResponseWriter, r *http.Request, points int) {
-	id, err := app.getIDFromRequest(w, r)
+// completeTask completes the task with the given code. Tasks without a verifier add points to the user right away,
+// multiplied by the user's tier, other tasks stay pending until their verifier confirms them.
+func (app *Config) completeTask(w http.ResponseWriter, r *http.Request, code string) {
+	var requestPayload struct {
+		Proof    string `json:"proof,omitempty"`
+		ProofURL string `json:"proof_url,omitempty"`
+		FileRef  string `json:"file_ref,omitempty"`
+	}
+	id, err := app.getOwnIDFromRequest(w, r)
 	if err != nil {
 		return
 	}
-	err = app.Repo.AddPoints(id, points)
+	task, err := app.Repo.GetTask(code)
+	if errors.Is(err, data.ErrTaskNotFound) {
+		app.errorJSON(w, errors.New("couldn't find task"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch task"), http.StatusInternalServerError)
+		return
+	}
+	if task.Verifier != data.VerifierNone && r.ContentLength != 0 {
+		err = app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	completion, err := app.submitTask(id, task, data.Proof{
+		Text:    requestPayload.Proof,
+		URL:     requestPayload.ProofURL,
+		FileRef: requestPayload.FileRef,
+	})
+	var proofErr *invalidProofError
+	if errors.As(err, &proofErr) {
+		app.errorJSON(w, proofErr.err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		app.errorJSON(w, errors.New("couldn't add points to the user"), http.StatusBadRequest)
+		app.writeCompletionError(w, err)
+		return
+	}
+
+	if completion.Status != data.CompletionApproved {
+		payload := jsonResponse{
+			Error:   false,
+			Message: fmt.Sprintf("task %s of user with id %d is waiting for verification", task.Code, id),
+			Data:    completion,
+		}
+		app.writeJSON(w, http.StatusAccepted, payload)
 		return
 	}
 
 	payload := jsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("complete task worked for user with id %d, added points %d", id, points),
+		Message: fmt.Sprintf("complete task worked for user with id %d, added points %d", id, completion.Points),
+		Data:    completion,
 	}
 
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
+// completePostAboutUs submits a post about us for the review
+func (app *Config) completePostAboutUs(w http.ResponseWriter, r *http.Request) {
+	app.completeTask(w, r, "postAboutUs")
+}
+
 // completeTelegramSign completes telegram sign to add points to the user
 func (app *Config) completeTelegramSign(w http.ResponseWriter, r *http.Request) {
-	app.completeTask(w, r, 50)
+	app.completeTask(w, r, "telegramSign")
 }
 
 // completeTelegramSign completes X sign to add points to the user
 func (app *Config) completeXSign(w http.ResponseWriter, r *http.Request) {
-	app.completeTask(w, r, 75)
-}
-
-// Kuarhodron special task to add 10k points
-func (app *Config) Kuarhodron(w http.ResponseWriter, r *http.Request) {
-	var requestPayload struct {
-		SecretWaterPassword string `json:"water_password"`
-	}
-	err := app.readJSON(w, r, &requestPayload)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
-		return
-	}
-	if requestPayload.SecretWaterPassword == "KUARHODRON" {
-		app.completeTask(w, r, 10000)
-	}
+	app.completeTask(w, r, "XSign")
 }
 
 // retrieveOne retrieves one user from the database by id
 func (app *Config) retrieveOne(w http.ResponseWriter, r *http.Request) {
 
-	id, err := app.getIDFromRequest(w, r)
+	id, err := app.getOwnIDFromRequest(w, r)
 	if err != nil {
 		return
 	}
@@ -227,12 +374,33 @@ func (app *Config) retrieveOne(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// retrieveBadges retrieves the badges awarded to one user by id
+func (app *Config) retrieveBadges(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	badges, err := app.Repo.GetBadges(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch badges"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Retrieved badges of the user"),
+		Data:    badges,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
 // redeemReferrer redeems referrer for the owner of the referrer and for the user, who used it base on id and referrer
 func (app *Config) redeemReferrer(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
 		Referrer string `json:"referrer"`
 	}
-	id, err := app.getIDFromRequest(w, r)
+	id, err := app.getOwnIDFromRequest(w, r)
 	if err != nil {
 		return
 	}
@@ -242,8 +410,16 @@ func (app *Config) redeemReferrer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	err = app.Repo.RedeemReferrer(id, requestPayload.Referrer)
+	if errors.Is(err, data.ErrFraudBlocked) {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, data.ErrReferrerAlreadyRedeemed) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
-		app.errorJSON(w, errors.New("couldn't redeem referrer"), http.StatusBadRequest)
+		app.errorJSON(w, errors.New("couldn't redeem referrer"), http.StatusInternalServerError)
 		return
 	}
 	payload := jsonResponse{
@@ -255,17 +431,25 @@ func (app *Config) redeemReferrer(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// DeleteUser delets user from the DB
+// DeleteUser delets user from the DB, users can only delete their own account
 func (app *Config) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
 	var requestPayload struct {
-		id int `json:"id"`
+		ID int `json:"id"`
 	}
-	err := app.readJSON(w, r, &requestPayload)
+	err = app.readJSON(w, r, &requestPayload)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	err = app.Repo.DeleteByID(requestPayload.id)
+	if requestPayload.ID != userID {
+		app.errorJSON(w, errors.New("you can only delete your own account"), http.StatusForbidden)
+		return
+	}
+	err = app.Repo.DeleteByID(requestPayload.ID)
 	if err != nil {
 		app.errorJSON(w, errors.New("couldn't delete user"), http.StatusBadRequest)
 		return
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// asUser serves the request on the user routes as if authTokenMiddleware authenticated the user
+func asUser(app *Config, userID int, method, target, body string) *httptest.ResponseRecorder {
+	mux := chi.NewRouter()
+	mux.Get("/users/{id}/status", app.retrieveOne)
+	mux.Post("/users/{id}/referrer", app.redeemReferrer)
+	mux.Post("/users/{id}/task/complete", app.someTask)
+	mux.Post("/users/deleteUser", app.DeleteUser)
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUserRoutesOwnAccountOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"status", http.MethodGet, "/users/2/status", ""},
+		{"referrer", http.MethodPost, "/users/2/referrer", `{"referrer":"abc"}`},
+		{"task", http.MethodPost, "/users/2/task/complete", ""},
+		{"delete", http.MethodPost, "/users/deleteUser", `{"id":2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo(&data.User{ID: 1}, &data.User{ID: 2})
+			app := &Config{Repo: repo}
+
+			rec := asUser(app, 1, tt.method, tt.target, tt.body)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s %s by another user responded with %d, want %d", tt.method, tt.target, rec.Code, http.StatusForbidden)
+			}
+			if len(repo.deleted) != 0 {
+				t.Errorf("another user deleted users %v", repo.deleted)
+			}
+		})
+	}
+}
+
+func TestDeleteOwnAccount(t *testing.T) {
+	repo := newFakeRepo(&data.User{ID: 1}, &data.User{ID: 2})
+	app := &Config{Repo: repo}
+
+	rec := asUser(app, 2, http.MethodPost, "/users/deleteUser", `{"id":2}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("deleting the own account responded with %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if !slices.Equal(repo.deleted, []int{2}) {
+		t.Errorf("deleted users %v, want [2]", repo.deleted)
+	}
+
+	rec = asUser(app, 1, http.MethodGet, "/users/1/status", "")
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("reading the own status responded with %d, want %d", rec.Code, http.StatusAccepted)
+	}
+}
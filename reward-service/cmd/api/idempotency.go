@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// idempotencyKeyLease is how long a key is reserved for the request processing it. A request after the
+// lease takes the key over, so a key isn't stuck in progress when the process dies while handling it.
+const idempotencyKeyLease = time.Minute
+
+// responseRecorder passes the response through to the client while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// requestFingerprint hashes the parts of the request which must be equal for a replay
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayable reports whether a response with the status is final and may be replayed for the same key.
+// Server errors and the client errors which go away by themselves are not, the client should retry them.
+func replayable(status int) bool {
+	switch {
+	case status >= http.StatusOK && status < http.StatusMultipleChoices:
+		return true
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return false
+	default:
+		return status >= http.StatusBadRequest && status < http.StatusInternalServerError
+	}
+}
+
+// idempotencyMiddleware honours the Idempotency-Key header: the first response for a key is stored,
+// later requests with the same key get the stored response instead of being executed again
+func (app *Config) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.errorJSON(w, errors.New("Idempotency-Key must be at most 255 characters long"), http.StatusBadRequest)
+			return
+		}
+		userID, err := app.getUserIDFromContext(w, r)
+		if err != nil {
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		stored, err := app.Repo.ReserveIdempotencyKey(userID, key, fingerprint, app.IdempotencyTTL, idempotencyKeyLease)
+		if err != nil {
+			app.errorJSON(w, errors.New("couldn't check idempotency key"), http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.Fingerprint != fingerprint:
+				app.errorJSON(w, errors.New("idempotency key was already used for a different request"), http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				app.errorJSON(w, errors.New("request with this idempotency key is still in progress"), http.StatusConflict)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.ResponseBody)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			// a panicking handler leaves no response to store, free the key so the client can retry it
+			if p := recover(); p != nil {
+				err := app.Repo.ReleaseIdempotencyKey(userID, key)
+				if err != nil {
+					log.Printf("failed to release idempotency key %q of user %d: %v", key, userID, err)
+				}
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		// only final answers are stored, the client should be able to retry everything else
+		if !replayable(rec.status) {
+			err = app.Repo.ReleaseIdempotencyKey(userID, key)
+		} else {
+			err = app.Repo.SaveIdempotencyResponse(userID, key, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("failed to finish idempotency key %q of user %d: %v", key, userID, err)
+		}
+	})
+}
+
+// purgeIdempotencyKeys periodically deletes idempotency keys whose TTL has passed
+func (app *Config) purgeIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.Repo.DeleteExpiredIdempotencyKeys()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Deleted %d expired idempotency keys", n)
+		}
+	}
+}
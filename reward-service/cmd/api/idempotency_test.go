@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idempotencyTest is a handler behind idempotencyMiddleware which counts how often it ran
+type idempotencyTest struct {
+	app     *Config
+	handler http.Handler
+	runs    int
+	status  int
+}
+
+func newIdempotencyTest() *idempotencyTest {
+	it := &idempotencyTest{app: &Config{Repo: newFakeRepo()}, status: http.StatusAccepted}
+	it.handler = it.app.idempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		it.runs++
+		w.WriteHeader(it.status)
+		fmt.Fprintf(w, "run %d of %s", it.runs, body)
+	}))
+	return it
+}
+
+// send sends the request of the user with the key and returns the response
+func (it *idempotencyTest) send(userID int, key, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	it.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	it := newIdempotencyTest()
+
+	first := it.send(1, "key", "/users/1/referrer", `{"referrer":"abc"}`)
+	second := it.send(1, "key", "/users/1/referrer", `{"referrer":"abc"}`)
+	if it.runs != 1 {
+		t.Fatalf("handler ran %d times for a retried request, want once", it.runs)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("retry got %d %q, want the stored %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response isn't marked with Idempotent-Replayed")
+	}
+
+	// keys belong to the user who sent them
+	it.send(2, "key", "/users/2/referrer", `{"referrer":"abc"}`)
+	if it.runs != 2 {
+		t.Errorf("handler ran %d times, want the request of another user with the same key to run", it.runs)
+	}
+	// requests without a key always run
+	it.send(1, "", "/users/1/referrer", `{"referrer":"abc"}`)
+	it.send(1, "", "/users/1/referrer", `{"referrer":"abc"}`)
+	if it.runs != 4 {
+		t.Errorf("handler ran %d times, want requests without a key to run every time", it.runs)
+	}
+}
+
+func TestIdempotencyKeyReusedForAnotherRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"other body", "/users/1/referrer", `{"referrer":"xyz"}`},
+		{"other path", "/users/1/task/complete", `{"referrer":"abc"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := newIdempotencyTest()
+			it.send(1, "key", "/users/1/referrer", `{"referrer":"abc"}`)
+
+			rec := it.send(1, "key", tt.path, tt.body)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("reused key responded with %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+			}
+			if it.runs != 1 {
+				t.Errorf("handler ran %d times, want a reused key to be refused without running", it.runs)
+			}
+		})
+	}
+}
+
+func TestIdempotencyOnlyFinalResponsesReplayed(t *testing.T) {
+	tests := []struct {
+		status     int
+		wantReplay bool
+	}{
+		{http.StatusAccepted, true},
+		{http.StatusBadRequest, true},
+		{http.StatusConflict, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			it := newIdempotencyTest()
+			it.status = tt.status
+			it.send(1, "key", "/users/1/referrer", `{}`)
+
+			it.status = http.StatusAccepted
+			rec := it.send(1, "key", "/users/1/referrer", `{}`)
+			if replayed := it.runs == 1; replayed != tt.wantReplay {
+				t.Fatalf("retry after %d ran the handler %d times, want replayed = %v", tt.status, it.runs, tt.wantReplay)
+			}
+			if !tt.wantReplay && rec.Code != http.StatusAccepted {
+				t.Errorf("retry after %d got %d, want the response of the new run", tt.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	it := newIdempotencyTest()
+	// the key is reserved by a request which didn't finish yet
+	fingerprint := requestFingerprint(httptest.NewRequest(http.MethodPost, "/users/1/referrer", nil), []byte(`{}`))
+	it.app.Repo.ReserveIdempotencyKey(1, "key", fingerprint, time.Hour, time.Minute)
+
+	rec := it.send(1, "key", "/users/1/referrer", `{}`)
+	if rec.Code != http.StatusConflict || it.runs != 0 {
+		t.Errorf("request with a key in progress got %d and ran %d times, want %d without running", rec.Code, it.runs, http.StatusConflict)
+	}
+
+	// the request holding the key died, once its lease is over the key is taken over
+	it.app.Repo.(*fakeRepo).idempotencyLeases["1|key"] = time.Now().Add(-time.Second)
+	rec = it.send(1, "key", "/users/1/referrer", `{}`)
+	if rec.Code != http.StatusAccepted || it.runs != 1 {
+		t.Errorf("request with a key past its lease got %d and ran %d times, want it to run", rec.Code, it.runs)
+	}
+}
+
+func TestIdempotencyPanicReleasesKey(t *testing.T) {
+	it := newIdempotencyTest()
+	panicking := it.app.idempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/users/1/referrer", strings.NewReader(`{}`))
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, 1))
+	req.Header.Set("Idempotency-Key", "key")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic of the handler was swallowed")
+			}
+		}()
+		panicking.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	rec := it.send(1, "key", "/users/1/referrer", `{}`)
+	if rec.Code != http.StatusAccepted || it.runs != 1 {
+		t.Errorf("retry after a panic got %d and ran %d times, want it to run", rec.Code, it.runs)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// webhookEventLease is how long an event is reserved for the request processing it. A delivery after the
+// lease takes the event over, so an event isn't stuck when the process dies while processing it.
+const webhookEventLease = 5 * time.Minute
+
+// WebhookSource is an external system allowed to send events to /webhooks/{name}. Events maps
+// the event types of the source to the codes of the tasks they complete. The shared secret is
+// read from the environment variable named by SecretEnv.
+type WebhookSource struct {
+	Name      string            `json:"name"`
+	SecretEnv string            `json:"secret_env"`
+	Tolerance string            `json:"tolerance,omitempty"`
+	Events    map[string]string `json:"events"`
+
+	secret    string
+	tolerance time.Duration
+}
+
+// webhookEvent is the body of an inbound webhook
+type webhookEvent struct {
+	ID     string     `json:"id"`
+	Type   string     `json:"type"`
+	UserID int        `json:"user_id"`
+	Proof  data.Proof `json:"proof"`
+}
+
+// loadWebhookSources reads the webhook sources from a JSON file, tolerance is used by sources which don't set their own
+func loadWebhookSources(path string, tolerance time.Duration) (map[string]*WebhookSource, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook sources: %w", err)
+	}
+	var list []*WebhookSource
+	err = json.Unmarshal(content, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhook sources: %w", err)
+	}
+
+	sources := make(map[string]*WebhookSource, len(list))
+	for _, s := range list {
+		s.secret = os.Getenv(s.SecretEnv)
+		if s.Name == "" || s.secret == "" {
+			return nil, fmt.Errorf("webhook source %q needs a name and a secret in %s", s.Name, s.SecretEnv)
+		}
+		s.tolerance = tolerance
+		if s.Tolerance != "" {
+			s.tolerance, err = time.ParseDuration(s.Tolerance)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tolerance of webhook source %s: %w", s.Name, err)
+			}
+		}
+		sources[s.Name] = s
+	}
+	return sources, nil
+}
+
+// verifySignature checks the signature of a request from the source
+func (s *WebhookSource) verifySignature(r *http.Request, body []byte) error {
+	return verifySignature(r, body, s.secret, s.tolerance)
+}
+
+// verifySignature checks the X-Webhook-Signature header, HMAC-SHA256 of "<timestamp>.<body>" with the secret
+// in hex, optionally prefixed by "sha256=". The X-Webhook-Timestamp header must be within the tolerance,
+// so a captured request can't be replayed later.
+func verifySignature(r *http.Request, body []byte, secret string, tolerance time.Duration) error {
+	timestamp := r.Header.Get("X-Webhook-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed X-Webhook-Timestamp")
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return errors.New("webhook timestamp is outside the tolerance")
+	}
+
+	expected := signWebhook(secret, timestamp, body)
+	signature := "sha256=" + strings.TrimPrefix(r.Header.Get("X-Webhook-Signature"), "sha256=")
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("invalid webhook signature")
+	}
+	return nil
+}
+
+// receiveWebhook accepts a signed event from an external system and completes the task mapped to its type
+// for the user. Every event id is processed once, deliveries of an already received event are acknowledged
+// without doing anything. A delivery of an event which is still being processed is refused, so the source
+// delivers it again in case the processing doesn't finish.
+func (app *Config) receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	source, ok := app.WebhookSources[chi.URLParam(r, "source")]
+	if !ok {
+		app.errorJSON(w, errors.New("unknown webhook source"), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	err = source.verifySignature(r, body)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	var ev webhookEvent
+	err = json.Unmarshal(body, &ev)
+	if err != nil || ev.ID == "" || ev.Type == "" {
+		app.errorJSON(w, errors.New("event needs an id and a type"), http.StatusBadRequest)
+		return
+	}
+
+	stored, err := app.Repo.ReserveWebhookEvent(data.WebhookEvent{
+		Source:    source.Name,
+		EventID:   ev.ID,
+		EventType: ev.Type,
+		UserID:    ev.UserID,
+	}, webhookEventLease)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't record webhook event"), http.StatusInternalServerError)
+		return
+	}
+	if stored != nil && stored.Status == data.WebhookProcessing {
+		app.errorJSON(w, fmt.Errorf("event %s is still being processed", ev.ID), http.StatusConflict)
+		return
+	}
+	if stored != nil {
+		payload := jsonResponse{
+			Error:   false,
+			Message: fmt.Sprintf("Event %s was already received", ev.ID),
+			Data:    stored,
+		}
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	status, detail, httpStatus, err := app.processWebhookEvent(source, ev)
+	if err != nil {
+		if status == "" {
+			// temporary failure, the source may deliver the event again
+			app.releaseWebhookEvent(source.Name, ev.ID)
+		} else {
+			app.finishWebhookEvent(source.Name, ev.ID, status, err.Error())
+		}
+		app.errorJSON(w, err, httpStatus)
+		return
+	}
+	if status != data.WebhookProcessed {
+		// processed events were finished together with their completion
+		app.finishWebhookEvent(source.Name, ev.ID, status, detail)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Event %s %s", ev.ID, status),
+		Data:    map[string]string{"status": status, "detail": detail},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// processWebhookEvent completes the task mapped to the event type. The signed event is the verification,
+// so the completion is approved whatever verifier the task has. A completed task marks the event processed
+// in its own transaction, the other outcomes are left to the caller. An empty status with an error means
+// the failure is temporary.
+func (app *Config) processWebhookEvent(source *WebhookSource, ev webhookEvent) (string, string, int, error) {
+	code, ok := source.Events[ev.Type]
+	if !ok {
+		return data.WebhookIgnored, fmt.Sprintf("event type %s is not mapped to a task", ev.Type), 0, nil
+	}
+	task, err := app.Repo.GetTask(code)
+	if err != nil {
+		log.Printf("webhook source %s maps %s to task %s: %v", source.Name, ev.Type, code, err)
+		return "", "", http.StatusInternalServerError, errors.New("couldn't find task")
+	}
+
+	completion, err := app.Repo.CompleteWebhookTask(data.WebhookEvent{
+		Source:  source.Name,
+		EventID: ev.ID,
+		UserID:  ev.UserID,
+	}, *task, ev.Proof)
+	switch {
+	case errors.Is(err, data.ErrWebhookEventFinished):
+		return data.WebhookProcessed, err.Error(), 0, nil
+	case errors.Is(err, data.ErrTaskAlreadyCompleted):
+		return data.WebhookIgnored, err.Error(), 0, nil
+	case errors.Is(err, data.ErrUserNotFound):
+		return data.WebhookRejected, "", http.StatusUnprocessableEntity, err
+	case errors.Is(err, data.ErrFraudBlocked):
+		return data.WebhookRejected, "", http.StatusForbidden, err
+	case err != nil:
+		return "", "", http.StatusInternalServerError, errors.New("couldn't add points to the user")
+	}
+	return data.WebhookProcessed, fmt.Sprintf("task %s completed, completion %d, %d points", task.Code, completion.ID, completion.Points), 0, nil
+}
+
+// finishWebhookEvent stores the outcome of the event, a failure only leaves the event marked as processing
+func (app *Config) finishWebhookEvent(source, eventID, status, detail string) {
+	err := app.Repo.FinishWebhookEvent(source, eventID, status, detail)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// releaseWebhookEvent forgets the event after a temporary failure, a failure only leaves the event marked as
+// processing until its lease ends
+func (app *Config) releaseWebhookEvent(source, eventID string) {
+	err := app.Repo.ReleaseWebhookEvent(source, eventID)
+	if err != nil {
+		log.Println(err)
+	}
+}
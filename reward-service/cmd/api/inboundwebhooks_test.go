@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// signedRequest returns a webhook request with the body signed by the secret at the given time
+func signedRequest(secret string, at time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/crm", strings.NewReader(body))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, []byte(body)))
+	return req
+}
+
+func TestVerifySignature(t *testing.T) {
+	const body = `{"id":"evt_1","type":"signup","user_id":7}`
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    string
+		wantErr bool
+	}{
+		{"valid", func() *http.Request {
+			return signedRequest("secret", time.Now(), body)
+		}, body, false},
+		{"without the sha256= prefix", func() *http.Request {
+			req := signedRequest("secret", time.Now(), body)
+			req.Header.Set("X-Webhook-Signature", strings.TrimPrefix(req.Header.Get("X-Webhook-Signature"), "sha256="))
+			return req
+		}, body, false},
+		{"within the tolerance", func() *http.Request {
+			return signedRequest("secret", time.Now().Add(-4*time.Minute), body)
+		}, body, false},
+		{"tampered body", func() *http.Request {
+			return signedRequest("secret", time.Now(), body)
+		}, strings.Replace(body, "7", "8", 1), true},
+		{"other secret", func() *http.Request {
+			return signedRequest("other", time.Now(), body)
+		}, body, true},
+		{"no signature", func() *http.Request {
+			req := signedRequest("secret", time.Now(), body)
+			req.Header.Del("X-Webhook-Signature")
+			return req
+		}, body, true},
+		{"missing timestamp", func() *http.Request {
+			req := signedRequest("secret", time.Now(), body)
+			req.Header.Del("X-Webhook-Timestamp")
+			return req
+		}, body, true},
+		{"malformed timestamp", func() *http.Request {
+			req := signedRequest("secret", time.Now(), body)
+			req.Header.Set("X-Webhook-Timestamp", "yesterday")
+			return req
+		}, body, true},
+		{"timestamp changed after signing", func() *http.Request {
+			req := signedRequest("secret", time.Now().Add(-time.Minute), body)
+			req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+			return req
+		}, body, true},
+		{"too old", func() *http.Request {
+			return signedRequest("secret", time.Now().Add(-6*time.Minute), body)
+		}, body, true},
+		{"too far in the future", func() *http.Request {
+			return signedRequest("secret", time.Now().Add(6*time.Minute), body)
+		}, body, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignature(tt.request(), []byte(tt.body), "secret", 5*time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySignature() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessWebhookEvent(t *testing.T) {
+	source := &WebhookSource{Name: "crm", Events: map[string]string{"signup": "crm-signup", "broken": "missing"}}
+	tests := []struct {
+		name           string
+		eventType      string
+		completeErr    error
+		wantStatus     string
+		wantHTTPStatus int
+		wantErr        bool
+	}{
+		{"completed", "signup", nil, data.WebhookProcessed, 0, false},
+		{"unmapped type", "newsletter", nil, data.WebhookIgnored, 0, false},
+		{"task already completed", "signup", data.ErrTaskAlreadyCompleted, data.WebhookIgnored, 0, false},
+		{"finished by another delivery", "signup", data.ErrWebhookEventFinished, data.WebhookProcessed, 0, false},
+		{"unknown user", "signup", data.ErrUserNotFound, data.WebhookRejected, http.StatusUnprocessableEntity, true},
+		{"fraud", "signup", data.ErrFraudBlocked, data.WebhookRejected, http.StatusForbidden, true},
+		{"temporary failure", "signup", errors.New("connection reset"), "", http.StatusInternalServerError, true},
+		{"mapped to an unknown task", "broken", nil, "", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.tasks["crm-signup"] = &data.Task{Code: "crm-signup", Points: 50}
+			repo.webhookErr = tt.completeErr
+			repo.webhookEvents["crm|evt_1"] = &data.WebhookEvent{Source: "crm", EventID: "evt_1", Status: data.WebhookProcessing}
+			app := &Config{Repo: repo}
+
+			status, _, httpStatus, err := app.processWebhookEvent(source, webhookEvent{ID: "evt_1", Type: tt.eventType, UserID: 7})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processWebhookEvent() error = %v, want error %v", err, tt.wantErr)
+			}
+			if status != tt.wantStatus || httpStatus != tt.wantHTTPStatus {
+				t.Errorf("processWebhookEvent() = %q with %d, want %q with %d", status, httpStatus, tt.wantStatus, tt.wantHTTPStatus)
+			}
+		})
+	}
+}
+
+func TestReceiveWebhookReplay(t *testing.T) {
+	repo := newFakeRepo()
+	repo.tasks["crm-signup"] = &data.Task{Code: "crm-signup", Points: 50}
+	app := &Config{
+		Repo: repo,
+		WebhookSources: map[string]*WebhookSource{
+			"crm": {Name: "crm", Events: map[string]string{"signup": "crm-signup"}, secret: "secret", tolerance: 5 * time.Minute},
+		},
+	}
+	deliver := func(body string) int {
+		req := signedRequest("secret", time.Now(), body)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("source", "crm")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		app.receiveWebhook(rec, req)
+		return rec.Code
+	}
+
+	const body = `{"id":"evt_1","type":"signup","user_id":7}`
+	for i := range 3 {
+		if status := deliver(body); status != http.StatusAccepted {
+			t.Fatalf("delivery %d responded with %d, want %d", i+1, status, http.StatusAccepted)
+		}
+	}
+	if repo.webhookCompletions != 1 {
+		t.Errorf("3 deliveries of one event completed the task %d times, want once", repo.webhookCompletions)
+	}
+
+	// a delivery while the first one is still processing is refused, so the source retries it later
+	repo.webhookEvents["crm|evt_2"] = &data.WebhookEvent{Source: "crm", EventID: "evt_2", Status: data.WebhookProcessing}
+	if status := deliver(`{"id":"evt_2","type":"signup","user_id":7}`); status != http.StatusConflict {
+		t.Errorf("delivery of an event in processing responded with %d, want %d", status, http.StatusConflict)
+	}
+
+	// an event released after a temporary failure is processed again by the next delivery
+	repo.webhookErr = errors.New("connection reset")
+	if status := deliver(`{"id":"evt_3","type":"signup","user_id":7}`); status != http.StatusInternalServerError {
+		t.Fatalf("delivery with a failing repository responded with %d, want %d", status, http.StatusInternalServerError)
+	}
+	repo.webhookErr = nil
+	if status := deliver(`{"id":"evt_3","type":"signup","user_id":7}`); status != http.StatusAccepted {
+		t.Errorf("delivery after a temporary failure responded with %d, want %d", status, http.StatusAccepted)
+	}
+	if repo.webhookCompletions != 2 {
+		t.Errorf("completed the task %d times, want 2", repo.webhookCompletions)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"reward-service/data"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait     = 10 * time.Second
+	wsPongWait      = 60 * time.Second
+	wsPingInterval  = 30 * time.Second
+	wsSendBuffer    = 16
+	wsMaxMessage    = 4096
+	defaultBoardTop = 10
+	maxBoardTop     = 100
+)
+
+// boardKey identifies a leaderboard a client can subscribe to
+type boardKey struct {
+	Board  string
+	Window string
+	Top    int
+}
+
+// boardState is the last sent top of a leaderboard and the clients subscribed to it
+type boardState struct {
+	entries []*data.LeaderboardEntry
+	clients map[*wsClient]bool
+}
+
+// wsConn is the part of *websocket.Conn the hub and the write pump use
+type wsConn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// wsClient is a WebSocket connection subscribed to at most one leaderboard
+type wsClient struct {
+	conn      wsConn
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	key       *boardKey    // guarded by the mutex of the hub
+	authCheck func() error // checks again every liveAuthCheck that the session of the client is still valid
+}
+
+// leaderboardHub keeps the tops of the leaderboards clients are subscribed to and sends them the changes
+type leaderboardHub struct {
+	repo   data.Repository
+	mu     sync.Mutex
+	boards map[boardKey]*boardState
+}
+
+// newLeaderboardHub returns a hub without subscribers
+func newLeaderboardHub(repo data.Repository) *leaderboardHub {
+	return &leaderboardHub{repo: repo, boards: make(map[boardKey]*boardState)}
+}
+
+// newUpgrader returns the WebSocket upgrader accepting requests from the same host and from the comma separated
+// list of allowed origins
+func newUpgrader(allowedOrigins string) websocket.Upgrader {
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[origin] = true
+		}
+	}
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || allowed[origin] {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+}
+
+// run refreshes the leaderboards after balances have changed, at most once per throttle, and refreshes
+// all of them every refresh so that the windows move on without new points
+func (h *leaderboardHub) run(live *broker[data.LiveUpdate], throttle, refresh time.Duration) {
+	updates, unsubscribe := live.Subscribe(256)
+	defer unsubscribe()
+
+	throttleTicker := time.NewTicker(throttle)
+	defer throttleTicker.Stop()
+	refreshTicker := time.NewTicker(refresh)
+	defer refreshTicker.Stop()
+
+	dirty := false
+	for {
+		select {
+		case update := <-updates:
+			if update.Type == data.LiveBalance {
+				dirty = true
+			}
+		case <-throttleTicker.C:
+			if dirty {
+				dirty = false
+				h.refresh()
+			}
+		case <-refreshTicker.C:
+			h.refresh()
+		}
+	}
+}
+
+// refresh fetches the top of every subscribed leaderboard and sends it to the subscribers if it changed
+func (h *leaderboardHub) refresh() {
+	h.mu.Lock()
+	keys := make([]boardKey, 0, len(h.boards))
+	for key := range h.boards {
+		keys = append(keys, key)
+	}
+	h.mu.Unlock()
+
+	for _, key := range keys {
+		entries, err := h.repo.GetTopUsers(key.Board, key.Window, key.Top)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		h.mu.Lock()
+		state, ok := h.boards[key]
+		if ok && !sameEntries(state.entries, entries) {
+			state.entries = entries
+			msg := boardMessage(key, entries)
+			for c := range state.clients {
+				h.sendLocked(c, msg)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// subscribe moves the client to the leaderboard and sends it the current top
+func (h *leaderboardHub) subscribe(c *wsClient, key boardKey) error {
+	entries, err := h.repo.GetTopUsers(key.Board, key.Window, key.Top)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(c)
+	state, ok := h.boards[key]
+	if !ok {
+		state = &boardState{clients: make(map[*wsClient]bool)}
+		h.boards[key] = state
+	}
+	msg := boardMessage(key, entries)
+	if ok && !sameEntries(state.entries, entries) {
+		for other := range state.clients {
+			h.sendLocked(other, msg)
+		}
+	}
+	state.entries = entries
+	state.clients[c] = true
+	c.key = &key
+
+	h.sendLocked(c, msg)
+	return nil
+}
+
+// remove unsubscribes the client from its leaderboard
+func (h *leaderboardHub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c)
+}
+
+func (h *leaderboardHub) removeLocked(c *wsClient) {
+	if c.key == nil {
+		return
+	}
+	if state, ok := h.boards[*c.key]; ok {
+		delete(state.clients, c)
+		if len(state.clients) == 0 {
+			delete(h.boards, *c.key)
+		}
+	}
+	c.key = nil
+}
+
+// sendLocked queues the message for the client. A client whose queue is full is too slow to follow the
+// leaderboard and gets disconnected.
+func (h *leaderboardHub) sendLocked(c *wsClient, msg []byte) {
+	if !c.trySend(msg) {
+		h.removeLocked(c)
+		go c.close(websocket.ClosePolicyViolation, "client is too slow")
+	}
+}
+
+// boardMessage encodes the top of the leaderboard sent to clients
+func boardMessage(key boardKey, entries []*data.LeaderboardEntry) []byte {
+	msg, _ := json.Marshal(map[string]any{
+		"type":    "leaderboard",
+		"board":   key.Board,
+		"window":  key.Window,
+		"top":     key.Top,
+		"entries": entries,
+	})
+	return msg
+}
+
+// sameEntries reports whether two tops of a leaderboard are equal
+func sameEntries(a, b []*data.LeaderboardEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// trySend queues the message without blocking and reports whether it was queued
+func (c *wsClient) trySend(msg []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendJSON queues a reply to the client, closing a client which does not read its messages
+func (c *wsClient) sendJSON(v any) {
+	msg, _ := json.Marshal(v)
+	if !c.trySend(msg) {
+		c.close(websocket.ClosePolicyViolation, "client is too slow")
+	}
+}
+
+// close sends the close frame and closes the connection, only the first call has an effect
+func (c *wsClient) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+		c.conn.Close()
+	})
+}
+
+// writePump writes the queued messages, pings the client and checks its session, it is the only writer of data frames
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	authTicker := time.NewTicker(liveAuthCheck)
+	defer authTicker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-authTicker.C:
+			if c.authCheck == nil {
+				continue
+			}
+			err := c.authCheck()
+			if err != nil {
+				c.close(websocket.ClosePolicyViolation, "session is no longer valid")
+				return
+			}
+		}
+	}
+}
+
+// leaderboardSocket upgrades the request of the authenticated user to a WebSocket. The client chooses the
+// leaderboard with {"type": "subscribe", "board": "earned", "window": "week", "top": 10} and receives the top
+// on subscribing and on every change; {"type": "ping"} is answered with {"type": "pong"}. The access token is
+// checked again every liveAuthCheck, the socket is closed when the session was revoked or the token expired.
+func (app *Config) leaderboardSocket(w http.ResponseWriter, r *http.Request) {
+	_, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	conn, err := app.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already answered the request
+		return
+	}
+
+	c := &wsClient{conn: conn, send: make(chan []byte, wsSendBuffer), done: make(chan struct{})}
+	c.authCheck = func() error {
+		_, err := app.authenticateAccessToken(app.SecretKey, cookie.Value)
+		return err
+	}
+	defer func() {
+		app.Leaderboards.remove(c)
+		c.close(websocket.CloseNormalClosure, "")
+	}()
+	go c.writePump()
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("leaderboard socket closed: ", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var msg struct {
+			Type   string `json:"type"`
+			Board  string `json:"board"`
+			Window string `json:"window"`
+			Top    int    `json:"top"`
+		}
+		err = json.Unmarshal(raw, &msg)
+		if err != nil {
+			c.sendJSON(map[string]any{"type": "error", "message": "message must be a JSON object"})
+			continue
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			key := boardKey{Board: msg.Board, Window: msg.Window, Top: msg.Top}
+			if key.Board == "" {
+				key.Board = data.BoardBalance
+			}
+			if key.Window == "" {
+				key.Window = data.WindowAll
+			}
+			if key.Top <= 0 {
+				key.Top = defaultBoardTop
+			}
+			key.Top = min(key.Top, maxBoardTop)
+
+			err = app.Leaderboards.subscribe(c, key)
+			if errors.Is(err, data.ErrUnknownBoard) {
+				c.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+			} else if err != nil {
+				log.Println(err)
+				c.sendJSON(map[string]any{"type": "error", "message": "couldn't fetch leaderboard"})
+			}
+		case "unsubscribe":
+			app.Leaderboards.remove(c)
+			c.sendJSON(map[string]any{"type": "unsubscribed"})
+		case "ping":
+			c.sendJSON(map[string]any{"type": "pong"})
+		default:
+			c.sendJSON(map[string]any{"type": "error", "message": "unknown message type " + msg.Type})
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"reward-service/data"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn is a WebSocket connection which keeps the close code instead of writing frames
+type fakeConn struct {
+	mu        sync.Mutex
+	closeCode int
+	closed    chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (f *fakeConn) WriteMessage(messageType int, data []byte) error { return nil }
+func (f *fakeConn) SetWriteDeadline(t time.Time) error              { return nil }
+
+func (f *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage && len(data) >= 2 {
+		f.mu.Lock()
+		f.closeCode = int(data[0])<<8 | int(data[1])
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *fakeConn) Close() error {
+	close(f.closed)
+	return nil
+}
+
+// newFakeClient returns a client on a fake connection whose queue holds buffer messages, nobody reads the queue
+func newFakeClient(buffer int) (*wsClient, *fakeConn) {
+	conn := newFakeConn()
+	return &wsClient{conn: conn, send: make(chan []byte, buffer), done: make(chan struct{})}, conn
+}
+
+// lastBoard reads the queued messages of the client and returns the top of the last one
+func lastBoard(t *testing.T, c *wsClient) (top int, ok bool) {
+	t.Helper()
+	for {
+		select {
+		case raw := <-c.send:
+			var msg struct{ Top int }
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				t.Fatal(err)
+			}
+			top, ok = msg.Top, true
+		default:
+			return top, ok
+		}
+	}
+}
+
+func TestLeaderboardHubResubscribe(t *testing.T) {
+	repo := newFakeRepo()
+	repo.standings = map[int]data.Standing{1: {Rank: 1, Score: 300}, 2: {Rank: 2, Score: 200}}
+	h := newLeaderboardHub(repo)
+	top1 := boardKey{Board: data.BoardBalance, Window: data.WindowAll, Top: 1}
+	top10 := boardKey{Board: data.BoardBalance, Window: data.WindowAll, Top: 10}
+
+	c, _ := newFakeClient(wsSendBuffer)
+	other, _ := newFakeClient(wsSendBuffer)
+	for _, sub := range []struct {
+		c   *wsClient
+		key boardKey
+	}{{c, top1}, {other, top1}, {c, top10}} {
+		if err := h.subscribe(sub.c, sub.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if h.boards[top1].clients[c] || !h.boards[top10].clients[c] || *c.key != top10 {
+		t.Errorf("resubscribed client is on %v, want only on the top 10", *c.key)
+	}
+	if top, _ := lastBoard(t, c); top != 10 {
+		t.Errorf("resubscribed client last got the top %d, want 10", top)
+	}
+
+	// a change of the top 1 reaches only the client still subscribed to it
+	lastBoard(t, other)
+	repo.standings[2] = data.Standing{Rank: 1, Score: 400}
+	repo.standings[1] = data.Standing{Rank: 2, Score: 300}
+	h.refresh()
+	if top, ok := lastBoard(t, other); !ok || top != 1 {
+		t.Errorf("subscriber of the top 1 got %d, %v after the change, want the top 1", top, ok)
+	}
+	if top, ok := lastBoard(t, c); ok && top != 10 {
+		t.Errorf("resubscribed client got the top %d after the change", top)
+	}
+
+	// the last client leaving a board removes it
+	h.remove(other)
+	if _, ok := h.boards[top1]; ok {
+		t.Error("board without subscribers was kept")
+	}
+}
+
+func TestLeaderboardHubSlowClient(t *testing.T) {
+	repo := newFakeRepo()
+	repo.standings = map[int]data.Standing{1: {Rank: 1, Score: 300}}
+	h := newLeaderboardHub(repo)
+	key := boardKey{Board: data.BoardBalance, Window: data.WindowAll, Top: 10}
+
+	// the slow client has room for the top it gets on subscribing and nothing more
+	slow, slowConn := newFakeClient(1)
+	fast, fastConn := newFakeClient(wsSendBuffer)
+	for _, c := range []*wsClient{slow, fast} {
+		if err := h.subscribe(c, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo.standings[2] = data.Standing{Rank: 2, Score: 200}
+	h.refresh()
+
+	select {
+	case <-slowConn.closed:
+	case <-time.After(time.Second):
+		t.Fatal("client with a full queue was not disconnected")
+	}
+	slowConn.mu.Lock()
+	code := slowConn.closeCode
+	slowConn.mu.Unlock()
+	if code != websocket.ClosePolicyViolation {
+		t.Errorf("slow client was closed with %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+	if h.boards[key].clients[slow] || slow.key != nil {
+		t.Error("disconnected client is still subscribed")
+	}
+
+	select {
+	case <-fastConn.closed:
+		t.Error("client which keeps up was disconnected")
+	default:
+	}
+	if !h.boards[key].clients[fast] {
+		t.Error("client which keeps up lost its subscription")
+	}
+	if msgs := len(fast.send); msgs != 2 {
+		t.Errorf("client which keeps up got %d messages, want the top on subscribing and after the change", msgs)
+	}
+}
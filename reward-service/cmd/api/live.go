@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reward-service/data"
+	"time"
+)
+
+const (
+	liveBuffer    = 64
+	liveHeartbeat = 15 * time.Second
+	liveAuthCheck = time.Minute
+)
+
+// listenLiveUpdates passes the live updates from Postgres to the in-process hub, reconnecting when the
+// connection is lost. Updates sent while it reconnects are lost, the streams catch up on the next change.
+func (app *Config) listenLiveUpdates(retry time.Duration) {
+	for {
+		err := app.Repo.ListenLiveUpdates(context.Background(), func(update data.LiveUpdate) {
+			app.Live.Publish(context.Background(), update)
+		})
+		log.Printf("live updates interrupted, retrying in %s: %v", retry, err)
+		time.Sleep(retry)
+	}
+}
+
+// writeEvent writes one server-sent event and flushes it to the client
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data any) error {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, out)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// streamEvents streams the balance, new badges and leaderboard rank of the authenticated user as server-sent
+// events. The current balance and rank are sent first, then every change of them. The access token is checked
+// again every liveAuthCheck, the stream ends when the session was revoked or the token expired.
+func (app *Config) streamEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.errorJSON(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	updates, unsubscribe := app.Live.Subscribe(liveBuffer)
+	defer unsubscribe()
+
+	// subscribe first, so that no change between reading the rank and subscribing is missed
+	rank, score, err := app.Repo.GetRank(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch balance"), http.StatusInternalServerError)
+		return
+	}
+	ranks, unwatch := app.Ranks.watch(userID, data.Standing{Rank: rank, Score: score})
+	defer unwatch()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = writeEvent(w, flusher, "balance", map[string]any{"score": score})
+	if err == nil {
+		err = writeEvent(w, flusher, "rank", map[string]any{"rank": rank})
+	}
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	authCheck := time.NewTicker(liveAuthCheck)
+	defer authCheck.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-authCheck.C:
+			_, err = app.authenticateAccessToken(app.SecretKey, cookie.Value)
+			if err != nil {
+				return
+			}
+		case change := <-ranks:
+			err = writeEvent(w, flusher, "rank", change)
+		case update := <-updates:
+			switch {
+			case update.Type == data.LiveBalance && update.UserID == userID:
+				err = writeEvent(w, flusher, "balance", map[string]any{
+					"score":  update.Score,
+					"amount": update.Amount,
+					"kind":   update.Kind,
+				})
+			case update.Type == data.LiveBadge && update.UserID == userID:
+				err = writeEvent(w, flusher, "badge", update.Badge)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
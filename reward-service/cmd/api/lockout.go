@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// getDummyHash returns a hash made with the same parameters as real passwords, compared against when the email
+// is unknown so that the response takes as long as for an existing user
+func (app *Config) getDummyHash() string {
+	dummyHashOnce.Do(func() {
+		hash, err := app.PasswordHasher.Hash("dummy password for timing")
+		if err != nil {
+			log.Println("failed to generate dummy hash: ", err)
+			return
+		}
+		dummyHash = hash
+	})
+	return dummyHash
+}
+
+// loginKeys returns the keys under which failed logins are counted for the email and for the IP address
+func loginKeys(email, ip string) (string, string) {
+	return "email:" + strings.ToLower(strings.TrimSpace(email)), "ip:" + ip
+}
+
+// writeLocked tells the client that logins are locked until the given time
+func (app *Config) writeLocked(w http.ResponseWriter, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, retryAfter)))
+	app.errorJSON(w, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
+}
+
+// recordLoginFailure counts the failed login for the email and the IP address. When the account of an existing
+// user gets locked, an unlock link is issued for it.
+func (app *Config) recordLoginFailure(email, ip string, userExists bool) {
+	emailKey, ipKey := loginKeys(email, ip)
+
+	lockedUntil, err := app.Repo.RecordLoginFailure(emailKey, app.AccountLockout)
+	if err != nil {
+		return
+	}
+	if !lockedUntil.IsZero() && userExists {
+		token := app.signToken("unlock", strings.ToLower(strings.TrimSpace(email)), lockedUntil.Add(24*time.Hour))
+		body := fmt.Sprintf("Your account was locked after too many failed login attempts until %s.\n\n"+
+			"If it was you, unlock the account by opening the link:\n%s/auth/unlock?token=%s\n",
+			lockedUntil.Format(time.RFC1123), app.PublicURL, token)
+		err = app.Mailer.Send(email, "Your account was locked", body)
+		if err != nil {
+			log.Printf("failed to send unlock link to %s: %v", email, err)
+		}
+	}
+
+	_, err = app.Repo.RecordLoginFailure(ipKey, app.IPLockout)
+	if err != nil {
+		return
+	}
+}
+
+// unlockAccount unlocks the account by the token from the unlock link
+func (app *Config) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	email, err := app.verifyToken("unlock", r.URL.Query().Get("token"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	emailKey, _ := loginKeys(email, "")
+	err = app.Repo.ResetLoginFailures(emailKey)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't unlock account"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Account unlocked"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// adminUnlockUser unlocks the account of the user with id from the URL
+func (app *Config) adminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	email, err := app.Repo.GetEmailByID(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch user"), http.StatusNotFound)
+		return
+	}
+	emailKey, _ := loginKeys(email, "")
+	err = app.Repo.ResetLoginFailures(emailKey)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't unlock account"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Account of user with id %d unlocked", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
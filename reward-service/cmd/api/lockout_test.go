@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateLockout(t *testing.T) {
+	repo := newFakeRepo(&data.User{ID: 1, Email: "ann@example.com", Password: "right", FirstName: "Ann", Active: 1})
+	mailer := &fakeMailer{}
+	app := &Config{
+		Repo:           repo,
+		Mailer:         mailer,
+		AccountLockout: data.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour},
+		IPLockout:      data.LockoutPolicy{Threshold: 100, Base: time.Minute, Max: time.Hour},
+	}
+
+	login := func(password string) int {
+		body := `{"email": "ann@example.com", "password": "` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		app.Authenticate(rec, req)
+		return rec.Code
+	}
+
+	for range 2 {
+		if code := login("wrong"); code != http.StatusBadRequest {
+			t.Fatalf("wrong password responded with %d, want %d", code, http.StatusBadRequest)
+		}
+	}
+	if code := login("right"); code != http.StatusAccepted {
+		t.Fatalf("right password under the threshold responded with %d, want %d", code, http.StatusAccepted)
+	}
+
+	// the successful login has reset the counter, two more failures still don't lock the account
+	for range 2 {
+		login("wrong")
+	}
+	if code := login("right"); code != http.StatusAccepted {
+		t.Fatalf("failures before the last success were counted, login responded with %d", code)
+	}
+
+	for range 3 {
+		login("wrong")
+	}
+	if code := login("right"); code != http.StatusTooManyRequests {
+		t.Errorf("login of a locked account responded with %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "ann@example.com" || !strings.Contains(mailer.sent[0].body, "/auth/unlock?token=") {
+		t.Errorf("sent emails = %+v, want one unlock link to the locked account", mailer.sent)
+	}
+}
+
+func TestAuthenticateUnknownEmailCounted(t *testing.T) {
+	repo := newFakeRepo()
+	app := &Config{
+		Repo:           repo,
+		AccountLockout: data.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour},
+		IPLockout:      data.LockoutPolicy{Threshold: 100, Base: time.Minute, Max: time.Hour},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(`{"email": "Nobody@example.com", "password": "x"}`))
+	rec := httptest.NewRecorder()
+	app.Authenticate(rec, req)
+
+	// the response must not tell an unknown email from a wrong password
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errInvalidCredentials.Error()) {
+		t.Errorf("unknown email responded with %d %s", rec.Code, rec.Body.String())
+	}
+	if repo.loginFailures["email:nobody@example.com"] != 1 {
+		t.Errorf("failures of the unknown email = %d, want 1", repo.loginFailures["email:nobody@example.com"])
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// smtpMailer sends emails through an SMTP server
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.from, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+
+	err := smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// fileMailer doesn't send anything, it appends the emails to a file or writes them to the log when there is
+// no file. It is meant for local testing.
+type fileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (m *fileMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("To: %s\nSubject: %s\nDate: %s\n\n%s\n", to, subject, time.Now().Format(time.RFC1123Z), body)
+	if m.path == "" {
+		log.Printf("Email:\n%s", msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open mail file: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(msg + "----\n")
+	if err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	return nil
+}
+
+// setupMailer chooses the mailer by MAILER: "smtp" or "file"
+func setupMailer() Mailer {
+	if os.Getenv("MAILER") != "smtp" {
+		return &fileMailer{path: os.Getenv("MAIL_FILE")}
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	return &smtpMailer{
+		addr:     net.JoinHostPort(host, strings.TrimSpace(os.Getenv("SMTP_PORT"))),
+		host:     host,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     os.Getenv("MAIL_FROM"),
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"database/sql"
 	"embed"
 	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
 	"github.com/joho/godotenv"
 	"github.com/pressly/goose/v3"
 	"log"
 	"net/http"
 	"os"
 	"reward-service/data"
+	"strconv"
 	"time"
 
 	_ "github.com/jackc/pgconn"
@@ -23,9 +26,34 @@ var counts int64
 var EmbedMigrations embed.FS
 
 type Config struct {
-	Repo      data.Repository
-	Client    *http.Client
-	SecretKey string
+	Repo               data.Repository
+	Client             *http.Client
+	SecretKey          string
+	TransferDailyLimit int
+	IdempotencyTTL     time.Duration
+	CheckinRules       data.CheckinRules
+	PublicURL          string
+	Verifiers          map[string]*Verifier
+	RateLimiter        RateLimitStore
+	AccountLockout     data.LockoutPolicy
+	IPLockout          data.LockoutPolicy
+	PromoLockout       data.LockoutPolicy
+	Mailer             Mailer
+	EmailTokenTTL      time.Duration
+	ResetTokenTTL      time.Duration
+	PasswordHasher     data.PasswordHasher
+	TOTPIssuer         string
+	OIDCProviders      map[string]*OIDCProvider
+	WebhookSources     map[string]*WebhookSource
+	Publisher          multiPublisher
+	Events             *broker[*data.DomainEvent]
+	Live               *broker[data.LiveUpdate]
+	Leaderboards       *leaderboardHub
+	Ranks              *rankHub
+	Upgrader           websocket.Upgrader
+	GraphQLSchema      graphql.Schema
+	GraphQLMaxDepth    int
+	GraphQLComplexity  int
 }
 
 // main starts the server and establishing connection to database
@@ -57,9 +85,94 @@ func main() {
 
 	// set up config
 	app := Config{
-		Client: &http.Client{},
+		Client:             &http.Client{},
+		Mailer:             setupMailer(),
+		EmailTokenTTL:      envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+		ResetTokenTTL:      envDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+		SecretKey:          os.Getenv("SECRET_KEY"),
+		PublicURL:          os.Getenv("PUBLIC_URL"),
+		TOTPIssuer:         envString("TOTP_ISSUER", "RewardService"),
+		TransferDailyLimit: envInt("TRANSFER_DAILY_LIMIT", 1000),
+		IdempotencyTTL:     envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		CheckinRules: data.CheckinRules{
+			Rewards:     parseRewards(os.Getenv("CHECKIN_REWARDS"), []int{10, 15, 20, 30, 40, 60, 100}),
+			Grace:       envDuration("CHECKIN_GRACE", 2*time.Hour),
+			FreezePrice: envInt("STREAK_FREEZE_PRICE", 200),
+			MaxFreezes:  envInt("STREAK_FREEZE_MAX", 2),
+		},
+		AccountLockout: data.LockoutPolicy{
+			Threshold: envInt("LOCKOUT_ACCOUNT_THRESHOLD", 5),
+			Base:      envDuration("LOCKOUT_BASE", time.Minute),
+			Max:       envDuration("LOCKOUT_MAX", 24*time.Hour),
+		},
+		IPLockout: data.LockoutPolicy{
+			Threshold: envInt("LOCKOUT_IP_THRESHOLD", 20),
+			Base:      envDuration("LOCKOUT_BASE", time.Minute),
+			Max:       envDuration("LOCKOUT_MAX", 24*time.Hour),
+		},
+		PromoLockout: data.LockoutPolicy{
+			Threshold: envInt("PROMO_LOCKOUT_THRESHOLD", 5),
+			Base:      envDuration("LOCKOUT_BASE", time.Minute),
+			Max:       envDuration("LOCKOUT_MAX", 24*time.Hour),
+		},
 	}
 	app.setupRepo(conn)
+	if path := os.Getenv("OIDC_PROVIDERS"); path != "" {
+		app.OIDCProviders, err = loadOIDCProviders(path)
+		if err != nil {
+			log.Panic("Error loading OIDC providers ", err)
+		}
+		log.Printf("Loaded %d OIDC providers", len(app.OIDCProviders))
+	}
+	if path := os.Getenv("VERIFIERS"); path != "" {
+		app.Verifiers, err = loadVerifiers(path)
+		if err != nil {
+			log.Panic("Error loading verifiers ", err)
+		}
+		log.Printf("Loaded verifiers of %d tasks", len(app.Verifiers))
+	}
+	if path := os.Getenv("WEBHOOK_SOURCES"); path != "" {
+		app.WebhookSources, err = loadWebhookSources(path, envDuration("WEBHOOK_TOLERANCE", 5*time.Minute))
+		if err != nil {
+			log.Panic("Error loading webhook sources ", err)
+		}
+		log.Printf("Loaded %d webhook sources", len(app.WebhookSources))
+	}
+	app.setupRateLimiter(os.Getenv("RATE_LIMIT_STORE"))
+	err = app.setupPublisher(os.Getenv("EVENT_SINKS"))
+	if err != nil {
+		log.Panic("Error setting up event publisher ", err)
+	}
+
+	go app.purgeIdempotencyKeys(time.Hour)
+	go app.purgeProofTokens(time.Hour)
+	go app.expirePoints(envDuration("POINTS_EXPIRY_INTERVAL", time.Hour))
+	if inactivity := envDuration("TIER_DEMOTION_INACTIVITY", 0); inactivity > 0 {
+		go app.demoteInactiveUsers(inactivity, time.Hour)
+	}
+	go app.requestVerifications(envDuration("VERIFICATION_INTERVAL", 5*time.Second),
+		envDuration("VERIFICATION_RETRY_BASE", 30*time.Second), envInt("VERIFICATION_MAX_ATTEMPTS", 8),
+		envDuration("VERIFICATION_TIMEOUT", 24*time.Hour))
+	go app.deliverWebhooks(envDuration("WEBHOOK_DELIVERY_INTERVAL", 5*time.Second),
+		envDuration("WEBHOOK_RETRY_BASE", 30*time.Second), envInt("WEBHOOK_MAX_ATTEMPTS", 8))
+	app.Live = newBroker[data.LiveUpdate]()
+	go app.listenLiveUpdates(5 * time.Second)
+	app.Leaderboards = newLeaderboardHub(app.Repo)
+	app.Ranks = newRankHub(app.Repo)
+	app.Upgrader = newUpgrader(os.Getenv("WS_ALLOWED_ORIGINS"))
+	app.GraphQLSchema, err = newGraphQLSchema()
+	if err != nil {
+		log.Panic("Error building GraphQL schema ", err)
+	}
+	app.GraphQLMaxDepth = envInt("GRAPHQL_MAX_DEPTH", 6)
+	app.GraphQLComplexity = envInt("GRAPHQL_MAX_COMPLEXITY", 500)
+	go app.Leaderboards.run(app.Live, time.Second, envDuration("LEADERBOARD_REFRESH_INTERVAL", time.Minute))
+	go app.Ranks.run(app.Live, time.Second, envDuration("RANK_REFRESH_INTERVAL", time.Minute))
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		go app.serveGRPC(grpcPort)
+	}
+	go app.publishEvents(envDuration("EVENT_PUBLISH_INTERVAL", time.Second))
+	go app.purgeOutbox(envDuration("EVENT_RETENTION", 7*24*time.Hour), time.Hour)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
@@ -113,11 +226,85 @@ func connectToDB() *sql.DB {
 	}
 }
 
+// envString reads a string from the environment, falling back to def when it is unset or empty
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt reads an integer from the environment, falling back to def when it is unset or malformed
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envDuration reads a duration like "24h" from the environment, falling back to def when it is unset or malformed
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
 // setupRepo sets new postgres repository
 func (app *Config) setupRepo(conn *sql.DB) {
 	if conn == nil {
 		log.Fatal("Database connection is nil")
 	}
 	db := data.NewPostgresRepository(conn)
+	if path := os.Getenv("BADGES_CONFIG"); path != "" {
+		rules, err := data.LoadBadgeRules(path)
+		if err != nil {
+			log.Panic("Error loading badge rules ", err)
+		}
+		db.BadgeRules = rules
+		log.Printf("Loaded %d badge rules", len(rules))
+	}
+	db.FraudRules = []data.FraudRule{
+		data.VelocityRule{Window: time.Hour, MaxPoints: envInt("FRAUD_MAX_POINTS_PER_HOUR", 15000), Action: data.FraudBlock},
+		data.VelocityRule{Window: 24 * time.Hour, MaxPoints: envInt("FRAUD_MAX_POINTS_PER_DAY", 50000), Action: data.FraudFlag},
+		data.AccountsPerIPRule{MaxAccounts: envInt("FRAUD_MAX_ACCOUNTS_PER_IP", 5), Action: data.FraudBlock},
+		data.ReferralRingRule{MutualAction: data.FraudBlock, SameIPAction: data.FraudFlag},
+	}
+	hasher, err := data.NewPasswordHasher(os.Getenv("PASSWORD_HASH"), envInt("BCRYPT_COST", 12),
+		envInt("ARGON2_TIME", 3), envInt("ARGON2_MEMORY", 64*1024), envInt("ARGON2_THREADS", 2))
+	if err != nil {
+		log.Fatal("Invalid password hashing parameters: ", err)
+	}
+	db.PasswordHasher = hasher
+	if db.PasswordHasher.Algorithm != data.HashArgon2id {
+		db.PasswordHasher.Algorithm = data.HashBcrypt
+	}
+	db.PasswordPolicy = data.PasswordPolicy{
+		MinLength:   envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:   envInt("PASSWORD_MAX_LENGTH", 72),
+		MinClasses:  envInt("PASSWORD_MIN_CLASSES", 1),
+		BreachedDir: os.Getenv("PASSWORD_BREACHED_DIR"),
+	}
+	if db.PasswordHasher.Algorithm == data.HashBcrypt && db.PasswordPolicy.MaxLength > 72 {
+		// bcrypt ignores everything after 72 bytes
+		db.PasswordPolicy.MaxLength = 72
+	}
+	db.PromoSecret = os.Getenv("PROMO_CODE_SECRET")
+	if db.PromoSecret == "" {
+		log.Fatal("PROMO_CODE_SECRET must be set, promo codes are hashed with it")
+	}
+	app.PasswordHasher = db.PasswordHasher
 	app.Repo = db
 }
+
+// setupRateLimiter sets the store of the rate limiter, "postgres" shares the limits between replicas
+func (app *Config) setupRateLimiter(store string) {
+	switch store {
+	case "postgres":
+		app.RateLimiter = newPostgresStore(app.Repo)
+	default:
+		app.RateLimiter = newMemoryStore()
+	}
+}
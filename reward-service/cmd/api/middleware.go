@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
@@ -18,9 +19,9 @@ type UserData struct {
 	AccessToken        string
 }
 
-// generateTokens generates refresh and access tokens for the user
-func generateTokens(userID int, secretKey string) (*UserData, error) {
-	accessToken, err := generateAccessToken(userID, secretKey)
+// generateTokens generates refresh and access tokens for the user, tokenVersion is the current version of the user's sessions
+func generateTokens(userID, tokenVersion int, secretKey string) (*UserData, error) {
+	accessToken, err := generateAccessToken(userID, tokenVersion, secretKey)
 	if err != nil {
 		return nil, err
 	}
@@ -65,11 +66,12 @@ func generateRefreshToken() (string, string, error) {
 }
 
 // generateAccessToken generates access tokens based on who was authenticated
-func generateAccessToken(userID int, secretKey string) (string, error) {
+func generateAccessToken(userID, tokenVersion int, secretKey string) (string, error) {
 	expirationTime := time.Now().Add(time.Minute * 15)
 
 	claims := &jwt.MapClaims{
 		"sub": userID,
+		"ver": tokenVersion,
 		"exp": expirationTime.Unix(),
 	}
 
@@ -82,6 +84,63 @@ func generateAccessToken(userID int, secretKey string) (string, error) {
 	return tokenString, nil
 }
 
+// issueAccessToken generates tokens for the current session version of the user and hands the access token to the client
+func (app *Config) issueAccessToken(w http.ResponseWriter, userID int) error {
+	tokenVersion, err := app.Repo.GetTokenVersion(userID)
+	if err != nil {
+		return err
+	}
+	userData, err := generateTokens(userID, tokenVersion, app.SecretKey)
+	if err != nil {
+		return err
+	}
+
+	setAccessTokenCookie(w, userData.AccessToken)
+	return validateRefreshToken(userData.HashedRefreshToken, userData.RefreshToken)
+}
+
+// setAccessTokenCookie hands the access token to the client
+func setAccessTokenCookie(w http.ResponseWriter, accessToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    accessToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(15 * time.Minute),
+	})
+}
+
+// authenticateAccessToken returns the user the access token was issued to, tokens issued before the password was
+// changed carry an older version and are refused
+func (app *Config) authenticateAccessToken(secretKey, tokenString string) (int, error) {
+	claims := &jwt.MapClaims{
+		"sub": userIDKey,
+	}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secretKey), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !token.Valid {
+		return 0, errors.New("invalid access token")
+	}
+
+	userID, ok := (*claims)["sub"].(float64)
+	if !ok {
+		return 0, errors.New("access token has no subject")
+	}
+
+	tokenVersion, _ := (*claims)["ver"].(float64)
+	currentVersion, err := app.Repo.GetTokenVersion(int(userID))
+	if err != nil || int(tokenVersion) != currentVersion {
+		return 0, errors.New("session was revoked")
+	}
+	return int(userID), nil
+}
+
 // authTokenMiddleware auths users to get access to some pages only by having access token
 func (app *Config) authTokenMiddleware(secretKey string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -92,28 +151,35 @@ func (app *Config) authTokenMiddleware(secretKey string) func(http.Handler) http
 				app.errorJSON(w, err, http.StatusUnauthorized)
 				return
 			}
-			tokenString := cookie.Value
-			claims := &jwt.MapClaims{
-				"sub": userIDKey,
-			}
-			token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-				return []byte(secretKey), nil
-			})
-
-			if err != nil || !token.Valid {
-				app.errorJSON(w, err, http.StatusUnauthorized)
-				return
-			}
-
-			userID, ok := (*claims)["sub"].(float64)
-			if !ok {
+			userID, err := app.authenticateAccessToken(secretKey, cookie.Value)
+			if err != nil {
 				app.errorJSON(w, err, http.StatusUnauthorized)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), userIDKey, int(userID))
+			ctx := context.WithValue(r.Context(), userIDKey, userID)
 			r = r.WithContext(ctx)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// adminMiddleware lets through only users with the admin role, must be used after authTokenMiddleware
+func (app *Config) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := app.getUserIDFromContext(w, r)
+		if err != nil {
+			return
+		}
+		isAdmin, err := app.Repo.IsAdmin(userID)
+		if err != nil {
+			app.errorJSON(w, errors.New("couldn't check permissions"), http.StatusInternalServerError)
+			return
+		}
+		if !isAdmin {
+			app.errorJSON(w, errors.New("admin role required"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS point_transactions(
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INT NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    memo VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+CREATE INDEX IF NOT EXISTS point_transactions_user_id_idx ON point_transactions(user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS transfers(
+    id serial PRIMARY KEY,
+    sender_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    recipient_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INT NOT NULL CHECK (amount > 0),
+    memo VARCHAR(255),
+    idempotency_key VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (sender_id, idempotency_key)
+    );
+CREATE INDEX IF NOT EXISTS transfers_sender_id_idx ON transfers(sender_id, created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS transfers;
+DROP TABLE IF EXISTS point_transactions;
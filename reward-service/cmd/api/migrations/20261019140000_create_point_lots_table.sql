@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS point_lots(
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INT NOT NULL,
+    remaining INT NOT NULL CHECK (remaining >= 0),
+    earned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+    );
+CREATE INDEX IF NOT EXISTS point_lots_user_id_idx ON point_lots(user_id, expires_at) WHERE remaining > 0;
+CREATE INDEX IF NOT EXISTS point_lots_expires_at_idx ON point_lots(expires_at) WHERE remaining > 0;
+
+-- points earned before lots existed start their 12 months now
+INSERT INTO point_lots (user_id, amount, remaining, earned_at, expires_at)
+SELECT id, score, score, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + interval '12 months'
+FROM users WHERE score > 0;
+
+-- +goose Down
+DROP TABLE IF EXISTS point_lots;
@@ -0,0 +1,46 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS tiers(
+    id serial PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    min_points INT UNIQUE NOT NULL,
+    multiplier NUMERIC(4, 2) NOT NULL DEFAULT 1
+    );
+
+INSERT INTO tiers (id, name, min_points, multiplier) VALUES
+    (1, 'Bronze', 0, 1.00),
+    (2, 'Silver', 1000, 1.10),
+    (3, 'Gold', 5000, 1.25),
+    (4, 'Platinum', 20000, 1.50)
+ON CONFLICT DO NOTHING;
+SELECT setval('tiers_id_seq', (SELECT max(id) FROM tiers));
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS lifetime_points INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS tier_id INT NOT NULL DEFAULT 1 REFERENCES tiers(id),
+    ADD COLUMN IF NOT EXISTS last_earned_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS tier_changed_at TIMESTAMP;
+
+-- the current score is the best known approximation of the points earned so far
+UPDATE users SET lifetime_points = score WHERE score > 0;
+UPDATE users SET tier_id = (
+    SELECT id FROM tiers WHERE min_points <= users.lifetime_points ORDER BY min_points DESC LIMIT 1
+);
+
+CREATE TABLE IF NOT EXISTS tier_changes(
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    from_tier_id INT NOT NULL REFERENCES tiers(id),
+    to_tier_id INT NOT NULL REFERENCES tiers(id),
+    reason VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+CREATE INDEX IF NOT EXISTS tier_changes_user_id_idx ON tier_changes(user_id, created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS tier_changes;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS tier_changed_at,
+    DROP COLUMN IF EXISTS last_earned_at,
+    DROP COLUMN IF EXISTS tier_id,
+    DROP COLUMN IF EXISTS lifetime_points;
+DROP TABLE IF EXISTS tiers;
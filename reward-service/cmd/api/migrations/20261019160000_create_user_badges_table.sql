@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_badges(
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    badge_code VARCHAR(100) NOT NULL,
+    awarded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, badge_code)
+    );
+
+-- +goose Down
+DROP TABLE IF EXISTS user_badges;
@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS streaks(
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    current_streak INT NOT NULL DEFAULT 0,
+    longest_streak INT NOT NULL DEFAULT 0,
+    last_checkin_date DATE,
+    freezes INT NOT NULL DEFAULT 0 CHECK (freezes >= 0)
+    );
+
+CREATE TABLE IF NOT EXISTS checkins(
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    checkin_date DATE NOT NULL,
+    streak_day INT NOT NULL,
+    points INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, checkin_date)
+    );
+
+-- +goose Down
+DROP TABLE IF EXISTS checkins;
+DROP TABLE IF EXISTS streaks;
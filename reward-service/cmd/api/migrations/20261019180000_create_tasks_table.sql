@@ -0,0 +1,33 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS tasks(
+    code VARCHAR(100) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    points INT NOT NULL CHECK (points >= 0),
+    verifier VARCHAR(20) NOT NULL DEFAULT 'none' CHECK (verifier IN ('none', 'webhook', 'proof_token', 'manual')),
+    verifier_url VARCHAR(255),
+    repeatable BOOLEAN NOT NULL DEFAULT false
+    );
+
+INSERT INTO tasks (code, name, points, verifier, verifier_url, repeatable) VALUES
+    ('complete', 'Some task', 100, 'none', NULL, true),
+    ('telegramSign', 'Subscribe to the Telegram channel', 50, 'webhook', 'http://fake-verifier:8090/verify', false),
+    ('XSign', 'Follow us on X', 75, 'webhook', 'http://fake-verifier:8090/verify', false),
+    ('kuarhodron', 'Kuarhodron', 10000, 'none', NULL, true)
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS task_completions(
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    task_code VARCHAR(100) NOT NULL REFERENCES tasks(code),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    proof TEXT,
+    points INT NOT NULL DEFAULT 0,
+    reason VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP
+    );
+CREATE INDEX IF NOT EXISTS task_completions_user_id_idx ON task_completions(user_id, task_code);
+
+-- +goose Down
+DROP TABLE IF EXISTS task_completions;
+DROP TABLE IF EXISTS tasks;
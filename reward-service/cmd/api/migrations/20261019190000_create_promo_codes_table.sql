@@ -0,0 +1,31 @@
+-- +goose Up
+-- admins are appointed directly in the database: UPDATE users SET role = 'admin' WHERE id = ...
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
+
+CREATE TABLE IF NOT EXISTS promo_codes(
+    id serial PRIMARY KEY,
+    code_hash CHAR(64) UNIQUE NOT NULL,
+    reward INT NOT NULL CHECK (reward > 0),
+    max_uses INT NOT NULL DEFAULT 0 CHECK (max_uses >= 0),
+    uses INT NOT NULL DEFAULT 0,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+
+CREATE TABLE IF NOT EXISTS promo_redemptions(
+    promo_code_id INT NOT NULL REFERENCES promo_codes(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redeemed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (promo_code_id, user_id)
+    );
+
+-- the hardcoded kuarhodron task is replaced by promo codes
+DELETE FROM tasks WHERE code = 'kuarhodron'
+    AND NOT EXISTS (SELECT 1 FROM task_completions WHERE task_code = 'kuarhodron');
+
+-- +goose Down
+DROP TABLE IF EXISTS promo_redemptions;
+DROP TABLE IF EXISTS promo_codes;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
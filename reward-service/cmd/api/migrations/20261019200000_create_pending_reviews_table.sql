@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS pending_reviews(
+    id serial PRIMARY KEY,
+    completion_id INT UNIQUE NOT NULL REFERENCES task_completions(id) ON DELETE CASCADE,
+    proof_text TEXT,
+    proof_url VARCHAR(2048),
+    file_ref VARCHAR(255),
+    reviewer_id INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    reviewed_at TIMESTAMP
+    );
+
+INSERT INTO tasks (code, name, points, verifier, repeatable) VALUES
+    ('postAboutUs', 'Post about us', 200, 'manual', false)
+ON CONFLICT DO NOTHING;
+
+-- +goose Down
+DELETE FROM tasks WHERE code = 'postAboutUs'
+    AND NOT EXISTS (SELECT 1 FROM task_completions WHERE task_code = 'postAboutUs');
+DROP TABLE IF EXISTS pending_reviews;
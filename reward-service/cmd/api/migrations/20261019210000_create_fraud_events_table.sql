@@ -0,0 +1,23 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN IF NOT EXISTS registration_ip VARCHAR(45);
+CREATE INDEX IF NOT EXISTS users_registration_ip_idx ON users(registration_ip);
+
+-- user_id has no foreign key: events are written while the user row may be locked, and stay after the user is deleted
+CREATE TABLE IF NOT EXISTS fraud_events(
+    id serial PRIMARY KEY,
+    user_id INT,
+    rule VARCHAR(100) NOT NULL,
+    action VARCHAR(10) NOT NULL,
+    event_type VARCHAR(20) NOT NULL,
+    amount INT NOT NULL DEFAULT 0,
+    kind VARCHAR(50),
+    ip VARCHAR(45),
+    details TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+CREATE INDEX IF NOT EXISTS fraud_events_created_at_idx ON fraud_events(created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS fraud_events;
+DROP INDEX IF EXISTS users_registration_ip_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS registration_ip;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets(
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    allowed BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+    );
+
+-- +goose Down
+DROP TABLE IF EXISTS rate_limit_buckets;
@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS email_verifications (
+    nonce TEXT PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS email_verifications_user_id_idx ON email_verifications (user_id);
+
+ALTER TABLE users ALTER COLUMN active SET DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE users ALTER COLUMN active SET DEFAULT 1;
+
+DROP TABLE IF EXISTS email_verifications;
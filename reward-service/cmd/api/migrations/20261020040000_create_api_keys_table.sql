@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL UNIQUE,
+    secret_hash TEXT NOT NULL,
+    scopes TEXT NOT NULL DEFAULT '',
+    rate_limit TEXT,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS partner_awards (
+    id SERIAL PRIMARY KEY,
+    api_key_id INT NOT NULL REFERENCES api_keys(id),
+    external_id TEXT NOT NULL,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INT NOT NULL CHECK (amount > 0),
+    reason TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    UNIQUE (api_key_id, external_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS partner_awards;
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS webhook_events (
+    source TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    user_id INT,
+    status TEXT NOT NULL,
+    detail TEXT,
+    received_at TIMESTAMP NOT NULL DEFAULT now(),
+    processed_at TIMESTAMP,
+    PRIMARY KEY (source, event_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS webhook_events;
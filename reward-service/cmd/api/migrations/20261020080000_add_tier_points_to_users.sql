@@ -0,0 +1,8 @@
+-- +goose Up
+-- tier_points are the points counted towards the current tier. They follow lifetime_points,
+-- but a demotion resets them to the threshold of the lower tier, so the tier has to be earned again.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tier_points INT NOT NULL DEFAULT 0;
+UPDATE users SET tier_points = lifetime_points;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN IF EXISTS tier_points;
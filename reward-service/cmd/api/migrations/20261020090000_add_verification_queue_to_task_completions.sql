@@ -0,0 +1,22 @@
+-- +goose Up
+-- pending completions of webhook verified tasks are queued here until their verifier accepts the request
+ALTER TABLE task_completions
+    ADD COLUMN IF NOT EXISTS verification_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS next_verification_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS verification_sent_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS task_completions_next_verification_idx ON task_completions(next_verification_at)
+    WHERE status = 'pending' AND next_verification_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS task_completions_verification_sent_idx ON task_completions(verification_sent_at)
+    WHERE status = 'pending' AND verification_sent_at IS NOT NULL;
+
+-- completions which were waiting before the queue existed are sent again
+UPDATE task_completions c SET next_verification_at = now()
+FROM tasks t WHERE t.code = c.task_code AND t.verifier = 'webhook' AND c.status = 'pending';
+
+-- +goose Down
+DROP INDEX IF EXISTS task_completions_verification_sent_idx;
+DROP INDEX IF EXISTS task_completions_next_verification_idx;
+ALTER TABLE task_completions
+    DROP COLUMN IF EXISTS verification_sent_at,
+    DROP COLUMN IF EXISTS next_verification_at,
+    DROP COLUMN IF EXISTS verification_attempts;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- an event stays reserved by the request processing it until locked_until, later deliveries take it over
+ALTER TABLE webhook_events ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+UPDATE webhook_events SET locked_until = received_at WHERE status = 'processing';
+
+-- +goose Down
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS locked_until;
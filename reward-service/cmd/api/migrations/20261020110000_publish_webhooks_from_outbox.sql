@@ -0,0 +1,15 @@
+-- +goose Up
+-- sinks which accepted an event whose publishing didn't finish yet, they are skipped when it is published again
+CREATE TABLE IF NOT EXISTS outbox_publications (
+    event_id BIGINT NOT NULL REFERENCES outbox_events(id) ON DELETE CASCADE,
+    sink TEXT NOT NULL,
+    published_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (event_id, sink)
+);
+
+-- the webhooks sink queues an event once per subscription however often it is published
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (subscription_id, event_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS webhook_deliveries_event_idx;
+DROP TABLE IF EXISTS outbox_publications;
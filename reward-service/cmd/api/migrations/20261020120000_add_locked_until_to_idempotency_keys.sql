@@ -0,0 +1,7 @@
+-- +goose Up
+-- a key stays reserved by the request processing it until locked_until, later requests with the key take it over
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+UPDATE idempotency_keys SET locked_until = created_at WHERE status_code IS NULL;
+
+-- +goose Down
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS locked_until;
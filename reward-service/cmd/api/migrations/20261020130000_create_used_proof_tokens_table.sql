@@ -0,0 +1,14 @@
+-- +goose Up
+-- proof tokens are accepted once, the hash of a token is kept until it expires
+CREATE TABLE IF NOT EXISTS used_proof_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    task_code TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS used_proof_tokens_expires_at_idx ON used_proof_tokens (expires_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS used_proof_tokens;
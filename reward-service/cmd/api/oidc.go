@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+)
+
+const oidcFlowTTL = 10 * time.Minute
+
+// OIDCProvider is an external identity provider users can log in with. The client secret is read from
+// the environment variable named by ClientSecretEnv, so it doesn't have to be kept in the config file.
+type OIDCProvider struct {
+	Name            string   `json:"name"`
+	Issuer          string   `json:"issuer"`
+	ClientID        string   `json:"client_id"`
+	ClientSecretEnv string   `json:"client_secret_env"`
+	Scopes          []string `json:"scopes"`
+
+	clientSecret string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the part of the provider's /.well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the claims of an ID token the user is identified by
+type oidcClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// loadOIDCProviders reads the provider configs from a JSON file
+func loadOIDCProviders(path string) (map[string]*OIDCProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read oidc providers: %w", err)
+	}
+	var list []*OIDCProvider
+	err = json.Unmarshal(content, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse oidc providers: %w", err)
+	}
+
+	providers := make(map[string]*OIDCProvider, len(list))
+	for _, p := range list {
+		if p.Name == "" || p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %q needs a name, an issuer and a client id", p.Name)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+		if p.ClientSecretEnv != "" {
+			p.clientSecret = os.Getenv(p.ClientSecretEnv)
+		}
+		providers[p.Name] = p
+	}
+	return providers, nil
+}
+
+// discover fetches the provider's endpoints once and keeps them
+func (p *OIDCProvider) discover(client *http.Client) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	err := getJSON(client, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover provider %s: %w", p.Name, err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("provider %s reports issuer %q instead of %q", p.Name, d.Issuer, p.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// publicKey returns the signing key of the provider by id, the keys are fetched again when the id is unknown
+func (p *OIDCProvider) publicKey(client *http.Client, kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover(client)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = getJSON(client, d.JWKSURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch keys of provider %s: %w", p.Name, err)
+	}
+
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("provider %s has no key %q", p.Name, kid)
+	}
+	return key, nil
+}
+
+// exchangeCode exchanges the authorization code and the PKCE verifier for an ID token
+func (p *OIDCProvider) exchangeCode(client *http.Client, code, verifier, redirectURI string) (string, error) {
+	d, err := p.discover(client)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	resp, err := client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange code: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint of provider %s responded with %d", p.Name, resp.StatusCode)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if token.IDToken == "" {
+		return "", fmt.Errorf("provider %s returned no id token", p.Name)
+	}
+	return token.IDToken, nil
+}
+
+// verifyIDToken checks the signature, the issuer, the audience, the expiry and the nonce of the ID token
+func (p *OIDCProvider) verifyIDToken(client *http.Client, raw, nonce string) (*oidcClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(client, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("id token was issued by another issuer")
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("id token was issued for another client")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	var c oidcClaims
+	c.Subject, _ = claims["sub"].(string)
+	c.Email, _ = claims["email"].(string)
+	c.EmailVerified, _ = claims["email_verified"].(bool)
+	c.GivenName, _ = claims["given_name"].(string)
+	c.FamilyName, _ = claims["family_name"].(string)
+	if c.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return &c, nil
+}
+
+// getJSON fetches and decodes a JSON document
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getOIDCProvider returns the provider from the URL or writes an error when it is not configured
+func (app *Config) getOIDCProvider(w http.ResponseWriter, r *http.Request) (*OIDCProvider, bool) {
+	provider, ok := app.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		app.errorJSON(w, errors.New("unknown identity provider"), http.StatusNotFound)
+	}
+	return provider, ok
+}
+
+// oidcRedirectURI is where the provider sends the user back to
+func (app *Config) oidcRedirectURI(provider *OIDCProvider) string {
+	return app.PublicURL + "/auth/oidc/" + provider.Name + "/callback"
+}
+
+// oidcLogin redirects the user to the provider to log in
+func (app *Config) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.getOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+	authorizeURL, err := app.startOIDCFlow(w, provider, 0)
+	if err != nil {
+		log.Println(err)
+		app.errorJSON(w, errors.New("identity provider is not available"), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// linkOIDCIdentity starts linking an identity of the provider to the current user and returns where to send
+// the user. The callback links the identity instead of logging in, so an account with a password gets
+// an identity only from a session of its owner.
+func (app *Config) linkOIDCIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	provider, ok := app.getOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+	authorizeURL, err := app.startOIDCFlow(w, provider, userID)
+	if err != nil {
+		log.Println(err)
+		app.errorJSON(w, errors.New("identity provider is not available"), http.StatusBadGateway)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Continue at %s to link the identity", provider.Name),
+		Data:    map[string]string{"authorization_url": authorizeURL},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// startOIDCFlow returns the authorization URL of the provider. The state, the nonce, the PKCE verifier and
+// the user the identity is linked to, 0 for a login, are kept in a signed cookie until the provider sends
+// the user back.
+func (app *Config) startOIDCFlow(w http.ResponseWriter, provider *OIDCProvider, linkUserID int) (string, error) {
+	d, err := provider.discover(app.Client)
+	if err != nil {
+		return "", err
+	}
+
+	var values [3]string
+	for i := range values {
+		b := make([]byte, 32)
+		_, err = rand.Read(b)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate login state: %w", err)
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	challenge := sha256.Sum256([]byte(verifier))
+
+	flow := strings.Join([]string{provider.Name, state, nonce, verifier, strconv.Itoa(linkUserID)}, "|")
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_flow",
+		Value:    app.signToken("oidc", flow, time.Now().Add(oidcFlowTTL)),
+		Path:     "/auth/oidc/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(oidcFlowTTL),
+	})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", app.oidcRedirectURI(provider))
+	query.Set("scope", strings.Join(provider.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// oidcCallback finishes the login with the provider. The external identity is looked up, linked to the user
+// with the same verified email or used to create a new user, then the user is logged in like with a password.
+func (app *Config) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.getOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		app.errorJSON(w, fmt.Errorf("identity provider refused the login: %s", errCode), http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie("oidc_flow")
+	if err != nil {
+		app.errorJSON(w, errors.New("login was not started or took too long"), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_flow", Path: "/auth/oidc/", MaxAge: -1})
+	flow, err := app.verifyToken("oidc", cookie.Value)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(flow, "|")
+	if len(parts) != 5 || parts[0] != provider.Name || parts[1] != r.URL.Query().Get("state") {
+		app.errorJSON(w, errors.New("login state does not match"), http.StatusBadRequest)
+		return
+	}
+	nonce, verifier := parts[2], parts[3]
+	linkUserID, err := strconv.Atoi(parts[4])
+	if err != nil {
+		app.errorJSON(w, errors.New("login state does not match"), http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := provider.exchangeCode(app.Client, r.URL.Query().Get("code"), verifier, app.oidcRedirectURI(provider))
+	if err != nil {
+		log.Println(err)
+		app.errorJSON(w, errors.New("couldn't finish login with the identity provider"), http.StatusBadGateway)
+		return
+	}
+	claims, err := provider.verifyIDToken(app.Client, idToken, nonce)
+	if err != nil {
+		log.Printf("rejected id token of provider %s: %v", provider.Name, err)
+		app.errorJSON(w, errors.New("couldn't finish login with the identity provider"), http.StatusUnauthorized)
+		return
+	}
+	if linkUserID != 0 {
+		app.finishIdentityLink(w, linkUserID, provider, claims)
+		return
+	}
+
+	userID, err := app.oidcUser(r, provider, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errIdentityConflict), errors.Is(err, data.ErrFraudBlocked):
+			app.errorJSON(w, err, http.StatusConflict)
+		default:
+			app.errorJSON(w, errors.New("couldn't log in with the identity provider"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err := app.Repo.GetOne(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch user"), http.StatusInternalServerError)
+		return
+	}
+	if user.Active == 0 {
+		app.errorJSON(w, errors.New("email address is not verified"), http.StatusForbidden)
+		return
+	}
+	enabled, err := app.Repo.TOTPEnabled(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		app.writeTwoFactorChallenge(w, userID)
+		return
+	}
+
+	err = app.issueAccessToken(w, userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Welcome back, %s!", user.FirstName),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+var errIdentityConflict = errors.New("an account with this email already exists, log in with the password and link the identity")
+
+// oidcUser returns the user of the external identity, linking or creating one on the first login
+func (app *Config) oidcUser(r *http.Request, provider *OIDCProvider, claims *oidcClaims) (int, error) {
+	userID, err := app.Repo.GetUserByIdentity(provider.Name, claims.Subject)
+	if !errors.Is(err, data.ErrIdentityNotFound) {
+		return userID, err
+	}
+	if validateEmail(claims.Email) != nil {
+		return 0, errors.New("identity provider didn't share a valid email address")
+	}
+
+	existing, err := app.Repo.EmailCheck(claims.Email)
+	switch {
+	case err == nil:
+		// an unverified email at the provider would let anybody take over the account with that email, and
+		// an active account belongs to whoever verified the email here, who links identities from a session
+		if !claims.EmailVerified || existing.Active == 1 {
+			return 0, errIdentityConflict
+		}
+		// linking activates an account nobody verified the email of, LinkIdentity drops its password then
+		err = app.Repo.LinkIdentity(existing.ID, provider.Name, claims.Subject, claims.Email, true)
+		return existing.ID, err
+	case !errors.Is(err, data.ErrUserNotFound):
+		return 0, err
+	}
+
+	user := data.User{
+		Email:          claims.Email,
+		FirstName:      claims.GivenName,
+		LastName:       claims.FamilyName,
+		RegistrationIP: clientIP(r),
+	}
+	if claims.EmailVerified {
+		user.Active = 1
+	}
+	userID, err = app.Repo.InsertWithIdentity(user, provider.Name, claims.Subject)
+	if err != nil {
+		return 0, err
+	}
+	if !claims.EmailVerified {
+		err = app.sendVerificationEmail(userID, user.Email)
+		if err != nil {
+			log.Printf("failed to send verification email to user %d: %v", userID, err)
+		}
+	}
+	return userID, nil
+}
+
+// finishIdentityLink links the identity the provider returned to the user who started linking it
+func (app *Config) finishIdentityLink(w http.ResponseWriter, userID int, provider *OIDCProvider, claims *oidcClaims) {
+	linkedTo, err := app.Repo.GetUserByIdentity(provider.Name, claims.Subject)
+	switch {
+	case err == nil && linkedTo != userID:
+		app.errorJSON(w, errors.New("identity is already linked to another account"), http.StatusConflict)
+		return
+	case errors.Is(err, data.ErrIdentityNotFound):
+		// the provider vouches for its own email only, the email of the account stays as it is
+		err = app.Repo.LinkIdentity(userID, provider.Name, claims.Subject, claims.Email, false)
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't link identity"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Linked %s identity to user %d", provider.Name, userID),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getIdentities returns the external identities linked to the current user
+func (app *Config) getIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	identities, err := app.Repo.GetIdentities(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch identities"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched identities of user %d", userID),
+		Data:    identities,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reward-service/data"
+	"reward-service/internal/fakeoidc"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+)
+
+type discardMailer struct{}
+
+func (discardMailer) Send(to, subject, body string) error { return nil }
+
+// oidcTest is the API with the fake identity provider configured as "fake"
+type oidcTest struct {
+	app      *Config
+	repo     *fakeRepo
+	provider *OIDCProvider
+	fake     *fakeoidc.Provider
+	api      string
+	client   *http.Client
+}
+
+// newOIDCTest starts the API with the users and the fake identity provider
+func newOIDCTest(t *testing.T, users ...*data.User) *oidcTest {
+	t.Helper()
+	fake, err := fakeoidc.New("", "reward-service", "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeServer := httptest.NewServer(fake.Handler())
+	t.Cleanup(fakeServer.Close)
+	fake.Issuer = fakeServer.URL
+
+	repo := newFakeRepo(users...)
+	provider := &OIDCProvider{
+		Name:         "fake",
+		Issuer:       fakeServer.URL,
+		ClientID:     "reward-service",
+		Scopes:       []string{"openid", "email", "profile"},
+		clientSecret: "client-secret",
+	}
+	app := &Config{
+		Repo:          repo,
+		Client:        &http.Client{Timeout: 5 * time.Second},
+		Mailer:        discardMailer{},
+		RateLimiter:   newMemoryStore(),
+		SecretKey:     "test-secret",
+		EmailTokenTTL: time.Hour,
+		OIDCProviders: map[string]*OIDCProvider{"fake": provider},
+	}
+	api := httptest.NewServer(app.routes())
+	t.Cleanup(api.Close)
+	app.PublicURL = api.URL
+
+	return &oidcTest{
+		app:      app,
+		repo:     repo,
+		provider: provider,
+		fake:     fake,
+		api:      api.URL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// redirect requests the URL and returns where it redirects to along with the flow cookie, if one was set
+func (o *oidcTest) redirect(t *testing.T, target string) (*url.URL, *http.Cookie) {
+	t.Helper()
+	resp, err := o.client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET %s responded with %d, want a redirect", target, resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == "oidc_flow" {
+			return location, c
+		}
+	}
+	return location, nil
+}
+
+// login starts the login, lets the fake provider log in the email and returns the callback URL and the flow cookie
+func (o *oidcTest) login(t *testing.T, email string) (*url.URL, *http.Cookie) {
+	t.Helper()
+	authorize, cookie := o.redirect(t, o.api+"/auth/oidc/fake/login")
+	if cookie == nil {
+		t.Fatal("login didn't set the flow cookie")
+	}
+	query := authorize.Query()
+	query.Set("login_hint", email)
+	authorize.RawQuery = query.Encode()
+	callback, _ := o.redirect(t, authorize.String())
+	return callback, cookie
+}
+
+// callback finishes the login and returns the status of the response
+func (o *oidcTest) callback(t *testing.T, callback *url.URL, cookie *http.Cookie) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, callback.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOIDCLinking(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		existing   *data.User
+		wantStatus int
+		wantLinked bool
+		wantActive int
+	}{
+		{"new user", "bob@example.com", nil, http.StatusAccepted, false, 1},
+		{"new user with unverified email", "unverified.bob@example.com", nil, http.StatusForbidden, false, 0},
+		{"active account", "bob@example.com",
+			&data.User{ID: 1, Email: "bob@example.com", Active: 1}, http.StatusConflict, false, 1},
+		{"inactive account", "bob@example.com",
+			&data.User{ID: 1, Email: "bob@example.com"}, http.StatusAccepted, true, 1},
+		{"account with unverified email", "unverified.bob@example.com",
+			&data.User{ID: 1, Email: "unverified.bob@example.com", Active: 1}, http.StatusConflict, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var users []*data.User
+			if tt.existing != nil {
+				users = append(users, tt.existing)
+			}
+			o := newOIDCTest(t, users...)
+
+			callback, cookie := o.login(t, tt.email)
+			status := o.callback(t, callback, cookie)
+			if status != tt.wantStatus {
+				t.Errorf("callback responded with %d, want %d", status, tt.wantStatus)
+			}
+			if linked := len(o.repo.linked) > 0; linked != tt.wantLinked {
+				t.Errorf("identity linked = %v, want %v", linked, tt.wantLinked)
+			}
+			u := o.repo.user(tt.email)
+			if u == nil {
+				t.Fatal("user was not created")
+			}
+			if u.Active != tt.wantActive {
+				t.Errorf("user active = %d, want %d", u.Active, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestOIDCLinkedIdentity(t *testing.T) {
+	o := newOIDCTest(t, &data.User{ID: 1, Email: "old@example.com", Active: 1})
+	o.repo.identities["fake|fake-bob@example.com"] = 1
+
+	callback, cookie := o.login(t, "bob@example.com")
+	status := o.callback(t, callback, cookie)
+	if status != http.StatusAccepted {
+		t.Errorf("callback responded with %d, want %d", status, http.StatusAccepted)
+	}
+	if len(o.repo.linked) != 0 || len(o.repo.users) != 1 {
+		t.Errorf("login with a linked identity linked %v and left %d users", o.repo.linked, len(o.repo.users))
+	}
+}
+
+// link starts linking the identity of the email to the user from a session of the user, lets the fake provider
+// log in the email and returns the callback URL and the flow cookie
+func (o *oidcTest) link(t *testing.T, userID int, email string) (*url.URL, *http.Cookie) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/me/identities/fake", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("provider", "fake")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	o.app.linkOIDCIdentity(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("linking responded with %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp struct {
+		Data struct {
+			AuthorizationURL string `json:"authorization_url"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "oidc_flow" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("linking didn't set the flow cookie")
+	}
+
+	authorize, err := url.Parse(resp.Data.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	query.Set("login_hint", email)
+	authorize.RawQuery = query.Encode()
+	callback, _ := o.redirect(t, authorize.String())
+	return callback, cookie
+}
+
+func TestOIDCLinkFromSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		linkedTo   int
+		wantStatus int
+		wantLinked bool
+	}{
+		{"new identity", 0, http.StatusAccepted, true},
+		{"already linked to the user", 1, http.StatusAccepted, false},
+		{"linked to another user", 2, http.StatusConflict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOIDCTest(t, &data.User{ID: 1, Email: "bob@example.com", Active: 1},
+				&data.User{ID: 2, Email: "mallory@example.com", Active: 1})
+			if tt.linkedTo != 0 {
+				o.repo.identities["fake|fake-bob@example.com"] = tt.linkedTo
+			}
+
+			callback, cookie := o.link(t, 1, "bob@example.com")
+			status := o.callback(t, callback, cookie)
+			if status != tt.wantStatus {
+				t.Errorf("callback responded with %d, want %d", status, tt.wantStatus)
+			}
+			if linked := slices.Equal(o.repo.linked, []int{1}); linked != tt.wantLinked {
+				t.Errorf("identity linked to %v, want linked to user 1 = %v", o.repo.linked, tt.wantLinked)
+			}
+			if len(o.repo.users) != 2 {
+				t.Errorf("linking left %d users, want 2", len(o.repo.users))
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		tamper     func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie)
+		wantStatus int
+	}{
+		{"untouched", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			return callback, cookie
+		}, http.StatusAccepted},
+		{"no flow cookie", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			return callback, nil
+		}, http.StatusBadRequest},
+		{"forged flow cookie", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			forged := *cookie
+			forged.Value += "0"
+			return callback, &forged
+		}, http.StatusBadRequest},
+		{"other state", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			query := callback.Query()
+			query.Set("state", "guessed")
+			callback.RawQuery = query.Encode()
+			return callback, cookie
+		}, http.StatusBadRequest},
+		{"cookie of another login", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			// the state is taken from the other login too, the PKCE verifier no longer matches the code
+			other, otherCookie := o.login(t, "mallory@example.com")
+			query := callback.Query()
+			query.Set("state", other.Query().Get("state"))
+			callback.RawQuery = query.Encode()
+			return callback, otherCookie
+		}, http.StatusBadGateway},
+		{"refused by provider", func(t *testing.T, o *oidcTest, callback *url.URL, cookie *http.Cookie) (*url.URL, *http.Cookie) {
+			callback.RawQuery = url.Values{"error": {"access_denied"}}.Encode()
+			return callback, cookie
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOIDCTest(t)
+			callback, cookie := o.login(t, "bob@example.com")
+			callback, cookie = tt.tamper(t, o, callback, cookie)
+
+			status := o.callback(t, callback, cookie)
+			if status != tt.wantStatus {
+				t.Errorf("callback responded with %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestOIDCCodeReused(t *testing.T) {
+	o := newOIDCTest(t)
+	callback, cookie := o.login(t, "bob@example.com")
+	status := o.callback(t, callback, cookie)
+	if status != http.StatusAccepted {
+		t.Fatalf("callback responded with %d, want %d", status, http.StatusAccepted)
+	}
+
+	status = o.callback(t, callback, cookie)
+	if status != http.StatusBadGateway {
+		t.Errorf("callback with a used code responded with %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	o := newOIDCTest(t)
+	other, err := fakeoidc.New(o.fake.Issuer, "reward-service", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":            o.fake.Issuer,
+			"sub":            "fake-bob@example.com",
+			"aud":            "reward-service",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          "nonce",
+			"email":          "bob@example.com",
+			"email_verified": true,
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		issuer  *fakeoidc.Provider
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{"valid", o.fake, claims(nil), false},
+		{"other issuer", o.fake, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }), true},
+		{"other audience", o.fake, claims(func(c jwt.MapClaims) { c["aud"] = "another-client" }), true},
+		{"no audience", o.fake, claims(func(c jwt.MapClaims) { delete(c, "aud") }), true},
+		{"expired", o.fake, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }), true},
+		{"no expiry", o.fake, claims(func(c jwt.MapClaims) { delete(c, "exp") }), true},
+		{"other nonce", o.fake, claims(func(c jwt.MapClaims) { c["nonce"] = "replayed" }), true},
+		{"no subject", o.fake, claims(func(c jwt.MapClaims) { delete(c, "sub") }), true},
+		{"signed by another key", other, claims(nil), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.issuer.IDToken(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := o.provider.verifyIDToken(http.DefaultClient, raw, "nonce")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (c.Subject != "fake-bob@example.com" || !c.EmailVerified) {
+				t.Errorf("verifyIDToken() = %+v", c)
+			}
+		})
+	}
+
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString([]byte("client-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.provider.verifyIDToken(http.DefaultClient, hs256, "nonce")
+	if err == nil {
+		t.Error("verifyIDToken() accepted a HS256 token")
+	}
+}
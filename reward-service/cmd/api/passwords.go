@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reward-service/data"
+	"time"
+)
+
+// hashResetToken returns the hash under which a password reset token is stored
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgotPassword sends a password reset token to the email. The response is the same whether the email is registered or not.
+func (app *Config) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Repo.GetByEmail(requestPayload.Email)
+	if err == nil {
+		err = app.sendPasswordReset(user.ID, user.Email)
+		if err != nil {
+			log.Printf("failed to send password reset to user %d: %v", user.ID, err)
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("If the account exists, a password reset link was sent to %s", requestPayload.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// sendPasswordReset stores the hash of a new reset token and mails the token to the user
+func (app *Config) sendPasswordReset(userID int, email string) error {
+	token, err := randomNonce()
+	if err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	expires := time.Now().Add(app.ResetTokenTTL)
+	err = app.Repo.CreatePasswordReset(userID, hashResetToken(token), expires)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Somebody asked to reset the password of your account. If it was you, send the token\n\n%s\n\n"+
+		"to %s/auth/password/reset together with the new password before %s.\n"+
+		"Otherwise ignore this email, your password stays the same.\n",
+		token, app.PublicURL, expires.Format(time.RFC1123))
+	return app.Mailer.Send(email, "Reset your password", body)
+}
+
+// resetPassword sets a new password by the reset token and revokes all sessions of the user
+func (app *Config) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.Repo.ResetPassword(hashResetToken(requestPayload.Token), requestPayload.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidPasswordReset), errors.Is(err, data.ErrWeakPassword):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		default:
+			app.errorJSON(w, errors.New("couldn't reset password"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// whoever knows the new password may log in right away
+	email, err := app.Repo.GetEmailByID(userID)
+	if err == nil {
+		emailKey, _ := loginKeys(email, "")
+		app.Repo.ResetLoginFailures(emailKey)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Password was reset, log in with the new password"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// changePassword changes the password of the current user, who has to confirm the current password.
+// Other sessions are revoked, the current one gets a new access token.
+func (app *Config) changePassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	email, err := app.Repo.GetEmailByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch user"), http.StatusInternalServerError)
+		return
+	}
+	user, err := app.Repo.EmailCheck(email)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch user"), http.StatusInternalServerError)
+		return
+	}
+	valid, err := app.Repo.PasswordMatches(requestPayload.CurrentPassword, *user)
+	if err != nil || !valid {
+		app.errorJSON(w, errors.New("current password is wrong"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Repo.ChangePassword(userID, requestPayload.NewPassword)
+	if err != nil {
+		if errors.Is(err, data.ErrWeakPassword) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't change password"), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.issueAccessToken(w, userID)
+	if err != nil {
+		log.Printf("failed to issue a new access token for user %d: %v", userID, err)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Password changed, other sessions were logged out"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
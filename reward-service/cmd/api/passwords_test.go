@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mailedResetToken returns the reset token from the last email sent, it is the line of its own
+// between the greeting and the instructions
+func mailedResetToken(t *testing.T, mailer *fakeMailer) string {
+	t.Helper()
+	if len(mailer.sent) == 0 {
+		t.Fatal("no email was sent")
+	}
+	body := mailer.sent[len(mailer.sent)-1].body
+	parts := strings.Split(body, "\n\n")
+	if len(parts) < 2 {
+		t.Fatalf("no token in the email %q", body)
+	}
+	return parts[1]
+}
+
+func TestSendPasswordReset(t *testing.T) {
+	repo := newFakeRepo()
+	mailer := &fakeMailer{}
+	app := &Config{Repo: repo, Mailer: mailer, ResetTokenTTL: 15 * time.Minute}
+
+	var tokens []string
+	for range 2 {
+		before := time.Now()
+		err := app.sendPasswordReset(1, "bob@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := mailedResetToken(t, mailer)
+		tokens = append(tokens, token)
+
+		if _, ok := repo.resets[token]; ok {
+			t.Error("the reset token was stored in plain text")
+		}
+		reset, ok := repo.resets[hashResetToken(token)]
+		if !ok {
+			t.Fatalf("the hash of the mailed token %q was not stored", token)
+		}
+		if reset.expires.Before(before.Add(app.ResetTokenTTL)) || reset.expires.After(time.Now().Add(app.ResetTokenTTL)) {
+			t.Errorf("reset expires at %v, want %v after it was issued", reset.expires, app.ResetTokenTTL)
+		}
+	}
+
+	if tokens[0] == tokens[1] {
+		t.Errorf("two resets got the same token %q", tokens[0])
+	}
+	if len(tokens[0]) < 32 {
+		t.Errorf("reset token %q is shorter than 128 bits", tokens[0])
+	}
+}
+
+func TestResetPasswordRevokesSessions(t *testing.T) {
+	repo := newFakeRepo(&data.User{ID: 1, Email: "bob@example.com", Password: "old password", Active: 1})
+	mailer := &fakeMailer{}
+	app := &Config{Repo: repo, Mailer: mailer, SecretKey: "test-secret", ResetTokenTTL: 15 * time.Minute}
+	protected := app.authTokenMiddleware(app.SecretKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	session := func(accessToken string) int {
+		req := httptest.NewRequest(http.MethodGet, "/me/history", nil)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: accessToken})
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	reset := func(token string) int {
+		body := `{"token": "` + token + `", "password": "new password"}`
+		rec := httptest.NewRecorder()
+		app.resetPassword(rec, httptest.NewRequest(http.MethodPost, "/auth/password/reset", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	oldSession, err := generateTokens(1, 0, app.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := session(oldSession.AccessToken); code != http.StatusOK {
+		t.Fatalf("session before the reset responded with %d", code)
+	}
+
+	app.sendPasswordReset(1, "bob@example.com")
+	first := mailedResetToken(t, mailer)
+	app.sendPasswordReset(1, "bob@example.com")
+	second := mailedResetToken(t, mailer)
+	repo.loginFailures["email:bob@example.com"] = 4
+
+	if code := reset(second); code != http.StatusAccepted {
+		t.Fatalf("reset responded with %d, want %d", code, http.StatusAccepted)
+	}
+	if code := session(oldSession.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("session issued before the reset responded with %d, want %d", code, http.StatusUnauthorized)
+	}
+	newSession, _ := generateTokens(1, 1, app.SecretKey)
+	if code := session(newSession.AccessToken); code != http.StatusOK {
+		t.Errorf("session issued after the reset responded with %d", code)
+	}
+	if code := reset(first); code != http.StatusBadRequest {
+		t.Errorf("the other reset token responded with %d after the reset, want %d", code, http.StatusBadRequest)
+	}
+	if code := reset(second); code != http.StatusBadRequest {
+		t.Errorf("the used reset token responded with %d, want %d", code, http.StatusBadRequest)
+	}
+	if repo.loginFailures["email:bob@example.com"] != 0 {
+		t.Error("failed logins were not cleared by the reset")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reward-service/data"
+	"time"
+)
+
+const maxMemoLength = 255
+
+// createTransfer moves points from the authenticated user to another user
+func (app *Config) createTransfer(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RecipientID int    `json:"recipient_id"`
+		Amount      int    `json:"amount"`
+		Memo        string `json:"memo,omitempty"`
+	}
+	senderID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" || len(idempotencyKey) > 255 {
+		app.errorJSON(w, errors.New("Idempotency-Key header is required and must be at most 255 characters long"), http.StatusBadRequest)
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(requestPayload.Memo) > maxMemoLength {
+		app.errorJSON(w, fmt.Errorf("memo must be at most %d characters long", maxMemoLength), http.StatusBadRequest)
+		return
+	}
+
+	transfer, err := app.Repo.TransferPoints(data.Transfer{
+		SenderID:       senderID,
+		RecipientID:    requestPayload.RecipientID,
+		Amount:         requestPayload.Amount,
+		Memo:           requestPayload.Memo,
+		IdempotencyKey: idempotencyKey,
+	}, app.TransferDailyLimit)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUserNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrIdempotencyKeyReused):
+			app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		case errors.Is(err, data.ErrInsufficientPoints),
+			errors.Is(err, data.ErrDailyLimitExceeded),
+			errors.Is(err, data.ErrSelfTransfer),
+			errors.Is(err, data.ErrInvalidTransferAmount):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		default:
+			app.errorJSON(w, errors.New("couldn't transfer points"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Transferred %d points to user with id %d", transfer.Amount, transfer.RecipientID),
+		Data:    transfer,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getHistory retrieves the latest points history of the authenticated user
+func (app *Config) getHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	history, err := app.Repo.GetHistory(id, 100)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch history"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched points history"),
+		Data:    history,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getPoints retrieves the balance of the authenticated user and the points which are going to expire
+func (app *Config) getPoints(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	balance, err := app.Repo.GetPointsBalance(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch points balance"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched points balance"),
+		Data:    balance,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// expirePoints periodically writes off the points whose lots have expired
+func (app *Config) expirePoints(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.Repo.ExpirePoints()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Expired points of %d users", n)
+		}
+	}
+}
+
+// getTierChanges retrieves the promotions and demotions of the authenticated user
+func (app *Config) getTierChanges(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	changes, err := app.Repo.GetTierChanges(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch tier changes"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched tier changes"),
+		Data:    changes,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// demoteInactiveUsers periodically moves users who stopped earning points one tier down
+func (app *Config) demoteInactiveUsers(inactivity, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.Repo.DemoteInactiveUsers(inactivity)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Demoted %d inactive users", n)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chosen promo codes must have at least minPromoCodeLength characters besides the separators,
+// minPromoCodeDistinct of them different, so they can't be guessed within the redeem limits
+const (
+	minPromoCodeLength   = 12
+	minPromoCodeDistinct = 6
+)
+
+// errInvalidPromoCode answers unknown codes. Only they are counted toward the lockout: a user who guesses
+// codes mostly hits unknown ones, while the other errors tell about a real code the user already knows.
+var errInvalidPromoCode = errors.New("promo code is invalid")
+
+// checkPromoCode returns an error if the chosen code is too short or too repetitive
+func checkPromoCode(code string) error {
+	distinct := make(map[rune]bool)
+	length := 0
+	for _, c := range data.NormalizePromoCode(code) {
+		if c == '-' || c == ' ' {
+			continue
+		}
+		distinct[c] = true
+		length++
+	}
+	if length < minPromoCodeLength || len(distinct) < minPromoCodeDistinct {
+		return fmt.Errorf("promo code must have at least %d characters besides separators, %d of them different",
+			minPromoCodeLength, minPromoCodeDistinct)
+	}
+	return nil
+}
+
+// promoFailureKey returns the key under which failed redeems of the user are counted
+func promoFailureKey(userID int) string {
+	return fmt.Sprintf("promo:user:%d", userID)
+}
+
+// generatePromoCode generates a random code like "K3XQ-7JD2-MZ4A"
+func generatePromoCode() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:12]
+	return code[:4] + "-" + code[4:8] + "-" + code[8:], nil
+}
+
+// createPromoCode creates a new promo code, the plain code is returned only in this response
+func (app *Config) createPromoCode(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code       string     `json:"code,omitempty"`
+		Reward     int        `json:"reward"`
+		MaxUses    int        `json:"max_uses,omitempty"`
+		ValidFrom  *time.Time `json:"valid_from,omitempty"`
+		ValidUntil *time.Time `json:"valid_until,omitempty"`
+	}
+	adminID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if requestPayload.Reward <= 0 || requestPayload.MaxUses < 0 {
+		app.errorJSON(w, errors.New("reward must be positive and max_uses can't be negative"), http.StatusBadRequest)
+		return
+	}
+	if requestPayload.ValidFrom != nil && requestPayload.ValidUntil != nil && requestPayload.ValidUntil.Before(*requestPayload.ValidFrom) {
+		app.errorJSON(w, errors.New("valid_until must be after valid_from"), http.StatusBadRequest)
+		return
+	}
+
+	code := strings.TrimSpace(requestPayload.Code)
+	if code == "" {
+		code, err = generatePromoCode()
+		if err != nil {
+			app.errorJSON(w, errors.New("couldn't generate promo code"), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = checkPromoCode(code)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	promo, err := app.Repo.InsertPromoCode(code, data.PromoCode{
+		Reward:     requestPayload.Reward,
+		MaxUses:    requestPayload.MaxUses,
+		ValidFrom:  requestPayload.ValidFrom,
+		ValidUntil: requestPayload.ValidUntil,
+		CreatedBy:  adminID,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPromoCodeExists):
+			app.errorJSON(w, err, http.StatusConflict)
+		default:
+			app.errorJSON(w, errors.New("couldn't create promo code"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created promo code %s", strings.ToUpper(code)),
+		Data: struct {
+			Code string `json:"code"`
+			*data.PromoCode
+		}{strings.ToUpper(code), promo},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// redeemPromoCode redeems a promo code for the authenticated user. Unknown codes are counted per user
+// like failed logins, too many of them lock the redeeming for a while.
+func (app *Config) redeemPromoCode(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestPayload.Code) == "" {
+		app.errorJSON(w, errors.New("code is required"), http.StatusBadRequest)
+		return
+	}
+
+	failureKey := promoFailureKey(id)
+	lockedUntil, err := app.Repo.GetLoginLock(failureKey)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't redeem promo code"), http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		retryAfter := int(math.Ceil(time.Until(lockedUntil).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, retryAfter)))
+		app.errorJSON(w, errors.New("too many invalid promo codes, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	promo, err := app.Repo.RedeemPromoCode(id, requestPayload.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPromoCodeNotFound):
+			_, err = app.Repo.RecordLoginFailure(failureKey, app.PromoLockout)
+			if err != nil {
+				log.Printf("failed to count invalid promo code of user %d: %v", id, err)
+			}
+			app.errorJSON(w, errInvalidPromoCode, http.StatusBadRequest)
+		case errors.Is(err, data.ErrPromoCodeAlreadyUsed):
+			app.errorJSON(w, err, http.StatusConflict)
+		case errors.Is(err, data.ErrPromoCodeExhausted), errors.Is(err, data.ErrPromoCodeNotActive):
+			app.errorJSON(w, err, http.StatusGone)
+		case errors.Is(err, data.ErrFraudBlocked):
+			app.errorJSON(w, err, http.StatusForbidden)
+		default:
+			app.errorJSON(w, errors.New("couldn't redeem promo code"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.Repo.ResetLoginFailures(failureKey)
+	if err != nil {
+		log.Printf("failed to reset invalid promo codes of user %d: %v", id, err)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Promo code redeemed, added points %d", promo.Reward),
+		Data: struct {
+			Reward int `json:"reward"`
+		}{promo.Reward},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"reward-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPromoCode(t *testing.T) {
+	tests := []struct {
+		code    string
+		wantErr bool
+	}{
+		{"SUMMER-SALE-2026", false},
+		{"k3xq-7jd2-mz4a", false},
+		{"  ABCDEF123456  ", false},
+		{"ABCDEF12345", true},    // 11 characters
+		{"ABC-DEF-123-45", true}, // separators don't count
+		{"AAAAAABBBBBB", true},   // only 2 different characters
+		{"ABCDEAAAAAAA", true},   // 5 different characters
+		{"abcdeAAAAAAA", true},   // lower case is the same character after normalizing
+		{"", true},
+	}
+	for _, tt := range tests {
+		err := checkPromoCode(tt.code)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkPromoCode(%q) error = %v, want error %v", tt.code, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGeneratePromoCode(t *testing.T) {
+	format := regexp.MustCompile(`^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`)
+	seen := make(map[string]bool)
+	for range 100 {
+		code, err := generatePromoCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(code) {
+			t.Fatalf("generatePromoCode() = %q, want three groups of four base32 characters", code)
+		}
+		if seen[code] {
+			t.Fatalf("generatePromoCode() returned %q twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestRedeemPromoCodeErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantStatus   int
+		wantFailures int
+	}{
+		{"redeemed", nil, http.StatusAccepted, 0},
+		{"unknown code", data.ErrPromoCodeNotFound, http.StatusBadRequest, 1},
+		{"already used", data.ErrPromoCodeAlreadyUsed, http.StatusConflict, 0},
+		{"used up", data.ErrPromoCodeExhausted, http.StatusGone, 0},
+		{"not active", data.ErrPromoCodeNotActive, http.StatusGone, 0},
+		{"fraud", data.ErrFraudBlocked, http.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.promoErrs["SUMMER-SALE-2026"] = tt.err
+			app := &Config{Repo: repo, PromoLockout: data.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour}}
+
+			req := httptest.NewRequest(http.MethodPost, "/me/promo-codes/redeem", strings.NewReader(`{"code":"summer-sale-2026"}`))
+			req = req.WithContext(context.WithValue(req.Context(), userIDKey, 1))
+			rec := httptest.NewRecorder()
+			app.redeemPromoCode(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("redeem responded with %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if failures := repo.loginFailures[promoFailureKey(1)]; failures != tt.wantFailures {
+				t.Errorf("counted %d failures, want %d", failures, tt.wantFailures)
+			}
+			if tt.err == data.ErrPromoCodeNotFound && !strings.Contains(rec.Body.String(), errInvalidPromoCode.Error()) {
+				t.Errorf("unknown code was answered with %s, want the masked error", rec.Body)
+			}
+		})
+	}
+}
+
+func TestRedeemPromoCodeLockout(t *testing.T) {
+	repo := newFakeRepo()
+	repo.promoErrs["UNKNOWN-CODE-1"] = data.ErrPromoCodeNotFound
+	app := &Config{Repo: repo, PromoLockout: data.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour}}
+
+	redeem := func(code string) int {
+		req := httptest.NewRequest(http.MethodPost, "/me/promo-codes/redeem", strings.NewReader(`{"code":"`+code+`"}`))
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, 1))
+		rec := httptest.NewRecorder()
+		app.redeemPromoCode(rec, req)
+		return rec.Code
+	}
+	for range 3 {
+		redeem("UNKNOWN-CODE-1")
+	}
+	// once locked even a valid code is refused until the lock expires
+	if status := redeem("SUMMER-SALE-2026"); status != http.StatusTooManyRequests {
+		t.Errorf("redeem after 3 unknown codes responded with %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"reward-service/data"
+	"sync"
+	"time"
+)
+
+const rankBuffer = 8
+
+// rankChange is a new place of a user on the leaderboard
+type rankChange struct {
+	Rank     int `json:"rank"`
+	Previous int `json:"previous"`
+}
+
+// rankHub follows the ranks of the users with an open event stream. A balance change marks the users whose
+// rank it may change, and their ranks are fetched together at most once per throttle instead of by every
+// stream on every change.
+type rankHub struct {
+	repo      data.Repository
+	mu        sync.Mutex
+	standings map[int]data.Standing
+	streams   map[int]map[chan rankChange]bool
+	stale     map[int]bool
+}
+
+// newRankHub returns a hub without streams
+func newRankHub(repo data.Repository) *rankHub {
+	return &rankHub{
+		repo:      repo,
+		standings: make(map[int]data.Standing),
+		streams:   make(map[int]map[chan rankChange]bool),
+		stale:     make(map[int]bool),
+	}
+}
+
+// watch adds a stream of the user whose standing was just read. It returns the channel receiving the rank
+// changes and the function removing the stream. The rank is checked again with the next batch, in case it
+// changed while the stream was added.
+func (h *rankHub) watch(userID int, standing data.Standing) (<-chan rankChange, func()) {
+	ch := make(chan rankChange, rankBuffer)
+
+	h.mu.Lock()
+	if h.streams[userID] == nil {
+		h.streams[userID] = make(map[chan rankChange]bool)
+	}
+	h.streams[userID][ch] = true
+	h.standings[userID] = standing
+	h.stale[userID] = true
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.streams[userID], ch)
+			if len(h.streams[userID]) == 0 {
+				delete(h.streams, userID)
+				delete(h.standings, userID)
+				delete(h.stale, userID)
+			}
+		})
+	}
+}
+
+// run fetches the ranks marked by balance changes at most once per throttle, and all ranks every refresh
+// so that the streams catch up on changes lost while the live updates were interrupted
+func (h *rankHub) run(live *broker[data.LiveUpdate], throttle, refresh time.Duration) {
+	updates, unsubscribe := live.Subscribe(256)
+	defer unsubscribe()
+
+	throttleTicker := time.NewTicker(throttle)
+	defer throttleTicker.Stop()
+	refreshTicker := time.NewTicker(refresh)
+	defer refreshTicker.Stop()
+
+	for {
+		select {
+		case update := <-updates:
+			if update.Type == data.LiveBalance {
+				h.mark(update)
+			}
+		case <-throttleTicker.C:
+			h.refresh(false)
+		case <-refreshTicker.C:
+			h.refresh(true)
+		}
+	}
+}
+
+// mark marks the ranks the balance change may have changed: the rank of the user whose balance changed,
+// and the ranks of the users whose score the user passed in either direction
+func (h *rankHub) mark(update data.LiveUpdate) {
+	previous := update.Score - update.Amount
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, s := range h.standings {
+		if id == update.UserID || (previous > s.Score) != (update.Score > s.Score) {
+			h.stale[id] = true
+		}
+	}
+}
+
+// refresh fetches the marked ranks, or all of them, in one query and sends the changed ones to the streams
+func (h *rankHub) refresh(all bool) {
+	h.mu.Lock()
+	var ids []int
+	for id := range h.standings {
+		if all || h.stale[id] {
+			ids = append(ids, id)
+		}
+		delete(h.stale, id)
+	}
+	h.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	standings, err := h.repo.GetStandings(ids)
+	if err != nil {
+		log.Println(err)
+		h.mu.Lock()
+		for _, id := range ids {
+			if _, ok := h.standings[id]; ok {
+				h.stale[id] = true
+			}
+		}
+		h.mu.Unlock()
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, s := range standings {
+		old, ok := h.standings[id]
+		if !ok {
+			continue
+		}
+		h.standings[id] = s
+		if s.Rank == old.Rank {
+			continue
+		}
+		for ch := range h.streams[id] {
+			select {
+			case ch <- rankChange{Rank: s.Rank, Previous: old.Rank}:
+			default:
+				log.Printf("stream of user %d is too slow, dropped a rank change", id)
+			}
+		}
+	}
+}
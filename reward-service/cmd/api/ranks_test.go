@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reward-service/data"
+	"slices"
+	"testing"
+)
+
+func TestRankHub(t *testing.T) {
+	repo := newFakeRepo()
+	repo.standings = map[int]data.Standing{
+		1: {Rank: 1, Score: 300},
+		2: {Rank: 2, Score: 200},
+		3: {Rank: 3, Score: 100},
+	}
+	h := newRankHub(repo)
+	streams := make(map[int]<-chan rankChange)
+	for id, s := range repo.standings {
+		ch, unwatch := h.watch(id, s)
+		defer unwatch()
+		streams[id] = ch
+	}
+
+	// the ranks are checked once after the streams were added
+	h.refresh(false)
+	if len(repo.standingQueries) != 1 || !slices.Equal(repo.standingQueries[0], []int{1, 2, 3}) {
+		t.Fatalf("queries after watching = %v, want one for all users", repo.standingQueries)
+	}
+
+	// user 3 passes user 2 but not user 1
+	repo.standings[3] = data.Standing{Rank: 2, Score: 250}
+	repo.standings[2] = data.Standing{Rank: 3, Score: 200}
+	h.mark(data.LiveUpdate{Type: data.LiveBalance, UserID: 3, Score: 250, Amount: 150})
+	h.mark(data.LiveUpdate{Type: data.LiveBalance, UserID: 4, Score: 50, Amount: 10})
+	h.refresh(false)
+	if len(repo.standingQueries) != 2 || !slices.Equal(repo.standingQueries[1], []int{2, 3}) {
+		t.Fatalf("queries after the changes = %v, want one for users 2 and 3", repo.standingQueries)
+	}
+
+	want := map[int]*rankChange{1: nil, 2: {Rank: 3, Previous: 2}, 3: {Rank: 2, Previous: 3}}
+	for id, w := range want {
+		select {
+		case got := <-streams[id]:
+			if w == nil || got != *w {
+				t.Errorf("user %d got rank change %+v, want %+v", id, got, w)
+			}
+		default:
+			if w != nil {
+				t.Errorf("user %d got no rank change, want %+v", id, *w)
+			}
+		}
+	}
+
+	h.refresh(false)
+	if len(repo.standingQueries) != 2 {
+		t.Errorf("refresh without changes queried %v", repo.standingQueries[2:])
+	}
+}
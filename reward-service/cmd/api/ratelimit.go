@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket: up to Burst requests at once, refilled to Burst over Per
+type Rate struct {
+	Burst int
+	Per   time.Duration
+}
+
+// refillPerSecond is the number of tokens added to the bucket every second
+func (rate Rate) refillPerSecond() float64 {
+	return float64(rate.Burst) / rate.Per.Seconds()
+}
+
+// parseRate parses a rate like "5/1m", falling back to def when it is unset or malformed
+func parseRate(s string, def Rate) Rate {
+	burstStr, perStr, found := strings.Cut(s, "/")
+	if !found {
+		return def
+	}
+	burst, err := strconv.Atoi(burstStr)
+	if err != nil || burst <= 0 {
+		return def
+	}
+	per, err := time.ParseDuration(perStr)
+	if err != nil || per <= 0 {
+		return def
+	}
+	return Rate{Burst: burst, Per: per}
+}
+
+// RateLimitStore keeps the token buckets. Take takes one token from the bucket under key and returns
+// whether it was taken and how many tokens are left.
+type RateLimitStore interface {
+	Take(key string, rate Rate) (allowed bool, remaining float64, err error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryStore keeps buckets in the memory of one process, enough for a single replica
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{buckets: make(map[string]*bucket)}
+	go s.cleanup(10 * time.Minute)
+	return s
+}
+
+func (s *memoryStore) Take(key string, rate Rate) (bool, float64, error) {
+	allowed, remaining := s.take(key, rate, time.Now())
+	return allowed, remaining, nil
+}
+
+// take refills the bucket under key for the time passed since its last use and takes one token at now
+func (s *memoryStore) take(key string, rate Rate, now time.Time) (bool, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate.refillPerSecond())
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
+
+// cleanup periodically forgets buckets which were not used for a while
+func (s *memoryStore) cleanup(idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if time.Since(b.updated) > idle {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// postgresStore keeps buckets in Postgres, so the limits are shared by all replicas
+type postgresStore struct {
+	repo data.Repository
+}
+
+func newPostgresStore(repo data.Repository) *postgresStore {
+	s := &postgresStore{repo: repo}
+	go s.cleanup(time.Hour)
+	return s
+}
+
+func (s *postgresStore) Take(key string, rate Rate) (bool, float64, error) {
+	return s.repo.TakeToken(key, rate.Burst, rate.refillPerSecond())
+}
+
+// cleanup periodically deletes buckets which were not used for a while
+func (s *postgresStore) cleanup(idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := s.repo.DeleteIdleBuckets(int(idle.Seconds()))
+		if err != nil {
+			log.Println("failed to delete idle rate limit buckets: ", err)
+		}
+	}
+}
+
+// keyByIP keys the limit by the IP address of the client, for public routes
+func keyByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// keyBySubject keys the limit by the authenticated user, falling back to the IP address
+func keyBySubject(r *http.Request) string {
+	if id, ok := r.Context().Value(userIDKey).(int); ok {
+		return fmt.Sprintf("sub:%d", id)
+	}
+	return keyByIP(r)
+}
+
+// rateLimitMiddleware limits the requests to rate per key, the buckets of different names are independent.
+// Responses carry RateLimit-* headers, rejected requests get 429 with Retry-After.
+func (app *Config) rateLimitMiddleware(name string, rate Rate, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, remaining, err := app.RateLimiter.Take(name+":"+key(r), rate)
+			if err != nil {
+				// an unavailable store must not take the whole service down
+				log.Printf("rate limiter %s failed: %v", name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// seconds until the bucket is full again and until the next token is available
+			reset := math.Ceil((float64(rate.Burst) - remaining) / rate.refillPerSecond())
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(rate.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(remaining)))))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+
+			if !allowed {
+				retryAfter := math.Ceil((1 - remaining) / rate.refillPerSecond())
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, retryAfter))))
+				app.errorJSON(w, errors.New("too many requests"), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	// 5 requests at once, refilled at one token every 2 seconds
+	rate := Rate{Burst: 5, Per: 10 * time.Second}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	type take struct {
+		key           string
+		at            time.Time
+		wantAllowed   bool
+		wantRemaining float64
+	}
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{"burst then refused", []take{
+			{"a", at(0), true, 4},
+			{"a", at(0), true, 3},
+			{"a", at(0), true, 2},
+			{"a", at(0), true, 1},
+			{"a", at(0), true, 0},
+			{"a", at(0), false, 0},
+		}},
+		{"refused take doesn't use up the refill", []take{
+			{"a", at(0), true, 4}, {"a", at(0), true, 3}, {"a", at(0), true, 2}, {"a", at(0), true, 1}, {"a", at(0), true, 0},
+			{"a", at(time.Second), false, 0.5},
+			{"a", at(2 * time.Second), true, 0},
+		}},
+		{"refill is capped at the burst", []take{
+			{"a", at(0), true, 4},
+			{"a", at(time.Hour), true, 4},
+		}},
+		{"keys have their own buckets", []take{
+			{"a", at(0), true, 4}, {"a", at(0), true, 3}, {"a", at(0), true, 2}, {"a", at(0), true, 1}, {"a", at(0), true, 0},
+			{"a", at(0), false, 0},
+			{"b", at(0), true, 4},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &memoryStore{buckets: make(map[string]*bucket)}
+			for i, tk := range tt.takes {
+				allowed, remaining := s.take(tk.key, rate, tk.at)
+				if allowed != tk.wantAllowed || remaining != tk.wantRemaining {
+					t.Fatalf("take %d of %q = %v, %v, want %v, %v", i, tk.key, allowed, remaining, tk.wantAllowed, tk.wantRemaining)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitedRoute(t *testing.T) {
+	t.Setenv("RATE_LIMIT_AUTHENTICATE", "2/1m")
+	app := &Config{Repo: newFakeRepo(), RateLimiter: newMemoryStore()}
+	routes := app.routes()
+
+	login := func(ip string) *httptest.ResponseRecorder {
+		// the body is invalid, a request which gets past the limit is refused by the handler without a lookup
+		req := httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader("{"))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		rec := login("192.0.2.1")
+		if rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d within the limit was refused", i+1)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != wantRemaining {
+			t.Errorf("request %d has RateLimit-Limit %q and RateLimit-Remaining %q, want 2 and %s", i+1,
+				rec.Header().Get("RateLimit-Limit"), rec.Header().Get("RateLimit-Remaining"), wantRemaining)
+		}
+	}
+
+	rec := login("192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit responded with %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// one token comes back every 30 seconds
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("Retry-After = %q, want 30", rec.Header().Get("Retry-After"))
+	}
+
+	if rec := login("192.0.2.2"); rec.Code == http.StatusTooManyRequests {
+		t.Error("another IP address was refused by the limit of the first one")
+	}
+}
+
+func TestRateLimitBySubject(t *testing.T) {
+	app := &Config{RateLimiter: newMemoryStore()}
+	limited := app.rateLimitMiddleware("user", Rate{Burst: 1, Per: time.Minute}, keyBySubject)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(userID int) int {
+		req := httptest.NewRequest(http.MethodGet, "/me/history", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+		rec := httptest.NewRecorder()
+		limited.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// both users come from the same address, each has a bucket of their own
+	if send(1) != http.StatusOK || send(2) != http.StatusOK {
+		t.Fatal("first requests of two users were refused")
+	}
+	if code := send(1); code != http.StatusTooManyRequests {
+		t.Errorf("second request of a user responded with %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"reward-service/data"
+	"slices"
+	"sync"
+	"time"
+)
+
+// fakeRepo is the in-memory repository shared by the handler tests. It embeds data.Repository, so a test
+// reaching a method which is not faked here panics instead of silently passing.
+type fakeRepo struct {
+	data.Repository
+
+	mu      sync.Mutex
+	users   map[int]*data.User
+	deleted []int // users deleted by DeleteByID
+
+	idempotency       map[string]*data.IdempotencyRecord // by "user|key"
+	idempotencyLeases map[string]time.Time
+
+	loginFailures map[string]int
+	lockedUntil   map[string]time.Time
+
+	promoErrs map[string]error // what RedeemPromoCode fails with by code, other codes are redeemed
+
+	resets        map[string]fakeReset // outstanding password resets by the stored token hash
+	tokenVersions map[int]int
+
+	completions map[int]*data.TaskCompletion
+	retries     map[int]time.Time
+	resolved    chan *data.TaskCompletion
+
+	identities map[string]int // user ids by "provider|subject"
+	linked     []int          // users an identity was linked to by LinkIdentity
+
+	events      []*data.DomainEvent // the outbox, every claim returns all unpublished events
+	published   map[int64]bool
+	publishedTo map[int64][]string
+
+	standings       map[int]data.Standing
+	standingQueries [][]int // the ids of every GetStandings call, sorted
+
+	tasks       map[string]*data.Task
+	taskLookups []string // the codes of every GetTask call
+
+	webhookEvents      map[string]*data.WebhookEvent // by "source|event id"
+	webhookErr         error                         // what CompleteWebhookTask fails with
+	webhookCompletions int
+	deliveryOutcomes   []fakeDeliveryOutcome // every FinishDelivery call
+
+	reviews map[int]*data.Review
+
+	apiKeys    map[string]*data.APIKey // by prefix
+	touchedKey []int                   // the ids of every TouchAPIKey call
+
+	userQueries [][]int // the ids of every GetUsersByIDs call, sorted
+	admins      map[int]bool
+	topQueries  int
+}
+
+type fakeDeliveryOutcome struct {
+	id          int64
+	statusCode  int
+	err         string
+	nextAttempt time.Time
+}
+
+type fakeReset struct {
+	userID  int
+	expires time.Time
+}
+
+// newFakeRepo returns a repository with the users stored by id
+func newFakeRepo(users ...*data.User) *fakeRepo {
+	r := &fakeRepo{
+		users:             make(map[int]*data.User),
+		idempotency:       make(map[string]*data.IdempotencyRecord),
+		idempotencyLeases: make(map[string]time.Time),
+		loginFailures:     make(map[string]int),
+		lockedUntil:       make(map[string]time.Time),
+		promoErrs:         make(map[string]error),
+		resets:            make(map[string]fakeReset),
+		tokenVersions:     make(map[int]int),
+		completions:       make(map[int]*data.TaskCompletion),
+		retries:           make(map[int]time.Time),
+		resolved:          make(chan *data.TaskCompletion, 1),
+		identities:        make(map[string]int),
+		published:         make(map[int64]bool),
+		publishedTo:       make(map[int64][]string),
+		tasks:             make(map[string]*data.Task),
+		webhookEvents:     make(map[string]*data.WebhookEvent),
+		reviews:           make(map[int]*data.Review),
+		apiKeys:           make(map[string]*data.APIKey),
+		admins:            make(map[int]bool),
+	}
+	for _, u := range users {
+		r.users[u.ID] = u
+	}
+	return r
+}
+
+func (r *fakeRepo) GetOne(id int) (*data.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return nil, data.ErrUserNotFound
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (r *fakeRepo) EmailCheck(email string) (*data.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Email == email {
+			copied := *u
+			return &copied, nil
+		}
+	}
+	return nil, data.ErrUserNotFound
+}
+
+// PasswordMatches compares the plain text with the stored password as is, the fake users are stored unhashed
+func (r *fakeRepo) PasswordMatches(plainText string, user data.User) (bool, error) {
+	return plainText == user.Password, nil
+}
+
+func (r *fakeRepo) DeleteByID(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.users, id)
+	r.deleted = append(r.deleted, id)
+	return nil
+}
+
+// ReserveIdempotencyKey reserves the key for the lease, a key without a response is taken over after its lease
+func (r *fakeRepo) ReserveIdempotencyKey(userID int, key, fingerprint string, ttl, lease time.Duration) (*data.IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := fmt.Sprintf("%d|%s", userID, key)
+	if stored, ok := r.idempotency[id]; ok && (stored.StatusCode != 0 || time.Now().Before(r.idempotencyLeases[id])) {
+		copied := *stored
+		return &copied, nil
+	}
+	r.idempotency[id] = &data.IdempotencyRecord{UserID: userID, Key: key, Fingerprint: fingerprint}
+	r.idempotencyLeases[id] = time.Now().Add(lease)
+	return nil, nil
+}
+
+func (r *fakeRepo) SaveIdempotencyResponse(userID int, key string, statusCode int, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := r.idempotency[fmt.Sprintf("%d|%s", userID, key)]
+	stored.StatusCode = statusCode
+	stored.ResponseBody = body
+	return nil
+}
+
+func (r *fakeRepo) ReleaseIdempotencyKey(userID int, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.idempotency, fmt.Sprintf("%d|%s", userID, key))
+	return nil
+}
+
+func (r *fakeRepo) GetLoginLock(keys ...string) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var latest time.Time
+	for _, key := range keys {
+		if until := r.lockedUntil[key]; until.After(time.Now()) && until.After(latest) {
+			latest = until
+		}
+	}
+	return latest, nil
+}
+
+// RecordLoginFailure locks the key for the base duration of the policy once the threshold is reached
+func (r *fakeRepo) RecordLoginFailure(key string, policy data.LockoutPolicy) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loginFailures[key]++
+	if r.loginFailures[key] < policy.Threshold {
+		return time.Time{}, nil
+	}
+	r.lockedUntil[key] = time.Now().Add(policy.Base)
+	return r.lockedUntil[key], nil
+}
+
+func (r *fakeRepo) ResetLoginFailures(keys ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.loginFailures, key)
+		delete(r.lockedUntil, key)
+	}
+	return nil
+}
+
+func (r *fakeRepo) RedeemPromoCode(userID int, code string) (*data.PromoCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.promoErrs[data.NormalizePromoCode(code)]; err != nil {
+		return nil, err
+	}
+	return &data.PromoCode{ID: 1, Reward: 50, Uses: 1}, nil
+}
+
+func (r *fakeRepo) GetEmailByID(id int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return "", data.ErrUserNotFound
+	}
+	return u.Email, nil
+}
+
+func (r *fakeRepo) CreatePasswordReset(userID int, tokenHash string, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resets[tokenHash] = fakeReset{userID: userID, expires: expires}
+	return nil
+}
+
+// ResetPassword uses up every outstanding reset of the token's user and bumps the token version
+func (r *fakeRepo) ResetPassword(tokenHash, password string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reset, ok := r.resets[tokenHash]
+	if !ok || time.Now().After(reset.expires) {
+		return 0, data.ErrInvalidPasswordReset
+	}
+	for hash, other := range r.resets {
+		if other.userID == reset.userID {
+			delete(r.resets, hash)
+		}
+	}
+	r.users[reset.userID].Password = password
+	r.tokenVersions[reset.userID]++
+	return reset.userID, nil
+}
+
+func (r *fakeRepo) GetTokenVersion(userID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokenVersions[userID], nil
+}
+
+// TOTPEnabled reports two-factor authentication as off, the fake users log in with the password alone
+func (r *fakeRepo) TOTPEnabled(userID int) (bool, error) {
+	return false, nil
+}
+
+func (r *fakeRepo) GetCompletion(id int) (*data.TaskCompletion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.completions[id]
+	if !ok {
+		return nil, data.ErrCompletionNotFound
+	}
+	copied := *c
+	return &copied, nil
+}
+
+// ResolveCompletion resolves the completion and sends a copy of it to resolved
+func (r *fakeRepo) ResolveCompletion(id int, approved bool, reason string) (*data.TaskCompletion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.completions[id]
+	if !ok {
+		return nil, data.ErrCompletionNotFound
+	}
+	if c.Status != data.CompletionPending {
+		return nil, data.ErrCompletionNotPending
+	}
+	c.Status = data.CompletionRejected
+	if approved {
+		c.Status = data.CompletionApproved
+	}
+	c.Reason = reason
+	copied := *c
+	r.resolved <- &copied
+	return &copied, nil
+}
+
+// FinishVerificationRequest remembers the next attempt of the completion in retries
+func (r *fakeRepo) FinishVerificationRequest(id int, nextAttempt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retries[id] = nextAttempt
+	return nil
+}
+
+// user returns the user with the email, nil if there is none
+func (r *fakeRepo) user(email string) *data.User {
+	u, _ := r.EmailCheck(email)
+	return u
+}
+
+func (r *fakeRepo) GetUserByIdentity(provider, subject string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	userID, ok := r.identities[provider+"|"+subject]
+	if !ok {
+		return 0, data.ErrIdentityNotFound
+	}
+	return userID, nil
+}
+
+func (r *fakeRepo) LinkIdentity(userID int, provider, subject, email string, emailVerified bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.identities[provider+"|"+subject] = userID
+	r.linked = append(r.linked, userID)
+	if emailVerified {
+		r.users[userID].Active = 1
+	}
+	return nil
+}
+
+func (r *fakeRepo) InsertWithIdentity(user data.User, provider, subject string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user.ID = len(r.users) + 1
+	r.users[user.ID] = &user
+	r.identities[provider+"|"+subject] = user.ID
+	return user.ID, nil
+}
+
+func (r *fakeRepo) CreateEmailVerification(userID int, nonce string, expires time.Time) error {
+	return nil
+}
+
+func (r *fakeRepo) ClaimOutboxEvents(limit int, lease time.Duration) ([]*data.DomainEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var claimed []*data.DomainEvent
+	for _, e := range r.events {
+		if r.published[e.Sequence] || len(claimed) == limit {
+			continue
+		}
+		copied := *e
+		copied.PublishedTo = slices.Clone(r.publishedTo[e.Sequence])
+		claimed = append(claimed, &copied)
+	}
+	return claimed, nil
+}
+
+func (r *fakeRepo) MarkEventsPublished(sequences []int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range sequences {
+		r.published[s] = true
+	}
+	return nil
+}
+
+func (r *fakeRepo) MarkEventsPublishedTo(sink string, sequences []int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range sequences {
+		r.publishedTo[s] = append(r.publishedTo[s], sink)
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetStandings(ids []int) (map[int]data.Standing, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.standingQueries = append(r.standingQueries, sorted(ids))
+	standings := make(map[int]data.Standing)
+	for _, id := range ids {
+		if s, ok := r.standings[id]; ok {
+			standings[id] = s
+		}
+	}
+	return standings, nil
+}
+
+// sorted returns a sorted copy of the ids
+func sorted(ids []int) []int {
+	s := slices.Clone(ids)
+	slices.Sort(s)
+	return s
+}
+
+func (r *fakeRepo) GetTask(code string) (*data.Task, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.taskLookups = append(r.taskLookups, code)
+	task, ok := r.tasks[code]
+	if !ok {
+		return nil, data.ErrTaskNotFound
+	}
+	copied := *task
+	return &copied, nil
+}
+
+func (r *fakeRepo) GetUsersByIDs(ids []int) ([]*data.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.userQueries = append(r.userQueries, sorted(ids))
+	var users []*data.User
+	for _, id := range ids {
+		if u, ok := r.users[id]; ok {
+			copied := *u
+			users = append(users, &copied)
+		}
+	}
+	return users, nil
+}
+
+func (r *fakeRepo) IsAdmin(id int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.admins[id], nil
+}
+
+// GetTopUsers returns the users with standings by rank, every board and window is the same
+func (r *fakeRepo) GetTopUsers(board, window string, limit int) ([]*data.LeaderboardEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topQueries++
+	var entries []*data.LeaderboardEntry
+	for id, s := range r.standings {
+		entries = append(entries, &data.LeaderboardEntry{Rank: s.Rank, UserID: id, Points: s.Score})
+	}
+	slices.SortFunc(entries, func(a, b *data.LeaderboardEntry) int { return a.Rank - b.Rank })
+	return entries[:min(limit, len(entries))], nil
+}
+
+// ReserveWebhookEvent returns the stored event when the event was received before, leases are not modelled
+func (r *fakeRepo) ReserveWebhookEvent(ev data.WebhookEvent, lease time.Duration) (*data.WebhookEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stored, ok := r.webhookEvents[ev.Source+"|"+ev.EventID]; ok {
+		copied := *stored
+		return &copied, nil
+	}
+	ev.Status = data.WebhookProcessing
+	r.webhookEvents[ev.Source+"|"+ev.EventID] = &ev
+	return nil, nil
+}
+
+func (r *fakeRepo) CompleteWebhookTask(ev data.WebhookEvent, task data.Task, proof data.Proof) (*data.TaskCompletion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.webhookErr != nil {
+		return nil, r.webhookErr
+	}
+	r.webhookCompletions++
+	r.webhookEvents[ev.Source+"|"+ev.EventID].Status = data.WebhookProcessed
+	return &data.TaskCompletion{ID: r.webhookCompletions, UserID: ev.UserID, TaskCode: task.Code, Points: task.Points}, nil
+}
+
+func (r *fakeRepo) FinishWebhookEvent(source, eventID, status, detail string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ev := r.webhookEvents[source+"|"+eventID]
+	ev.Status, ev.Detail = status, detail
+	return nil
+}
+
+func (r *fakeRepo) ReleaseWebhookEvent(source, eventID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.webhookEvents, source+"|"+eventID)
+	return nil
+}
+
+func (r *fakeRepo) FinishDelivery(id int64, statusCode int, deliveryErr string, nextAttempt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveryOutcomes = append(r.deliveryOutcomes, fakeDeliveryOutcome{id, statusCode, deliveryErr, nextAttempt})
+	return nil
+}
+
+func (r *fakeRepo) GetAPIKeyByPrefix(prefix string) (*data.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.apiKeys[prefix]
+	if !ok {
+		return nil, data.ErrAPIKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (r *fakeRepo) TouchAPIKey(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.touchedKey = append(r.touchedKey, id)
+	return nil
+}
+
+// ResolveReview resolves a pending review like the repository does, without crediting points
+func (r *fakeRepo) ResolveReview(id, reviewerID int, approved bool, reason string) (*data.Review, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	review, ok := r.reviews[id]
+	if !ok {
+		return nil, data.ErrReviewNotFound
+	}
+	if review.Status != data.CompletionPending {
+		return nil, data.ErrCompletionNotPending
+	}
+	review.Status, review.ReviewerID = data.CompletionRejected, reviewerID
+	review.Reason = reason
+	if approved {
+		review.Status = data.CompletionApproved
+	}
+	copied := *review
+	return &copied, nil
+}
+
+// fakeMailer keeps the sent emails instead of sending them
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+type sentMail struct {
+	to, subject, body string
+}
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
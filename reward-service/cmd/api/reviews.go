@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reward-service/data"
+	"strconv"
+)
+
+// listReviews lists the review queue, pending reviews by default, "status" query parameter selects other statuses
+func (app *Config) listReviews(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = data.CompletionPending
+	case "all":
+		status = ""
+	case data.CompletionPending, data.CompletionApproved, data.CompletionRejected:
+	default:
+		app.errorJSON(w, errors.New("unknown review status"), http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	reviews, err := app.Repo.GetReviews(status, limit)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch reviews"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d reviews", len(reviews)),
+		Data:    reviews,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getUserReviews lists the reviews of the authenticated user's completions together with rejection reasons
+func (app *Config) getUserReviews(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	reviews, err := app.Repo.GetUserReviews(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch reviews"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched reviews"),
+		Data:    reviews,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// approveReview approves the reviewed completion and credits the task points
+func (app *Config) approveReview(w http.ResponseWriter, r *http.Request) {
+	app.resolveReview(w, r, true, "")
+}
+
+// rejectReview rejects the reviewed completion with a reason which is shown to the user
+func (app *Config) rejectReview(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if requestPayload.Reason == "" || len(requestPayload.Reason) > 255 {
+		app.errorJSON(w, errors.New("reason is required and must be at most 255 characters long"), http.StatusBadRequest)
+		return
+	}
+	app.resolveReview(w, r, false, requestPayload.Reason)
+}
+
+// resolveReview resolves the review with id from the URL on behalf of the authenticated admin
+func (app *Config) resolveReview(w http.ResponseWriter, r *http.Request, approved bool, reason string) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	reviewerID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+
+	review, err := app.Repo.ResolveReview(id, reviewerID, approved, reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrReviewNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrCompletionNotPending):
+			app.errorJSON(w, errors.New("review is already resolved"), http.StatusConflict)
+		default:
+			app.errorJSON(w, errors.New("couldn't resolve review"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Review %d is %s", review.ID, review.Status),
+		Data:    review,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
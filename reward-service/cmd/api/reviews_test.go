@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestResolveReviewRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		status     string // the status of review 4 before the request
+		wantStatus int
+		wantReview string // the status of review 4 after the request
+	}{
+		{"approve", "/reviews/4/approve", "", data.CompletionPending, http.StatusAccepted, data.CompletionApproved},
+		{"reject", "/reviews/4/reject", `{"reason":"the post is not about us"}`, data.CompletionPending, http.StatusAccepted, data.CompletionRejected},
+		{"reject without a reason", "/reviews/4/reject", `{"reason":""}`, data.CompletionPending, http.StatusBadRequest, data.CompletionPending},
+		{"reject with a long reason", "/reviews/4/reject", `{"reason":"` + strings.Repeat("x", 256) + `"}`, data.CompletionPending, http.StatusBadRequest, data.CompletionPending},
+		{"approve a rejected review", "/reviews/4/approve", "", data.CompletionRejected, http.StatusConflict, data.CompletionRejected},
+		{"reject an approved review", "/reviews/4/reject", `{"reason":"changed my mind"}`, data.CompletionApproved, http.StatusConflict, data.CompletionApproved},
+		{"unknown review", "/reviews/5/approve", "", data.CompletionPending, http.StatusNotFound, data.CompletionPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepo()
+			repo.reviews[4] = &data.Review{ID: 4, CompletionID: 9, UserID: 7, TaskCode: "postAboutUs", Status: tt.status}
+			app := &Config{Repo: repo}
+			mux := chi.NewRouter()
+			mux.Post("/reviews/{id}/approve", app.approveReview)
+			mux.Post("/reviews/{id}/reject", app.rejectReview)
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), userIDKey, 1))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s responded with %d, want %d: %s", tt.target, rec.Code, tt.wantStatus, rec.Body)
+			}
+			review := repo.reviews[4]
+			if review.Status != tt.wantReview {
+				t.Errorf("review is %s, want %s", review.Status, tt.wantReview)
+			}
+			if tt.wantReview != tt.status && review.ReviewerID != 1 {
+				t.Errorf("review was resolved by %d, want the admin 1", review.ReviewerID)
+			}
+		})
+	}
+}
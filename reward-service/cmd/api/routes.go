@@ -3,6 +3,8 @@ package main
 import (
 	"net/http"
 	"os"
+	"reward-service/data"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -15,8 +17,8 @@ func (app *Config) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key", "X-API-Key"},
+		ExposedHeaders:   []string{"Link", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -24,19 +26,90 @@ func (app *Config) routes() http.Handler {
 
 	mux.Group(func(r chi.Router) {
 		r.Use(app.authTokenMiddleware(os.Getenv("SECRET_KEY"))) //
+		r.Use(app.rateLimitMiddleware("user", parseRate(os.Getenv("RATE_LIMIT_USER"), Rate{Burst: 120, Per: time.Minute}), keyBySubject))
 
 		r.Get("/users/{id}/status", app.retrieveOne)
+		r.Get("/users/{id}/badges", app.retrieveBadges)
 		r.Get("/users/leaderboard", app.GetLeaderboard)
-		r.Post("/users/{id}/task/telegramSign", app.completeTelegramSign)
-		r.Post("/users/{id}/task/XSign", app.completeXSign)
-		r.Post("/users/{id}/referrer", app.redeemReferrer)
 		r.Post("/users/deleteUser", app.DeleteUser)
-		r.Post("/users/{id}/task/complete", app.someTask)
-		r.Post("/users/{id}/kuarhodron", app.Kuarhodron)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.idempotencyMiddleware)
+
+			r.Post("/users/{id}/task/telegramSign", app.completeTelegramSign)
+			r.Post("/users/{id}/task/XSign", app.completeXSign)
+			r.Post("/users/{id}/referrer", app.redeemReferrer)
+			r.Post("/users/{id}/task/complete", app.someTask)
+			r.Post("/users/{id}/task/postAboutUs", app.completePostAboutUs)
+		})
+
+		r.Get("/me/history", app.getHistory)
+		r.Get("/me/points", app.getPoints)
+		r.Post("/me/transfers", app.createTransfer)
+		r.Get("/me/tier-changes", app.getTierChanges)
+		r.Get("/me/streak", app.getStreak)
+		r.Post("/me/checkin", app.checkIn)
+		r.With(app.idempotencyMiddleware).Post("/me/streak-freezes", app.buyStreakFreeze)
+		r.Get("/me/reviews", app.getUserReviews)
+		r.With(app.idempotencyMiddleware).Post("/me/promo-codes/redeem", app.redeemPromoCode)
+		r.Post("/me/password", app.changePassword)
+		r.Post("/me/2fa/enroll", app.enrollTwoFactor)
+		r.Post("/me/2fa/confirm", app.confirmTwoFactor)
+		r.Post("/me/2fa/disable", app.disableTwoFactor)
+		r.Get("/me/identities", app.getIdentities)
+		r.Post("/me/identities/{provider}", app.linkOIDCIdentity)
+		r.Get("/me/events", app.streamEvents)
+		r.Get("/ws/leaderboard", app.leaderboardSocket)
+		r.Post("/graphql", app.serveGraphQL)
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(app.adminMiddleware)
+
+			r.Post("/promo-codes", app.createPromoCode)
+			r.Get("/reviews", app.listReviews)
+			r.Post("/reviews/{id}/approve", app.approveReview)
+			r.Post("/reviews/{id}/reject", app.rejectReview)
+			r.Get("/fraud-events", app.listFraudEvents)
+			r.Post("/users/{id}/unlock", app.adminUnlockUser)
+			r.Post("/api-keys", app.createAPIKey)
+			r.Get("/api-keys", app.listAPIKeys)
+			r.Post("/api-keys/{id}/revoke", app.revokeAPIKey)
+			r.Post("/webhooks", app.createWebhookSubscription)
+			r.Get("/webhooks", app.listWebhookSubscriptions)
+			r.Post("/webhooks/{id}/deactivate", app.deactivateWebhookSubscription)
+			r.Get("/webhook-deliveries/dead", app.listDeadDeliveries)
+			r.Post("/webhook-deliveries/{id}/replay", app.replayDelivery)
+		})
 	})
 
-	mux.Post("/authenticate", app.Authenticate)
-	mux.Post("/registrate", app.Registrate)
+	mux.Route("/partner", func(r chi.Router) {
+		partnerRate := parseRate(os.Getenv("RATE_LIMIT_PARTNER"), Rate{Burst: 600, Per: time.Minute})
+
+		r.With(app.apiKeyMiddleware(data.ScopePointsWrite, partnerRate)).Post("/points", app.partnerAwardPoints)
+		r.With(app.apiKeyMiddleware(data.ScopePointsRead, partnerRate)).Get("/users/{id}/points", app.partnerGetPoints)
+	})
+
+	mux.Post("/webhooks/{source}", app.receiveWebhook)
+
+	mux.Post("/internal/verifications/{id}", app.resolveVerification)
+
+	mux.With(app.rateLimitMiddleware("authenticate", parseRate(os.Getenv("RATE_LIMIT_AUTHENTICATE"), Rate{Burst: 5, Per: time.Minute}), keyByIP)).
+		Post("/authenticate", app.Authenticate)
+	mux.With(app.rateLimitMiddleware("2fa", parseRate(os.Getenv("RATE_LIMIT_AUTHENTICATE"), Rate{Burst: 5, Per: time.Minute}), keyByIP)).
+		Post("/auth/2fa", app.completeTwoFactor)
+	mux.With(app.rateLimitMiddleware("oidc", parseRate(os.Getenv("RATE_LIMIT_AUTHENTICATE"), Rate{Burst: 5, Per: time.Minute}), keyByIP)).
+		Get("/auth/oidc/{provider}/login", app.oidcLogin)
+	mux.Get("/auth/oidc/{provider}/callback", app.oidcCallback)
+	mux.With(app.rateLimitMiddleware("registrate", parseRate(os.Getenv("RATE_LIMIT_REGISTRATE"), Rate{Burst: 3, Per: time.Minute}), keyByIP)).
+		Post("/registrate", app.Registrate)
+	mux.Get("/auth/unlock", app.unlockAccount)
+	mux.Get("/auth/verify-email", app.verifyEmail)
+	mux.With(app.rateLimitMiddleware("resend-verification", parseRate(os.Getenv("RATE_LIMIT_REGISTRATE"), Rate{Burst: 3, Per: time.Minute}), keyByIP)).
+		Post("/auth/resend-verification", app.resendVerification)
+	mux.With(app.rateLimitMiddleware("forgot-password", parseRate(os.Getenv("RATE_LIMIT_REGISTRATE"), Rate{Burst: 3, Per: time.Minute}), keyByIP)).
+		Post("/auth/password/forgot", app.forgotPassword)
+	mux.With(app.rateLimitMiddleware("reset-password", parseRate(os.Getenv("RATE_LIMIT_AUTHENTICATE"), Rate{Burst: 5, Per: time.Minute}), keyByIP)).
+		Post("/auth/password/reset", app.resetPassword)
 
 	return mux
 }
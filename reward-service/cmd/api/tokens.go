@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformedToken = errors.New("malformed token")
+	errInvalidToken   = errors.New("invalid token")
+	errExpiredToken   = errors.New("token has expired")
+)
+
+// signToken issues a token for links sent to users. The token carries the payload and the expiry time and is signed
+// with the secret key together with the purpose, so a token issued for one purpose is not accepted for another.
+func (app *Config) signToken(purpose, payload string, expires time.Time) string {
+	body := fmt.Sprintf("%s|%d", payload, expires.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(body)) + "." + app.tokenSignature(purpose, body)
+}
+
+// verifyToken checks a token issued by signToken for the purpose and returns its payload
+func (app *Config) verifyToken(purpose, token string) (string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", errMalformedToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errMalformedToken
+	}
+	if !hmac.Equal([]byte(signature), []byte(app.tokenSignature(purpose, string(body)))) {
+		return "", errInvalidToken
+	}
+
+	i := strings.LastIndex(string(body), "|")
+	if i < 0 {
+		return "", errMalformedToken
+	}
+	expires, err := strconv.ParseInt(string(body[i+1:]), 10, 64)
+	if err != nil {
+		return "", errMalformedToken
+	}
+	if time.Now().Unix() > expires {
+		return "", errExpiredToken
+	}
+	return string(body[:i]), nil
+}
+
+func (app *Config) tokenSignature(purpose, body string) string {
+	mac := hmac.New(sha256.New, []byte(app.SecretKey))
+	mac.Write([]byte(purpose + "|" + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomNonce returns a random hex string, used to make signed tokens single-use
+func randomNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
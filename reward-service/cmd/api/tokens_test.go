@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	app := &Config{SecretKey: "test-secret"}
+	valid := app.signToken("verify-email", "7|nonce", time.Now().Add(time.Hour))
+
+	if payload, err := app.verifyToken("verify-email", valid); err != nil || payload != "7|nonce" {
+		t.Fatalf("verifyToken() = %q, %v, want %q", payload, err, "7|nonce")
+	}
+
+	encoded, signature, _ := strings.Cut(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte("8|nonce|99999999999"))
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		wantErr error
+	}{
+		{"other purpose", "unlock", valid, errInvalidToken},
+		{"signed with another key", "verify-email",
+			(&Config{SecretKey: "other-secret"}).signToken("verify-email", "7|nonce", time.Now().Add(time.Hour)), errInvalidToken},
+		{"changed payload", "verify-email", forged + "." + signature, errInvalidToken},
+		{"changed signature", "verify-email", encoded + "." + strings.Repeat("0", len(signature)), errInvalidToken},
+		{"no signature", "verify-email", encoded, errMalformedToken},
+		{"not base64", "verify-email", "!!!." + signature, errMalformedToken},
+		{"empty", "verify-email", "", errMalformedToken},
+		{"expired", "verify-email", app.signToken("verify-email", "7|nonce", time.Now().Add(-time.Second)), errExpiredToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := app.verifyToken(tt.purpose, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("verifyToken() = %q, %v, want %v", payload, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenWithoutExpiry(t *testing.T) {
+	app := &Config{SecretKey: "test-secret"}
+	// correctly signed, but the body has no expiry after the payload
+	body := "7"
+	token := base64.RawURLEncoding.EncodeToString([]byte(body)) + "." + app.tokenSignature("verify-email", body)
+
+	_, err := app.verifyToken("verify-email", token)
+	if !errors.Is(err, errMalformedToken) {
+		t.Errorf("verifyToken() error = %v, want %v", err, errMalformedToken)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod         = 30
+	totpDigits         = 6
+	recoveryCodesCount = 10
+	challengeTTL       = 5 * time.Minute
+)
+
+var errInvalidTOTPCode = errors.New("invalid two-factor authentication code")
+
+// totpCode computes the RFC 6238 code of the base32 secret for the time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("malformed totp secret: %w", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// otpauthURI returns the key URI authenticator apps read from the QR code, labelled "<issuer>:<account>"
+func otpauthURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// matchTOTP checks the code against the current time step and one step on either side for clock drift.
+// Steps up to lastUsedStep are skipped, so a code can't be used twice. Returns the matching step.
+func matchTOTP(secret, code string, lastUsedStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(code), []byte(expected)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns new recovery codes like "abcd-efgh-ijkl-mnop" and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	hashes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, fmt.Sprintf("%s-%s-%s-%s", raw[0:4], raw[4:8], raw[8:12], raw[12:16]))
+		hashes = append(hashes, hashRecoveryCode(raw))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash under which a recovery code is stored, dashes and case don't matter
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor checks a TOTP code or, when it is given, a recovery code of the user
+func (app *Config) checkSecondFactor(userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		remaining, err := app.Repo.UseRecoveryCode(userID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		log.Printf("User %d used a recovery code, %d left", userID, remaining)
+		return nil
+	}
+
+	totp, err := app.Repo.GetTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled {
+		return data.ErrTwoFactorNotEnabled
+	}
+	step, ok := matchTOTP(totp.Secret, code, totp.LastUsedStep)
+	if !ok {
+		return errInvalidTOTPCode
+	}
+	return app.Repo.UseTOTPStep(userID, step)
+}
+
+// writeTwoFactorChallenge answers a login with a correct password of a user with two-factor authentication.
+// The challenge token has to be exchanged together with a code for the access token. It carries the current
+// session version of the user, so a password change or reset revokes the challenges issued before it.
+func (app *Config) writeTwoFactorChallenge(w http.ResponseWriter, userID int) {
+	tokenVersion, err := app.Repo.GetTokenVersion(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	token := app.signToken("2fa", fmt.Sprintf("%d|%d", userID, tokenVersion), time.Now().Add(challengeTTL))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("2FA required"),
+		Data: map[string]any{
+			"two_factor_required": true,
+			"challenge_token":     token,
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// completeTwoFactor exchanges the challenge token and a TOTP or recovery code for the access token
+func (app *Config) completeTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	subject, err := app.verifyToken("2fa", requestPayload.ChallengeToken)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	idPart, versionPart, _ := strings.Cut(subject, "|")
+	userID, err := strconv.Atoi(idPart)
+	if err != nil {
+		app.errorJSON(w, errMalformedToken, http.StatusUnauthorized)
+		return
+	}
+	tokenVersion, err := strconv.Atoi(versionPart)
+	if err != nil {
+		app.errorJSON(w, errMalformedToken, http.StatusUnauthorized)
+		return
+	}
+	currentVersion, err := app.Repo.GetTokenVersion(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	if tokenVersion != currentVersion {
+		app.errorJSON(w, errors.New("challenge was revoked, log in again"), http.StatusUnauthorized)
+		return
+	}
+	email, err := app.Repo.GetEmailByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+
+	// wrong codes count as failed logins, so codes can't be guessed faster than passwords
+	ip := clientIP(r)
+	emailKey, ipKey := loginKeys(email, ip)
+	lockedUntil, err := app.Repo.GetLoginLock(emailKey, ipKey)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		app.writeLocked(w, lockedUntil)
+		return
+	}
+
+	err = app.checkSecondFactor(userID, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidTOTPCode), errors.Is(err, data.ErrTOTPCodeUsed), errors.Is(err, data.ErrInvalidRecoveryCode):
+			app.recordLoginFailure(email, ip, true)
+			app.errorJSON(w, err, http.StatusUnauthorized)
+		default:
+			app.errorJSON(w, errors.New("couldn't authenticate"), http.StatusInternalServerError)
+		}
+		return
+	}
+	app.Repo.ResetLoginFailures(emailKey)
+
+	err = app.issueAccessToken(w, userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Welcome back!"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// enrollTwoFactor generates a new TOTP secret for the current user and returns it as an otpauth URI
+// for authenticator apps. Two-factor authentication is enabled once a code is confirmed.
+func (app *Config) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	email, err := app.Repo.GetEmailByID(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch user"), http.StatusInternalServerError)
+		return
+	}
+
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't generate secret"), http.StatusInternalServerError)
+		return
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+
+	err = app.Repo.StartTOTPEnrollment(userID, secret)
+	if err != nil {
+		if errors.Is(err, data.ErrTwoFactorEnabled) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't start enrolment"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Add the key to an authenticator app and confirm it with a code"),
+		Data: map[string]string{
+			"secret":      secret,
+			"otpauth_uri": otpauthURI(app.TOTPIssuer, email, secret),
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// confirmTwoFactor enables two-factor authentication once the user proves the authenticator app works.
+// The recovery codes are returned only here.
+func (app *Config) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	totp, err := app.Repo.GetTOTP(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrTOTPNotEnrolled) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't fetch secret"), http.StatusInternalServerError)
+		return
+	}
+	if totp.Enabled {
+		app.errorJSON(w, data.ErrTwoFactorEnabled, http.StatusConflict)
+		return
+	}
+	step, ok := matchTOTP(totp.Secret, requestPayload.Code, totp.LastUsedStep)
+	if !ok {
+		app.errorJSON(w, errInvalidTOTPCode, http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't generate recovery codes"), http.StatusInternalServerError)
+		return
+	}
+	err = app.Repo.ConfirmTOTP(userID, step, hashes)
+	if err != nil {
+		if errors.Is(err, data.ErrTwoFactorEnabled) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't enable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Two-factor authentication enabled, keep the recovery codes in a safe place"),
+		Data:    map[string][]string{"recovery_codes": codes},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// disableTwoFactor turns two-factor authentication off, the user has to give a TOTP or recovery code
+func (app *Config) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.checkSecondFactor(userID, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidTOTPCode), errors.Is(err, data.ErrTOTPCodeUsed), errors.Is(err, data.ErrInvalidRecoveryCode),
+			errors.Is(err, data.ErrTwoFactorNotEnabled), errors.Is(err, data.ErrTOTPNotEnrolled):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		default:
+			app.errorJSON(w, errors.New("couldn't check the code"), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.Repo.DisableTOTP(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't disable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Two-factor authentication disabled"),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
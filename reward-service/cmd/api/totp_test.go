@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes, a 6 digit code is their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode() at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	lower, err := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 59/totpPeriod)
+	if err != nil || lower != "287082" {
+		t.Errorf("totpCode() of the lower case secret = %s, %v", lower, err)
+	}
+	_, err = totpCode("not base32!", 1)
+	if err == nil {
+		t.Error("totpCode() of a malformed secret returned no error")
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Now().Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastUsed int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", code(now), 0, now, true},
+		{"previous step", code(now - 1), 0, now - 1, true},
+		{"next step", code(now + 1), 0, now + 1, true},
+		{"too old", code(now - 2), 0, 0, false},
+		{"already used", code(now), now, 0, false},
+		{"surrounding spaces", " " + code(now) + " ", 0, now, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(rfc6238Secret, tt.code, tt.lastUsed)
+			if ok != tt.wantOK || (ok && step != tt.wantStep) {
+				t.Errorf("matchTOTP() = %d, %v, want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri, err := url.Parse(otpauthURI("RewardService", "alice@example.com", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/RewardService:alice@example.com" {
+		t.Errorf("otpauthURI() = %s", uri)
+	}
+	query := uri.Query()
+	if query.Get("issuer") != "RewardService" || query.Get("secret") != rfc6238Secret || query.Get("digits") != "6" {
+		t.Errorf("otpauthURI() query = %v", query)
+	}
+}
+
+func TestTwoFactorChallengeRevoked(t *testing.T) {
+	repo := newFakeRepo()
+	repo.tokenVersions[7] = 3
+	app := &Config{Repo: repo, SecretKey: "test-secret"}
+
+	rec := httptest.NewRecorder()
+	app.writeTwoFactorChallenge(rec, 7)
+	var challenge struct {
+		Data struct {
+			ChallengeToken string `json:"challenge_token"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &challenge)
+	if err != nil || challenge.Data.ChallengeToken == "" {
+		t.Fatalf("challenge %s, %v", rec.Body.String(), err)
+	}
+
+	// a password change bumps the session version of the user
+	repo.tokenVersions[7] = 4
+	tokens := map[string]string{
+		"issued before the password change": challenge.Data.ChallengeToken,
+		"without a version":                 app.signToken("2fa", strconv.Itoa(7), time.Now().Add(challengeTTL)),
+	}
+	for name, token := range tokens {
+		body, _ := json.Marshal(map[string]string{"challenge_token": token, "code": "000000"})
+		rec := httptest.NewRecorder()
+		app.completeTwoFactor(rec, httptest.NewRequest(http.MethodPost, "/auth/2fa", bytes.NewReader(body)))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: completeTwoFactor() answered %d, want %d", name, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reward-service/data"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verificationTolerance is how old the timestamp of a verifier callback may be
+const verificationTolerance = 5 * time.Minute
+
+// Verifier is an external service which verifies the completions of the listed tasks. Its secret is read from the
+// environment variable named by SecretEnv. The secret signs the verification requests sent to the verifier,
+// the callbacks it sends back and the proof tokens it issues, and is never sent itself. Every verifier has
+// its own secret, so one verifier can't vouch for the tasks of another.
+type Verifier struct {
+	Name      string   `json:"name"`
+	SecretEnv string   `json:"secret_env"`
+	Tasks     []string `json:"tasks"`
+
+	secret string
+}
+
+// loadVerifiers reads the verifiers from a JSON file, the result maps the task codes to their verifier
+func loadVerifiers(path string) (map[string]*Verifier, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read verifiers: %w", err)
+	}
+	var list []*Verifier
+	err = json.Unmarshal(content, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verifiers: %w", err)
+	}
+
+	verifiers := make(map[string]*Verifier)
+	for _, v := range list {
+		v.secret = os.Getenv(v.SecretEnv)
+		if v.Name == "" || v.secret == "" {
+			return nil, fmt.Errorf("verifier %q needs a name and a secret in %s", v.Name, v.SecretEnv)
+		}
+		for _, task := range v.Tasks {
+			if other, ok := verifiers[task]; ok {
+				return nil, fmt.Errorf("task %s is listed by verifiers %s and %s", task, other.Name, v.Name)
+			}
+			verifiers[task] = v
+		}
+	}
+	return verifiers, nil
+}
+
+// verifierSecret returns the secret of the verifier of the task, empty when the task has no verifier
+func (app *Config) verifierSecret(task string) string {
+	v, ok := app.Verifiers[task]
+	if !ok {
+		return ""
+	}
+	return v.secret
+}
+
+// verificationRequest is sent to the webhook verifier of a task
+type verificationRequest struct {
+	VerificationID int    `json:"verification_id"`
+	UserID         int    `json:"user_id"`
+	Task           string `json:"task"`
+	Proof          string `json:"proof,omitempty"`
+	CallbackURL    string `json:"callback_url"`
+}
+
+// proofSignature signs the user, the task and the expiry time of a proof token
+func proofSignature(userID int, task string, expires int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d:%s:%d", userID, task, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyProofToken checks a proof token issued by a verifier and returns its expiry time. The token has the form
+// "<expires unix>.<signature>", where the signature is HMAC-SHA256 of "<user id>:<task>:<expires unix>" with the
+// secret of the task's verifier. A valid token is used up by the completion it is submitted with, see data.Proof.
+func verifyProofToken(token string, userID int, task, secret string) (time.Time, error) {
+	if secret == "" {
+		return time.Time{}, errors.New("proof tokens are not accepted")
+	}
+	expiresStr, signature, found := strings.Cut(token, ".")
+	if !found {
+		return time.Time{}, errors.New("malformed proof token")
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("malformed proof token")
+	}
+	if time.Now().Unix() > expires {
+		return time.Time{}, errors.New("proof token has expired")
+	}
+	expected := proofSignature(userID, task, expires, secret)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return time.Time{}, errors.New("invalid proof token")
+	}
+	return time.Unix(expires, 0), nil
+}
+
+// purgeProofTokens periodically deletes the used proof tokens which have expired
+func (app *Config) purgeProofTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.Repo.DeleteExpiredProofTokens()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Deleted %d expired proof tokens", n)
+		}
+	}
+}
+
+// requestVerifications periodically sends the queued verification requests to the webhook verifiers. A failed
+// request is retried with exponential backoff starting at retryBase, after maxAttempts the completion is rejected,
+// so the user can submit the task again. Completions the verifier doesn't answer within timeout are rejected too.
+func (app *Config) requestVerifications(interval, retryBase time.Duration, maxAttempts int, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			verifications, err := app.Repo.ClaimDueVerifications(deliveryBatch, deliveryLease)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+
+			var wg sync.WaitGroup
+			for _, v := range verifications {
+				wg.Add(1)
+				go func(v *data.PendingVerification) {
+					defer wg.Done()
+					app.requestVerification(v, retryBase, maxAttempts)
+				}(v)
+			}
+			wg.Wait()
+
+			if len(verifications) < deliveryBatch {
+				break
+			}
+		}
+
+		n, err := app.Repo.ExpireVerifications(timeout)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Rejected %d verifications not answered in time", n)
+		}
+	}
+}
+
+// requestVerification makes one attempt to send the verification request and stores the outcome
+func (app *Config) requestVerification(v *data.PendingVerification, retryBase time.Duration, maxAttempts int) {
+	err := app.sendVerificationRequest(v)
+	if err == nil {
+		err = app.Repo.FinishVerificationRequest(v.ID, time.Time{})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if v.Attempts >= maxAttempts {
+		log.Printf("verification %d of task %s failed after %d attempts: %v", v.ID, v.TaskCode, v.Attempts, err)
+		_, err = app.Repo.ResolveCompletion(v.ID, false, "verifier is unavailable")
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	backoff := retryBase << (v.Attempts - 1)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	err = app.Repo.FinishVerificationRequest(v.ID, time.Now().Add(backoff))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendVerificationRequest asks the webhook verifier of the task to check the completion, any 2xx status means
+// the verifier accepted the request and answers later through the verification callback. The request is signed
+// like an outbound webhook with the secret of the verifier.
+func (app *Config) sendVerificationRequest(v *data.PendingVerification) error {
+	secret := app.verifierSecret(v.TaskCode)
+	if secret == "" {
+		return fmt.Errorf("no verifier is configured for task %s", v.TaskCode)
+	}
+
+	body, err := json.Marshal(verificationRequest{
+		VerificationID: v.ID,
+		UserID:         v.UserID,
+		Task:           v.TaskCode,
+		Proof:          v.Proof,
+		CallbackURL:    fmt.Sprintf("%s/internal/verifications/%d", app.PublicURL, v.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode verification request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.VerifierURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	resp, err := app.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("verifier responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// resolveVerification receives the decision of a verifier about a pending task completion. The callback must be
+// signed with the secret of the verifier of the completed task.
+func (app *Config) resolveVerification(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Approved bool   `json:"approved"`
+		Reason   string `json:"reason,omitempty"`
+	}
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	stored, err := app.Repo.GetCompletion(id)
+	if err != nil && !errors.Is(err, data.ErrCompletionNotFound) {
+		app.errorJSON(w, errors.New("couldn't fetch verification"), http.StatusInternalServerError)
+		return
+	}
+	// unknown completions are answered like bad signatures, so callers can't probe the ids
+	secret := ""
+	if stored != nil {
+		secret = app.verifierSecret(stored.TaskCode)
+	}
+	if secret == "" || verifySignature(r, body, secret, verificationTolerance) != nil {
+		app.errorJSON(w, errors.New("invalid verifier credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	err = json.Unmarshal(body, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	completion, err := app.Repo.ResolveCompletion(id, requestPayload.Approved, requestPayload.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrCompletionNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrCompletionNotPending), errors.Is(err, data.ErrWrongVerifier):
+			app.errorJSON(w, err, http.StatusConflict)
+		default:
+			app.errorJSON(w, errors.New("couldn't resolve verification"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Verification %d is %s", completion.ID, completion.Status),
+		Data:    completion,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
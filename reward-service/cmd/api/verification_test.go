@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"reward-service/internal/fakeverifier"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyProofToken(t *testing.T) {
+	const secret = "verifier-secret"
+	expires := time.Now().Add(time.Hour).Unix()
+	signature := proofSignature(7, "telegramSign", expires, secret)
+	valid := fmt.Sprintf("%d.%s", expires, signature)
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := fmt.Sprintf("%d.%s", past, proofSignature(7, "telegramSign", past, secret))
+
+	tests := []struct {
+		name    string
+		token   string
+		userID  int
+		task    string
+		secret  string
+		wantErr bool
+	}{
+		{"valid", valid, 7, "telegramSign", secret, false},
+		{"expired", expired, 7, "telegramSign", secret, true},
+		{"other user", valid, 8, "telegramSign", secret, true},
+		{"other task", valid, 7, "XSign", secret, true},
+		{"secret of another verifier", valid, 7, "telegramSign", "other-secret", true},
+		{"task without verifier", valid, 7, "telegramSign", "", true},
+		{"extended expiry", fmt.Sprintf("%d.%s", expires+3600, signature), 7, "telegramSign", secret, true},
+		{"no signature", strconv.FormatInt(expires, 10), 7, "telegramSign", secret, true},
+		{"malformed expiry", "soon." + signature, 7, "telegramSign", secret, true},
+		{"empty", "", 7, "telegramSign", secret, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyProofToken(tt.token, tt.userID, tt.task, tt.secret)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyProofToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// the expiry is how long the used token has to be remembered
+			if !tt.wantErr && got.Unix() != expires {
+				t.Errorf("verifyProofToken() = %v, want the expiry %v", got, time.Unix(expires, 0))
+			}
+		})
+	}
+}
+
+// newVerificationTest starts the API with one pending completion of telegramSign, id 1, whose verifier has
+// the secret "fake-secret", and a fake verifier which signs with verifierSecret
+func newVerificationTest(t *testing.T, verifierSecret string) (*Config, *fakeRepo, string) {
+	t.Helper()
+	repo := newFakeRepo()
+	repo.completions[1] = &data.TaskCompletion{ID: 1, UserID: 7, TaskCode: "telegramSign", Status: data.CompletionPending}
+	app := &Config{
+		Repo:   repo,
+		Client: &http.Client{Timeout: 5 * time.Second},
+		Verifiers: map[string]*Verifier{
+			"telegramSign": {Name: "fake", Tasks: []string{"telegramSign"}, secret: "fake-secret"},
+		},
+	}
+	api := httptest.NewServer(app.routes())
+	t.Cleanup(api.Close)
+	app.PublicURL = api.URL
+
+	verifier := &fakeverifier.Verifier{Secret: verifierSecret, Client: api.Client()}
+	fake := httptest.NewServer(verifier.Handler())
+	t.Cleanup(fake.Close)
+
+	return app, repo, fake.URL + "/verify"
+}
+
+func TestVerificationCallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		proof      string
+		wantStatus string
+	}{
+		{"approved", "joined", data.CompletionApproved},
+		{"rejected", "reject", data.CompletionRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, repo, verifierURL := newVerificationTest(t, "fake-secret")
+
+			v := &data.PendingVerification{
+				TaskCompletion: data.TaskCompletion{ID: 1, UserID: 7, TaskCode: "telegramSign", Proof: tt.proof},
+				VerifierURL:    verifierURL,
+				Attempts:       1,
+			}
+			app.requestVerification(v, time.Minute, 3)
+
+			repo.mu.Lock()
+			next, ok := repo.retries[1]
+			repo.mu.Unlock()
+			if !ok || !next.IsZero() {
+				t.Fatalf("verification request was not accepted, next attempt %v", next)
+			}
+
+			select {
+			case c := <-repo.resolved:
+				if c.Status != tt.wantStatus {
+					t.Errorf("completion is %s, want %s", c.Status, tt.wantStatus)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("verifier didn't call back")
+			}
+		})
+	}
+}
+
+func TestVerificationRequestRetried(t *testing.T) {
+	app, repo, verifierURL := newVerificationTest(t, "other-secret")
+
+	v := &data.PendingVerification{
+		TaskCompletion: data.TaskCompletion{ID: 1, UserID: 7, TaskCode: "telegramSign"},
+		VerifierURL:    verifierURL,
+		Attempts:       2,
+	}
+	before := time.Now()
+	app.requestVerification(v, time.Minute, 3)
+
+	repo.mu.Lock()
+	next := repo.retries[1]
+	repo.mu.Unlock()
+	if next.Before(before.Add(2*time.Minute)) || next.After(time.Now().Add(2*time.Minute)) {
+		t.Errorf("next attempt at %v, want two minutes from now", next)
+	}
+
+	// the last attempt gives up and rejects the completion, so the user can submit the task again
+	v.Attempts = 3
+	app.requestVerification(v, time.Minute, 3)
+	select {
+	case c := <-repo.resolved:
+		if c.Status != data.CompletionRejected {
+			t.Errorf("completion is %s, want %s", c.Status, data.CompletionRejected)
+		}
+	default:
+		t.Error("completion was not rejected after the last attempt")
+	}
+}
+
+func TestVerificationCallbackSignature(t *testing.T) {
+	app, repo, _ := newVerificationTest(t, "fake-secret")
+	body := []byte(`{"approved":true}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		id        int
+		secret    string
+		timestamp string
+	}{
+		{"secret of another verifier", 1, "other-secret", now},
+		{"stale timestamp", 1, "fake-secret", stale},
+		{"unknown completion", 2, "fake-secret", now},
+		{"unsigned", 1, "", now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/internal/verifications/%d", app.PublicURL, tt.id),
+				bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Webhook-Timestamp", tt.timestamp)
+			if tt.secret != "" {
+				req.Header.Set("X-Webhook-Signature", fakeverifier.Sign(tt.secret, tt.timestamp, body))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("callback answered %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+			}
+		})
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if status := repo.completions[1].Status; status != data.CompletionPending {
+		t.Errorf("completion is %s after forged callbacks", status)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reward-service/data"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	deliveryBatch   = 50
+	deliveryTimeout = 10 * time.Second
+	deliveryLease   = time.Minute
+	maxRetryBackoff = 6 * time.Hour
+)
+
+// signWebhook returns the signature of an outbound delivery, made the same way as for inbound webhooks:
+// HMAC-SHA256 of "<timestamp>.<body>" with the secret of the subscription
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPublisher is the event sink of the webhook subscriptions, it queues a delivery of the event for
+// every subscription interested in it. deliverWebhooks sends the deliveries and retries them on its own.
+type webhookPublisher struct {
+	repo data.Repository
+}
+
+// Publish queues the deliveries of the event
+func (p webhookPublisher) Publish(ctx context.Context, event *data.DomainEvent) error {
+	return p.repo.EnqueueWebhookDeliveries(event)
+}
+
+// deliverWebhooks periodically sends the queued webhook deliveries. A failed delivery is retried with
+// exponential backoff starting at retryBase, after maxAttempts it is moved to the dead letters.
+func (app *Config) deliverWebhooks(interval, retryBase time.Duration, maxAttempts int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			deliveries, err := app.Repo.ClaimDueDeliveries(deliveryBatch, deliveryLease)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+
+			var wg sync.WaitGroup
+			for _, d := range deliveries {
+				wg.Add(1)
+				go func(d *data.WebhookDelivery) {
+					defer wg.Done()
+					app.deliverWebhook(d, retryBase, maxAttempts)
+				}(d)
+			}
+			wg.Wait()
+
+			if len(deliveries) < deliveryBatch {
+				break
+			}
+		}
+	}
+}
+
+// deliverWebhook makes one attempt to send the delivery and stores the outcome
+func (app *Config) deliverWebhook(d *data.WebhookDelivery, retryBase time.Duration, maxAttempts int) {
+	statusCode, err := app.sendWebhook(d)
+	if err == nil {
+		err = app.Repo.FinishDelivery(d.ID, statusCode, "", time.Time{})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var next time.Time
+	if d.Attempts < maxAttempts {
+		next = time.Now().Add(retryBackoff(retryBase, d.Attempts))
+	} else {
+		log.Printf("webhook delivery %d of event %s to %s is dead after %d attempts: %v", d.ID, d.EventID, d.URL, d.Attempts, err)
+	}
+	err = app.Repo.FinishDelivery(d.ID, statusCode, err.Error(), next)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// retryBackoff returns how long to wait after the given failed attempt, counted from 1: retryBase doubled
+// for every attempt before it, at most maxRetryBackoff
+func retryBackoff(retryBase time.Duration, attempts int) time.Duration {
+	if attempts > 32 {
+		return maxRetryBackoff
+	}
+	backoff := retryBase << max(attempts-1, 0)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// sendWebhook posts the signed event to the subscription, any 2xx status is a success
+func (app *Config) sendWebhook(d *data.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", d.EventID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.Secret, timestamp, d.Payload))
+
+	resp, err := app.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// createWebhookSubscription subscribes a URL to events, the secret is returned only in this response
+func (app *Config) createWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"event_types"`
+		Secret     string   `json:"secret,omitempty"`
+	}
+	adminID, err := app.getUserIDFromContext(w, r)
+	if err != nil {
+		return
+	}
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(requestPayload.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		app.errorJSON(w, errors.New("url must be an absolute http or https URL"), http.StatusBadRequest)
+		return
+	}
+	if len(requestPayload.EventTypes) == 0 {
+		app.errorJSON(w, errors.New("at least one event type is required"), http.StatusBadRequest)
+		return
+	}
+
+	secret := requestPayload.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		_, err = rand.Read(b)
+		if err != nil {
+			app.errorJSON(w, errors.New("couldn't generate secret"), http.StatusInternalServerError)
+			return
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	subscription := data.WebhookSubscription{
+		URL:        requestPayload.URL,
+		EventTypes: requestPayload.EventTypes,
+		Secret:     secret,
+		CreatedBy:  adminID,
+	}
+	err = app.Repo.CreateWebhookSubscription(&subscription)
+	if err != nil {
+		if errors.Is(err, data.ErrUnknownEventType) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't create webhook subscription"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created webhook subscription %d, store the secret now, it is not shown again", subscription.ID),
+		Data: map[string]any{
+			"secret":       secret,
+			"subscription": subscription,
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// listWebhookSubscriptions returns all webhook subscriptions without their secrets
+func (app *Config) listWebhookSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := app.Repo.ListWebhookSubscriptions()
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch webhook subscriptions"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d webhook subscriptions", len(subscriptions)),
+		Data:    subscriptions,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// deactivateWebhookSubscription stops queueing events for the subscription with id from the URL,
+// deliveries already queued are still sent
+func (app *Config) deactivateWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	err = app.Repo.DeactivateWebhookSubscription(id)
+	if err != nil {
+		if errors.Is(err, data.ErrSubscriptionNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't deactivate webhook subscription"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Deactivated webhook subscription %d", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// listDeadDeliveries returns the deliveries which ran out of attempts
+func (app *Config) listDeadDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	deliveries, err := app.Repo.GetDeadDeliveries(limit)
+	if err != nil {
+		app.errorJSON(w, errors.New("couldn't fetch dead webhook deliveries"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Fetched %d dead webhook deliveries", len(deliveries)),
+		Data:    deliveries,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// replayDelivery queues the dead delivery with id from the URL again
+func (app *Config) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := app.getIDFromRequest(w, r)
+	if err != nil {
+		return
+	}
+	err = app.Repo.ReplayDelivery(int64(id))
+	if err != nil {
+		if errors.Is(err, data.ErrDeliveryNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, errors.New("couldn't replay webhook delivery"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Webhook delivery %d queued again", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reward-service/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"points.credited"}`)
+	signature := signWebhook("secret", "1760000000", body)
+	if !strings.HasPrefix(signature, "sha256=") || len(signature) != len("sha256=")+64 {
+		t.Fatalf("signWebhook() = %q, want sha256= and 64 hex digits", signature)
+	}
+	if signWebhook("secret", "1760000000", body) != signature {
+		t.Error("signWebhook() is not deterministic")
+	}
+
+	for name, other := range map[string]string{
+		"other secret":    signWebhook("other", "1760000000", body),
+		"other timestamp": signWebhook("secret", "1760000001", body),
+		"other body":      signWebhook("secret", "1760000000", append(body, ' ')),
+		// the dot keeps the timestamp and the body apart
+		"shifted timestamp": signWebhook("secret", "176000000", append([]byte("0"), body...)),
+	} {
+		if other == signature {
+			t.Errorf("signature with %s is the same", name)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, maxRetryBackoff}, // 512 minutes are more than the cap
+		{64, maxRetryBackoff}, // the shift would overflow
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(time.Minute, tt.attempts); got != tt.want {
+			t.Errorf("retryBackoff(1m, %d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		attempts  int
+		wantErr   bool
+		wantRetry time.Duration // 0 when the delivery is finished, delivered or dead
+	}{
+		{"delivered", http.StatusNoContent, 1, false, 0},
+		{"first failure", http.StatusInternalServerError, 1, true, time.Minute},
+		{"third failure", http.StatusBadGateway, 3, true, 4 * time.Minute},
+		{"redirects are failures", http.StatusFound, 2, true, 2 * time.Minute},
+		{"out of attempts", http.StatusInternalServerError, 5, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *http.Request
+			var receivedBody []byte
+			subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				receivedBody, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer subscriber.Close()
+
+			repo := newFakeRepo()
+			app := &Config{Repo: repo, Client: &http.Client{
+				Timeout:       time.Second,
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}}
+			d := &data.WebhookDelivery{ID: 9, URL: subscriber.URL, Secret: "secret", EventID: "evt_1",
+				EventType: "points.credited", Payload: []byte(`{"id":"evt_1"}`), Attempts: tt.attempts}
+
+			start := time.Now()
+			app.deliverWebhook(d, time.Minute, 5)
+
+			// the subscriber checks the delivery like inbound webhooks are checked here
+			if err := verifySignature(received, receivedBody, "secret", time.Minute); err != nil {
+				t.Errorf("subscriber couldn't verify the delivery: %v", err)
+			}
+			if received.Header.Get("X-Webhook-Id") != "evt_1" {
+				t.Errorf("delivery has id %q, want evt_1", received.Header.Get("X-Webhook-Id"))
+			}
+
+			if len(repo.deliveryOutcomes) != 1 {
+				t.Fatalf("stored %d outcomes, want 1", len(repo.deliveryOutcomes))
+			}
+			outcome := repo.deliveryOutcomes[0]
+			if outcome.id != 9 || outcome.statusCode != tt.status || (outcome.err != "") != tt.wantErr {
+				t.Errorf("stored outcome %+v, want status %d and error %v", outcome, tt.status, tt.wantErr)
+			}
+			switch {
+			case tt.wantRetry == 0 && !outcome.nextAttempt.IsZero():
+				t.Errorf("finished delivery is retried at %s", outcome.nextAttempt)
+			case tt.wantRetry != 0:
+				if wait := outcome.nextAttempt.Sub(start); wait < tt.wantRetry || wait > tt.wantRetry+time.Second {
+					t.Errorf("delivery is retried after %s, want %s", wait, tt.wantRetry)
+				}
+			}
+		})
+	}
+}
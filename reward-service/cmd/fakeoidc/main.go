@@ -0,0 +1,36 @@
+// Command fakeoidc is a local stand-in for an OpenID Connect identity provider, see package fakeoidc.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reward-service/internal/fakeoidc"
+)
+
+// main starts the fake identity provider
+func main() {
+	port := envOr("FAKE_OIDC_PORT", "8091")
+	p, err := fakeoidc.New(
+		envOr("FAKE_OIDC_ISSUER", "http://localhost:"+port),
+		envOr("FAKE_OIDC_CLIENT_ID", "reward-service"),
+		os.Getenv("FAKE_OIDC_CLIENT_SECRET"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Starting fake OIDC provider %s on port %s", p.Issuer, port)
+	err = http.ListenAndServe(fmt.Sprintf(":%s", port), p.Handler())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
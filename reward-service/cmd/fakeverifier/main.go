@@ -0,0 +1,32 @@
+// Command fakeverifier is a local stand-in for the external task verifiers, see package fakeverifier.
+// Requests and callbacks are signed with VERIFIER_SECRET, which must match the secret of the "fake"
+// verifier of the reward service.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reward-service/internal/fakeverifier"
+	"time"
+)
+
+// main starts the fake verifier
+func main() {
+	port := os.Getenv("FAKE_VERIFIER_PORT")
+	if port == "" {
+		port = "8090"
+	}
+	v := &fakeverifier.Verifier{
+		Secret: os.Getenv("VERIFIER_SECRET"),
+		Delay:  time.Second,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	log.Printf("Starting fake verifier on port %s", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%s", port), v.Handler())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be granted
+const (
+	ScopePointsRead  = "points:read"
+	ScopePointsWrite = "points:write"
+)
+
+const TxKindPartner = "partner"
+
+var (
+	ErrAPIKeyNotFound     = errors.New("api key does not exist")
+	ErrUnknownScope       = errors.New("unknown scope")
+	ErrInvalidAwardAmount = errors.New("amount must be positive")
+	ErrExternalIDReused   = errors.New("external id was already used for a different award")
+	ErrExternalIDRequired = errors.New("external id is required")
+)
+
+// APIKey is a credential of a partner integration. Only the prefix is stored in clear, the secret part
+// of the key is stored hashed. RateLimit overrides the default limit of partner requests, like "100/1m".
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	SecretHash string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  string     `json:"rate_limit,omitempty"`
+	CreatedBy  int        `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope tells whether the key was granted the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PartnerAward is a credit of points made by a partner, ExternalID identifies the action on the partner's side
+type PartnerAward struct {
+	ID         int       `json:"id"`
+	APIKeyID   int       `json:"api_key_id"`
+	ExternalID string    `json:"external_id"`
+	UserID     int       `json:"user_id"`
+	Amount     int       `json:"amount"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const apiKeyColumns = `id, name, prefix, secret_hash, scopes, coalesce(rate_limit, ''), coalesce(created_by, 0),
+       created_at, last_used_at, revoked_at`
+
+func scanAPIKey(scan func(dest ...any) error) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	err := scan(&k.ID, &k.Name, &k.Prefix, &k.SecretHash, &scopes, &k.RateLimit, &k.CreatedBy,
+		&k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	return &k, nil
+}
+
+// CreateAPIKey stores a new key, the id and the creation time are set on the key
+func (u *PostgresRepository) CreateAPIKey(key *APIKey) error {
+	for _, s := range key.Scopes {
+		if s != ScopePointsRead && s != ScopePointsWrite {
+			return fmt.Errorf("%w: %s", ErrUnknownScope, s)
+		}
+	}
+
+	err := u.queryRow(context.Background(),
+		`insert into api_keys (name, prefix, secret_hash, scopes, rate_limit, created_by, created_at)
+         values ($1, $2, $3, $4, nullif($5, ''), nullif($6, 0), now()) returning id, created_at`,
+		key.Name, key.Prefix, key.SecretHash, strings.Join(key.Scopes, " "), key.RateLimit, key.CreatedBy,
+	).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		log.Println("failed to create api key: ", err)
+		return err
+	}
+	return nil
+}
+
+// GetAPIKeyByPrefix returns the key with the prefix, revoked keys included
+func (u *PostgresRepository) GetAPIKeyByPrefix(prefix string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	row := u.Conn.QueryRowContext(ctx, `select `+apiKeyColumns+` from api_keys where prefix = $1`, prefix)
+	k, err := scanAPIKey(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch api key: ", err)
+		return nil, err
+	}
+	return k, nil
+}
+
+// ListAPIKeys returns all keys, newest first
+func (u *PostgresRepository) ListAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx, `select `+apiKeyColumns+` from api_keys order by created_at desc, id desc`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records the use of the key. The time is only updated once a minute to spare writes.
+func (u *PostgresRepository) TouchAPIKey(id int) error {
+	_, err := u.execQuery(context.Background(),
+		`update api_keys set last_used_at = now()
+         where id = $1 and (last_used_at is null or last_used_at < now() - interval '1 minute')`, id)
+	if err != nil {
+		log.Println("failed to touch api key: ", err)
+		return err
+	}
+	return nil
+}
+
+// RevokeAPIKey revokes the key, it is kept for the history of its awards
+func (u *PostgresRepository) RevokeAPIKey(id int) error {
+	res, err := u.execQuery(context.Background(),
+		`update api_keys set revoked_at = coalesce(revoked_at, now()) where id = $1`, id)
+	if err != nil {
+		log.Println("failed to revoke api key: ", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// AwardPartnerPoints credits points to the user on behalf of a partner. A repeated call with the same
+// external id returns the award made by the first call and changes nothing.
+func (u *PostgresRepository) AwardPartnerPoints(key *APIKey, a PartnerAward) (*PartnerAward, error) {
+	if a.Amount <= 0 {
+		return nil, ErrInvalidAwardAmount
+	}
+	if a.ExternalID == "" {
+		return nil, ErrExternalIDRequired
+	}
+
+	var result *PartnerAward
+	var replayed bool
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		var exists bool
+		err := tx.QueryRowContext(ctx, `select true from users where id = $1 for update`, a.UserID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		created := a
+		created.APIKeyID = key.ID
+		err = tx.QueryRowContext(ctx,
+			`insert into partner_awards (api_key_id, external_id, user_id, amount, reason, created_at)
+             values ($1, $2, $3, $4, nullif($5, ''), now())
+             on conflict (api_key_id, external_id) do nothing returning id, created_at`,
+			key.ID, a.ExternalID, a.UserID, a.Amount, a.Reason).Scan(&created.ID, &created.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			existing := PartnerAward{APIKeyID: key.ID, ExternalID: a.ExternalID}
+			err = tx.QueryRowContext(ctx,
+				`select id, user_id, amount, coalesce(reason, ''), created_at from partner_awards
+                 where api_key_id = $1 and external_id = $2`, key.ID, a.ExternalID).Scan(
+				&existing.ID, &existing.UserID, &existing.Amount, &existing.Reason, &existing.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to fetch partner award: %w", err)
+			}
+			if existing.UserID != a.UserID || existing.Amount != a.Amount || existing.Reason != a.Reason {
+				return ErrExternalIDReused
+			}
+			result = &existing
+			replayed = true
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert partner award: %w", err)
+		}
+		result = &created
+
+		memo := key.Name
+		if a.Reason != "" {
+			memo = key.Name + ": " + a.Reason
+		}
+		return u.applyPoints(tx, a.UserID, a.Amount, TxKindPartner, memo)
+	})
+	if err != nil {
+		log.Printf("failed to award partner points to user %d: %v", a.UserID, err)
+		return nil, err
+	}
+	if !replayed {
+		u.afterPointEvent(a.UserID)
+	}
+
+	return result, nil
+}
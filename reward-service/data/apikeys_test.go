@@ -0,0 +1,67 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// partnerDB answers the queries of AwardPartnerPoints, stored is the award already made with the external id or nil
+func partnerDB(stored []any) func(query string, args []any) [][]any {
+	ledger := &ledgerDB{scores: map[int64]int64{7: 0}}
+	return func(query string, args []any) [][]any {
+		switch {
+		case strings.Contains(query, "select true from users where id = $1 for update"):
+			return [][]any{{true}}
+		case strings.Contains(query, "insert into partner_awards"):
+			if stored != nil {
+				return nil
+			}
+			return [][]any{{int64(5), time.Now()}}
+		case strings.Contains(query, "from partner_awards"):
+			return [][]any{stored}
+		case strings.Contains(query, "select lifetime_points from users"):
+			return [][]any{{int64(40)}}
+		}
+		return ledger.respond(query, args)
+	}
+}
+
+func TestAwardPartnerPointsOnce(t *testing.T) {
+	award := PartnerAward{ExternalID: "order-1", UserID: 7, Amount: 40}
+	tests := []struct {
+		name       string
+		stored     []any
+		wantErr    error
+		wantCredit bool
+	}{
+		{"first award", nil, nil, true},
+		{"same award again", []any{int64(5), int64(7), int64(40), "", time.Now()}, nil, false},
+		{"external id reused for another award", []any{int64(5), int64(7), int64(90), "", time.Now()}, ErrExternalIDReused, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, partnerDB(tt.stored))
+			repo.BadgeRules = []BadgeRule{{Code: "earner", Metric: MetricLifetimePoints, Threshold: 1000}}
+
+			result, err := repo.AwardPartnerPoints(&APIKey{ID: 3, Name: "shop"}, award)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AwardPartnerPoints() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (result.ID != 5 || result.Amount != 40) {
+				t.Errorf("AwardPartnerPoints() = %+v, want award 5 of 40 points", result)
+			}
+
+			credited := len(db.ran("update users set score = score + $1")) > 0
+			if credited != tt.wantCredit {
+				t.Errorf("points credited = %v, want %v", credited, tt.wantCredit)
+			}
+			// badges are evaluated after a new award only, a replay changes nothing they depend on
+			evaluated := len(db.ran("select lifetime_points from users")) > 0
+			if evaluated != tt.wantCredit {
+				t.Errorf("badges evaluated = %v, want %v", evaluated, tt.wantCredit)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Metrics which a badge rule can be based on
+const (
+	MetricTasksCompleted = "tasks_completed"
+	MetricReferrals      = "referrals"
+	MetricLifetimePoints = "lifetime_points"
+	MetricWeeklyRank     = "weekly_rank"
+)
+
+// BadgeRule declares a badge and the condition to award it: the metric of the user must reach Threshold,
+// for weekly_rank the rank must be Threshold or better
+type BadgeRule struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Metric      string `json:"metric"`
+	Threshold   int    `json:"threshold"`
+}
+
+// Badge is a badge awarded to the user
+type Badge struct {
+	Code        string    `json:"code"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	AwardedAt   time.Time `json:"awarded_at"`
+}
+
+// LoadBadgeRules reads badge rules from a JSON file with an array of rules
+func LoadBadgeRules(path string) ([]BadgeRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read badge rules: %w", err)
+	}
+
+	var rules []BadgeRule
+	err = json.Unmarshal(content, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse badge rules: %w", err)
+	}
+
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		switch rule.Metric {
+		case MetricTasksCompleted, MetricReferrals, MetricLifetimePoints, MetricWeeklyRank:
+		default:
+			return nil, fmt.Errorf("badge %q has unknown metric %q", rule.Code, rule.Metric)
+		}
+		if rule.Code == "" || seen[rule.Code] {
+			return nil, fmt.Errorf("badge code %q is empty or duplicated", rule.Code)
+		}
+		if rule.Threshold <= 0 {
+			return nil, fmt.Errorf("badge %q must have a positive threshold", rule.Code)
+		}
+		seen[rule.Code] = true
+	}
+	return rules, nil
+}
+
+// metric calculates the current value of the metric for the user
+func (u *PostgresRepository) metric(userID int, metric string) (int, error) {
+	var query string
+	switch metric {
+	case MetricTasksCompleted:
+		query = `select count(*) from point_transactions where user_id = $1 and kind = '` + TxKindTask + `'`
+	case MetricReferrals:
+		// distinct users who redeemed the referrer of the owner, so one friend redeeming it again counts once
+		query = `select count(distinct r.user_id) from point_transactions r join users owner on owner.referrer = r.memo
+                 where owner.id = $1 and r.kind = '` + TxKindReferred + `'`
+	case MetricLifetimePoints:
+		query = `select lifetime_points from users where id = $1`
+	case MetricWeeklyRank:
+		query = `select coalesce((
+                     select rank from (
+                         select user_id, rank() over (order by sum(amount) desc) as rank
+                         from point_transactions
+                         where amount > 0 and kind <> '` + TxKindTransferIn + `' and created_at >= now() - interval '7 days'
+                         group by user_id
+                     ) board where user_id = $1
+                 ), 0)`
+	default:
+		return 0, fmt.Errorf("unknown metric %q", metric)
+	}
+
+	var value int
+	err := u.queryRow(context.Background(), query, userID).Scan(&value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to calculate %s: %w", metric, err)
+	}
+	return value, nil
+}
+
+// EvaluateBadges checks every badge rule against the user and awards the badges whose condition is met.
+// A badge is awarded only once, the newly awarded badges are returned.
+func (u *PostgresRepository) EvaluateBadges(userID int) ([]*Badge, error) {
+	values := make(map[string]int)
+	var awarded []*Badge
+
+	for _, rule := range u.BadgeRules {
+		value, ok := values[rule.Metric]
+		if !ok {
+			var err error
+			value, err = u.metric(userID, rule.Metric)
+			if err != nil {
+				return awarded, err
+			}
+			values[rule.Metric] = value
+		}
+
+		reached := value >= rule.Threshold
+		if rule.Metric == MetricWeeklyRank {
+			reached = value > 0 && value <= rule.Threshold
+		}
+		if !reached {
+			continue
+		}
+
+		stmt := `insert into user_badges (user_id, badge_code, awarded_at) values ($1, $2, now())
+                 on conflict (user_id, badge_code) do nothing returning awarded_at`
+		badge := Badge{Code: rule.Code, Name: rule.Name, Description: rule.Description}
+		err := u.queryRow(context.Background(), stmt, userID, rule.Code).Scan(&badge.AwardedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			// no row is returned when the badge was awarded before
+			continue
+		}
+		if err != nil {
+			return awarded, fmt.Errorf("failed to award badge %q: %w", rule.Code, err)
+		}
+		awarded = append(awarded, &badge)
+
+		err = notifyLive(u.Conn, LiveUpdate{Type: LiveBadge, UserID: userID, Badge: &badge})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return awarded, nil
+}
+
+// afterPointEvent runs after points of the users have changed and evaluates their badges
+func (u *PostgresRepository) afterPointEvent(userIDs ...int) {
+	for _, id := range userIDs {
+		badges, err := u.EvaluateBadges(id)
+		if err != nil {
+			log.Printf("failed to evaluate badges of user %d: %v", id, err)
+		}
+		for _, badge := range badges {
+			log.Printf("User %d was awarded badge %q", id, badge.Code)
+		}
+	}
+}
+
+// GetBadges returns the badges of the user, oldest first. Badges removed from the rules are skipped.
+func (u *PostgresRepository) GetBadges(userID int) ([]*Badge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select badge_code, awarded_at from user_badges where user_id = $1 order by awarded_at`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch badges: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make(map[string]BadgeRule, len(u.BadgeRules))
+	for _, rule := range u.BadgeRules {
+		rules[rule.Code] = rule
+	}
+
+	badges := []*Badge{}
+	for rows.Next() {
+		var badge Badge
+		if err := rows.Scan(&badge.Code, &badge.AwardedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan badge: %w", err)
+		}
+		rule, ok := rules[badge.Code]
+		if !ok {
+			continue
+		}
+		badge.Name = rule.Name
+		badge.Description = rule.Description
+		badges = append(badges, &badge)
+	}
+	return badges, rows.Err()
+}
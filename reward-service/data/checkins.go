@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	TxKindCheckin      = "checkin"
+	TxKindStreakFreeze = "streak_freeze"
+)
+
+var (
+	ErrAlreadyCheckedIn = errors.New("already checked in today")
+	ErrUnknownTimeZone  = errors.New("unknown time zone")
+	ErrTooManyFreezes   = errors.New("maximum number of streak freezes reached")
+)
+
+// CheckinRules configures daily check-ins. Rewards[n] is paid on the (n+1)-th day of a streak,
+// the last reward is paid for every day after that. A check-in made within Grace after local
+// midnight still counts for the previous day when that day was missed.
+type CheckinRules struct {
+	Rewards     []int
+	Grace       time.Duration
+	FreezePrice int
+	MaxFreezes  int
+}
+
+// Streak is the check-in state of the user
+type Streak struct {
+	UserID          int    `json:"user_id"`
+	TimeZone        string `json:"time_zone"`
+	CurrentStreak   int    `json:"current_streak"`
+	LongestStreak   int    `json:"longest_streak"`
+	LastCheckinDate string `json:"last_checkin_date,omitempty"`
+	Freezes         int    `json:"freezes"`
+}
+
+// Checkin is the result of one daily check-in
+type Checkin struct {
+	Date          string `json:"date"`
+	Points        int    `json:"points"`
+	FreezesUsed   int    `json:"freezes_used"`
+	CurrentStreak int    `json:"current_streak"`
+	LongestStreak int    `json:"longest_streak"`
+}
+
+// reward returns the points for the given day of a streak
+func (c CheckinRules) reward(day int) int {
+	if len(c.Rewards) == 0 || day <= 0 {
+		return 0
+	}
+	if day > len(c.Rewards) {
+		return c.Rewards[len(c.Rewards)-1]
+	}
+	return c.Rewards[day-1]
+}
+
+// lockStreak locks the user and returns the check-in state, creating it on the first use.
+// When the user has no time zone yet, timeZone is stored.
+func lockStreak(tx *sql.Tx, userID int, timeZone string) (*Streak, error) {
+	ctx := context.Background()
+
+	var exists bool
+	err := tx.QueryRowContext(ctx, `select true from users where id = $1 for update`, userID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	_, err = tx.ExecContext(ctx,
+		`insert into streaks (user_id, time_zone) values ($1, $2) on conflict (user_id) do nothing`, userID, timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create streak: %w", err)
+	}
+
+	s := Streak{UserID: userID}
+	var last sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		`select time_zone, current_streak, longest_streak, last_checkin_date, freezes from streaks where user_id = $1`,
+		userID).Scan(&s.TimeZone, &s.CurrentStreak, &s.LongestStreak, &last, &s.Freezes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch streak: %w", err)
+	}
+	if last.Valid {
+		s.LastCheckinDate = last.Time.Format(time.DateOnly)
+	}
+	return &s, nil
+}
+
+// nextStreak decides what a check-in at now does to a streak last checked in on the date last, zero when there
+// was no check-in yet. It returns the date the check-in counts for, how many of the freezes it uses to cover
+// the missed days and whether the streak continues or starts again. Dates are days in the location loc, kept
+// as midnight UTC like the dates stored in the database.
+func nextStreak(last, now time.Time, loc *time.Location, freezes int, grace time.Duration) (date time.Time, freezesUsed int, continued bool, err error) {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if last.IsZero() {
+		return today, 0, false, nil
+	}
+
+	missed := int(today.Sub(last).Hours()/24) - 1
+	switch {
+	case missed < 0:
+		return time.Time{}, 0, false, ErrAlreadyCheckedIn
+	case missed == 1 && now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)) < grace:
+		// checked in just after midnight, the check-in still counts for the missed day
+		return today.AddDate(0, 0, -1), 0, true, nil
+	case missed == 0:
+		return today, 0, true, nil
+	case missed <= freezes:
+		return today, missed, true, nil
+	default:
+		return today, 0, false, nil
+	}
+}
+
+// CheckIn records the check-in of the user for the current day in the user's time zone and pays the streak reward.
+// timeZone is only used when the user checks in for the first time.
+func (u *PostgresRepository) CheckIn(userID int, timeZone string, rules CheckinRules) (*Checkin, error) {
+	if timeZone != "" {
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return nil, ErrUnknownTimeZone
+		}
+	}
+
+	var result Checkin
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		streak, err := lockStreak(tx, userID, timeZone)
+		if err != nil {
+			return err
+		}
+		loc, err := time.LoadLocation(streak.TimeZone)
+		if err != nil {
+			return ErrUnknownTimeZone
+		}
+
+		var last time.Time
+		if streak.LastCheckinDate != "" {
+			last, _ = time.Parse(time.DateOnly, streak.LastCheckinDate)
+		}
+		date, freezesUsed, continued, err := nextStreak(last, time.Now(), loc, streak.Freezes, rules.Grace)
+		if err != nil {
+			return err
+		}
+
+		if continued {
+			streak.CurrentStreak++
+		} else {
+			streak.CurrentStreak = 1
+		}
+		streak.Freezes -= freezesUsed
+		result.FreezesUsed = freezesUsed
+		streak.LongestStreak = max(streak.LongestStreak, streak.CurrentStreak)
+
+		result.Date = date.Format(time.DateOnly)
+		result.Points = rules.reward(streak.CurrentStreak)
+		result.CurrentStreak = streak.CurrentStreak
+		result.LongestStreak = streak.LongestStreak
+
+		_, err = tx.ExecContext(context.Background(),
+			`insert into checkins (user_id, checkin_date, streak_day, points, created_at) values ($1, $2, $3, $4, now())`,
+			userID, result.Date, streak.CurrentStreak, result.Points)
+		if err != nil {
+			return fmt.Errorf("failed to record check-in: %w", err)
+		}
+
+		_, err = tx.ExecContext(context.Background(),
+			`update streaks set current_streak = $1, longest_streak = $2, last_checkin_date = $3, freezes = $4
+             where user_id = $5`,
+			streak.CurrentStreak, streak.LongestStreak, result.Date, streak.Freezes, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update streak: %w", err)
+		}
+
+		if result.Points > 0 {
+			memo := fmt.Sprintf("day %d of the streak", streak.CurrentStreak)
+			return u.applyPoints(tx, userID, result.Points, TxKindCheckin, memo)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to check in user %d: %v", userID, err)
+		return nil, err
+	}
+	u.afterPointEvent(userID)
+
+	return &result, nil
+}
+
+// GetStreak returns the check-in state of the user
+func (u *PostgresRepository) GetStreak(userID int) (*Streak, error) {
+	query := `select time_zone, current_streak, longest_streak, last_checkin_date, freezes from streaks where user_id = $1`
+
+	s := Streak{UserID: userID, TimeZone: "UTC"}
+	var last sql.NullTime
+	err := u.queryRow(context.Background(), query, userID).Scan(&s.TimeZone, &s.CurrentStreak, &s.LongestStreak, &last, &s.Freezes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &s, nil
+	}
+	if err != nil {
+		log.Println("failed to fetch streak: ", err)
+		return nil, err
+	}
+	if last.Valid {
+		s.LastCheckinDate = last.Time.Format(time.DateOnly)
+	}
+	return &s, nil
+}
+
+// BuyStreakFreeze exchanges points for a streak freeze, which covers one missed day of the streak
+func (u *PostgresRepository) BuyStreakFreeze(userID int, rules CheckinRules) (*Streak, error) {
+	var streak *Streak
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		streak, err = lockStreak(tx, userID, "")
+		if err != nil {
+			return err
+		}
+		if streak.Freezes >= rules.MaxFreezes {
+			return ErrTooManyFreezes
+		}
+
+		err = expireUserLots(tx, userID)
+		if err != nil {
+			return err
+		}
+		var score int
+		err = tx.QueryRowContext(context.Background(), `select score from users where id = $1`, userID).Scan(&score)
+		if err != nil {
+			return fmt.Errorf("failed to fetch score: %w", err)
+		}
+		if score < rules.FreezePrice {
+			return ErrInsufficientPoints
+		}
+
+		streak.Freezes++
+		_, err = tx.ExecContext(context.Background(), `update streaks set freezes = $1 where user_id = $2`, streak.Freezes, userID)
+		if err != nil {
+			return fmt.Errorf("failed to add streak freeze: %w", err)
+		}
+		if rules.FreezePrice > 0 {
+			return u.applyPoints(tx, userID, -rules.FreezePrice, TxKindStreakFreeze, "")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to buy streak freeze for user %d: %v", userID, err)
+		return nil, err
+	}
+	u.afterPointEvent(userID)
+
+	return streak, nil
+}
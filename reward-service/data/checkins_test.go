@@ -0,0 +1,76 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextStreak(t *testing.T) {
+	// the user lives at UTC+3, so 21:00 UTC is already midnight of the next day
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	day := func(date string) time.Time {
+		d, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	at := func(local string) time.Time {
+		ts, err := time.ParseInLocation("2006-01-02 15:04", local, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	tests := []struct {
+		name          string
+		last          string
+		now           time.Time
+		freezes       int
+		wantDate      string
+		wantFreezes   int
+		wantContinued bool
+		wantErr       error
+	}{
+		{"first check-in", "", at("2026-10-19 12:00"), 0, "2026-10-19", 0, false, nil},
+		{"next day", "2026-10-18", at("2026-10-19 12:00"), 0, "2026-10-19", 0, true, nil},
+		{"twice a day", "2026-10-19", at("2026-10-19 23:59"), 0, "", 0, false, ErrAlreadyCheckedIn},
+		{"day in the local time zone", "2026-10-18", at("2026-10-19 01:00").In(time.UTC), 0, "2026-10-19", 0, true, nil},
+		{"already checked in locally", "2026-10-19", time.Date(2026, 10, 18, 21, 30, 0, 0, time.UTC), 0, "", 0, false, ErrAlreadyCheckedIn},
+		{"missed a day", "2026-10-17", at("2026-10-19 12:00"), 0, "2026-10-19", 0, false, nil},
+		{"within grace after a missed day", "2026-10-17", at("2026-10-19 00:30"), 0, "2026-10-18", 0, true, nil},
+		{"grace ended", "2026-10-17", at("2026-10-19 01:00"), 0, "2026-10-19", 0, false, nil},
+		{"grace doesn't cover two days", "2026-10-16", at("2026-10-19 00:30"), 0, "2026-10-19", 0, false, nil},
+		{"freeze covers a missed day", "2026-10-17", at("2026-10-19 12:00"), 1, "2026-10-19", 1, true, nil},
+		{"grace before freezes", "2026-10-17", at("2026-10-19 00:30"), 1, "2026-10-18", 0, true, nil},
+		{"freezes cover missed days", "2026-10-15", at("2026-10-19 12:00"), 3, "2026-10-19", 3, true, nil},
+		{"not enough freezes", "2026-10-15", at("2026-10-19 12:00"), 2, "2026-10-19", 0, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var last time.Time
+			if tt.last != "" {
+				last = day(tt.last)
+			}
+
+			date, freezesUsed, continued, err := nextStreak(last, tt.now, loc, tt.freezes, time.Hour)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("nextStreak() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := date.Format(time.DateOnly); got != tt.wantDate {
+				t.Errorf("nextStreak() date = %s, want %s", got, tt.wantDate)
+			}
+			if freezesUsed != tt.wantFreezes {
+				t.Errorf("nextStreak() used %d freezes, want %d", freezesUsed, tt.wantFreezes)
+			}
+			if continued != tt.wantContinued {
+				t.Errorf("nextStreak() continued = %v, want %v", continued, tt.wantContinued)
+			}
+		})
+	}
+}
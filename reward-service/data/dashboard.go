@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Referral is the redemption of the referrer of a user by another user
+type Referral struct {
+	OwnerID    int       `json:"owner_id"`
+	UserID     int       `json:"user_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// The batch queries below load data for many users at once, so that a GraphQL query asking for the same field of
+// every user on a page costs one query instead of one per user.
+
+// GetUsersByIDs returns the users with the given ids, unknown ids are skipped
+func (u *PostgresRepository) GetUsersByIDs(ids []int) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select u.id, u.email, u.first_name, u.last_name, u.active, u.score, u.created_at, u.updated_at,
+                coalesce(u.referrer, ''), coalesce(t.name, '')
+         from users u left join tiers t on t.id = u.tier_id where u.id = any($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Email, &user.FirstName, &user.LastName, &user.Active, &user.Score,
+			&user.CreatedAt, &user.UpdatedAt, &user.Referrer, &user.Tier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+// GetHistories returns up to limit latest ledger entries of each user, newest first, by user id
+func (u *PostgresRepository) GetHistories(ids []int, limit int) (map[int][]*Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select id, user_id, amount, kind, memo, created_at from (
+             select id, user_id, amount, kind, coalesce(memo, '') as memo, created_at,
+                    row_number() over (partition by user_id order by created_at desc, id desc) as n
+             from point_transactions where user_id = any($1)
+         ) t where n <= $2 order by user_id, n`, ids, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch histories: %w", err)
+	}
+	defer rows.Close()
+
+	histories := make(map[int][]*Transaction)
+	for rows.Next() {
+		var t Transaction
+		err := rows.Scan(&t.ID, &t.UserID, &t.Amount, &t.Kind, &t.Memo, &t.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		histories[t.UserID] = append(histories[t.UserID], &t)
+	}
+	return histories, rows.Err()
+}
+
+// GetReferrals returns who redeemed the referrers of the users, newest first, by the id of the referrer's owner
+func (u *PostgresRepository) GetReferrals(ownerIDs []int) (map[int][]*Referral, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// the user who redeemed a referrer is credited with kind "referred" and the referrer in the memo
+	rows, err := u.Conn.QueryContext(ctx,
+		`select o.id, t.user_id, t.created_at
+         from users o join point_transactions t on t.kind = $2 and t.memo = o.referrer
+         where o.id = any($1) order by o.id, t.created_at desc`, ownerIDs, TxKindReferred)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch referrals: %w", err)
+	}
+	defer rows.Close()
+
+	referrals := make(map[int][]*Referral)
+	for rows.Next() {
+		var r Referral
+		err := rows.Scan(&r.OwnerID, &r.UserID, &r.RedeemedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan referral: %w", err)
+		}
+		referrals[r.OwnerID] = append(referrals[r.OwnerID], &r)
+	}
+	return referrals, rows.Err()
+}
+
+// GetTasks returns all task definitions ordered by code
+func (u *PostgresRepository) GetTasks() ([]*Task, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select code, name, points, verifier, coalesce(verifier_url, ''), repeatable from tasks order by code`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		var t Task
+		err := rows.Scan(&t.Code, &t.Name, &t.Points, &t.Verifier, &t.VerifierURL, &t.Repeatable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, &t)
+	}
+	return tasks, rows.Err()
+}
+
+// GetCompletedTaskCodes returns the codes of the tasks the user has completed or is waiting to be verified for
+func (u *PostgresRepository) GetCompletedTaskCodes(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select distinct task_code from task_completions where user_id = $1 and status <> $2`, userID, CompletionRejected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch completed tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrInvalidVerification = errors.New("verification link is invalid or was already used")
+
+// CreateEmailVerification stores the nonce of a verification link sent to the user
+func (u *PostgresRepository) CreateEmailVerification(userID int, nonce string, expires time.Time) error {
+	_, err := u.execQuery(context.Background(),
+		`insert into email_verifications (nonce, user_id, expires_at) values ($1, $2, $3)`, nonce, userID, expires)
+	if err != nil {
+		log.Println("failed to create email verification: ", err)
+		return err
+	}
+	return nil
+}
+
+// VerifyEmail uses up the verification link and activates the user
+func (u *PostgresRepository) VerifyEmail(userID int, nonce string) error {
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		var id int
+		err := tx.QueryRowContext(ctx,
+			`update email_verifications set used_at = now()
+             where nonce = $1 and user_id = $2 and used_at is null and expires_at > now() returning user_id`,
+			nonce, userID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidVerification
+		}
+		if err != nil {
+			return fmt.Errorf("failed to use email verification: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `update users set active = 1, updated_at = now() where id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to activate user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to verify email of user %d: %v", userID, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database for the repository tests. It records every statement run on it and answers
+// queries through respond, a query respond returns no rows for gets an empty result.
+type fakeDB struct {
+	mu         sync.Mutex
+	respond    func(query string, args []any) [][]any
+	statements []fakeStatement
+	commits    int
+	rollbacks  int
+}
+
+// fakeStatement is a statement run on the fake database with its arguments
+type fakeStatement struct {
+	query string
+	args  []any
+}
+
+// newFakeRepository returns a repository on a fake database which answers queries through respond
+func newFakeRepository(t *testing.T, respond func(query string, args []any) [][]any) (*PostgresRepository, *fakeDB) {
+	t.Helper()
+	db := &fakeDB{respond: respond}
+	conn := sql.OpenDB(db)
+	t.Cleanup(func() { conn.Close() })
+	return &PostgresRepository{Conn: conn}, db
+}
+
+// ran returns the arguments of every statement containing the text, in the order they ran
+func (db *fakeDB) ran(text string) [][]any {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var args [][]any
+	for _, s := range db.statements {
+		if strings.Contains(s.query, text) {
+			args = append(args, s.args)
+		}
+	}
+	return args
+}
+
+func (db *fakeDB) record(query string, named []driver.NamedValue) [][]any {
+	args := make([]any, len(named))
+	for i, v := range named {
+		args[i] = v.Value
+	}
+	db.mu.Lock()
+	db.statements = append(db.statements, fakeStatement{query: query, args: args})
+	db.mu.Unlock()
+	if db.respond == nil {
+		return nil
+	}
+	return db.respond(query, args)
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx(c), nil }
+
+// CheckNamedValue passes arguments the default converter doesn't know, like slices, through as they are
+func (c fakeConn) CheckNamedValue(v *driver.NamedValue) error {
+	converted, err := driver.DefaultParameterConverter.ConvertValue(v.Value)
+	if err == nil {
+		v.Value = converted
+	}
+	return nil
+}
+
+// ExecContext affects one row, unless respond answers the statement: then it affects as many rows as were answered
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rows := c.db.record(query, args)
+	if rows != nil {
+		return driver.RowsAffected(len(rows)), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{rows: c.db.record(query, args)}, nil
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.rollbacks++
+	return nil
+}
+
+type fakeRows struct {
+	rows [][]any
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rows[r.next] {
+		dest[i] = v
+	}
+	r.next++
+	return nil
+}
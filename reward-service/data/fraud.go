@@ -0,0 +1,231 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Actions a fraud rule can take, ordered by severity
+const (
+	FraudAllow = iota
+	FraudFlag
+	FraudBlock
+)
+
+// Types of events checked by the fraud rules
+const (
+	FraudEventCredit       = "credit"
+	FraudEventRegistration = "registration"
+)
+
+var ErrFraudBlocked = errors.New("operation was blocked by the fraud checks")
+
+// Querier is implemented by both *sql.DB and *sql.Tx, so rules can run inside or outside a transaction
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// FraudEvent is what the fraud rules are asked about: a credit of points or a registration
+type FraudEvent struct {
+	Type   string
+	UserID int
+	Amount int
+	Kind   string
+	Memo   string
+	IP     string
+}
+
+// FraudRule is one check of the fraud chain. Check returns the action to take and, unless the action is
+// FraudAllow, a description of what was detected. Rules ignore the event types they are not interested in.
+type FraudRule interface {
+	Name() string
+	Check(q Querier, ev FraudEvent) (action int, details string, err error)
+}
+
+// FraudRecord is a stored result of a rule which flagged or blocked an event
+type FraudRecord struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id,omitempty"`
+	Rule      string    `json:"rule"`
+	Action    string    `json:"action"`
+	EventType string    `json:"event_type"`
+	Amount    int       `json:"amount,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func fraudActionName(action int) string {
+	switch action {
+	case FraudBlock:
+		return "block"
+	case FraudFlag:
+		return "flag"
+	default:
+		return "allow"
+	}
+}
+
+// checkFraud runs the event through every fraud rule. Flags and blocks are stored in fraud_events through
+// the connection, not q, so that a block is kept even though the transaction of the event is rolled back.
+func (u *PostgresRepository) checkFraud(q Querier, ev FraudEvent) error {
+	worst := FraudAllow
+	for _, rule := range u.FraudRules {
+		action, details, err := rule.Check(q, ev)
+		if err != nil {
+			return fmt.Errorf("fraud rule %s failed: %w", rule.Name(), err)
+		}
+		if action == FraudAllow {
+			continue
+		}
+		worst = max(worst, action)
+
+		_, err = u.execQuery(context.Background(),
+			`insert into fraud_events (user_id, rule, action, event_type, amount, kind, ip, details, created_at)
+             values (nullif($1, 0), $2, $3, $4, $5, $6, $7, $8, now())`,
+			ev.UserID, rule.Name(), fraudActionName(action), ev.Type, ev.Amount, ev.Kind, ev.IP, details)
+		if err != nil {
+			log.Printf("failed to record fraud event of rule %s: %v", rule.Name(), err)
+		}
+	}
+
+	if worst == FraudBlock {
+		return ErrFraudBlocked
+	}
+	return nil
+}
+
+// GetFraudEvents returns the latest flagged and blocked events, newest first
+func (u *PostgresRepository) GetFraudEvents(limit int) ([]*FraudRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, coalesce(user_id, 0), rule, action, event_type, amount, coalesce(kind, ''), coalesce(ip, ''), details, created_at
+              from fraud_events order by created_at desc, id desc limit $1`
+
+	rows, err := u.Conn.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch fraud events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*FraudRecord{}
+	for rows.Next() {
+		var e FraudRecord
+		err := rows.Scan(&e.ID, &e.UserID, &e.Rule, &e.Action, &e.EventType, &e.Amount, &e.Kind, &e.IP, &e.Details, &e.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fraud event: %w", err)
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// VelocityRule limits how many points a user can be credited within Window, transfers between users are not counted
+type VelocityRule struct {
+	Window    time.Duration
+	MaxPoints int
+	Action    int
+}
+
+func (r VelocityRule) Name() string {
+	return fmt.Sprintf("velocity_%s", r.Window)
+}
+
+func (r VelocityRule) Check(q Querier, ev FraudEvent) (int, string, error) {
+	if ev.Type != FraudEventCredit || ev.Kind == TxKindTransferIn {
+		return FraudAllow, "", nil
+	}
+
+	var earned int
+	err := q.QueryRowContext(context.Background(),
+		`select coalesce(sum(amount), 0) from point_transactions
+         where user_id = $1 and amount > 0 and kind <> $2 and created_at >= now() - $3 * interval '1 second'`,
+		ev.UserID, TxKindTransferIn, int64(r.Window.Seconds())).Scan(&earned)
+	if err != nil {
+		return FraudAllow, "", err
+	}
+	if earned+ev.Amount > r.MaxPoints {
+		return r.Action, fmt.Sprintf("%d points within %s, the limit is %d", earned+ev.Amount, r.Window, r.MaxPoints), nil
+	}
+	return FraudAllow, "", nil
+}
+
+// AccountsPerIPRule limits how many accounts can be registered from one IP address
+type AccountsPerIPRule struct {
+	MaxAccounts int
+	Action      int
+}
+
+func (r AccountsPerIPRule) Name() string {
+	return "accounts_per_ip"
+}
+
+func (r AccountsPerIPRule) Check(q Querier, ev FraudEvent) (int, string, error) {
+	if ev.Type != FraudEventRegistration || ev.IP == "" {
+		return FraudAllow, "", nil
+	}
+
+	var accounts int
+	err := q.QueryRowContext(context.Background(),
+		`select count(*) from users where registration_ip = $1`, ev.IP).Scan(&accounts)
+	if err != nil {
+		return FraudAllow, "", err
+	}
+	if accounts >= r.MaxAccounts {
+		return r.Action, fmt.Sprintf("%d accounts are already registered from %s", accounts, ev.IP), nil
+	}
+	return FraudAllow, "", nil
+}
+
+// ReferralRingRule detects suspicious referrals: two users who redeemed each other's referrers,
+// or a referrer redeemed by an account registered from the same IP as its owner
+type ReferralRingRule struct {
+	MutualAction int
+	SameIPAction int
+}
+
+func (r ReferralRingRule) Name() string {
+	return "referral_ring"
+}
+
+func (r ReferralRingRule) Check(q Querier, ev FraudEvent) (int, string, error) {
+	// the user who redeemed a referrer is credited with kind "referred" and the referrer in the memo
+	if ev.Type != FraudEventCredit || ev.Kind != TxKindReferred {
+		return FraudAllow, "", nil
+	}
+	ctx := context.Background()
+
+	var ownerID int
+	var ownerIP, userIP, userReferrer string
+	err := q.QueryRowContext(ctx,
+		`select owner.id, coalesce(owner.registration_ip, ''), coalesce(redeemer.registration_ip, ''), coalesce(redeemer.referrer, '')
+         from users owner, users redeemer where owner.referrer = $1 and redeemer.id = $2`,
+		ev.Memo, ev.UserID).Scan(&ownerID, &ownerIP, &userIP, &userReferrer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FraudAllow, "", nil
+	}
+	if err != nil {
+		return FraudAllow, "", err
+	}
+
+	var mutual bool
+	err = q.QueryRowContext(ctx,
+		`select exists(select 1 from point_transactions where user_id = $1 and kind = $2 and memo = $3)`,
+		ownerID, TxKindReferred, userReferrer).Scan(&mutual)
+	if err != nil {
+		return FraudAllow, "", err
+	}
+	if mutual && userReferrer != "" {
+		return r.MutualAction, fmt.Sprintf("users %d and %d redeemed each other's referrers", ev.UserID, ownerID), nil
+	}
+	if ownerIP != "" && ownerIP == userIP {
+		return r.SameIPAction, fmt.Sprintf("users %d and %d were registered from the same IP %s", ev.UserID, ownerID, ownerIP), nil
+	}
+	return FraudAllow, "", nil
+}
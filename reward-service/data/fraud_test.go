@@ -0,0 +1,174 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeQuerier returns a Querier on the fake database, the rules run on it the way they run on a transaction
+func fakeQuerier(t *testing.T, respond func(query string, args []any) [][]any) (Querier, *fakeDB) {
+	t.Helper()
+	db := &fakeDB{respond: respond}
+	conn := sql.OpenDB(db)
+	t.Cleanup(func() { conn.Close() })
+	return conn, db
+}
+
+func TestVelocityRule(t *testing.T) {
+	rule := VelocityRule{Window: time.Hour, MaxPoints: 100, Action: FraudBlock}
+	tests := []struct {
+		name       string
+		ev         FraudEvent
+		earned     int64
+		wantAction int
+		wantQuery  bool
+	}{
+		{"under the limit", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 30, Kind: TxKindTask}, 60, FraudAllow, true},
+		{"up to the limit", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 40, Kind: TxKindTask}, 60, FraudAllow, true},
+		{"over the limit", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 41, Kind: TxKindTask}, 60, FraudBlock, true},
+		{"one credit over the limit", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 101, Kind: TxKindTask}, 0, FraudBlock, true},
+		{"transfers are not counted", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 500, Kind: TxKindTransferIn}, 60, FraudAllow, false},
+		{"registrations are ignored", FraudEvent{Type: FraudEventRegistration, IP: "10.0.0.1"}, 60, FraudAllow, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, db := fakeQuerier(t, func(query string, args []any) [][]any {
+				return [][]any{{tt.earned}}
+			})
+
+			action, details, err := rule.Check(q, tt.ev)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if action != tt.wantAction {
+				t.Errorf("Check() action = %s, want %s", fraudActionName(action), fraudActionName(tt.wantAction))
+			}
+			if (action != FraudAllow) != (details != "") {
+				t.Errorf("Check() details = %q with action %s", details, fraudActionName(action))
+			}
+
+			queries := db.ran("from point_transactions")
+			if (len(queries) > 0) != tt.wantQuery {
+				t.Fatalf("rule read the ledger = %v, want %v", len(queries) > 0, tt.wantQuery)
+			}
+			if tt.wantQuery && (queries[0][0] != int64(1) || queries[0][2] != int64(3600)) {
+				t.Errorf("rule read the ledger with %v, want user 1 and a window of 3600 seconds", queries[0])
+			}
+		})
+	}
+}
+
+func TestAccountsPerIPRule(t *testing.T) {
+	rule := AccountsPerIPRule{MaxAccounts: 3, Action: FraudBlock}
+	tests := []struct {
+		name       string
+		ev         FraudEvent
+		accounts   int64
+		wantAction int
+	}{
+		{"first account", FraudEvent{Type: FraudEventRegistration, IP: "10.0.0.1"}, 0, FraudAllow},
+		{"below the limit", FraudEvent{Type: FraudEventRegistration, IP: "10.0.0.1"}, 2, FraudAllow},
+		{"limit reached", FraudEvent{Type: FraudEventRegistration, IP: "10.0.0.1"}, 3, FraudBlock},
+		{"unknown IP", FraudEvent{Type: FraudEventRegistration}, 10, FraudAllow},
+		{"credits are ignored", FraudEvent{Type: FraudEventCredit, UserID: 1, Amount: 10, IP: "10.0.0.1"}, 10, FraudAllow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, db := fakeQuerier(t, func(query string, args []any) [][]any {
+				if strings.Contains(query, "where registration_ip = $1") && args[0] == tt.ev.IP {
+					return [][]any{{tt.accounts}}
+				}
+				return nil
+			})
+
+			action, _, err := rule.Check(q, tt.ev)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if action != tt.wantAction {
+				t.Errorf("Check() action = %s, want %s", fraudActionName(action), fraudActionName(tt.wantAction))
+			}
+			if tt.ev.Type != FraudEventRegistration && len(db.statements) != 0 {
+				t.Errorf("rule queried the database for a %s event", tt.ev.Type)
+			}
+		})
+	}
+}
+
+func TestReferralRingRule(t *testing.T) {
+	rule := ReferralRingRule{MutualAction: FraudBlock, SameIPAction: FraudFlag}
+	redeem := FraudEvent{Type: FraudEventCredit, UserID: 2, Amount: 25, Kind: TxKindReferred, Memo: "owner-ref"}
+	tests := []struct {
+		name       string
+		ev         FraudEvent
+		owner      []any // owner id, owner IP, redeemer IP, redeemer's own referrer
+		mutual     bool
+		wantAction int
+	}{
+		{"unrelated users", redeem, []any{int64(1), "10.0.0.1", "10.0.0.2", "user-ref"}, false, FraudAllow},
+		{"mutual redemption", redeem, []any{int64(1), "10.0.0.1", "10.0.0.2", "user-ref"}, true, FraudBlock},
+		{"same IP", redeem, []any{int64(1), "10.0.0.1", "10.0.0.1", "user-ref"}, false, FraudFlag},
+		{"mutual is checked first", redeem, []any{int64(1), "10.0.0.1", "10.0.0.1", "user-ref"}, true, FraudBlock},
+		{"unknown IPs are not the same", redeem, []any{int64(1), "", "", "user-ref"}, false, FraudAllow},
+		{"redeemer without a referrer", redeem, []any{int64(1), "10.0.0.1", "10.0.0.2", ""}, true, FraudAllow},
+		{"unknown referrer", redeem, nil, false, FraudAllow},
+		{"other credits are ignored", FraudEvent{Type: FraudEventCredit, UserID: 2, Amount: 100, Kind: TxKindReferral, Memo: "owner-ref"},
+			[]any{int64(1), "10.0.0.1", "10.0.0.1", "user-ref"}, true, FraudAllow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := fakeQuerier(t, func(query string, args []any) [][]any {
+				switch {
+				case strings.Contains(query, "from users owner, users redeemer") && tt.owner != nil:
+					return [][]any{tt.owner}
+				case strings.Contains(query, "from point_transactions"):
+					return [][]any{{tt.mutual}}
+				}
+				return nil
+			})
+
+			action, _, err := rule.Check(q, tt.ev)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if action != tt.wantAction {
+				t.Errorf("Check() action = %s, want %s", fraudActionName(action), fraudActionName(tt.wantAction))
+			}
+		})
+	}
+}
+
+func TestCreditsLockTheUserBeforeTheFraudRules(t *testing.T) {
+	db := &ledgerDB{scores: map[int64]int64{1: 0}}
+	repo, fake := newFakeRepository(t, func(query string, args []any) [][]any {
+		if strings.Contains(query, "from point_transactions") {
+			return [][]any{{int64(0)}}
+		}
+		return db.respond(query, args)
+	})
+	repo.FraudRules = []FraudRule{VelocityRule{Window: time.Hour, MaxPoints: 100, Action: FraudBlock}}
+
+	err := repo.withTx(context.Background(), func(tx *sql.Tx) error {
+		return repo.applyPoints(tx, 1, 10, TxKindTask, "")
+	})
+	if err != nil {
+		t.Fatalf("applyPoints() error = %v", err)
+	}
+
+	lock, rule := -1, -1
+	for i, s := range fake.statements {
+		if strings.Contains(s.query, "from users where id = $1 for update") && lock < 0 {
+			lock = i
+		}
+		if strings.Contains(s.query, "from point_transactions") && rule < 0 {
+			rule = i
+		}
+	}
+	// without the lock two concurrent credits could both read the ledger before either is recorded
+	if lock < 0 || rule < 0 || lock > rule {
+		t.Errorf("user locked at statement %d and ledger read by the rule at %d, want the lock first", lock, rule)
+	}
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes new passwords with the configured algorithm and parameters. Hashes made with any
+// supported algorithm can be verified, NeedsRehash tells which of them should be replaced.
+type PasswordHasher struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // in KiB
+	Argon2Threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	// argon2MinMemory is the least memory in KiB argon2id is configured with, the minimum recommended by OWASP
+	argon2MinMemory = 19 * 1024
+)
+
+// unusablePasswordPrefix marks a password placeholder of a user without a password, see unusablePassword
+const unusablePasswordPrefix = "!"
+
+// NewPasswordHasher returns a hasher with the given parameters, checking that they are in the range the
+// algorithms accept. Parameters of both algorithms are checked, hashes made with either are verified.
+func NewPasswordHasher(algorithm string, bcryptCost, argon2Time, argon2Memory, argon2Threads int) (PasswordHasher, error) {
+	switch {
+	case bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost:
+		return PasswordHasher{}, fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, bcryptCost)
+	case argon2Time < 1 || argon2Time > math.MaxUint32:
+		return PasswordHasher{}, fmt.Errorf("argon2 time must be at least 1, got %d", argon2Time)
+	case argon2Memory < argon2MinMemory || argon2Memory > math.MaxUint32:
+		return PasswordHasher{}, fmt.Errorf("argon2 memory must be at least %d KiB, got %d", argon2MinMemory, argon2Memory)
+	case argon2Threads < 1 || argon2Threads > math.MaxUint8:
+		return PasswordHasher{}, fmt.Errorf("argon2 threads must be between 1 and %d, got %d", math.MaxUint8, argon2Threads)
+	}
+	return PasswordHasher{
+		Algorithm:     algorithm,
+		BcryptCost:    bcryptCost,
+		Argon2Time:    uint32(argon2Time),
+		Argon2Memory:  uint32(argon2Memory),
+		Argon2Threads: uint8(argon2Threads),
+	}, nil
+}
+
+// Hash hashes the password. Argon2id hashes are stored in the PHC string format,
+// like $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>.
+func (h PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == HashArgon2id {
+		salt := make([]byte, argon2SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// Verify compares the password with a hash made by any supported algorithm. Nothing matches a password
+// placeholder, the password is hashed anyway so that the answer takes as long as for a real hash.
+func (h PasswordHasher) Verify(password, hash string) (bool, error) {
+	if strings.HasPrefix(hash, unusablePasswordPrefix) {
+		_, err := h.Hash(password)
+		return false, err
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, fmt.Errorf("failed to compare passwords: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// NeedsRehash tells whether the hash was made with another algorithm or other parameters than configured now
+func (h PasswordHasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, _, _, err := parseArgon2id(hash)
+		return err != nil || h.Algorithm != HashArgon2id || params.Argon2Time != h.Argon2Time ||
+			params.Argon2Memory != h.Argon2Memory || params.Argon2Threads != h.Argon2Threads
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || h.Algorithm == HashArgon2id || cost != h.BcryptCost
+}
+
+// parseArgon2id splits an argon2id hash in the PHC string format into its parameters, salt and key
+func parseArgon2id(hash string) (PasswordHasher, []byte, []byte, error) {
+	params := PasswordHasher{Algorithm: HashArgon2id}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads)
+	if err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,224 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters keep the tests fast, they are not meant for real passwords
+var (
+	testBcrypt   = PasswordHasher{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}
+	testArgon2id = PasswordHasher{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+)
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name                       string
+		cost, time, memory, thread int
+		wantErr                    bool
+	}{
+		{"defaults", 12, 3, 64 * 1024, 2, false},
+		{"bcrypt cost too low", bcrypt.MinCost - 1, 3, 64 * 1024, 2, true},
+		{"bcrypt cost too high", bcrypt.MaxCost + 1, 3, 64 * 1024, 2, true},
+		{"no argon2 time", 12, 0, 64 * 1024, 2, true},
+		{"argon2 memory too low", 12, 3, argon2MinMemory - 1, 2, true},
+		{"no argon2 threads", 12, 3, 64 * 1024, 0, true},
+		{"argon2 threads overflow uint8", 12, 3, 64 * 1024, 256, true},
+	}
+	for _, tt := range tests {
+		h, err := NewPasswordHasher(HashArgon2id, tt.cost, tt.time, tt.memory, tt.thread)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: NewPasswordHasher() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && (h.Argon2Time != uint32(tt.time) || h.Argon2Memory != uint32(tt.memory) || h.Argon2Threads != uint8(tt.thread)) {
+			t.Errorf("%s: NewPasswordHasher() = %+v", tt.name, h)
+		}
+	}
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	for _, h := range []PasswordHasher{testBcrypt, testArgon2id} {
+		t.Run(h.Algorithm, func(t *testing.T) {
+			hash, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name     string
+				password string
+				want     bool
+			}{
+				{"same password", "correct horse", true},
+				{"other password", "correct horsE", false},
+				{"prefix", "correct", false},
+				{"empty", "", false},
+			}
+			for _, tt := range tests {
+				got, err := h.Verify(tt.password, hash)
+				if err != nil {
+					t.Errorf("%s: Verify() error = %v", tt.name, err)
+				}
+				if got != tt.want {
+					t.Errorf("%s: Verify() = %v, want %v", tt.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerifyMalformed(t *testing.T) {
+	hashes := []string{
+		"",
+		"plain text",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+	}
+	for _, hash := range hashes {
+		ok, err := testArgon2id.Verify("password", hash)
+		if ok || err == nil {
+			t.Errorf("Verify() with hash %q = %v, %v, want an error", hash, ok, err)
+		}
+	}
+}
+
+func TestPasswordHasherVerifyUnusablePassword(t *testing.T) {
+	placeholder, err := unusablePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []PasswordHasher{testBcrypt, testArgon2id} {
+		for _, password := range []string{"", "password", placeholder, strings.TrimPrefix(placeholder, unusablePasswordPrefix)} {
+			ok, err := h.Verify(password, placeholder)
+			if ok || err != nil {
+				t.Errorf("%s: Verify(%q) with a placeholder = %v, %v, want false, nil", h.Algorithm, password, ok, err)
+			}
+		}
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	hash, err := testArgon2id.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Hash() = %q, want the PHC string format", hash)
+	}
+
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Argon2Time != 1 || params.Argon2Memory != 1024 || params.Argon2Threads != 1 {
+		t.Errorf("parseArgon2id() params = %+v", params)
+	}
+	if len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("parseArgon2id() salt %d and key %d bytes, want %d and %d", len(salt), len(key), argon2SaltLength, argon2KeyLength)
+	}
+
+	_, _, _, err = parseArgon2id("$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5")
+	if !errors.Is(err, errUnknownHash) {
+		t.Errorf("parseArgon2id() error = %v, want %v", err, errUnknownHash)
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	bcryptHash, err := testBcrypt.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := testArgon2id.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	costlier := testBcrypt
+	costlier.BcryptCost++
+	moreMemory := testArgon2id
+	moreMemory.Argon2Memory *= 2
+	moreTime := testArgon2id
+	moreTime.Argon2Time++
+
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"bcrypt with same cost", testBcrypt, bcryptHash, false},
+		{"bcrypt with higher cost configured", costlier, bcryptHash, true},
+		{"bcrypt when argon2id is configured", testArgon2id, bcryptHash, true},
+		{"argon2id with same parameters", testArgon2id, argon2Hash, false},
+		{"argon2id with more memory configured", moreMemory, argon2Hash, true},
+		{"argon2id with more time configured", moreTime, argon2Hash, true},
+		{"argon2id when bcrypt is configured", testBcrypt, argon2Hash, true},
+		{"unknown format", testBcrypt, "plain text", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBcryptToArgon2idRehash follows a password through the switch of the algorithm: the old bcrypt hash still
+// verifies, is reported for rehashing, and the new argon2id hash verifies and is up to date
+func TestBcryptToArgon2idRehash(t *testing.T) {
+	old, err := testBcrypt.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := testArgon2id.Verify("password", old)
+	if err != nil || !ok {
+		t.Fatalf("Verify() of the bcrypt hash = %v, %v", ok, err)
+	}
+	if !testArgon2id.NeedsRehash(old) {
+		t.Fatal("NeedsRehash() of the bcrypt hash = false")
+	}
+
+	rehashed, err := testArgon2id.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = testArgon2id.Verify("password", rehashed)
+	if err != nil || !ok {
+		t.Fatalf("Verify() of the argon2id hash = %v, %v", ok, err)
+	}
+	if testArgon2id.NeedsRehash(rehashed) {
+		t.Error("NeedsRehash() of the argon2id hash = true")
+	}
+}
+
+// TestBcryptMaxLength shows why the policy caps bcrypt passwords: bcrypt refuses longer passwords,
+// while argon2id uses every byte
+func TestBcryptMaxLength(t *testing.T) {
+	long := strings.Repeat("a", bcryptMaxLength)
+
+	_, err := testBcrypt.Hash(long)
+	if err != nil {
+		t.Errorf("Hash() of %d bytes error = %v", bcryptMaxLength, err)
+	}
+	_, err = testBcrypt.Hash(long + "b")
+	if !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		t.Errorf("Hash() of %d bytes error = %v, want %v", bcryptMaxLength+1, err, bcrypt.ErrPasswordTooLong)
+	}
+
+	hash, err := testArgon2id.Hash(long + "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := testArgon2id.Verify(long+"c", hash)
+	if err != nil || ok {
+		t.Errorf("Verify() with a different last byte = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// IdempotencyRecord is a stored Idempotency-Key together with the response it produced.
+// StatusCode is zero while the first request with the key is still being processed.
+type IdempotencyRecord struct {
+	UserID       int
+	Key          string
+	Fingerprint  string
+	StatusCode   int
+	ResponseBody []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// ReserveIdempotencyKey stores a new key for the user. If the key is already stored and not expired,
+// the stored record is returned instead and nothing is reserved. The reservation is leased for the given
+// time: a key still without a response after the lease ended, because the request never finished, is
+// reserved again.
+func (u *PostgresRepository) ReserveIdempotencyKey(userID int, key, fingerprint string, ttl, lease time.Duration) (*IdempotencyRecord, error) {
+	stmt := `insert into idempotency_keys (user_id, idempotency_key, fingerprint, created_at, expires_at, locked_until)
+             values ($1, $2, $3, now(), now() + $4 * interval '1 second', now() + $5 * interval '1 second')
+             on conflict (user_id, idempotency_key) do update
+                 set fingerprint = excluded.fingerprint, status_code = null, response_body = null,
+                     created_at = excluded.created_at, expires_at = excluded.expires_at, locked_until = excluded.locked_until
+                 where idempotency_keys.expires_at < now()
+                    or (idempotency_keys.status_code is null and idempotency_keys.locked_until <= now())
+             returning user_id`
+
+	var inserted int
+	err := u.queryRow(context.Background(), stmt, userID, key, fingerprint, int64(ttl.Seconds()), int64(lease.Seconds())).Scan(&inserted)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println("failed to reserve idempotency key: ", err)
+		return nil, err
+	}
+
+	query := `select user_id, idempotency_key, fingerprint, coalesce(status_code, 0), response_body, created_at, expires_at
+              from idempotency_keys where user_id = $1 and idempotency_key = $2`
+
+	var rec IdempotencyRecord
+	err = u.queryRow(context.Background(), query, userID, key).Scan(
+		&rec.UserID,
+		&rec.Key,
+		&rec.Fingerprint,
+		&rec.StatusCode,
+		&rec.ResponseBody,
+		&rec.CreatedAt,
+		&rec.ExpiresAt,
+	)
+	if err != nil {
+		log.Println("failed to fetch idempotency key: ", err)
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// SaveIdempotencyResponse stores the response produced for a reserved key so it can be replayed
+func (u *PostgresRepository) SaveIdempotencyResponse(userID int, key string, statusCode int, body []byte) error {
+	stmt := `update idempotency_keys set status_code = $1, response_body = $2, locked_until = null
+             where user_id = $3 and idempotency_key = $4`
+
+	_, err := u.execQuery(context.Background(), stmt, statusCode, body, userID, key)
+	if err != nil {
+		log.Println("failed to save idempotency response: ", err)
+		return err
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey removes a reserved key, so the request can be retried with it
+func (u *PostgresRepository) ReleaseIdempotencyKey(userID int, key string) error {
+	_, err := u.execQuery(context.Background(),
+		`delete from idempotency_keys where user_id = $1 and idempotency_key = $2`, userID, key)
+	if err != nil {
+		log.Println("failed to release idempotency key: ", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys removes all keys whose TTL has passed
+func (u *PostgresRepository) DeleteExpiredIdempotencyKeys() (int64, error) {
+	res, err := u.execQuery(context.Background(), `delete from idempotency_keys where expires_at < now()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
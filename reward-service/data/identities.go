@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrIdentityNotFound = errors.New("external identity is not linked to any user")
+
+// Identity is an account of the user at an external identity provider
+type Identity struct {
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	UserID      int        `json:"user_id"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// GetUserByIdentity returns the id of the user linked to the external identity and records the login
+func (u *PostgresRepository) GetUserByIdentity(provider, subject string) (int, error) {
+	var userID int
+	err := u.queryRow(context.Background(),
+		`update identities set last_login_at = now() where provider = $1 and subject = $2 returning user_id`,
+		provider, subject).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrIdentityNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch identity: ", err)
+		return 0, err
+	}
+	return userID, nil
+}
+
+// LinkIdentity links the external identity to an existing user. When the provider verified the email
+// of the user, the user is activated as if the email was verified here. Whoever registered the inactive
+// account never proved to own the email, so its password is replaced and its sessions are revoked.
+func (u *PostgresRepository) LinkIdentity(userID int, provider, subject, email string, emailVerified bool) error {
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		_, err := tx.ExecContext(ctx,
+			`insert into identities (provider, subject, user_id, email, created_at, last_login_at)
+             values ($1, $2, $3, nullif($4, ''), now(), now())`, provider, subject, userID, email)
+		if err != nil {
+			return fmt.Errorf("failed to link identity: %w", err)
+		}
+		if !emailVerified {
+			return nil
+		}
+
+		var active int
+		err = tx.QueryRowContext(ctx, `select active from users where id = $1 for update`, userID).Scan(&active)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch user: %w", err)
+		}
+		if active == 1 {
+			return nil
+		}
+
+		password, err := unusablePassword()
+		if err != nil {
+			return err
+		}
+		err = setPassword(tx, userID, password)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `update users set active = 1, updated_at = now() where id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to activate user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to link %s identity to user %d: %v", provider, userID, err)
+		return err
+	}
+	return nil
+}
+
+// InsertWithIdentity creates a user who signed up with an external identity provider and links the identity.
+// The user has no usable password until one is set through the password reset.
+func (u *PostgresRepository) InsertWithIdentity(user User, provider, subject string) (int, error) {
+	err := u.checkFraud(u.Conn, FraudEvent{Type: FraudEventRegistration, IP: user.RegistrationIP})
+	if err != nil {
+		return 0, err
+	}
+
+	password, err := unusablePassword()
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		err := tx.QueryRowContext(ctx,
+			`insert into users (email, first_name, last_name, password, active, score, created_at, updated_at, registration_ip)
+             values ($1, $2, $3, $4, $5, 0, now(), now(), nullif($6, '')) returning id`,
+			user.Email, user.FirstName, user.LastName, password, user.Active, user.RegistrationIP,
+		).Scan(&newID)
+		if err != nil {
+			return fmt.Errorf("failed to insert new user: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`insert into identities (provider, subject, user_id, email, created_at, last_login_at)
+             values ($1, $2, $3, nullif($4, ''), now(), now())`, provider, subject, newID, user.Email)
+		if err != nil {
+			return fmt.Errorf("failed to link identity: %w", err)
+		}
+
+		return emitEvent(tx, DomainUserRegistered, newID, registeredEvent(newID, user, provider))
+	})
+	if err != nil {
+		log.Printf("failed to create user with %s identity: %v", provider, err)
+		return 0, err
+	}
+	return newID, nil
+}
+
+// unusablePassword returns a password placeholder no password hashes to, the user has to set a password
+// through the password reset before logging in with one
+func unusablePassword() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password placeholder: %w", err)
+	}
+	return unusablePasswordPrefix + hex.EncodeToString(b), nil
+}
+
+// GetIdentities returns the external identities linked to the user
+func (u *PostgresRepository) GetIdentities(userID int) ([]*Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select provider, subject, user_id, coalesce(email, ''), created_at, last_login_at
+         from identities where user_id = $1 order by created_at`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		var i Identity
+		err := rows.Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.CreatedAt, &i.LastLoginAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %w", err)
+		}
+		identities = append(identities, &i)
+	}
+	return identities, rows.Err()
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Statuses of a received webhook event
+const (
+	WebhookProcessing = "processing"
+	WebhookProcessed  = "processed"
+	WebhookIgnored    = "ignored"
+	WebhookRejected   = "rejected"
+)
+
+var ErrWebhookEventFinished = errors.New("webhook event was already processed")
+
+// WebhookEvent is an event received from an external system, identified by the source and the event id
+type WebhookEvent struct {
+	Source      string     `json:"source"`
+	EventID     string     `json:"event_id"`
+	EventType   string     `json:"event_type"`
+	UserID      int        `json:"user_id,omitempty"`
+	Status      string     `json:"status"`
+	Detail      string     `json:"detail,omitempty"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+}
+
+// ReserveWebhookEvent records that the event is being processed. The reservation is leased for the given
+// time: an event still processing after the lease ended, because the process died before finishing it,
+// is reserved again. When the event was already received, the stored event is returned instead and
+// nothing is reserved.
+func (u *PostgresRepository) ReserveWebhookEvent(ev WebhookEvent, lease time.Duration) (*WebhookEvent, error) {
+	var source string
+	err := u.queryRow(context.Background(),
+		`insert into webhook_events (source, event_id, event_type, user_id, status, received_at, locked_until)
+         values ($1, $2, $3, nullif($4, 0), $5, now(), now() + $6 * interval '1 second')
+         on conflict (source, event_id) do update
+             set event_type = excluded.event_type, user_id = excluded.user_id, locked_until = excluded.locked_until
+             where webhook_events.status = $5 and webhook_events.locked_until <= now()
+         returning source`,
+		ev.Source, ev.EventID, ev.EventType, ev.UserID, WebhookProcessing, int64(lease.Seconds())).Scan(&source)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println("failed to reserve webhook event: ", err)
+		return nil, err
+	}
+
+	stored := WebhookEvent{Source: ev.Source, EventID: ev.EventID}
+	err = u.queryRow(context.Background(),
+		`select event_type, coalesce(user_id, 0), status, coalesce(detail, ''), received_at, processed_at
+         from webhook_events where source = $1 and event_id = $2`, ev.Source, ev.EventID).Scan(
+		&stored.EventType, &stored.UserID, &stored.Status, &stored.Detail, &stored.ReceivedAt, &stored.ProcessedAt)
+	if err != nil {
+		log.Println("failed to fetch webhook event: ", err)
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// CompleteWebhookTask completes the task for the user of the event and marks the event processed in the same
+// transaction, so the points of an event are credited once even when the process dies right after the commit.
+// ErrWebhookEventFinished is returned when another delivery of the event has finished it in the meantime.
+func (u *PostgresRepository) CompleteWebhookTask(ev WebhookEvent, task Task, proof Proof) (*TaskCompletion, error) {
+	return u.createCompletion(ev.UserID, task, proof, true, func(tx *sql.Tx, c *TaskCompletion) error {
+		detail := fmt.Sprintf("task %s completed, completion %d, %d points", task.Code, c.ID, c.Points)
+		res, err := tx.ExecContext(context.Background(),
+			`update webhook_events set status = $1, detail = $2, processed_at = now(), locked_until = null
+             where source = $3 and event_id = $4 and status = $5`,
+			WebhookProcessed, detail, ev.Source, ev.EventID, WebhookProcessing)
+		if err != nil {
+			return fmt.Errorf("failed to finish webhook event: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to finish webhook event: %w", err)
+		}
+		if n == 0 {
+			return ErrWebhookEventFinished
+		}
+		return nil
+	})
+}
+
+// FinishWebhookEvent stores the outcome of processing the event
+func (u *PostgresRepository) FinishWebhookEvent(source, eventID, status, detail string) error {
+	_, err := u.execQuery(context.Background(),
+		`update webhook_events set status = $1, detail = nullif($2, ''), processed_at = now(), locked_until = null
+         where source = $3 and event_id = $4`, status, detail, source, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to finish webhook event: %w", err)
+	}
+	return nil
+}
+
+// ReleaseWebhookEvent forgets the event, so the source can deliver it again after a temporary failure
+func (u *PostgresRepository) ReleaseWebhookEvent(source, eventID string) error {
+	_, err := u.execQuery(context.Background(),
+		`delete from webhook_events where source = $1 and event_id = $2`, source, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to release webhook event: %w", err)
+	}
+	return nil
+}
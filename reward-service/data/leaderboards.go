@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Leaderboards: the current balance, the points earned over all time or within a window
+const (
+	BoardBalance  = "balance"
+	BoardLifetime = "lifetime"
+	BoardEarned   = "earned"
+)
+
+// Windows of the earned leaderboard
+const (
+	WindowAll   = "all"
+	WindowDay   = "day"
+	WindowWeek  = "week"
+	WindowMonth = "month"
+)
+
+var ErrUnknownBoard = errors.New("unknown leaderboard or window")
+
+var windowIntervals = map[string]string{
+	WindowDay:   "1 day",
+	WindowWeek:  "7 days",
+	WindowMonth: "30 days",
+}
+
+// LeaderboardEntry is a place on a leaderboard
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	UserID    int    `json:"user_id"`
+	FirstName string `json:"first_name"`
+	Points    int    `json:"points"`
+}
+
+// GetTopUsers returns the first limit places of the leaderboard. The balance and lifetime boards only have the
+// all window, the earned board counts the points earned within the window like the weekly rank badge does.
+func (u *PostgresRepository) GetTopUsers(board, window string, limit int) ([]*LeaderboardEntry, error) {
+	var query string
+	var args []any
+	switch {
+	case board == BoardBalance && window == WindowAll:
+		query = `select rank() over (order by score desc), id, first_name, score
+                 from users order by score desc, id limit $1`
+		args = []any{limit}
+	case board == BoardLifetime && window == WindowAll, board == BoardEarned && window == WindowAll:
+		query = `select rank() over (order by lifetime_points desc), id, first_name, lifetime_points
+                 from users order by lifetime_points desc, id limit $1`
+		args = []any{limit}
+	case board == BoardEarned && windowIntervals[window] != "":
+		query = `select rank() over (order by sum(t.amount) desc), u.id, u.first_name, sum(t.amount)
+                 from point_transactions t join users u on u.id = t.user_id
+                 where t.amount > 0 and t.kind <> $2 and t.created_at >= now() - $3::interval
+                 group by u.id, u.first_name order by sum(t.amount) desc, u.id limit $1`
+		args = []any{limit, TxKindTransferIn, windowIntervals[window]}
+	default:
+		return nil, ErrUnknownBoard
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s leaderboard: %w", board, err)
+	}
+	defer rows.Close()
+
+	entries := []*LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		err := rows.Scan(&e.Rank, &e.UserID, &e.FirstName, &e.Points)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan leaderboard entry: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
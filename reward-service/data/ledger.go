@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Kinds of entries written to the points ledger
+const (
+	TxKindTask        = "task"
+	TxKindReferral    = "referral"
+	TxKindReferred    = "referred"
+	TxKindTransferIn  = "transfer_in"
+	TxKindTransferOut = "transfer_out"
+	TxKindExpiry      = "expiry"
+)
+
+// Transaction is one entry of the user's points history
+type Transaction struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Amount    int       `json:"amount"`
+	Kind      string    `json:"kind"`
+	Memo      string    `json:"memo,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// applyPoints changes the score of the user by amount and records the change in the ledger, must be called inside a transaction.
+// Credits go through the fraud checks first and open a new lot of points, debits write off the expired lots
+// and then consume the oldest lots first. The user row is locked before the fraud rules read the ledger of the user,
+// so two concurrent credits can't both pass the checks.
+func (u *PostgresRepository) applyPoints(tx *sql.Tx, userID, amount int, kind, memo string) error {
+	err := lockUsers(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if amount > 0 {
+		err := u.checkFraud(tx, FraudEvent{Type: FraudEventCredit, UserID: userID, Amount: amount, Kind: kind, Memo: memo})
+		if err != nil {
+			return err
+		}
+	}
+	if amount < 0 {
+		// consumeLots skips expired lots, their points must leave the score before the debit does
+		err := expireUserLots(tx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = recordPoints(tx, userID, amount, kind, memo)
+	if err != nil {
+		return err
+	}
+
+	if isEarned(kind, amount) {
+		err = addLifetimePoints(tx, userID, amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	if amount > 0 {
+		return addLot(tx, userID, amount)
+	}
+	if amount < 0 {
+		_, err = consumeLots(tx, userID, -amount)
+		return err
+	}
+	return nil
+}
+
+// movePoints moves amount of points from one user to another, must be called inside a transaction. The recipient
+// gets the lots taken from the sender with their original expiry, so passing points on doesn't renew them.
+func (u *PostgresRepository) movePoints(tx *sql.Tx, senderID, recipientID, amount int, memo string) error {
+	err := lockUsers(tx, lockOrder(senderID, recipientID)...)
+	if err != nil {
+		return err
+	}
+
+	err = u.checkFraud(tx, FraudEvent{Type: FraudEventCredit, UserID: recipientID, Amount: amount, Kind: TxKindTransferIn, Memo: memo})
+	if err != nil {
+		return err
+	}
+
+	err = recordPoints(tx, senderID, -amount, TxKindTransferOut, memo)
+	if err != nil {
+		return err
+	}
+	taken, err := consumeLots(tx, senderID, amount)
+	if err != nil {
+		return err
+	}
+
+	err = recordPoints(tx, recipientID, amount, TxKindTransferIn, memo)
+	if err != nil {
+		return err
+	}
+	return moveLots(tx, recipientID, taken)
+}
+
+// lockUsers locks the rows of the users in the given order. Locking a row the transaction already holds is a no-op.
+func lockUsers(tx *sql.Tx, userIDs ...int) error {
+	for _, id := range userIDs {
+		_, err := tx.ExecContext(context.Background(), `select id from users where id = $1 for update`, id)
+		if err != nil {
+			return fmt.Errorf("failed to lock user %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// recordPoints changes the score, writes the ledger entry and queues the events without touching the lots
+func recordPoints(tx *sql.Tx, userID, amount int, kind, memo string) error {
+	var score int
+	stmt := `update users set score = score + $1, updated_at = $2 where id = $3 returning score`
+	err := tx.QueryRowContext(context.Background(), stmt, amount, time.Now(), userID).Scan(&score)
+	if err != nil {
+		return fmt.Errorf("failed to change score of user %d: %w", userID, err)
+	}
+
+	stmt = `insert into point_transactions (user_id, amount, kind, memo, created_at) values ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(context.Background(), stmt, userID, amount, kind, memo, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record transaction of user %d: %w", userID, err)
+	}
+
+	event := map[string]any{
+		"user_id": userID,
+		"amount":  amount,
+		"kind":    kind,
+		"memo":    memo,
+		"score":   score,
+	}
+	eventType := DomainPointsAwarded
+	if amount < 0 {
+		eventType = DomainPointsSpent
+	}
+	err = emitEvent(tx, eventType, userID, event)
+	if err != nil {
+		return err
+	}
+
+	return notifyLive(tx, LiveUpdate{Type: LiveBalance, UserID: userID, Score: score, Amount: amount, Kind: kind})
+}
+
+// GetHistory returns the latest ledger entries of the user, newest first
+func (u *PostgresRepository) GetHistory(userID, limit int) ([]*Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, amount, kind, coalesce(memo, ''), created_at
+              from point_transactions where user_id = $1 order by created_at desc, id desc limit $2`
+
+	rows, err := u.Conn.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []*Transaction
+	for rows.Next() {
+		var t Transaction
+		err := rows.Scan(&t.ID, &t.UserID, &t.Amount, &t.Kind, &t.Memo, &t.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning transaction: %v", err)
+			return nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		history = append(history, &t)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// LiveChannel is the Postgres channel the live updates are sent through, so that every replica receives them
+const LiveChannel = "live_updates"
+
+// Types of live updates
+const (
+	LiveBalance = "balance"
+	LiveBadge   = "badge"
+)
+
+// LiveUpdate is a change pushed to connected clients: a new balance of the user or a newly awarded badge
+type LiveUpdate struct {
+	Type   string `json:"type"`
+	UserID int    `json:"user_id"`
+	Score  int    `json:"score"`
+	Amount int    `json:"amount,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	Badge  *Badge `json:"badge,omitempty"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// notifyLive sends the update to the listeners of LiveChannel. Sent in a transaction, the notification is
+// delivered only when the transaction commits.
+func notifyLive(e execer, update LiveUpdate) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to encode live update: %w", err)
+	}
+	_, err = e.ExecContext(context.Background(), `select pg_notify($1, $2)`, LiveChannel, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send live update: %w", err)
+	}
+	return nil
+}
+
+// ListenLiveUpdates listens to LiveChannel on a dedicated connection and calls fn for every update.
+// It blocks until ctx is done or the connection fails.
+func (u *PostgresRepository) ListenLiveUpdates(ctx context.Context, fn func(LiveUpdate)) error {
+	conn, err := u.Conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection for live updates: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+
+		_, err := pgConn.Exec(ctx, "listen "+LiveChannel)
+		if err != nil {
+			return fmt.Errorf("failed to listen to %s: %w", LiveChannel, err)
+		}
+
+		for {
+			n, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				// the connection goes back to the pool, it must not keep listening
+				_, unlistenErr := pgConn.Exec(context.Background(), "unlisten *")
+				if unlistenErr != nil {
+					return errors.Join(err, driver.ErrBadConn)
+				}
+				return fmt.Errorf("stopped listening to %s: %w", LiveChannel, err)
+			}
+
+			var update LiveUpdate
+			err = json.Unmarshal([]byte(n.Payload), &update)
+			if err != nil {
+				log.Printf("failed to decode live update %q: %v", n.Payload, err)
+				continue
+			}
+			fn(update)
+		}
+	})
+}
+
+// GetRank returns the place of the user on the leaderboard and the score of the user
+func (u *PostgresRepository) GetRank(userID int) (int, int, error) {
+	var rank, score int
+	err := u.queryRow(context.Background(),
+		`select (select count(*) from users o where o.score > u.score) + 1, u.score from users u where u.id = $1`,
+		userID).Scan(&rank, &score)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get rank of user %d: %w", userID, err)
+	}
+	return rank, score, nil
+}
+
+// Standing is the place of a user on the leaderboard and the score of the user
+type Standing struct {
+	Rank  int
+	Score int
+}
+
+// GetStandings returns the ranks and the scores of the users by id, users which don't exist are left out
+func (u *PostgresRepository) GetStandings(ids []int) (map[int]Standing, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select u.id, (select count(*) from users o where o.score > u.score) + 1, u.score from users u where u.id = any($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch standings: %w", err)
+	}
+	defer rows.Close()
+
+	standings := make(map[int]Standing)
+	for rows.Next() {
+		var id int
+		var s Standing
+		err := rows.Scan(&id, &s.Rank, &s.Score)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan standing: %w", err)
+		}
+		standings[id] = s
+	}
+	return standings, rows.Err()
+}
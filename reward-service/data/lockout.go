@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// LockoutPolicy configures the lockout after failed logins: after Threshold failures in a row the key is
+// locked for Base, every further failure doubles the lock up to Max
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// lockFor returns how long a key is locked after the number of failures in a row, zero when it is not locked
+func (p LockoutPolicy) lockFor(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	lock := p.Base
+	for i := p.Threshold; i < failures && lock < p.Max; i++ {
+		lock *= 2
+	}
+	return min(lock, p.Max)
+}
+
+// GetLoginLock returns the time until which any of the keys is locked, zero time when none is locked
+func (u *PostgresRepository) GetLoginLock(keys ...string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := u.queryRow(context.Background(),
+		`select max(locked_until) from login_failures where key = any($1) and locked_until > now()`, keys).Scan(&lockedUntil)
+	if err != nil {
+		log.Println("failed to check login lock: ", err)
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// RecordLoginFailure counts a failed login for the key and locks it when the policy says so,
+// failures older than a day are forgotten. Returns the time until which the key is locked, zero time when it is not locked.
+func (u *PostgresRepository) RecordLoginFailure(key string, policy LockoutPolicy) (time.Time, error) {
+	var failures int
+	err := u.queryRow(context.Background(),
+		`insert into login_failures (key, failures, last_failure_at) values ($1, 1, now())
+         on conflict (key) do update set
+             failures = case when login_failures.last_failure_at < now() - interval '1 day' then 1
+                             else login_failures.failures + 1 end,
+             last_failure_at = now()
+         returning failures`, key).Scan(&failures)
+	if err != nil {
+		log.Println("failed to record login failure: ", err)
+		return time.Time{}, err
+	}
+	lock := policy.lockFor(failures)
+	if lock == 0 {
+		return time.Time{}, nil
+	}
+
+	var lockedUntil time.Time
+	err = u.queryRow(context.Background(),
+		`update login_failures set locked_until = now() + $1 * interval '1 second' where key = $2 returning locked_until`,
+		int64(lock.Seconds()), key).Scan(&lockedUntil)
+	if err != nil {
+		log.Println("failed to lock login: ", err)
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+// ResetLoginFailures forgets the failed logins of the keys, which also unlocks them
+func (u *PostgresRepository) ResetLoginFailures(keys ...string) error {
+	_, err := u.execQuery(context.Background(), `delete from login_failures where key = any($1)`, keys)
+	if err != nil {
+		log.Println("failed to reset login failures: ", err)
+		return err
+	}
+	return nil
+}
+
+// GetEmailByID returns the email of the user
+func (u *PostgresRepository) GetEmailByID(id int) (string, error) {
+	var email string
+	err := u.queryRow(context.Background(), `select email from users where id = $1`, id).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch user's email: %w", err)
+	}
+	return email, nil
+}
@@ -0,0 +1,36 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyLockFor(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 5, Base: time.Minute, Max: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{7, 4 * time.Minute},
+		{8, 8 * time.Minute},
+		{9, 10 * time.Minute},
+		{50, 10 * time.Minute},
+		// a counter far past the threshold must not overflow the duration
+		{1 << 20, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.lockFor(tt.failures); got != tt.want {
+			t.Errorf("lockFor(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	capped := LockoutPolicy{Threshold: 1, Base: time.Hour, Max: time.Minute}
+	if got := capped.lockFor(1); got != time.Minute {
+		t.Errorf("lockFor() with Base above Max = %v, want %v", got, time.Minute)
+	}
+}
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// pointsLifetime is how long earned points stay spendable, in Postgres interval syntax
+const pointsLifetime = "12 months"
+
+// Expiration is an amount of points which expire at the same day
+type Expiration struct {
+	Amount    int       `json:"amount"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PointsBalance is the spendable balance of the user together with the upcoming expirations
+type PointsBalance struct {
+	Balance     int           `json:"balance"`
+	Expirations []*Expiration `json:"expirations"`
+}
+
+// addLot records a credit as a new lot of points which expires after pointsLifetime
+func addLot(tx *sql.Tx, userID, amount int) error {
+	stmt := `insert into point_lots (user_id, amount, remaining, earned_at, expires_at)
+             values ($1, $2, $2, now(), now() + interval '` + pointsLifetime + `')`
+	_, err := tx.ExecContext(context.Background(), stmt, userID, amount)
+	if err != nil {
+		return fmt.Errorf("failed to add points lot: %w", err)
+	}
+	return nil
+}
+
+// consumeLots takes amount of points from the lots of the user, oldest lots first.
+// The taken points are returned per lot, with the expiry of the lot they came from.
+func consumeLots(tx *sql.Tx, userID, amount int) ([]*Expiration, error) {
+	ctx := context.Background()
+
+	rows, err := tx.QueryContext(ctx,
+		`select id, remaining, expires_at from point_lots
+         where user_id = $1 and remaining > 0 and expires_at > now()
+         order by expires_at, id for update`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock points lots: %w", err)
+	}
+
+	type lot struct {
+		id, remaining int
+		expiresAt     time.Time
+	}
+	var lots []lot
+	for rows.Next() {
+		var l lot
+		if err := rows.Scan(&l.id, &l.remaining, &l.expiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan points lot: %w", err)
+		}
+		lots = append(lots, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var taken []*Expiration
+	for _, l := range lots {
+		if amount == 0 {
+			break
+		}
+		take := min(l.remaining, amount)
+		_, err = tx.ExecContext(ctx, `update point_lots set remaining = remaining - $1 where id = $2`, take, l.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to consume points lot: %w", err)
+		}
+		taken = append(taken, &Expiration{Amount: take, ExpiresAt: l.expiresAt})
+		amount -= take
+	}
+	if amount > 0 {
+		log.Printf("user %d spent %d points not covered by any lot", userID, amount)
+	}
+	return taken, nil
+}
+
+// moveLots gives the points taken from the lots of another user to the user, each part keeps its expiry
+func moveLots(tx *sql.Tx, userID int, taken []*Expiration) error {
+	for _, e := range taken {
+		_, err := tx.ExecContext(context.Background(),
+			`insert into point_lots (user_id, amount, remaining, earned_at, expires_at) values ($1, $2, $2, now(), $3)`,
+			userID, e.Amount, e.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to move points lot: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetPointsBalance returns the score of the user and the points which are going to expire, grouped by day
+func (u *PostgresRepository) GetPointsBalance(userID int) (*PointsBalance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var balance PointsBalance
+	err := u.Conn.QueryRowContext(ctx, `select score from users where id = $1`, userID).Scan(&balance.Balance)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch score: %w", err)
+	}
+
+	query := `select sum(remaining), date_trunc('day', expires_at) as day from point_lots
+              where user_id = $1 and remaining > 0 and expires_at > now()
+              group by day order by day`
+
+	rows, err := u.Conn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch expirations: %w", err)
+	}
+	defer rows.Close()
+
+	balance.Expirations = []*Expiration{}
+	for rows.Next() {
+		var e Expiration
+		if err := rows.Scan(&e.Amount, &e.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan expiration: %w", err)
+		}
+		balance.Expirations = append(balance.Expirations, &e)
+	}
+
+	return &balance, rows.Err()
+}
+
+// ExpirePoints writes off every lot whose expiry date has passed, returns the number of users affected
+func (u *PostgresRepository) ExpirePoints() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select distinct user_id from point_lots where remaining > 0 and expires_at <= now() limit 500`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired lots: %w", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan user id: %w", err)
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range userIDs {
+		err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+			return expireUserLots(tx, id)
+		})
+		if err != nil {
+			log.Printf("failed to expire points of user %d: %v", id, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// expireUserLots writes off the expired lots of one user. The user row is locked before the lots,
+// in the same order applyPoints uses, so the worker can't deadlock with a concurrent credit.
+func expireUserLots(tx *sql.Tx, userID int) error {
+	ctx := context.Background()
+
+	err := lockUsers(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	var total int
+	err = tx.QueryRowContext(ctx,
+		`select coalesce(sum(remaining), 0) from (
+             select remaining from point_lots
+             where user_id = $1 and remaining > 0 and expires_at <= now() for update
+         ) expired`, userID).Scan(&total)
+	if err != nil {
+		return fmt.Errorf("failed to lock expired lots: %w", err)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`update point_lots set remaining = 0 where user_id = $1 and remaining > 0 and expires_at <= now()`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to expire lots: %w", err)
+	}
+
+	return recordPoints(tx, userID, -total, TxKindExpiry, fmt.Sprintf("%d points expired", total))
+}
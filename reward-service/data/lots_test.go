@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lotsDB answers the query for the spendable lots of the user with the lots, given as id, remaining points and expiry
+func lotsDB(lots ...[]any) func(query string, args []any) [][]any {
+	return func(query string, args []any) [][]any {
+		if strings.Contains(query, "from point_lots") && strings.Contains(query, "for update") {
+			return lots
+		}
+		return nil
+	}
+}
+
+// ledgerDB is a fake of the users and their points for the paths which change scores. Scores follow the
+// updates run on them, the expired points of a user are gone once their lots were written off.
+type ledgerDB struct {
+	scores    map[int64]int64
+	expired   map[int64]int64
+	sentToday int64
+}
+
+func (l *ledgerDB) respond(query string, args []any) [][]any {
+	switch {
+	case strings.Contains(query, "from users where id = $1 for update"):
+		if _, ok := l.scores[args[0].(int64)]; ok {
+			return [][]any{{args[0]}}
+		}
+	case strings.Contains(query, "select score from users where id = $1"):
+		return [][]any{{l.scores[args[0].(int64)]}}
+	case strings.Contains(query, "update users set score = score + $1"):
+		l.scores[args[2].(int64)] += args[0].(int64)
+		return [][]any{{l.scores[args[2].(int64)]}}
+	case strings.Contains(query, "returning tier_points, tier_id"):
+		return [][]any{{args[0], int64(1)}}
+	case strings.Contains(query, "from tiers reached, tiers current"):
+		return [][]any{{int64(1), int64(0), int64(0)}}
+	case strings.Contains(query, "coalesce(sum(remaining), 0)"):
+		return [][]any{{l.expired[args[0].(int64)]}}
+	case strings.Contains(query, "update point_lots set remaining = 0"):
+		delete(l.expired, args[0].(int64))
+	case strings.Contains(query, "sum(amount)"):
+		return [][]any{{l.sentToday}}
+	case strings.Contains(query, "insert into transfers"):
+		return [][]any{{int64(1), time.Now()}}
+	case strings.Contains(query, "from streaks where user_id = $1"):
+		return [][]any{{"UTC", int64(0), int64(0), nil, int64(0)}}
+	}
+	return nil
+}
+
+func TestDebitsWriteOffExpiredPointsFirst(t *testing.T) {
+	// the user has 100 points in the score, 30 of them expired but the worker hasn't written them off yet
+	debits := []struct {
+		name  string
+		debit func(repo *PostgresRepository, amount int) error
+	}{
+		{"transfer", func(repo *PostgresRepository, amount int) error {
+			_, err := repo.TransferPoints(Transfer{SenderID: 1, RecipientID: 2, Amount: amount}, 0)
+			return err
+		}},
+		{"streak freeze", func(repo *PostgresRepository, amount int) error {
+			_, err := repo.BuyStreakFreeze(1, CheckinRules{MaxFreezes: 1, FreezePrice: amount})
+			return err
+		}},
+		{"ledger debit", func(repo *PostgresRepository, amount int) error {
+			return repo.withTx(context.Background(), func(tx *sql.Tx) error {
+				return repo.applyPoints(tx, 1, -amount, TxKindStreakFreeze, "")
+			})
+		}},
+	}
+	for _, d := range debits {
+		t.Run(d.name, func(t *testing.T) {
+			db := &ledgerDB{scores: map[int64]int64{1: 100, 2: 0}, expired: map[int64]int64{1: 30}}
+			repo, fake := newFakeRepository(t, db.respond)
+
+			err := d.debit(repo, 50)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db.scores[1] != 20 {
+				t.Errorf("score after spending 50 of 100 points with 30 expired = %d, want 20", db.scores[1])
+			}
+			// the expiry is written before the debit, never after it
+			changes := fake.ran("update users set score = score + $1")
+			if len(changes) == 0 || changes[0][0] != int64(-30) {
+				t.Errorf("score changes %v, want the expiry of 30 points first", changes)
+			}
+		})
+	}
+
+	for _, d := range debits[:2] {
+		t.Run(d.name+" over the unexpired points", func(t *testing.T) {
+			db := &ledgerDB{scores: map[int64]int64{1: 100, 2: 0}, expired: map[int64]int64{1: 30}}
+			repo, _ := newFakeRepository(t, db.respond)
+
+			err := d.debit(repo, 80)
+			if !errors.Is(err, ErrInsufficientPoints) {
+				t.Errorf("spending 80 of 70 unexpired points: error = %v, want %v", err, ErrInsufficientPoints)
+			}
+		})
+	}
+}
+
+func TestConsumeLots(t *testing.T) {
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	may := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		lots      [][]any
+		amount    int
+		wantTaken [][]any // points taken and the lot they were taken from
+		want      []*Expiration
+	}{
+		{"within the oldest lot", [][]any{{int64(1), int64(50), march}, {int64(2), int64(50), may}}, 30,
+			[][]any{{int64(30), int64(1)}}, []*Expiration{{Amount: 30, ExpiresAt: march}}},
+		{"oldest lot used up first", [][]any{{int64(1), int64(50), march}, {int64(2), int64(50), may}}, 70,
+			[][]any{{int64(50), int64(1)}, {int64(20), int64(2)}},
+			[]*Expiration{{Amount: 50, ExpiresAt: march}, {Amount: 20, ExpiresAt: may}}},
+		{"exactly the lots", [][]any{{int64(1), int64(50), march}, {int64(2), int64(50), may}}, 100,
+			[][]any{{int64(50), int64(1)}, {int64(50), int64(2)}},
+			[]*Expiration{{Amount: 50, ExpiresAt: march}, {Amount: 50, ExpiresAt: may}}},
+		{"more than the lots", [][]any{{int64(1), int64(30), march}}, 50,
+			[][]any{{int64(30), int64(1)}}, []*Expiration{{Amount: 30, ExpiresAt: march}}},
+		{"no lots", nil, 10, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, lotsDB(tt.lots...))
+			var got []*Expiration
+			err := repo.withTx(context.Background(), func(tx *sql.Tx) error {
+				var err error
+				got, err = consumeLots(tx, 1, tt.amount)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("consumeLots() = %v, want %v", got, tt.want)
+			}
+
+			taken := db.ran("update point_lots set remaining = remaining -")
+			if !reflect.DeepEqual(taken, tt.wantTaken) {
+				t.Errorf("consumeLots() took %v, want %v", taken, tt.wantTaken)
+			}
+			// the database hands out the lots oldest first and leaves out the expired ones
+			query := db.ran("from point_lots")
+			if len(query) != 1 {
+				t.Fatalf("consumeLots() queried the lots %d times", len(query))
+			}
+			for _, s := range db.statements {
+				if strings.Contains(s.query, "from point_lots") &&
+					(!strings.Contains(s.query, "order by expires_at, id") || !strings.Contains(s.query, "expires_at > now()")) {
+					t.Errorf("lots are not queried unexpired and oldest first: %s", s.query)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveLotsKeepsExpiry(t *testing.T) {
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	may := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	repo, db := newFakeRepository(t, nil)
+	err := repo.withTx(context.Background(), func(tx *sql.Tx) error {
+		return moveLots(tx, 2, []*Expiration{{Amount: 30, ExpiresAt: march}, {Amount: 20, ExpiresAt: may}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]any{{int64(2), int64(30), march}, {int64(2), int64(20), may}}
+	if got := db.ran("insert into point_lots"); !reflect.DeepEqual(got, want) {
+		t.Errorf("moveLots() inserted %v, want %v", got, want)
+	}
+}
+
+func TestExpireUserLots(t *testing.T) {
+	tests := []struct {
+		name        string
+		expired     int64
+		wantWritten bool
+	}{
+		{"expired points", 30, true},
+		{"nothing expired", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, func(query string, args []any) [][]any {
+				switch {
+				case strings.Contains(query, "coalesce(sum(remaining), 0)"):
+					return [][]any{{tt.expired}}
+				case strings.Contains(query, "returning score"):
+					return [][]any{{int64(100) - tt.expired}}
+				}
+				return nil
+			})
+			err := repo.withTx(context.Background(), func(tx *sql.Tx) error {
+				return expireUserLots(tx, 7)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the user row is locked before the lots
+			if len(db.statements) == 0 || !strings.Contains(db.statements[0].query, "from users where id = $1 for update") {
+				t.Errorf("expireUserLots() didn't lock the user first")
+			}
+			written := db.ran("insert into point_transactions")
+			if (len(written) > 0) != tt.wantWritten {
+				t.Fatalf("expiry written = %v, want %v", len(written) > 0, tt.wantWritten)
+			}
+			if !tt.wantWritten {
+				return
+			}
+			if written[0][0] != int64(7) || written[0][1] != -tt.expired || written[0][2] != TxKindExpiry {
+				t.Errorf("expiry recorded as %v, want %d points of kind %s for user 7", written[0], -tt.expired, TxKindExpiry)
+			}
+			if len(db.ran("update point_lots set remaining = 0")) != 1 {
+				t.Error("expired lots were not written off")
+			}
+		})
+	}
+}
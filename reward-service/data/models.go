@@ -7,34 +7,41 @@ import (
 	"fmt"
 	"log"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 const dbTimeout = time.Second * 3
 
 type PostgresRepository struct {
-	Conn *sql.DB
+	Conn           *sql.DB
+	BadgeRules     []BadgeRule
+	FraudRules     []FraudRule
+	PasswordPolicy PasswordPolicy
+	PasswordHasher PasswordHasher
+	PromoSecret    string
 }
 
 func NewPostgresRepository(pool *sql.DB) *PostgresRepository {
 	return &PostgresRepository{
-		Conn: pool,
+		Conn:           pool,
+		PasswordPolicy: PasswordPolicy{MinLength: 8, MaxLength: bcryptMaxLength, MinClasses: 1},
+		PasswordHasher: PasswordHasher{Algorithm: HashBcrypt, BcryptCost: 12},
 	}
 }
 
 // User is the structure which holds one user from the database.
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Password  string    `json:"-"`
-	Active    int       `json:"active,omitempty"`
-	Score     int       `json:"score,omitempty"`
-	Referrer  string    `json:"referrer,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             int       `json:"id"`
+	Email          string    `json:"email"`
+	FirstName      string    `json:"first_name"`
+	LastName       string    `json:"last_name"`
+	Password       string    `json:"-"`
+	Active         int       `json:"active,omitempty"`
+	Score          int       `json:"score,omitempty"`
+	Referrer       string    `json:"referrer,omitempty"`
+	Tier           string    `json:"tier,omitempty"`
+	RegistrationIP string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
 func (u *PostgresRepository) execQuery(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
@@ -49,6 +56,29 @@ func (u *PostgresRepository) queryRow(ctx context.Context, query string, args ..
 	return u.Conn.QueryRowContext(ctx, query, args...)
 }
 
+// withTx runs fn inside a single database transaction, committing on success and rolling back on error
+func (u *PostgresRepository) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := u.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
 // UserExists проверяет, существует ли пользователь с указанным id
 func (u *PostgresRepository) UserExists(id int) (bool, error) {
 	var exists bool
@@ -71,12 +101,14 @@ func (u *PostgresRepository) AddPoints(id, point int) error {
 		log.Println("User does not exist")
 		return errors.New("user does not exist")
 	}
-	stmt := `update users set score = score + $1, updated_at = $2 where id = $3`
-	_, err = u.execQuery(context.Background(), stmt, point, time.Now(), id)
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		return u.applyPoints(tx, id, point, TxKindTask, "")
+	})
 	if err != nil {
 		log.Printf("Error adding points to user %d: %v", id, err)
 		return fmt.Errorf("failed to add points: %w", err)
 	}
+	u.afterPointEvent(id)
 	return nil
 }
 
@@ -125,16 +157,18 @@ func (u *PostgresRepository) EmailCheck(email string) (*User, error) {
 	}
 
 	if !emailExists {
-		log.Println("User with that email does not exists: ", err)
-		return nil, err
+		return nil, ErrUserNotFound
 	}
 
-	query := `select first_name, password from users where email = $1`
+	query := `select id, email, first_name, password, active from users where email = $1`
 
 	var user User
 	err = u.queryRow(context.Background(), query, email).Scan(
+		&user.ID,
+		&user.Email,
 		&user.FirstName,
 		&user.Password,
+		&user.Active,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch user's password by email: %w", err)
@@ -166,7 +200,10 @@ func (u *PostgresRepository) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// RedeemReferrer redeems the referrer with provided id and referrer, adds points to both users
+var ErrReferrerAlreadyRedeemed = errors.New("user has already redeemed a referrer")
+
+// RedeemReferrer redeems the referrer with provided id and referrer, adds points to both users.
+// Every user can redeem a referrer only once.
 func (u *PostgresRepository) RedeemReferrer(id int, referrer string) error {
 	var referrerExists, idExists bool
 	var sameCheck string
@@ -202,17 +239,58 @@ func (u *PostgresRepository) RedeemReferrer(id int, referrer string) error {
 		return err
 	}
 
-	_, err = u.execQuery(context.Background(), "UPDATE users SET score = score + 100 WHERE referrer = $1", referrer)
-	if err != nil {
-		log.Println("failed to update referrer's score: ", err)
-		return err
-	}
+	var ownerID int
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+		err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE referrer = $1", referrer).Scan(&ownerID)
+		if err != nil {
+			return fmt.Errorf("failed to find referrer's owner: %w", err)
+		}
+
+		// both rows are locked in id order like in TransferPoints, the lock of the user also serializes
+		// concurrent redemptions, so only one of them passes the check below
+		for _, lockID := range lockOrder(id, ownerID) {
+			var locked int
+			err := tx.QueryRowContext(ctx, `select id from users where id = $1 for update`, lockID).Scan(&locked)
+			if err != nil {
+				return fmt.Errorf("failed to lock user %d: %w", lockID, err)
+			}
+		}
+
+		var redeemed bool
+		err = tx.QueryRowContext(ctx,
+			`select exists(select 1 from point_transactions where user_id = $1 and kind = $2)`, id, TxKindReferred).Scan(&redeemed)
+		if err != nil {
+			return fmt.Errorf("failed to check redeemed referrers: %w", err)
+		}
+		if redeemed {
+			return ErrReferrerAlreadyRedeemed
+		}
+
+		err = u.applyPoints(tx, ownerID, 100, TxKindReferral, referrer)
+		if err != nil {
+			return fmt.Errorf("failed to update referrer's score: %w", err)
+		}
 
-	_, err = u.execQuery(context.Background(), "UPDATE users SET score = score + 25 WHERE id = $1", id)
+		err = u.applyPoints(tx, id, 25, TxKindReferred, referrer)
+		if err != nil {
+			return fmt.Errorf("failed to update score for who redeemed referrer: %w", err)
+		}
+
+		event := map[string]any{
+			"referrer":        referrer,
+			"owner_id":        ownerID,
+			"owner_points":    100,
+			"user_id":         id,
+			"redeemer_points": 25,
+		}
+		return emitEvent(tx, DomainReferralRedeemed, id, event)
+	})
 	if err != nil {
-		log.Println("failed to update score for who redeemed referrer: ", err)
+		log.Println(err)
 		return err
 	}
+	u.afterPointEvent(ownerID, id)
 
 	return nil
 }
@@ -226,10 +304,10 @@ func (u *PostgresRepository) GetOne(id int) (*User, error) {
 
 	if !idExists {
 		log.Println("User does not exist")
-		return nil, errors.New("user does not exist")
+		return nil, ErrUserNotFound
 	}
-	query := `select id, email, first_name, last_name, active, score, created_at, updated_at, referrer 
-              from users where id = $1`
+	query := `select u.id, u.email, u.first_name, u.last_name, u.active, u.score, u.created_at, u.updated_at, u.referrer, t.name
+              from users u left join tiers t on t.id = u.tier_id where u.id = $1`
 
 	var user User
 	err = u.queryRow(context.Background(), query, id).Scan(
@@ -242,6 +320,7 @@ func (u *PostgresRepository) GetOne(id int) (*User, error) {
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.Referrer,
+		&user.Tier,
 	)
 	if err != nil {
 		log.Println("failed to fetch user by id: ", err)
@@ -328,7 +407,13 @@ func (u *PostgresRepository) DeleteByID(id int) error {
 	}
 	stmt := `delete from users where id = $1`
 
-	_, err = u.execQuery(context.Background(), stmt, id)
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(context.Background(), stmt, id)
+		if err != nil {
+			return err
+		}
+		return emitEvent(tx, DomainUserDeleted, id, map[string]any{"user_id": id})
+	})
 	if err != nil {
 		log.Println("failed to delete user by id: ", err)
 		return err
@@ -338,30 +423,38 @@ func (u *PostgresRepository) DeleteByID(id int) error {
 }
 
 func (u *PostgresRepository) Insert(user User) (int, error) {
-	if len(user.Password) < 8 {
-		return 0, errors.New("password must be at least 8 characters long")
+	hashedPassword, err := u.hashPassword(user.Password)
+	if err != nil {
+		return 0, err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	err = u.checkFraud(u.Conn, FraudEvent{Type: FraudEventRegistration, IP: user.RegistrationIP})
 	if err != nil {
-		return 0, fmt.Errorf("failed to hash password: %w", err)
+		return 0, err
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, active, score, created_at, updated_at, referrer)
-             values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
-
-	err = u.queryRow(context.Background(), stmt,
-		user.Email,
-		user.FirstName,
-		user.LastName,
-		hashedPassword,
-		user.Active,
-		user.Score,
-		time.Now(),
-		time.Now(),
-		user.Referrer,
-	).Scan(&newID)
+	// new users start with no points, points are only ever credited through the ledger
+	stmt := `insert into users (email, first_name, last_name, password, active, score, created_at, updated_at, referrer, registration_ip)
+             values ($1, $2, $3, $4, $5, 0, $6, $7, $8, nullif($9, '')) returning id`
+
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(context.Background(), stmt,
+			user.Email,
+			user.FirstName,
+			user.LastName,
+			hashedPassword,
+			user.Active,
+			time.Now(),
+			time.Now(),
+			user.Referrer,
+			user.RegistrationIP,
+		).Scan(&newID)
+		if err != nil {
+			return err
+		}
+		return emitEvent(tx, DomainUserRegistered, newID, registeredEvent(newID, user, ""))
+	})
 	if err != nil {
 		log.Println("failed to insert new user: ", err)
 		return 0, err
@@ -370,17 +463,18 @@ func (u *PostgresRepository) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// PasswordMatches compares a user supplied password with the hash we have stored for a given user
+// in the database. If the password and hash match, we return true; otherwise, we return false.
+// A matching password whose hash was made with outdated hashing parameters is rehashed.
 func (u *PostgresRepository) PasswordMatches(plainText string, user User) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, fmt.Errorf("failed to compare passwords: %w", err)
+	valid, err := u.PasswordHasher.Verify(plainText, user.Password)
+	if err != nil || !valid {
+		return false, err
+	}
+	if user.ID != 0 && u.PasswordHasher.NeedsRehash(user.Password) {
+		err = u.rehashPassword(user.ID, plainText)
+		if err != nil {
+			log.Printf("failed to rehash password of user %d: %v", user.ID, err)
 		}
 	}
 	return true, nil
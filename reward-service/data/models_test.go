@@ -0,0 +1,63 @@
+package data
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// referralDB answers the queries of RedeemReferrer for a redeemer and the owner of the referrer "friend"
+func referralDB(redeemerID, ownerID int64, redeemed bool) func(query string, args []any) [][]any {
+	ledger := &ledgerDB{scores: map[int64]int64{redeemerID: 0, ownerID: 0}}
+	return func(query string, args []any) [][]any {
+		switch {
+		case strings.Contains(query, "SELECT EXISTS(SELECT 1 FROM users WHERE"):
+			return [][]any{{true}}
+		case strings.Contains(query, "SELECT referrer FROM users WHERE id = $1"):
+			return [][]any{{"own"}}
+		case strings.Contains(query, "SELECT id FROM users WHERE referrer = $1"):
+			return [][]any{{ownerID}}
+		case strings.Contains(query, "from point_transactions where user_id = $1 and kind = $2)"):
+			return [][]any{{redeemed}}
+		}
+		return ledger.respond(query, args)
+	}
+}
+
+func TestRedeemReferrerLockOrder(t *testing.T) {
+	for _, tt := range []struct{ redeemer, owner int64 }{{3, 7}, {7, 3}} {
+		repo, db := newFakeRepository(t, referralDB(tt.redeemer, tt.owner, false))
+
+		err := repo.RedeemReferrer(int(tt.redeemer), "friend")
+		if err != nil {
+			t.Fatalf("RedeemReferrer() error = %v", err)
+		}
+
+		var locked []int64
+		for _, args := range db.ran("from users where id = $1 for update") {
+			if !slices.Contains(locked, args[0].(int64)) {
+				locked = append(locked, args[0].(int64))
+			}
+		}
+		// a redemption and one of the owner locks the users in the same order, so they can't deadlock
+		if !slices.Equal(locked, []int64{3, 7}) {
+			t.Errorf("redemption by %d of the referrer of %d locked users %v, want [3 7]", tt.redeemer, tt.owner, locked)
+		}
+	}
+}
+
+func TestRedeemReferrerOnlyOnce(t *testing.T) {
+	repo, db := newFakeRepository(t, referralDB(3, 7, true))
+
+	err := repo.RedeemReferrer(3, "friend")
+	if !errors.Is(err, ErrReferrerAlreadyRedeemed) {
+		t.Fatalf("RedeemReferrer() error = %v, want %v", err, ErrReferrerAlreadyRedeemed)
+	}
+	if credited := db.ran("update users set score = score + $1"); len(credited) != 0 {
+		t.Errorf("a second redemption credited points %v", credited)
+	}
+	if db.commits != 0 {
+		t.Error("a second redemption was committed")
+	}
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of the domain events written to the outbox
+const (
+	DomainUserRegistered   = "UserRegistered"
+	DomainPointsAwarded    = "PointsAwarded"
+	DomainPointsSpent      = "PointsSpent"
+	DomainReferralRedeemed = "ReferralRedeemed"
+	DomainUserDeleted      = "UserDeleted"
+)
+
+// DomainEvent is a change of the domain recorded in the outbox. Sequence grows with every event, ID is unique
+// and lets consumers drop the duplicates of at-least-once publishing. PublishedTo lists the sinks which
+// already accepted the event when an earlier attempt to publish it didn't reach every sink.
+type DomainEvent struct {
+	Sequence    int64           `json:"sequence"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	UserID      int             `json:"user_id,omitempty"`
+	Data        json.RawMessage `json:"data"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedTo []string        `json:"-"`
+}
+
+// emitEvent writes the domain event to the outbox in the transaction of the change it describes,
+// so the event is published if and only if the change is committed
+func emitEvent(tx *sql.Tx, eventType string, userID int, data any) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Errorf("failed to generate event id: %w", err)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+
+	_, err = tx.ExecContext(context.Background(),
+		`insert into outbox_events (event_id, event_type, user_id, payload, created_at) values ($1, $2, nullif($3, 0), $4, $5)`,
+		hex.EncodeToString(b), eventType, userID, string(payload), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to write %s event to outbox: %w", eventType, err)
+	}
+	return nil
+}
+
+// ClaimOutboxEvents takes up to limit unpublished events, oldest first. The events are leased for the given
+// time: if they are not marked as published before the lease ends, they are claimed again.
+func (u *PostgresRepository) ClaimOutboxEvents(limit int, lease time.Duration) ([]*DomainEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`with due as (
+             select id from outbox_events
+             where published_at is null and (locked_until is null or locked_until <= now())
+             order by id limit $1 for update skip locked
+         )
+         update outbox_events e set locked_until = now() + $2 * interval '1 second'
+         from due where e.id = due.id
+         returning e.id, e.event_id, e.event_type, coalesce(e.user_id, 0), e.payload, e.created_at,
+             coalesce((select string_agg(p.sink, ' ') from outbox_publications p where p.event_id = e.id), '')`,
+		limit, int64(lease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*DomainEvent
+	for rows.Next() {
+		var e DomainEvent
+		var publishedTo string
+		err := rows.Scan(&e.Sequence, &e.ID, &e.Type, &e.UserID, &e.Data, &e.CreatedAt, &publishedTo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		e.PublishedTo = strings.Fields(publishedTo)
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// update ... returning does not keep the order of the cte
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+	return events, nil
+}
+
+// MarkEventsPublished marks the outbox events with the given sequence numbers as published
+func (u *PostgresRepository) MarkEventsPublished(sequences []int64) error {
+	if len(sequences) == 0 {
+		return nil
+	}
+	_, err := u.execQuery(context.Background(),
+		`update outbox_events set published_at = now(), locked_until = null where id = any($1)`, sequences)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox events as published: %w", err)
+	}
+	return nil
+}
+
+// MarkEventsPublishedTo records that the sink accepted the outbox events with the given sequence numbers
+func (u *PostgresRepository) MarkEventsPublishedTo(sink string, sequences []int64) error {
+	if len(sequences) == 0 {
+		return nil
+	}
+	_, err := u.execQuery(context.Background(),
+		`insert into outbox_publications (event_id, sink, published_at) select unnest($1::bigint[]), $2, now()
+         on conflict do nothing`, sequences, sink)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox events as published to %s: %w", sink, err)
+	}
+	return nil
+}
+
+// DeletePublishedEvents removes the events published before the given time and returns how many were removed
+func (u *PostgresRepository) DeletePublishedEvents(before time.Time) (int64, error) {
+	res, err := u.execQuery(context.Background(), `delete from outbox_events where published_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete published outbox events: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrWeakPassword = errors.New("password does not meet the password policy")
+
+// bcryptMaxLength is the number of bytes bcrypt looks at, the rest of a longer password is silently ignored
+const bcryptMaxLength = 72
+
+// PasswordPolicy is the set of rules every new password has to follow. MinClasses is how many of the character
+// classes (lower case letters, upper case letters, digits, other characters) the password has to contain.
+// BreachedDir is a directory with a local copy of a k-anonymity breached password list: a file per first five hex
+// characters of the SHA-1 of a password, named by them, with a "SUFFIX:COUNT" line per breached password.
+type PasswordPolicy struct {
+	MinLength   int
+	MaxLength   int
+	MinClasses  int
+	BreachedDir string
+}
+
+// Validate checks the password against the policy, the returned error wraps ErrWeakPassword and says what is wrong
+func (p PasswordPolicy) Validate(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Errorf("%w: it must be at most %d bytes long", ErrWeakPassword, p.MaxLength)
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		return fmt.Errorf("%w: it must contain at least %d of lower case letters, upper case letters, digits and other characters",
+			ErrWeakPassword, p.MinClasses)
+	}
+
+	breached, err := p.isBreached(password)
+	if err != nil {
+		// the list is a safeguard, a broken copy must not stop users from setting passwords
+		log.Println("failed to check breached passwords: ", err)
+	}
+	if breached {
+		return fmt.Errorf("%w: it appeared in a data breach, choose another one", ErrWeakPassword)
+	}
+	return nil
+}
+
+// characterClasses counts the character classes used in the password
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// isBreached looks the password up in the local breached password list. Only the file of the hash prefix is read.
+func (p PasswordPolicy) isBreached(password string) (bool, error) {
+	if p.BreachedDir == "" {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(p.BreachedDir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: bcryptMaxLength, MinClasses: 2}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"long enough with two classes", "password1", false},
+		{"too short", "pass1", true},
+		{"one class", "passwordpassword", true},
+		{"other characters count as a class", "password!", false},
+		{"72 bytes", strings.Repeat("a1", 36), false},
+		{"73 bytes", strings.Repeat("a1", 36) + "a", true},
+		// 25 characters, but 75 bytes, bcrypt would drop the last three bytes
+		{"multibyte over 72 bytes", strings.Repeat("€", 24) + "1", true},
+		{"multibyte within 72 bytes", strings.Repeat("€", 23) + "1", false},
+		{"length counts characters", "ééééééé1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Validate(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrWeakPassword) {
+				t.Errorf("Validate() error = %v, want it to wrap %v", err, ErrWeakPassword)
+			}
+		})
+	}
+}
+
+// writeBreached stores the passwords in dir the way a k-anonymity breached password list is laid out
+func writeBreached(t *testing.T, dir string, passwords ...string) {
+	t.Helper()
+	files := make(map[string][]string)
+	for _, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		files[hash[:5]] = append(files[hash[:5]], hash[5:]+":42")
+	}
+	for prefix, lines := range files {
+		err := os.WriteFile(filepath.Join(dir, prefix), []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPasswordPolicyBreached(t *testing.T) {
+	dir := t.TempDir()
+	writeBreached(t, dir, "Password1", "letmein99")
+
+	// a file which shares the prefix but not the suffix of a password must not match it
+	sum := sha1.Sum([]byte("Unbreached1"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	err := os.WriteFile(filepath.Join(dir, hash[:5]), []byte(strings.Repeat("0", 35)+":1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := PasswordPolicy{MinLength: 8, MaxLength: bcryptMaxLength, MinClasses: 1, BreachedDir: dir}
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"listed", "Password1", true},
+		{"listed among others", "letmein99", true},
+		{"prefix file without the suffix", "Unbreached1", false},
+		{"no file for the prefix", "Tr0ub4dor&3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.isBreached(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("isBreached() = %v, want %v", got, tt.want)
+			}
+			err = policy.Validate(tt.password)
+			if (err != nil) != tt.want {
+				t.Errorf("Validate() error = %v, want an error %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyBreachedLowerCase(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("Password1"))
+	hash := hex.EncodeToString(sum[:])
+	err := os.WriteFile(filepath.Join(dir, strings.ToUpper(hash[:5])), []byte(hash[5:]+":3\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := PasswordPolicy{BreachedDir: dir}
+	got, err := policy.isBreached("Password1")
+	if err != nil || !got {
+		t.Errorf("isBreached() = %v, %v, want a match of the lower case suffix", got, err)
+	}
+}
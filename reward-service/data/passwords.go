@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrInvalidPasswordReset = errors.New("password reset token is invalid, expired or was already used")
+)
+
+// hashPassword checks the password against the password policy and hashes it
+func (u *PostgresRepository) hashPassword(password string) (string, error) {
+	err := u.PasswordPolicy.Validate(password)
+	if err != nil {
+		return "", err
+	}
+	return u.PasswordHasher.Hash(password)
+}
+
+// setPassword stores the new password and bumps the token version, which revokes every issued session
+func setPassword(tx *sql.Tx, userID int, hashedPassword string) error {
+	res, err := tx.ExecContext(context.Background(),
+		`update users set password = $1, token_version = token_version + 1, updated_at = now() where id = $2`,
+		hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// CreatePasswordReset stores the hash of a password reset token sent to the user
+func (u *PostgresRepository) CreatePasswordReset(userID int, tokenHash string, expires time.Time) error {
+	_, err := u.execQuery(context.Background(),
+		`insert into password_resets (token_hash, user_id, expires_at) values ($1, $2, $3)`, tokenHash, userID, expires)
+	if err != nil {
+		log.Println("failed to create password reset: ", err)
+		return err
+	}
+	return nil
+}
+
+// ResetPassword uses up the reset token, sets the new password and revokes the sessions of the user.
+// Other outstanding reset tokens of the user stop working too. Returns the id of the user.
+func (u *PostgresRepository) ResetPassword(tokenHash, password string) (int, error) {
+	hashedPassword, err := u.hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		err := tx.QueryRowContext(ctx,
+			`update password_resets set used_at = now()
+             where token_hash = $1 and used_at is null and expires_at > now() returning user_id`,
+			tokenHash).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidPasswordReset
+		}
+		if err != nil {
+			return fmt.Errorf("failed to use password reset: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`update password_resets set used_at = now() where user_id = $1 and used_at is null`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to invalidate password resets: %w", err)
+		}
+
+		return setPassword(tx, userID, hashedPassword)
+	})
+	if err != nil {
+		log.Println("failed to reset password: ", err)
+		return 0, err
+	}
+	return userID, nil
+}
+
+// ChangePassword sets the new password of the user and revokes the sessions of the user
+func (u *PostgresRepository) ChangePassword(userID int, password string) error {
+	hashedPassword, err := u.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = u.withTx(context.Background(), func(tx *sql.Tx) error {
+		return setPassword(tx, userID, hashedPassword)
+	})
+	if err != nil {
+		log.Printf("failed to change password of user %d: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// rehashPassword replaces the hash of the password with one made with the current hashing parameters,
+// sessions are not revoked since the password stays the same
+func (u *PostgresRepository) rehashPassword(userID int, password string) error {
+	hashedPassword, err := u.PasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = u.execQuery(context.Background(), `update users set password = $1 where id = $2`, hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("failed to rehash password: %w", err)
+	}
+	return nil
+}
+
+// GetTokenVersion returns the version of the user's sessions, tokens issued for an older version are revoked
+func (u *PostgresRepository) GetTokenVersion(userID int) (int, error) {
+	var version int
+	err := u.queryRow(context.Background(), `select token_version from users where id = $1`, userID).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch token version: ", err)
+		return 0, err
+	}
+	return version, nil
+}
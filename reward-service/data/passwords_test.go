@@ -0,0 +1,69 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		resetOwner []any // the user the token belongs to, nil when it is invalid, expired or used
+		password   string
+		wantErr    error
+	}{
+		{"valid token", []any{int64(7)}, "new password", nil},
+		{"invalid token", nil, "new password", ErrInvalidPasswordReset},
+		{"short password", []any{int64(7)}, "short", ErrWeakPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, func(query string, args []any) [][]any {
+				if strings.Contains(query, "returning user_id") && tt.resetOwner != nil {
+					return [][]any{tt.resetOwner}
+				}
+				return nil
+			})
+			repo.PasswordPolicy = PasswordPolicy{MinLength: 8}
+			repo.PasswordHasher = PasswordHasher{Algorithm: HashBcrypt, BcryptCost: 4}
+
+			userID, err := repo.ResetPassword("token hash", tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ResetPassword() error = %v, want %v", err, tt.wantErr)
+			}
+
+			updates := db.ran("update users set password")
+			if tt.wantErr != nil {
+				if len(updates) != 0 || db.commits != 0 {
+					t.Errorf("refused reset changed the password, %d updates and %d commits", len(updates), db.commits)
+				}
+				return
+			}
+			if userID != 7 {
+				t.Errorf("ResetPassword() = %d, want 7", userID)
+			}
+
+			used := db.ran("where token_hash = $1 and used_at is null and expires_at > now()")
+			if len(used) != 1 || used[0][0] != "token hash" {
+				t.Errorf("reset token used as %v, want the hash of the token", used)
+			}
+			// the other outstanding tokens of the user stop working
+			others := db.ran("update password_resets set used_at = now() where user_id = $1 and used_at is null")
+			if len(others) != 1 || others[0][0] != int64(7) {
+				t.Errorf("other reset tokens invalidated as %v, want those of user 7", others)
+			}
+			// the sessions of the user are revoked by the new token version
+			if len(updates) != 1 || !strings.Contains(db.statements[len(db.statements)-1].query, "token_version = token_version + 1") {
+				t.Fatalf("password updated %d times without bumping the token version", len(updates))
+			}
+			hash, _ := updates[0][0].(string)
+			if valid, _ := repo.PasswordHasher.Verify(tt.password, hash); !valid {
+				t.Error("the stored password is not the hash of the new password")
+			}
+			if db.commits != 1 {
+				t.Errorf("reset committed %d times, want 1", db.commits)
+			}
+		})
+	}
+}
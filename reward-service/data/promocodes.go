@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const TxKindPromoCode = "promo_code"
+
+var (
+	ErrPromoCodeNotFound    = errors.New("promo code does not exist")
+	ErrPromoCodeExists      = errors.New("promo code already exists")
+	ErrPromoCodeNotActive   = errors.New("promo code is not valid at this time")
+	ErrPromoCodeExhausted   = errors.New("promo code has been used up")
+	ErrPromoCodeAlreadyUsed = errors.New("promo code was already redeemed by this user")
+)
+
+// PromoCode is a code which gives Reward points once per user. Only the hash of the code is stored, keyed
+// with the promo code secret of the repository, so the codes can't be guessed offline from the database.
+// MaxUses of zero means the number of redemptions is not limited.
+type PromoCode struct {
+	ID         int        `json:"id"`
+	Reward     int        `json:"reward"`
+	MaxUses    int        `json:"max_uses"`
+	Uses       int        `json:"uses"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// NormalizePromoCode returns the code the way it is hashed: trimmed and in upper case
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// hashPromoCode normalizes the code and returns its HMAC-SHA256 with the promo code secret in hex
+func (u *PostgresRepository) hashPromoCode(code string) string {
+	mac := hmac.New(sha256.New, []byte(u.PromoSecret))
+	mac.Write([]byte(NormalizePromoCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsAdmin tells whether the user has the admin role
+func (u *PostgresRepository) IsAdmin(id int) (bool, error) {
+	var isAdmin bool
+	err := u.queryRow(context.Background(), "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND role = 'admin')", id).Scan(&isAdmin)
+	if err != nil {
+		log.Println("failed to check user's role: ", err)
+		return false, err
+	}
+	return isAdmin, nil
+}
+
+// InsertPromoCode stores a new promo code, code is the plain code which is hashed before storing
+func (u *PostgresRepository) InsertPromoCode(code string, promo PromoCode) (*PromoCode, error) {
+	stmt := `insert into promo_codes (code_hash, reward, max_uses, valid_from, valid_until, created_by, created_at)
+             values ($1, $2, $3, $4, $5, $6, now())
+             on conflict (code_hash) do nothing
+             returning id, created_at`
+
+	err := u.queryRow(context.Background(), stmt,
+		u.hashPromoCode(code),
+		promo.Reward,
+		promo.MaxUses,
+		promo.ValidFrom,
+		promo.ValidUntil,
+		promo.CreatedBy,
+	).Scan(&promo.ID, &promo.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPromoCodeExists
+	}
+	if err != nil {
+		log.Println("failed to insert promo code: ", err)
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// RedeemPromoCode credits the reward of the promo code to the user, checking the validity window,
+// the total number of uses and that the user hasn't redeemed the code before
+func (u *PostgresRepository) RedeemPromoCode(userID int, code string) (*PromoCode, error) {
+	var promo PromoCode
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		err := tx.QueryRowContext(ctx,
+			`select id, reward, max_uses, uses, valid_from, valid_until, coalesce(created_by, 0), created_at
+             from promo_codes where code_hash = $1 for update`, u.hashPromoCode(code)).Scan(
+			&promo.ID,
+			&promo.Reward,
+			&promo.MaxUses,
+			&promo.Uses,
+			&promo.ValidFrom,
+			&promo.ValidUntil,
+			&promo.CreatedBy,
+			&promo.CreatedAt,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPromoCodeNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock promo code: %w", err)
+		}
+
+		now := time.Now()
+		if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && now.After(*promo.ValidUntil)) {
+			return ErrPromoCodeNotActive
+		}
+		if promo.MaxUses > 0 && promo.Uses >= promo.MaxUses {
+			return ErrPromoCodeExhausted
+		}
+
+		res, err := tx.ExecContext(ctx,
+			`insert into promo_redemptions (promo_code_id, user_id, redeemed_at) values ($1, $2, now())
+             on conflict (promo_code_id, user_id) do nothing`, promo.ID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to record redemption: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrPromoCodeAlreadyUsed
+		}
+
+		_, err = tx.ExecContext(ctx, `update promo_codes set uses = uses + 1 where id = $1`, promo.ID)
+		if err != nil {
+			return fmt.Errorf("failed to count redemption: %w", err)
+		}
+		promo.Uses++
+
+		return u.applyPoints(tx, userID, promo.Reward, TxKindPromoCode, fmt.Sprintf("promo code #%d", promo.ID))
+	})
+	if err != nil {
+		log.Printf("failed to redeem promo code for user %d: %v", userID, err)
+		return nil, err
+	}
+	u.afterPointEvent(userID)
+
+	return &promo, nil
+}
@@ -0,0 +1,39 @@
+package data
+
+import (
+	"context"
+	"log"
+)
+
+// TakeToken takes one token from the token bucket stored under key. The bucket holds up to capacity tokens
+// and is refilled with refillPerSecond tokens per second. Returns whether a token was taken and how many are left.
+func (u *PostgresRepository) TakeToken(key string, capacity int, refillPerSecond float64) (bool, float64, error) {
+	refilled := `least($2::double precision, rate_limit_buckets.tokens +
+                     extract(epoch from clock_timestamp() - rate_limit_buckets.updated_at)::double precision * $3::double precision)`
+
+	stmt := `insert into rate_limit_buckets (key, tokens, allowed, updated_at) values ($1, $2 - 1, true, clock_timestamp())
+             on conflict (key) do update set
+                 tokens = ` + refilled + ` - case when ` + refilled + ` >= 1 then 1 else 0 end,
+                 allowed = ` + refilled + ` >= 1,
+                 updated_at = clock_timestamp()
+             returning allowed, tokens`
+
+	var allowed bool
+	var tokens float64
+	err := u.queryRow(context.Background(), stmt, key, capacity, refillPerSecond).Scan(&allowed, &tokens)
+	if err != nil {
+		log.Println("failed to take rate limit token: ", err)
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+// DeleteIdleBuckets removes rate limit buckets which were not used for longer than the given number of seconds
+func (u *PostgresRepository) DeleteIdleBuckets(idleSeconds int) (int64, error) {
+	res, err := u.execQuery(context.Background(),
+		`delete from rate_limit_buckets where updated_at < clock_timestamp() - $1 * interval '1 second'`, idleSeconds)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
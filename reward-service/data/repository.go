@@ -1,5 +1,10 @@
 package data
 
+import (
+	"context"
+	"time"
+)
+
 type Repository interface {
 	GetAll() ([]*User, error)
 	GetByEmail(email string) (*User, error)
@@ -12,4 +17,89 @@ type Repository interface {
 	RedeemReferrer(id int, referrer string) error
 	EmailCheck(email string) (*User, error)
 	UpdateScore(user User) error
+	TransferPoints(t Transfer, dailyLimit int) (*Transfer, error)
+	GetHistory(userID, limit int) ([]*Transaction, error)
+	ReserveIdempotencyKey(userID int, key, fingerprint string, ttl, lease time.Duration) (*IdempotencyRecord, error)
+	SaveIdempotencyResponse(userID int, key string, statusCode int, body []byte) error
+	ReleaseIdempotencyKey(userID int, key string) error
+	DeleteExpiredIdempotencyKeys() (int64, error)
+	GetPointsBalance(userID int) (*PointsBalance, error)
+	ExpirePoints() (int, error)
+	GetUserTier(userID int) (*Tier, error)
+	GetTierChanges(userID int) ([]*TierChange, error)
+	DemoteInactiveUsers(inactivity time.Duration) (int, error)
+	EvaluateBadges(userID int) ([]*Badge, error)
+	GetBadges(userID int) ([]*Badge, error)
+	CheckIn(userID int, timeZone string, rules CheckinRules) (*Checkin, error)
+	GetStreak(userID int) (*Streak, error)
+	BuyStreakFreeze(userID int, rules CheckinRules) (*Streak, error)
+	GetTask(code string) (*Task, error)
+	GetCompletion(id int) (*TaskCompletion, error)
+	CreateCompletion(userID int, task Task, proof Proof, approved bool) (*TaskCompletion, error)
+	DeleteExpiredProofTokens() (int64, error)
+	ResolveCompletion(id int, approved bool, reason string) (*TaskCompletion, error)
+	ClaimDueVerifications(limit int, lease time.Duration) ([]*PendingVerification, error)
+	FinishVerificationRequest(id int, nextAttempt time.Time) error
+	ExpireVerifications(timeout time.Duration) (int, error)
+	IsAdmin(id int) (bool, error)
+	InsertPromoCode(code string, promo PromoCode) (*PromoCode, error)
+	RedeemPromoCode(userID int, code string) (*PromoCode, error)
+	GetReviews(status string, limit int) ([]*Review, error)
+	GetUserReviews(userID int) ([]*Review, error)
+	ResolveReview(id, reviewerID int, approved bool, reason string) (*Review, error)
+	GetFraudEvents(limit int) ([]*FraudRecord, error)
+	TakeToken(key string, capacity int, refillPerSecond float64) (bool, float64, error)
+	DeleteIdleBuckets(idleSeconds int) (int64, error)
+	GetLoginLock(keys ...string) (time.Time, error)
+	RecordLoginFailure(key string, policy LockoutPolicy) (time.Time, error)
+	ResetLoginFailures(keys ...string) error
+	GetEmailByID(id int) (string, error)
+	CreateEmailVerification(userID int, nonce string, expires time.Time) error
+	VerifyEmail(userID int, nonce string) error
+	CreatePasswordReset(userID int, tokenHash string, expires time.Time) error
+	ResetPassword(tokenHash, password string) (int, error)
+	ChangePassword(userID int, password string) error
+	GetTokenVersion(userID int) (int, error)
+	StartTOTPEnrollment(userID int, secret string) error
+	GetTOTP(userID int) (*TOTP, error)
+	TOTPEnabled(userID int) (bool, error)
+	ConfirmTOTP(userID int, step int64, codeHashes []string) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, codeHash string) (int, error)
+	DisableTOTP(userID int) error
+	GetUserByIdentity(provider, subject string) (int, error)
+	LinkIdentity(userID int, provider, subject, email string, emailVerified bool) error
+	InsertWithIdentity(user User, provider, subject string) (int, error)
+	GetIdentities(userID int) ([]*Identity, error)
+	CreateAPIKey(key *APIKey) error
+	GetAPIKeyByPrefix(prefix string) (*APIKey, error)
+	ListAPIKeys() ([]*APIKey, error)
+	TouchAPIKey(id int) error
+	RevokeAPIKey(id int) error
+	AwardPartnerPoints(key *APIKey, a PartnerAward) (*PartnerAward, error)
+	ReserveWebhookEvent(ev WebhookEvent, lease time.Duration) (*WebhookEvent, error)
+	CompleteWebhookTask(ev WebhookEvent, task Task, proof Proof) (*TaskCompletion, error)
+	FinishWebhookEvent(source, eventID, status, detail string) error
+	ReleaseWebhookEvent(source, eventID string) error
+	CreateWebhookSubscription(s *WebhookSubscription) error
+	ListWebhookSubscriptions() ([]*WebhookSubscription, error)
+	DeactivateWebhookSubscription(id int) error
+	ClaimDueDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	FinishDelivery(id int64, statusCode int, deliveryErr string, nextAttempt time.Time) error
+	GetDeadDeliveries(limit int) ([]*WebhookDelivery, error)
+	ReplayDelivery(id int64) error
+	EnqueueWebhookDeliveries(event *DomainEvent) error
+	ClaimOutboxEvents(limit int, lease time.Duration) ([]*DomainEvent, error)
+	MarkEventsPublished(sequences []int64) error
+	MarkEventsPublishedTo(sink string, sequences []int64) error
+	DeletePublishedEvents(before time.Time) (int64, error)
+	ListenLiveUpdates(ctx context.Context, fn func(LiveUpdate)) error
+	GetRank(userID int) (int, int, error)
+	GetStandings(ids []int) (map[int]Standing, error)
+	GetTopUsers(board, window string, limit int) ([]*LeaderboardEntry, error)
+	GetUsersByIDs(ids []int) ([]*User, error)
+	GetHistories(ids []int, limit int) (map[int][]*Transaction, error)
+	GetReferrals(ownerIDs []int) (map[int][]*Referral, error)
+	GetTasks() ([]*Task, error)
+	GetCompletedTaskCodes(userID int) ([]string, error)
 }
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrReviewNotFound = errors.New("review does not exist")
+
+// Review is a task completion waiting for, or resolved by, a human moderator
+type Review struct {
+	ID           int        `json:"id"`
+	CompletionID int        `json:"completion_id"`
+	UserID       int        `json:"user_id"`
+	TaskCode     string     `json:"task"`
+	Proof        Proof      `json:"proof"`
+	Status       string     `json:"status"`
+	Points       int        `json:"points,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	ReviewerID   int        `json:"reviewer_id,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+}
+
+const reviewColumns = `r.id, r.completion_id, c.user_id, c.task_code, coalesce(r.proof_text, ''), coalesce(r.proof_url, ''),
+                       coalesce(r.file_ref, ''), c.status, c.points, coalesce(c.reason, ''), coalesce(r.reviewer_id, 0),
+                       r.created_at, r.reviewed_at`
+
+func scanReview(scanner interface{ Scan(...any) error }) (*Review, error) {
+	var r Review
+	err := scanner.Scan(
+		&r.ID,
+		&r.CompletionID,
+		&r.UserID,
+		&r.TaskCode,
+		&r.Proof.Text,
+		&r.Proof.URL,
+		&r.Proof.FileRef,
+		&r.Status,
+		&r.Points,
+		&r.Reason,
+		&r.ReviewerID,
+		&r.CreatedAt,
+		&r.ReviewedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// addReview puts a pending completion into the review queue
+func addReview(tx *sql.Tx, completionID int, proof Proof) error {
+	_, err := tx.ExecContext(context.Background(),
+		`insert into pending_reviews (completion_id, proof_text, proof_url, file_ref, created_at) values ($1, $2, $3, $4, now())`,
+		completionID, proof.Text, proof.URL, proof.FileRef)
+	if err != nil {
+		return fmt.Errorf("failed to add review: %w", err)
+	}
+	return nil
+}
+
+// GetReviews returns reviews with the given status, oldest first, or reviews in any status when status is empty
+func (u *PostgresRepository) GetReviews(status string, limit int) ([]*Review, error) {
+	return u.queryReviews(`where ($1 = '' or c.status = $1) order by r.created_at, r.id limit $2`, status, limit)
+}
+
+// GetUserReviews returns the reviews of the user's completions, newest first
+func (u *PostgresRepository) GetUserReviews(userID int) ([]*Review, error) {
+	return u.queryReviews(`where c.user_id = $1 order by r.created_at desc, r.id desc`, userID)
+}
+
+func (u *PostgresRepository) queryReviews(where string, args ...any) ([]*Review, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + reviewColumns + `
+              from pending_reviews r join task_completions c on c.id = r.completion_id ` + where
+
+	rows, err := u.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reviews: %w", err)
+	}
+	defer rows.Close()
+
+	reviews := []*Review{}
+	for rows.Next() {
+		r, err := scanReview(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan review: %w", err)
+		}
+		reviews = append(reviews, r)
+	}
+	return reviews, rows.Err()
+}
+
+// ResolveReview approves or rejects the reviewed completion. Approval credits the task points through the ledger,
+// the rejection reason is kept on the completion so the user can see it.
+func (u *PostgresRepository) ResolveReview(id, reviewerID int, approved bool, reason string) (*Review, error) {
+	var review *Review
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		var completionID int
+		err := tx.QueryRowContext(context.Background(),
+			`update pending_reviews set reviewer_id = $1, reviewed_at = now() where id = $2 returning completion_id`,
+			reviewerID, id).Scan(&completionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrReviewNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update review: %w", err)
+		}
+
+		_, err = u.resolveCompletion(tx, completionID, VerifierManual, approved, reason)
+		if err != nil {
+			return err
+		}
+
+		review, err = scanReview(tx.QueryRowContext(context.Background(),
+			`select `+reviewColumns+` from pending_reviews r join task_completions c on c.id = r.completion_id where r.id = $1`, id))
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to resolve review %d: %v", id, err)
+		return nil, err
+	}
+	if approved {
+		u.afterPointEvent(review.UserID)
+	}
+
+	return review, nil
+}
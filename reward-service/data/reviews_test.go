@@ -0,0 +1,78 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reviewDB answers the queries of ResolveReview for review 4 of completion 9 by user 7, the completion is in
+// the given status and its task is verified by verifier
+func reviewDB(status, verifier string) func(query string, args []any) [][]any {
+	approvals := completionDB()
+	return func(query string, args []any) [][]any {
+		switch {
+		case strings.Contains(query, "update pending_reviews set reviewer_id"):
+			if args[1] != int64(4) {
+				return nil
+			}
+			return [][]any{{int64(9)}}
+		case strings.Contains(query, "from task_completions c join tasks t"):
+			return [][]any{{int64(9), int64(7), "postAboutUs", status, "https://example.com/post", time.Now(), int64(20), verifier}}
+		case strings.Contains(query, "from pending_reviews r join task_completions c"):
+			return [][]any{{int64(4), int64(9), int64(7), "postAboutUs", "", "https://example.com/post", "", status,
+				int64(0), "", int64(1), time.Now(), time.Now()}}
+		}
+		return approvals(query, args)
+	}
+}
+
+func TestResolveReview(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         int
+		status     string
+		verifier   string
+		approved   bool
+		wantErr    error
+		wantStatus any // the status the completion is set to, nil when it is left alone
+	}{
+		{"approve", 4, CompletionPending, VerifierManual, true, nil, CompletionApproved},
+		{"reject", 4, CompletionPending, VerifierManual, false, nil, CompletionRejected},
+		{"approve an approved completion", 4, CompletionApproved, VerifierManual, true, ErrCompletionNotPending, nil},
+		{"reject an approved completion", 4, CompletionApproved, VerifierManual, false, ErrCompletionNotPending, nil},
+		{"approve a rejected completion", 4, CompletionRejected, VerifierManual, true, ErrCompletionNotPending, nil},
+		{"task not verified by reviews", 4, CompletionPending, VerifierWebhook, true, ErrWrongVerifier, nil},
+		{"unknown review", 5, CompletionPending, VerifierManual, true, ErrReviewNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, reviewDB(tt.status, tt.verifier))
+
+			_, err := repo.ResolveReview(tt.id, 1, tt.approved, "not about us")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ResolveReview() error = %v, want %v", err, tt.wantErr)
+			}
+
+			resolved := db.ran("update task_completions set status = $1")
+			switch {
+			case tt.wantStatus == nil && len(resolved) != 0:
+				t.Errorf("completion was resolved with %v", resolved)
+			case tt.wantStatus != nil && (len(resolved) != 1 || resolved[0][0] != tt.wantStatus):
+				t.Errorf("completion was resolved with %v, want %s", resolved, tt.wantStatus)
+			}
+			if tt.wantStatus == CompletionRejected && resolved[0][1] != "not about us" {
+				t.Errorf("rejection stored reason %v, want the reason of the reviewer", resolved[0][1])
+			}
+
+			credited := len(db.ran("update users set score = score + $1")) > 0
+			if credited != (tt.wantStatus == CompletionApproved) {
+				t.Errorf("points credited = %v, want %v", credited, tt.wantStatus == CompletionApproved)
+			}
+			if tt.wantErr != nil && db.commits != 0 {
+				t.Error("a refused resolution was committed")
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Verifiers which can confirm a task completion
+const (
+	VerifierNone       = "none"
+	VerifierWebhook    = "webhook"
+	VerifierProofToken = "proof_token"
+	VerifierManual     = "manual"
+)
+
+// Statuses of a task completion
+const (
+	CompletionPending  = "pending"
+	CompletionApproved = "approved"
+	CompletionRejected = "rejected"
+)
+
+var (
+	ErrTaskNotFound         = errors.New("task does not exist")
+	ErrTaskAlreadyCompleted = errors.New("task is already completed")
+	ErrCompletionNotFound   = errors.New("task completion does not exist")
+	ErrCompletionNotPending = errors.New("task completion is already resolved")
+	ErrWrongVerifier        = errors.New("task completion is verified by another verifier")
+	ErrProofTokenUsed       = errors.New("proof token was already used")
+)
+
+// Task is the definition of a task: how many points it is worth and who verifies its completion
+type Task struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Points      int    `json:"points"`
+	Verifier    string `json:"verifier"`
+	VerifierURL string `json:"-"`
+	Repeatable  bool   `json:"repeatable"`
+}
+
+// Proof is what the user submits to show that the task was done. TokenExpiresAt is set when Text is a proof token
+// which was checked against the verifier of the task, the token is then used up by the completion.
+type Proof struct {
+	Text           string    `json:"text,omitempty"`
+	URL            string    `json:"url,omitempty"`
+	FileRef        string    `json:"file_ref,omitempty"`
+	TokenExpiresAt time.Time `json:"-"`
+}
+
+// TaskCompletion is one attempt of the user to complete a task
+type TaskCompletion struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	TaskCode   string     `json:"task"`
+	Status     string     `json:"status"`
+	Proof      string     `json:"proof,omitempty"`
+	Points     int        `json:"points"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// GetTask returns the task definition by code
+func (u *PostgresRepository) GetTask(code string) (*Task, error) {
+	query := `select code, name, points, verifier, coalesce(verifier_url, ''), repeatable from tasks where code = $1`
+
+	var t Task
+	err := u.queryRow(context.Background(), query, code).Scan(&t.Code, &t.Name, &t.Points, &t.Verifier, &t.VerifierURL, &t.Repeatable)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch task: ", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetCompletion returns the task completion by id
+func (u *PostgresRepository) GetCompletion(id int) (*TaskCompletion, error) {
+	query := `select id, user_id, task_code, status, coalesce(proof, ''), points, coalesce(reason, ''), created_at, resolved_at
+              from task_completions where id = $1`
+
+	var c TaskCompletion
+	err := u.queryRow(context.Background(), query, id).Scan(
+		&c.ID,
+		&c.UserID,
+		&c.TaskCode,
+		&c.Status,
+		&c.Proof,
+		&c.Points,
+		&c.Reason,
+		&c.CreatedAt,
+		&c.ResolvedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCompletionNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch task completion: ", err)
+		return nil, err
+	}
+	return &c, nil
+}
+
+// taskReward multiplies the points of the task by the multiplier of the user's tier
+func taskReward(tx *sql.Tx, userID, points int) (int, error) {
+	var multiplier float64
+	err := tx.QueryRowContext(context.Background(),
+		`select t.multiplier from users u join tiers t on t.id = u.tier_id where u.id = $1`, userID).Scan(&multiplier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch tier multiplier: %w", err)
+	}
+	return int(math.Round(float64(points) * multiplier)), nil
+}
+
+// approveCompletion marks the completion approved and credits the task points, multiplied by the user's tier
+func (u *PostgresRepository) approveCompletion(tx *sql.Tx, c *TaskCompletion, taskPoints int) error {
+	points, err := taskReward(tx, c.UserID, taskPoints)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(context.Background(),
+		`update task_completions set status = $1, points = $2, resolved_at = now() where id = $3 returning resolved_at`,
+		CompletionApproved, points, c.ID).Scan(&c.ResolvedAt)
+	if err != nil {
+		return fmt.Errorf("failed to approve task completion: %w", err)
+	}
+	c.Status = CompletionApproved
+	c.Points = points
+
+	return u.applyPoints(tx, c.UserID, points, TxKindTask, c.TaskCode)
+}
+
+// CreateCompletion records that the user completed the task. When approved is true the points are credited
+// right away, otherwise the completion stays pending until a verifier resolves it. Pending completions of
+// manually verified tasks are put into the review queue, those of webhook verified tasks into the verification queue.
+func (u *PostgresRepository) CreateCompletion(userID int, task Task, proof Proof, approved bool) (*TaskCompletion, error) {
+	return u.createCompletion(userID, task, proof, approved, nil)
+}
+
+// createCompletion records the completion like CreateCompletion, finish is run at the end of the same transaction
+// when it is set, so what it records is committed together with the completion
+func (u *PostgresRepository) createCompletion(userID int, task Task, proof Proof, approved bool, finish func(tx *sql.Tx, c *TaskCompletion) error) (*TaskCompletion, error) {
+	c := TaskCompletion{UserID: userID, TaskCode: task.Code, Status: CompletionPending, Proof: proof.Text}
+
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		var exists bool
+		err := tx.QueryRowContext(ctx, `select true from users where id = $1 for update`, userID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		if !proof.TokenExpiresAt.IsZero() {
+			err = useProofToken(tx, userID, task.Code, proof)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !task.Repeatable {
+			var done bool
+			err = tx.QueryRowContext(ctx,
+				`select exists(select 1 from task_completions where user_id = $1 and task_code = $2 and status <> $3)`,
+				userID, task.Code, CompletionRejected).Scan(&done)
+			if err != nil {
+				return fmt.Errorf("failed to check previous completions: %w", err)
+			}
+			if done {
+				return ErrTaskAlreadyCompleted
+			}
+		}
+
+		// pending completions of webhook verified tasks are queued for their verifier
+		queued := !approved && task.Verifier == VerifierWebhook
+		err = tx.QueryRowContext(ctx,
+			`insert into task_completions (user_id, task_code, status, proof, points, created_at, next_verification_at)
+             values ($1, $2, $3, $4, 0, now(), case when $5::boolean then now() end) returning id, created_at`,
+			userID, task.Code, CompletionPending, proof.Text, queued).Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert task completion: %w", err)
+		}
+
+		switch {
+		case approved:
+			err = u.approveCompletion(tx, &c, task.Points)
+		case task.Verifier == VerifierManual:
+			err = addReview(tx, c.ID, proof)
+		}
+		if err != nil || finish == nil {
+			return err
+		}
+		return finish(tx, &c)
+	})
+	if err != nil {
+		log.Printf("failed to complete task %q for user %d: %v", task.Code, userID, err)
+		return nil, err
+	}
+	if approved {
+		u.afterPointEvent(userID)
+	}
+
+	return &c, nil
+}
+
+// useProofToken records the proof token as used, a token which was already used is refused with ErrProofTokenUsed.
+// Only the hash of the token is stored, until the token expires.
+func useProofToken(tx *sql.Tx, userID int, taskCode string, proof Proof) error {
+	sum := sha256.Sum256([]byte(proof.Text))
+	res, err := tx.ExecContext(context.Background(),
+		`insert into used_proof_tokens (token_hash, user_id, task_code, expires_at, used_at) values ($1, $2, $3, $4, now())
+         on conflict (token_hash) do nothing`,
+		hex.EncodeToString(sum[:]), userID, taskCode, proof.TokenExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to use proof token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to use proof token: %w", err)
+	}
+	if n == 0 {
+		return ErrProofTokenUsed
+	}
+	return nil
+}
+
+// DeleteExpiredProofTokens removes the used proof tokens which have expired, they are refused for their expiry anyway
+func (u *PostgresRepository) DeleteExpiredProofTokens() (int64, error) {
+	res, err := u.execQuery(context.Background(), `delete from used_proof_tokens where expires_at < now()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired proof tokens: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// ResolveCompletion approves or rejects a pending completion of a webhook verified task, crediting the task points
+// on approval. Completions of tasks with another verifier are refused, manual ones go through ResolveReview.
+func (u *PostgresRepository) ResolveCompletion(id int, approved bool, reason string) (*TaskCompletion, error) {
+	var c *TaskCompletion
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		c, err = u.resolveCompletion(tx, id, VerifierWebhook, approved, reason)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to resolve task completion %d: %v", id, err)
+		return nil, err
+	}
+	if approved {
+		u.afterPointEvent(c.UserID)
+	}
+
+	return c, nil
+}
+
+// resolveCompletion approves or rejects a pending completion inside a transaction,
+// the task of the completion must be verified by the given verifier
+func (u *PostgresRepository) resolveCompletion(tx *sql.Tx, id int, verifier string, approved bool, reason string) (*TaskCompletion, error) {
+	ctx := context.Background()
+
+	var c TaskCompletion
+	var taskPoints int
+	var taskVerifier string
+	err := tx.QueryRowContext(ctx,
+		`select c.id, c.user_id, c.task_code, c.status, coalesce(c.proof, ''), c.created_at, t.points, t.verifier
+         from task_completions c join tasks t on t.code = c.task_code
+         where c.id = $1 for update of c`, id).Scan(
+		&c.ID,
+		&c.UserID,
+		&c.TaskCode,
+		&c.Status,
+		&c.Proof,
+		&c.CreatedAt,
+		&taskPoints,
+		&taskVerifier,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCompletionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock task completion: %w", err)
+	}
+	if taskVerifier != verifier {
+		return nil, ErrWrongVerifier
+	}
+	if c.Status != CompletionPending {
+		return nil, ErrCompletionNotPending
+	}
+
+	if approved {
+		err = u.approveCompletion(tx, &c, taskPoints)
+		if err != nil {
+			return nil, err
+		}
+		return &c, nil
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`update task_completions set status = $1, reason = $2, resolved_at = now() where id = $3 returning resolved_at`,
+		CompletionRejected, reason, c.ID).Scan(&c.ResolvedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reject task completion: %w", err)
+	}
+	c.Status = CompletionRejected
+	c.Reason = reason
+	return &c, nil
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// completionDB answers the queries of an approved completion of a user in the lowest tier, used proof tokens
+// are remembered
+func completionDB() func(query string, args []any) [][]any {
+	used := make(map[any]bool)
+	return func(query string, args []any) [][]any {
+		switch {
+		case strings.Contains(query, "from users where id = $1 for update"):
+			return [][]any{{true}}
+		case strings.Contains(query, "insert into used_proof_tokens"):
+			if used[args[0]] {
+				return [][]any{}
+			}
+			used[args[0]] = true
+		case strings.Contains(query, "insert into task_completions"):
+			return [][]any{{int64(1), time.Now()}}
+		case strings.Contains(query, "select t.multiplier"):
+			return [][]any{{1.0}}
+		case strings.Contains(query, "returning resolved_at"):
+			return [][]any{{time.Now()}}
+		case strings.Contains(query, "returning tier_points, tier_id"):
+			return [][]any{{int64(10), int64(1)}}
+		case strings.Contains(query, "from tiers reached, tiers current"):
+			return [][]any{{int64(1), int64(0), int64(0)}}
+		case strings.Contains(query, "returning score"):
+			return [][]any{{int64(10)}}
+		}
+		return nil
+	}
+}
+
+func TestCreateCompletionUsesProofToken(t *testing.T) {
+	task := Task{Code: "telegramSign", Points: 10, Verifier: VerifierProofToken, Repeatable: true}
+	expires := time.Now().Add(time.Hour)
+	repo, db := newFakeRepository(t, completionDB())
+
+	complete := func(proof Proof) error {
+		_, err := repo.CreateCompletion(7, task, proof, true)
+		return err
+	}
+
+	if err := complete(Proof{Text: "token-1", TokenExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+	// the task is repeatable, but the same token is not
+	if err := complete(Proof{Text: "token-1", TokenExpiresAt: expires}); !errors.Is(err, ErrProofTokenUsed) {
+		t.Errorf("second completion with the same token: error = %v, want %v", err, ErrProofTokenUsed)
+	}
+	if err := complete(Proof{Text: "token-2", TokenExpiresAt: expires}); err != nil {
+		t.Errorf("completion with a new token: %v", err)
+	}
+	if inserted := len(db.ran("insert into task_completions")); inserted != 2 {
+		t.Errorf("%d completions recorded, want the replayed token refused before recording one", inserted)
+	}
+
+	used := db.ran("insert into used_proof_tokens")
+	if len(used) != 3 {
+		t.Fatalf("proof tokens used %d times, want 3", len(used))
+	}
+	if used[0][0] == "token-1" {
+		t.Error("the proof token was stored in plain text")
+	}
+	if !used[0][3].(time.Time).Equal(expires) {
+		t.Errorf("used token is kept until %v, want its expiry %v", used[0][3], expires)
+	}
+
+	// completions approved without checking a token, like those of inbound webhooks, use up nothing
+	complete(Proof{Text: "token-1"})
+	if len(db.ran("insert into used_proof_tokens")) != 3 {
+		t.Error("a proof which wasn't checked as a token was recorded as a used token")
+	}
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Tier is a loyalty level reached by earning MinPoints lifetime points
+type Tier struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	MinPoints  int     `json:"min_points"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// TierChange is one promotion or demotion of the user
+type TierChange struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	FromTierID int       `json:"from_tier_id"`
+	ToTierID   int       `json:"to_tier_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// isEarned tells whether a credit counts towards the lifetime points, received transfers do not
+func isEarned(kind string, amount int) bool {
+	return amount > 0 && kind != TxKindTransferIn
+}
+
+// addLifetimePoints adds earned points to the lifetime total and to the tier points, and promotes the user when
+// the tier points reach a new tier. The tier points start over from the threshold of the lower tier after a
+// demotion, so a demoted user has to earn the difference again to get the tier back.
+func addLifetimePoints(tx *sql.Tx, userID, amount int) error {
+	ctx := context.Background()
+
+	var tierPoints, currentTier int
+	err := tx.QueryRowContext(ctx,
+		`update users set lifetime_points = lifetime_points + $1, tier_points = tier_points + $1, last_earned_at = now()
+         where id = $2 returning tier_points, tier_id`, amount, userID).Scan(&tierPoints, &currentTier)
+	if err != nil {
+		return fmt.Errorf("failed to add lifetime points: %w", err)
+	}
+
+	var reachedTier, reachedMin, currentMin int
+	err = tx.QueryRowContext(ctx,
+		`select reached.id, reached.min_points, current.min_points
+         from tiers reached, tiers current
+         where current.id = $2 and reached.min_points <= $1
+         order by reached.min_points desc limit 1`, tierPoints, currentTier).Scan(&reachedTier, &reachedMin, &currentMin)
+	if err != nil {
+		return fmt.Errorf("failed to find tier for %d points: %w", tierPoints, err)
+	}
+
+	if reachedMin <= currentMin {
+		return nil
+	}
+	return changeTier(tx, userID, currentTier, reachedTier, "promotion")
+}
+
+// changeTier moves the user to another tier and records the change
+func changeTier(tx *sql.Tx, userID, fromTier, toTier int, reason string) error {
+	ctx := context.Background()
+
+	_, err := tx.ExecContext(ctx, `update users set tier_id = $1, tier_changed_at = now() where id = $2`, toTier, userID)
+	if err != nil {
+		return fmt.Errorf("failed to change tier: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`insert into tier_changes (user_id, from_tier_id, to_tier_id, reason, created_at) values ($1, $2, $3, $4, now())`,
+		userID, fromTier, toTier, reason)
+	if err != nil {
+		return fmt.Errorf("failed to record tier change: %w", err)
+	}
+	return nil
+}
+
+// GetUserTier returns the current tier of the user
+func (u *PostgresRepository) GetUserTier(userID int) (*Tier, error) {
+	query := `select t.id, t.name, t.min_points, t.multiplier
+              from users u join tiers t on t.id = u.tier_id where u.id = $1`
+
+	var t Tier
+	err := u.queryRow(context.Background(), query, userID).Scan(&t.ID, &t.Name, &t.MinPoints, &t.Multiplier)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		log.Println("failed to fetch user's tier: ", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetTierChanges returns the tier history of the user, newest first
+func (u *PostgresRepository) GetTierChanges(userID int) ([]*TierChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, from_tier_id, to_tier_id, reason, created_at
+              from tier_changes where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := u.Conn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tier changes: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []*TierChange
+	for rows.Next() {
+		var c TierChange
+		if err := rows.Scan(&c.ID, &c.UserID, &c.FromTierID, &c.ToTierID, &c.Reason, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan tier change: %w", err)
+		}
+		changes = append(changes, &c)
+	}
+	return changes, rows.Err()
+}
+
+// inactiveSince is the condition of an inactive user, $1 is the inactivity period in seconds
+const inactiveSince = `greatest(coalesce(u.last_earned_at, u.created_at), coalesce(u.tier_changed_at, u.created_at))
+                       < now() - $1 * interval '1 second'`
+
+// DemoteInactiveUsers moves users one tier down when they haven't earned points for the given period.
+// The period is counted from the latest of the last earning and the last tier change, so an inactive
+// user loses one tier per period. The tier points of a demoted user are set to the threshold of the
+// lower tier, earning points again promotes the user back once the difference is earned.
+func (u *PostgresRepository) DemoteInactiveUsers(inactivity time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select u.id from users u
+              join tiers t on t.id = u.tier_id
+              where exists (select 1 from tiers lower_tier where lower_tier.min_points < t.min_points)
+                and ` + inactiveSince + `
+              limit 500`
+
+	rows, err := u.Conn.QueryContext(ctx, query, int64(inactivity.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find inactive users: %w", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan inactive user: %w", err)
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	demoted := 0
+	for _, id := range userIDs {
+		var done bool
+		err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+			var err error
+			done, err = demoteInactiveUser(tx, id, inactivity)
+			return err
+		})
+		if err != nil {
+			log.Printf("failed to demote user %d: %v", id, err)
+			continue
+		}
+		if done {
+			demoted++
+		}
+	}
+	return demoted, nil
+}
+
+// demoteInactiveUser moves the user one tier down if the user is still inactive once the row is locked,
+// a user who earned points since the candidates were selected is left alone
+func demoteInactiveUser(tx *sql.Tx, userID int, inactivity time.Duration) (bool, error) {
+	ctx := context.Background()
+
+	var from, to, toMin int
+	err := tx.QueryRowContext(ctx,
+		`select u.tier_id, lower_tier.id, lower_tier.min_points
+         from users u
+         join tiers t on t.id = u.tier_id
+         join lateral (
+             select id, min_points from tiers where min_points < t.min_points order by min_points desc limit 1
+         ) lower_tier on true
+         where u.id = $2 and `+inactiveSince+`
+         for update of u`, int64(inactivity.Seconds()), userID).Scan(&from, &to, &toMin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to lock inactive user: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set tier_points = least(tier_points, $1) where id = $2`, toMin, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to reset tier points: %w", err)
+	}
+	return true, changeTier(tx, userID, from, to, "inactivity")
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddLifetimePoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		tierPoints  int64
+		currentTier int64
+		reached     []any // the highest tier within the tier points: id, min points and the min points of the current tier
+		wantTier    int64 // 0 when the tier stays
+	}{
+		{"below the next threshold", 999, 1, []any{int64(1), int64(0), int64(0)}, 0},
+		{"threshold reached", 1000, 1, []any{int64(2), int64(1000), int64(0)}, 2},
+		{"two thresholds at once", 5200, 1, []any{int64(3), int64(5000), int64(0)}, 3},
+		{"already in the tier", 6000, 3, []any{int64(3), int64(5000), int64(5000)}, 0},
+		// a demoted user is still below the threshold of the tier lost, earning never demotes
+		{"below the current tier", 1200, 3, []any{int64(2), int64(1000), int64(5000)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, func(query string, args []any) [][]any {
+				switch {
+				case strings.Contains(query, "returning tier_points, tier_id"):
+					return [][]any{{tt.tierPoints, tt.currentTier}}
+				case strings.Contains(query, "from tiers reached, tiers current"):
+					return [][]any{tt.reached}
+				}
+				return nil
+			})
+
+			err := repo.withTx(context.Background(), func(tx *sql.Tx) error {
+				return addLifetimePoints(tx, 7, 100)
+			})
+			if err != nil {
+				t.Fatalf("addLifetimePoints() error = %v", err)
+			}
+
+			lookups := db.ran("from tiers reached, tiers current")
+			if len(lookups) != 1 || lookups[0][0] != tt.tierPoints || lookups[0][1] != tt.currentTier {
+				t.Errorf("tier looked up with %v, want %d tier points in tier %d", lookups, tt.tierPoints, tt.currentTier)
+			}
+			changes := db.ran("insert into tier_changes")
+			if tt.wantTier == 0 {
+				if len(changes) != 0 {
+					t.Errorf("tier changed %v, want no change", changes)
+				}
+				return
+			}
+			if len(changes) != 1 || !slices.Equal(changes[0], []any{int64(7), tt.currentTier, tt.wantTier, "promotion"}) {
+				t.Errorf("tier changes %v, want a promotion from %d to %d", changes, tt.currentTier, tt.wantTier)
+			}
+		})
+	}
+}
+
+func TestDemoteInactiveUsers(t *testing.T) {
+	// users 1 and 2 looked inactive, but user 2 earned points before its row was locked
+	repo, db := newFakeRepository(t, func(query string, args []any) [][]any {
+		switch {
+		case strings.Contains(query, "select u.id from users u"):
+			return [][]any{{int64(1)}, {int64(2)}}
+		case strings.Contains(query, "join lateral") && args[1] == int64(1):
+			return [][]any{{int64(3), int64(2), int64(1000)}}
+		}
+		return nil
+	})
+
+	demoted, err := repo.DemoteInactiveUsers(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("DemoteInactiveUsers() error = %v", err)
+	}
+	if demoted != 1 {
+		t.Errorf("DemoteInactiveUsers() = %d, want 1", demoted)
+	}
+
+	// the inactivity is checked again under the lock with the same period
+	for _, args := range db.ran("join lateral") {
+		if args[0] != int64(30*24*60*60) {
+			t.Errorf("inactivity checked with %v seconds, want 30 days", args[0])
+		}
+	}
+	// the tier points drop to the threshold of the lower tier, one tier per period
+	if resets := db.ran("set tier_points = least(tier_points, $1)"); len(resets) != 1 || !slices.Equal(resets[0], []any{int64(1000), int64(1)}) {
+		t.Errorf("tier points reset %v, want user 1 to at most 1000", resets)
+	}
+	if changes := db.ran("insert into tier_changes"); len(changes) != 1 || !slices.Equal(changes[0], []any{int64(1), int64(3), int64(2), "inactivity"}) {
+		t.Errorf("tier changes %v, want user 1 from tier 3 to 2 for inactivity", changes)
+	}
+}
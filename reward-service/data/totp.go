@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotEnrolled     = errors.New("two-factor authentication enrolment was not started")
+	ErrTOTPCodeUsed        = errors.New("the code was already used")
+	ErrInvalidRecoveryCode = errors.New("recovery code is invalid or was already used")
+)
+
+// TOTP is the two-factor authentication secret of the user. LastUsedStep is the time step of the last accepted
+// code, codes of that step and earlier are not accepted again.
+type TOTP struct {
+	UserID       int
+	Secret       string
+	LastUsedStep int64
+	Enabled      bool
+}
+
+// StartTOTPEnrollment stores a new secret for the user, which is not used until it is confirmed.
+// Starting again replaces the unconfirmed secret.
+func (u *PostgresRepository) StartTOTPEnrollment(userID int, secret string) error {
+	res, err := u.execQuery(context.Background(),
+		`insert into user_totp (user_id, secret, created_at) values ($1, $2, now())
+         on conflict (user_id) do update set secret = excluded.secret, last_used_step = 0, created_at = excluded.created_at
+             where user_totp.confirmed_at is null`, userID, secret)
+	if err != nil {
+		log.Println("failed to start totp enrolment: ", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to start totp enrolment: %w", err)
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// GetTOTP returns the confirmed or pending secret of the user
+func (u *PostgresRepository) GetTOTP(userID int) (*TOTP, error) {
+	t := TOTP{UserID: userID}
+	err := u.queryRow(context.Background(),
+		`select secret, last_used_step, confirmed_at is not null from user_totp where user_id = $1`,
+		userID).Scan(&t.Secret, &t.LastUsedStep, &t.Enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		log.Println("failed to fetch totp secret: ", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TOTPEnabled tells whether the user has confirmed two-factor authentication
+func (u *PostgresRepository) TOTPEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := u.queryRow(context.Background(),
+		`select exists(select 1 from user_totp where user_id = $1 and confirmed_at is not null)`, userID).Scan(&enabled)
+	if err != nil {
+		log.Println("failed to check totp: ", err)
+		return false, err
+	}
+	return enabled, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with the pending secret, step is the time step of the code
+// which confirmed it. The hashes of new recovery codes replace the old ones.
+func (u *PostgresRepository) ConfirmTOTP(userID int, step int64, codeHashes []string) error {
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		res, err := tx.ExecContext(ctx,
+			`update user_totp set confirmed_at = now(), last_used_step = $1 where user_id = $2 and confirmed_at is null`,
+			step, userID)
+		if err != nil {
+			return fmt.Errorf("failed to confirm totp: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to confirm totp: %w", err)
+		}
+		if n == 0 {
+			return ErrTwoFactorEnabled
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from totp_recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		for _, hash := range codeHashes {
+			_, err = tx.ExecContext(ctx, `insert into totp_recovery_codes (user_id, code_hash) values ($1, $2)`, userID, hash)
+			if err != nil {
+				return fmt.Errorf("failed to insert recovery code: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to confirm totp of user %d: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// UseTOTPStep remembers that a code of the time step was accepted, so the same code can't be replayed
+func (u *PostgresRepository) UseTOTPStep(userID int, step int64) error {
+	res, err := u.execQuery(context.Background(),
+		`update user_totp set last_used_step = $1 where user_id = $2 and last_used_step < $1`, step, userID)
+	if err != nil {
+		log.Println("failed to use totp step: ", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to use totp step: %w", err)
+	}
+	if n == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code of the user and returns how many codes are left
+func (u *PostgresRepository) UseRecoveryCode(userID int, codeHash string) (int, error) {
+	var remaining int
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		res, err := tx.ExecContext(ctx,
+			`update totp_recovery_codes set used_at = now() where user_id = $1 and code_hash = $2 and used_at is null`,
+			userID, codeHash)
+		if err != nil {
+			return fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if n == 0 {
+			return ErrInvalidRecoveryCode
+		}
+
+		err = tx.QueryRowContext(ctx,
+			`select count(*) from totp_recovery_codes where user_id = $1 and used_at is null`, userID).Scan(&remaining)
+		if err != nil {
+			return fmt.Errorf("failed to count recovery codes: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to use recovery code of user %d: %v", userID, err)
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// DisableTOTP turns two-factor authentication off and deletes the secret and the recovery codes
+func (u *PostgresRepository) DisableTOTP(userID int) error {
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(context.Background(), `delete from totp_recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		_, err = tx.ExecContext(context.Background(), `delete from user_totp where user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to delete totp secret: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to disable totp of user %d: %v", userID, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrUserNotFound          = errors.New("user does not exist")
+	ErrInsufficientPoints    = errors.New("not enough points")
+	ErrSelfTransfer          = errors.New("cannot transfer points to yourself")
+	ErrDailyLimitExceeded    = errors.New("daily transfer limit exceeded")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was already used for a different transfer")
+	ErrInvalidTransferAmount = errors.New("transfer amount must be positive")
+)
+
+// Transfer is one peer-to-peer movement of points between two users
+type Transfer struct {
+	ID             int       `json:"id"`
+	SenderID       int       `json:"sender_id"`
+	RecipientID    int       `json:"recipient_id"`
+	Amount         int       `json:"amount"`
+	Memo           string    `json:"memo,omitempty"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// TransferPoints moves points from the sender to the recipient in one transaction.
+// Both user rows are locked in id order, see lockOrder, so that two opposite transfers can't deadlock.
+// A repeated call with the same idempotency key returns the transfer made by the first call.
+func (u *PostgresRepository) TransferPoints(t Transfer, dailyLimit int) (*Transfer, error) {
+	if t.Amount <= 0 {
+		return nil, ErrInvalidTransferAmount
+	}
+	if t.SenderID == t.RecipientID {
+		return nil, ErrSelfTransfer
+	}
+
+	var result *Transfer
+	err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+		ctx := context.Background()
+
+		for _, id := range lockOrder(t.SenderID, t.RecipientID) {
+			var locked int
+			err := tx.QueryRowContext(ctx, `select id from users where id = $1 for update`, id).Scan(&locked)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrUserNotFound
+			}
+			if err != nil {
+				return fmt.Errorf("failed to lock user %d: %w", id, err)
+			}
+		}
+
+		// expired points the worker hasn't written off yet still count in the score
+		err := expireUserLots(tx, t.SenderID)
+		if err != nil {
+			return err
+		}
+		var senderScore int
+		err = tx.QueryRowContext(ctx, `select score from users where id = $1`, t.SenderID).Scan(&senderScore)
+		if err != nil {
+			return fmt.Errorf("failed to fetch score of user %d: %w", t.SenderID, err)
+		}
+
+		// the sender row is locked, so retries with the same key are serialized here
+		existing, err := findTransferByKey(tx, t.SenderID, t.IdempotencyKey)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if existing.RecipientID != t.RecipientID || existing.Amount != t.Amount || existing.Memo != t.Memo {
+				return ErrIdempotencyKeyReused
+			}
+			result = existing
+			return nil
+		}
+
+		if senderScore < t.Amount {
+			return ErrInsufficientPoints
+		}
+
+		if dailyLimit > 0 {
+			var sentToday int
+			err = tx.QueryRowContext(ctx,
+				`select coalesce(sum(amount), 0) from transfers where sender_id = $1 and created_at >= date_trunc('day', now())`,
+				t.SenderID).Scan(&sentToday)
+			if err != nil {
+				return fmt.Errorf("failed to sum today's transfers: %w", err)
+			}
+			if sentToday+t.Amount > dailyLimit {
+				return ErrDailyLimitExceeded
+			}
+		}
+
+		created := t
+		err = tx.QueryRowContext(ctx,
+			`insert into transfers (sender_id, recipient_id, amount, memo, idempotency_key, created_at)
+             values ($1, $2, $3, $4, $5, now()) returning id, created_at`,
+			t.SenderID, t.RecipientID, t.Amount, t.Memo, t.IdempotencyKey).Scan(&created.ID, &created.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert transfer: %w", err)
+		}
+
+		memo := fmt.Sprintf("transfer #%d", created.ID)
+		if t.Memo != "" {
+			memo = fmt.Sprintf("%s: %s", memo, t.Memo)
+		}
+		err = u.movePoints(tx, t.SenderID, t.RecipientID, t.Amount, memo)
+		if err != nil {
+			return err
+		}
+
+		result = &created
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to transfer points from user %d to user %d: %v", t.SenderID, t.RecipientID, err)
+		return nil, err
+	}
+	u.afterPointEvent(t.SenderID, t.RecipientID)
+
+	return result, nil
+}
+
+// lockOrder returns the ids of the two users in the order their rows are locked, lowest id first
+func lockOrder(a, b int) []int {
+	if b < a {
+		return []int{b, a}
+	}
+	return []int{a, b}
+}
+
+// findTransferByKey looks for a transfer already made by the sender with the given idempotency key
+func findTransferByKey(tx *sql.Tx, senderID int, key string) (*Transfer, error) {
+	query := `select id, sender_id, recipient_id, amount, coalesce(memo, ''), idempotency_key, created_at
+              from transfers where sender_id = $1 and idempotency_key = $2`
+
+	var t Transfer
+	err := tx.QueryRowContext(context.Background(), query, senderID, key).Scan(
+		&t.ID,
+		&t.SenderID,
+		&t.RecipientID,
+		&t.Amount,
+		&t.Memo,
+		&t.IdempotencyKey,
+		&t.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up transfer by idempotency key: %w", err)
+	}
+	return &t, nil
+}
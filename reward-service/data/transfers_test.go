@@ -0,0 +1,72 @@
+package data
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// transferDB answers the queries of TransferPoints with the scores of the users and what the sender sent today
+func transferDB(scores map[int64]int64, sentToday int64) func(query string, args []any) [][]any {
+	return (&ledgerDB{scores: scores, sentToday: sentToday}).respond
+}
+
+func TestTransferPointsLockOrder(t *testing.T) {
+	for _, tt := range []struct{ sender, recipient int }{{3, 7}, {7, 3}} {
+		repo, db := newFakeRepository(t, transferDB(map[int64]int64{3: 0, 7: 0}, 0))
+
+		// both users have no points, so the transfer stops right after locking them
+		_, err := repo.TransferPoints(Transfer{SenderID: tt.sender, RecipientID: tt.recipient, Amount: 10}, 0)
+		if !errors.Is(err, ErrInsufficientPoints) {
+			t.Fatalf("TransferPoints() error = %v, want %v", err, ErrInsufficientPoints)
+		}
+
+		var locked []int64
+		for _, args := range db.ran("from users where id = $1 for update") {
+			if !slices.Contains(locked, args[0].(int64)) {
+				locked = append(locked, args[0].(int64))
+			}
+		}
+		// opposite transfers lock the users in the same order, so they can't deadlock
+		if !slices.Equal(locked, []int64{3, 7}) {
+			t.Errorf("transfer from %d to %d locked users %v, want [3 7]", tt.sender, tt.recipient, locked)
+		}
+	}
+}
+
+func TestTransferPointsChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		transfer   Transfer
+		scores     map[int64]int64
+		sentToday  int64
+		dailyLimit int
+		wantErr    error
+		wantInsert bool
+	}{
+		{"within the daily limit", Transfer{SenderID: 1, RecipientID: 2, Amount: 40}, map[int64]int64{1: 100, 2: 0}, 60, 100, nil, true},
+		{"no daily limit", Transfer{SenderID: 1, RecipientID: 2, Amount: 100}, map[int64]int64{1: 100, 2: 0}, 1000, 0, nil, true},
+		{"over the daily limit", Transfer{SenderID: 1, RecipientID: 2, Amount: 41}, map[int64]int64{1: 100, 2: 0}, 60, 100, ErrDailyLimitExceeded, false},
+		{"daily limit used up", Transfer{SenderID: 1, RecipientID: 2, Amount: 1}, map[int64]int64{1: 100, 2: 0}, 100, 100, ErrDailyLimitExceeded, false},
+		{"more than the sender has", Transfer{SenderID: 1, RecipientID: 2, Amount: 101}, map[int64]int64{1: 100, 2: 0}, 0, 0, ErrInsufficientPoints, false},
+		{"unknown recipient", Transfer{SenderID: 1, RecipientID: 2, Amount: 10}, map[int64]int64{1: 100}, 0, 0, ErrUserNotFound, false},
+		{"to yourself", Transfer{SenderID: 1, RecipientID: 1, Amount: 10}, map[int64]int64{1: 100}, 0, 0, ErrSelfTransfer, false},
+		{"nothing to send", Transfer{SenderID: 1, RecipientID: 2, Amount: 0}, map[int64]int64{1: 100, 2: 0}, 0, 0, ErrInvalidTransferAmount, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, transferDB(tt.scores, tt.sentToday))
+
+			_, err := repo.TransferPoints(tt.transfer, tt.dailyLimit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TransferPoints() error = %v, want %v", err, tt.wantErr)
+			}
+			if inserted := len(db.ran("insert into transfers")) > 0; inserted != tt.wantInsert {
+				t.Errorf("transfer inserted = %v, want %v", inserted, tt.wantInsert)
+			}
+			if tt.wantErr != nil && db.commits != 0 {
+				t.Error("a refused transfer was committed")
+			}
+		})
+	}
+}
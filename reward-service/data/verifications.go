@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// PendingVerification is a pending completion whose verification request is due to be sent to the webhook
+// verifier of its task
+type PendingVerification struct {
+	TaskCompletion
+	VerifierURL string
+	Attempts    int
+}
+
+// ClaimDueVerifications takes up to limit completions whose verification request is due. The claimed completions
+// are leased for the given time: if the worker dies before reporting the outcome, they are picked up again after it.
+func (u *PostgresRepository) ClaimDueVerifications(limit int, lease time.Duration) ([]*PendingVerification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`with due as (
+             select id from task_completions
+             where status = $1 and next_verification_at <= now()
+             order by next_verification_at, id limit $2 for update skip locked
+         )
+         update task_completions c
+         set next_verification_at = now() + $3 * interval '1 second', verification_attempts = c.verification_attempts + 1
+         from due, tasks t
+         where c.id = due.id and t.code = c.task_code
+         returning c.id, c.user_id, c.task_code, c.status, coalesce(c.proof, ''), c.created_at,
+                   coalesce(t.verifier_url, ''), c.verification_attempts`,
+		CompletionPending, limit, int64(lease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim verifications: %w", err)
+	}
+	defer rows.Close()
+
+	var verifications []*PendingVerification
+	for rows.Next() {
+		var v PendingVerification
+		err := rows.Scan(&v.ID, &v.UserID, &v.TaskCode, &v.Status, &v.Proof, &v.CreatedAt, &v.VerifierURL, &v.Attempts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan verification: %w", err)
+		}
+		verifications = append(verifications, &v)
+	}
+	return verifications, rows.Err()
+}
+
+// FinishVerificationRequest stores the outcome of a verification request. A failed request is sent again
+// at nextAttempt, a zero nextAttempt means the verifier accepted it and the completion waits for its answer.
+func (u *PostgresRepository) FinishVerificationRequest(id int, nextAttempt time.Time) error {
+	stmt := `update task_completions set next_verification_at = null, verification_sent_at = now()
+             where id = $1 and status = $2`
+	args := []any{id, CompletionPending}
+	if !nextAttempt.IsZero() {
+		stmt = `update task_completions set next_verification_at = $3 where id = $1 and status = $2`
+		args = append(args, nextAttempt)
+	}
+
+	_, err := u.execQuery(context.Background(), stmt, args...)
+	if err != nil {
+		return fmt.Errorf("failed to store outcome of verification request %d: %w", id, err)
+	}
+	return nil
+}
+
+// ExpireVerifications rejects the completions whose verifier didn't answer within the timeout after accepting
+// the request, so the user can submit the task again. Returns the number of rejected completions.
+func (u *PostgresRepository) ExpireVerifications(timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select id from task_completions
+         where status = $1 and verification_sent_at < now() - $2 * interval '1 second' limit 500`,
+		CompletionPending, int64(timeout.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find unanswered verifications: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan completion id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		err := u.withTx(context.Background(), func(tx *sql.Tx) error {
+			_, err := u.resolveCompletion(tx, id, VerifierWebhook, false, "verifier did not answer in time")
+			return err
+		})
+		if err != nil {
+			log.Printf("failed to expire verification of completion %d: %v", id, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
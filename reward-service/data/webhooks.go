@@ -0,0 +1,286 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Event types sent to webhook subscriptions
+const (
+	EventUserRegistered   = "user.registered"
+	EventPointsEarned     = "points.earned"
+	EventPointsSpent      = "points.spent"
+	EventReferralRedeemed = "referral.redeemed"
+)
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+var (
+	ErrSubscriptionNotFound = errors.New("webhook subscription does not exist")
+	ErrUnknownEventType     = errors.New("unknown event type")
+	ErrDeliveryNotFound     = errors.New("dead webhook delivery does not exist")
+)
+
+// WebhookSubscription is an endpoint of a downstream system which receives the events of the given types,
+// "*" stands for all types. The secret signs the deliveries.
+type WebhookSubscription struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Secret     string    `json:"-"`
+	Active     bool      `json:"active"`
+	CreatedBy  int       `json:"created_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an event from the outbox queued to be sent to one subscription
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int             `json:"subscription_id"`
+	URL            string          `json:"url"`
+	Secret         string          `json:"-"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// eventEnvelope is the body of every webhook delivery
+type eventEnvelope struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// webhookEventTypes maps the domain events to the event types sent to webhook subscriptions,
+// the other domain events are not sent
+var webhookEventTypes = map[string]string{
+	DomainUserRegistered:   EventUserRegistered,
+	DomainPointsAwarded:    EventPointsEarned,
+	DomainPointsSpent:      EventPointsSpent,
+	DomainReferralRedeemed: EventReferralRedeemed,
+}
+
+// EnqueueWebhookDeliveries queues the domain event from the outbox for every active subscription interested
+// in it. The delivery has the id of the domain event, so queueing the same event again does nothing.
+func (u *PostgresRepository) EnqueueWebhookDeliveries(event *DomainEvent) error {
+	eventType, ok := webhookEventTypes[event.Type]
+	if !ok {
+		return nil
+	}
+	ev := eventEnvelope{ID: event.ID, Type: eventType, CreatedAt: event.CreatedAt, Data: event.Data}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+
+	_, err = u.execQuery(context.Background(),
+		`insert into webhook_deliveries (subscription_id, event_id, event_type, payload, created_at, next_attempt_at)
+         select id, $1, $2, $3, now(), now() from webhook_subscriptions
+         where active and (event_types = '*' or $2 = any(string_to_array(event_types, ' ')))
+         on conflict (subscription_id, event_id) do nothing`,
+		ev.ID, eventType, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to enqueue %s event: %w", eventType, err)
+	}
+	return nil
+}
+
+// registeredEvent describes a new user, provider is the identity provider the user signed up with, if any
+func registeredEvent(userID int, user User, provider string) map[string]any {
+	return map[string]any{
+		"user_id":    userID,
+		"email":      user.Email,
+		"first_name": user.FirstName,
+		"last_name":  user.LastName,
+		"provider":   provider,
+	}
+}
+
+// CreateWebhookSubscription stores a new subscription, the id and the creation time are set on it
+func (u *PostgresRepository) CreateWebhookSubscription(s *WebhookSubscription) error {
+	for _, t := range s.EventTypes {
+		switch t {
+		case "*", EventUserRegistered, EventPointsEarned, EventPointsSpent, EventReferralRedeemed:
+		default:
+			return fmt.Errorf("%w: %s", ErrUnknownEventType, t)
+		}
+	}
+
+	err := u.queryRow(context.Background(),
+		`insert into webhook_subscriptions (url, event_types, secret, active, created_by, created_at)
+         values ($1, $2, $3, true, nullif($4, 0), now()) returning id, active, created_at`,
+		s.URL, strings.Join(s.EventTypes, " "), s.Secret, s.CreatedBy).Scan(&s.ID, &s.Active, &s.CreatedAt)
+	if err != nil {
+		log.Println("failed to create webhook subscription: ", err)
+		return err
+	}
+	return nil
+}
+
+// ListWebhookSubscriptions returns all subscriptions, newest first
+func (u *PostgresRepository) ListWebhookSubscriptions() ([]*WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select id, url, event_types, active, coalesce(created_by, 0), created_at
+         from webhook_subscriptions order by created_at desc, id desc`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []*WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		var eventTypes string
+		err := rows.Scan(&s.ID, &s.URL, &eventTypes, &s.Active, &s.CreatedBy, &s.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook subscription: %w", err)
+		}
+		s.EventTypes = strings.Fields(eventTypes)
+		subscriptions = append(subscriptions, &s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// DeactivateWebhookSubscription stops new events from being queued for the subscription
+func (u *PostgresRepository) DeactivateWebhookSubscription(id int) error {
+	res, err := u.execQuery(context.Background(), `update webhook_subscriptions set active = false where id = $1`, id)
+	if err != nil {
+		log.Println("failed to deactivate webhook subscription: ", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to deactivate webhook subscription: %w", err)
+	}
+	if n == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// ClaimDueDeliveries takes up to limit deliveries whose attempt is due. The claimed deliveries are leased
+// for the given time: if the worker dies before reporting the outcome, they are picked up again after it.
+func (u *PostgresRepository) ClaimDueDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`with due as (
+             select id from webhook_deliveries
+             where status = $1 and next_attempt_at <= now()
+             order by next_attempt_at, id limit $2 for update skip locked
+         )
+         update webhook_deliveries d set next_attempt_at = now() + $3 * interval '1 second', attempts = d.attempts + 1
+         from due, webhook_subscriptions s
+         where d.id = due.id and s.id = d.subscription_id
+         returning d.id, d.subscription_id, s.url, s.secret, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.created_at`,
+		DeliveryPending, limit, int64(lease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.URL, &d.Secret, &d.EventID, &d.EventType, &d.Payload,
+			&d.Status, &d.Attempts, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// FinishDelivery stores the outcome of an attempt. A failed delivery is retried at nextAttempt,
+// a zero nextAttempt moves it to the dead letters.
+func (u *PostgresRepository) FinishDelivery(id int64, statusCode int, deliveryErr string, nextAttempt time.Time) error {
+	var stmt string
+	var args []any
+	switch {
+	case deliveryErr == "":
+		stmt = `update webhook_deliveries set status = $1, last_status_code = $2, last_error = null, delivered_at = now()
+                where id = $3`
+		args = []any{DeliveryDelivered, statusCode, id}
+	case nextAttempt.IsZero():
+		stmt = `update webhook_deliveries set status = $1, last_status_code = nullif($2, 0), last_error = $3 where id = $4`
+		args = []any{DeliveryDead, statusCode, deliveryErr, id}
+	default:
+		stmt = `update webhook_deliveries set last_status_code = nullif($1, 0), last_error = $2, next_attempt_at = $3
+                where id = $4`
+		args = []any{statusCode, deliveryErr, nextAttempt, id}
+	}
+
+	_, err := u.execQuery(context.Background(), stmt, args...)
+	if err != nil {
+		return fmt.Errorf("failed to store outcome of webhook delivery %d: %w", id, err)
+	}
+	return nil
+}
+
+// GetDeadDeliveries returns the latest deliveries which ran out of attempts, newest first
+func (u *PostgresRepository) GetDeadDeliveries(limit int) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := u.Conn.QueryContext(ctx,
+		`select d.id, d.subscription_id, s.url, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+                coalesce(d.last_status_code, 0), coalesce(d.last_error, ''), d.created_at
+         from webhook_deliveries d join webhook_subscriptions s on s.id = d.subscription_id
+         where d.status = $1 order by d.created_at desc, d.id desc limit $2`, DeliveryDead, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dead webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.URL, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ReplayDelivery queues a dead delivery again with a fresh set of attempts
+func (u *PostgresRepository) ReplayDelivery(id int64) error {
+	res, err := u.execQuery(context.Background(),
+		`update webhook_deliveries set status = $1, attempts = 0, next_attempt_at = now() where id = $2 and status = $3`,
+		DeliveryPending, id, DeliveryDead)
+	if err != nil {
+		log.Println("failed to replay webhook delivery: ", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to replay webhook delivery: %w", err)
+	}
+	if n == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFinishDelivery(t *testing.T) {
+	next := time.Now().Add(time.Minute)
+	tests := []struct {
+		name       string
+		err        string
+		next       time.Time
+		wantStatus any // the status the delivery is set to, nil when it stays pending
+		wantNext   bool
+	}{
+		{"delivered", "", time.Time{}, DeliveryDelivered, false},
+		{"retried", "subscriber responded with 500", next, nil, true},
+		{"dead", "subscriber responded with 500", time.Time{}, DeliveryDead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, nil)
+
+			err := repo.FinishDelivery(4, 500, tt.err, tt.next)
+			if err != nil {
+				t.Fatalf("FinishDelivery() error = %v", err)
+			}
+
+			updates := db.ran("update webhook_deliveries")
+			if len(updates) != 1 {
+				t.Fatalf("ran %d updates, want 1", len(updates))
+			}
+			args := updates[0]
+			if args[len(args)-1] != int64(4) {
+				t.Errorf("updated delivery %v, want 4", args[len(args)-1])
+			}
+			setsStatus := strings.Contains(db.statements[0].query, "set status")
+			if setsStatus != (tt.wantStatus != nil) || (setsStatus && args[0] != tt.wantStatus) {
+				t.Errorf("update %q with %v, want status %v", db.statements[0].query, args, tt.wantStatus)
+			}
+			if retried := strings.Contains(db.statements[0].query, "next_attempt_at"); retried != tt.wantNext {
+				t.Errorf("next attempt scheduled = %v, want %v", retried, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestReplayDelivery(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		dead    bool
+		wantErr error
+	}{
+		{"dead delivery", true, nil},
+		{"delivery which isn't dead", false, ErrDeliveryNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, db := newFakeRepository(t, func(query string, args []any) [][]any {
+				if tt.dead {
+					return nil // the update affects the delivery
+				}
+				return [][]any{}
+			})
+
+			err := repo.ReplayDelivery(4)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReplayDelivery() error = %v, want %v", err, tt.wantErr)
+			}
+			// the replay starts over with a fresh set of attempts, only for dead deliveries
+			args := db.ran("attempts = 0")
+			if len(args) != 1 || args[0][0] != DeliveryPending || args[0][1] != int64(4) || args[0][2] != DeliveryDead {
+				t.Errorf("replay ran with %v, want pending delivery 4 if it is dead", args)
+			}
+		})
+	}
+}
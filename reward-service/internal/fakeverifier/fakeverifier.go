@@ -0,0 +1,99 @@
+// Package fakeverifier is a local stand-in for the external task verifiers. It accepts verification
+// requests from the reward service, approves them (unless the proof is "reject") and calls back
+// the callback URL of the request. Requests and callbacks are signed with the secret of the verifier.
+package fakeverifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type verificationRequest struct {
+	VerificationID int    `json:"verification_id"`
+	UserID         int    `json:"user_id"`
+	Task           string `json:"task"`
+	Proof          string `json:"proof,omitempty"`
+	CallbackURL    string `json:"callback_url"`
+}
+
+// Verifier answers the verification requests signed with its secret after the delay
+type Verifier struct {
+	Secret string
+	Delay  time.Duration
+	Client *http.Client
+}
+
+// Handler returns the handler of POST /verify
+func (v *Verifier) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /verify", v.verify)
+	return mux
+}
+
+func (v *Verifier) verify(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timestamp := r.Header.Get("X-Webhook-Timestamp")
+	if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(Sign(v.Secret, timestamp, body))) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req verificationRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	go v.callback(req)
+}
+
+// Sign returns the signature the reward service expects: HMAC-SHA256 of "<timestamp>.<body>" with the secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// callback sends the decision about the verification back to the reward service
+func (v *Verifier) callback(req verificationRequest) {
+	time.Sleep(v.Delay)
+
+	decision := map[string]any{"approved": req.Proof != "reject"}
+	if req.Proof == "reject" {
+		decision["reason"] = "rejected by fake verifier"
+	}
+	body, _ := json.Marshal(decision)
+
+	cb, err := http.NewRequest(http.MethodPost, req.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	cb.Header.Set("Content-Type", "application/json")
+	cb.Header.Set("X-Webhook-Timestamp", timestamp)
+	cb.Header.Set("X-Webhook-Signature", Sign(v.Secret, timestamp, body))
+
+	resp, err := v.Client.Do(cb)
+	if err != nil {
+		log.Printf("callback for verification %d failed: %v", req.VerificationID, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("verification %d of user %d for task %s resolved, callback answered %d",
+		req.VerificationID, req.UserID, req.Task, resp.StatusCode)
+}